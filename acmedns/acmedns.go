@@ -0,0 +1,298 @@
+// Package acmedns obtains and renews a certificate from an ACME CA such as
+// Let's Encrypt by answering DNS-01 challenges, publishing TXT records
+// through a DNS provider's API. Unlike the HTTP-01 and TLS-ALPN-01
+// challenges autocert answers, DNS-01 works for wildcard domains and for
+// hosts the CA can't reach, as long as their zone is public.
+//
+// The certificate and its key are written as PEM files for tlsconf to
+// serve, which picks renewals up as it does any other change to them.
+package acmedns
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/acme"
+)
+
+var orders = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "acme_certificate_orders_total",
+	Help: "Certificates ordered from the ACME CA, by result, ok or error.",
+}, []string{"result"})
+
+// Provider publishes the TXT records proving control of a domain. A
+// wildcard and its bare domain are proven with two records at the same
+// name, so Present adds to the records there rather than replacing them.
+type Provider interface {
+	// Present adds a TXT record with value at fqdn
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record Present added
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+type Options struct {
+	DirectoryURL string   // the CA's ACME directory
+	Email        string   // the account's contact, for expiry notices
+	Domains      []string // names on the certificate, *.example.com for a wildcard
+	Dir          string   // keeps the account key, cert.pem and key.pem
+	// RenewBefore renews the certificate once it expires within this
+	RenewBefore time.Duration
+	// PropagationTimeout is how long to wait for the TXT records to show
+	// up in DNS before asking the CA to check them anyway
+	PropagationTimeout time.Duration
+	Provider           Provider
+}
+
+// Manager keeps a certificate for Domains in Dir
+type Manager struct {
+	opts   Options
+	logger *zerolog.Logger
+}
+
+func NewManager(opts Options, logger *zerolog.Logger) *Manager {
+	return &Manager{opts: opts, logger: logger}
+}
+
+// CertFile is the certificate chain, PEM encoded
+func (m *Manager) CertFile() string {
+	return filepath.Join(m.opts.Dir, "cert.pem")
+}
+
+// KeyFile is the certificate's private key, PEM encoded
+func (m *Manager) KeyFile() string {
+	return filepath.Join(m.opts.Dir, "key.pem")
+}
+
+// Ensure orders a certificate unless Dir has one for Domains that isn't
+// due for renewal
+func (m *Manager) Ensure(ctx context.Context) error {
+	due, err := m.due()
+	if err != nil || !due {
+		return err
+	}
+	return m.order(ctx)
+}
+
+// Run checks the certificate every hour until ctx is done, renewing it
+// when it's due. A failed renewal is logged and tried again on the next
+// check, the current certificate is still good until it expires.
+func (m *Manager) Run(ctx context.Context) error {
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := m.Ensure(ctx); err != nil && ctx.Err() == nil {
+				m.logger.Error().Err(err).Strs("domains", m.opts.Domains).Msg("renewing certificate")
+			}
+		}
+	}
+}
+
+// due is whether there's no certificate for Domains yet, or it expires
+// within RenewBefore
+func (m *Manager) due() (bool, error) {
+	b, err := os.ReadFile(m.CertFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return true, nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true, nil
+	}
+	names := slices.Clone(cert.DNSNames)
+	want := slices.Clone(m.opts.Domains)
+	slices.Sort(names)
+	slices.Sort(want)
+	if !slices.Equal(names, want) {
+		return true, nil
+	}
+	return time.Until(cert.NotAfter) < m.opts.RenewBefore, nil
+}
+
+// order gets a certificate for Domains from the CA and writes it to Dir
+func (m *Manager) order(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			orders.WithLabelValues("error").Inc()
+		} else {
+			orders.WithLabelValues("ok").Inc()
+		}
+	}()
+	key, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.opts.DirectoryURL}
+	acct := &acme.Account{Contact: []string{"mailto:" + m.opts.Email}}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("registering account: %w", err)
+	}
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.opts.Domains...))
+	if err != nil {
+		return fmt.Errorf("ordering certificate: %w", err)
+	}
+	for _, u := range o.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return err
+		}
+	}
+	if o, err = client.WaitOrder(ctx, o.URI); err != nil {
+		return fmt.Errorf("waiting for order: %w", err)
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.opts.Domains}, certKey)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing order: %w", err)
+	}
+	var chain []byte
+	for _, c := range der {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	// the key first, a reader seeing the new chain sees its key too
+	if err := writeFile(m.KeyFile(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	if err := writeFile(m.CertFile(), chain); err != nil {
+		return err
+	}
+	m.logger.Info().Strs("domains", m.opts.Domains).Msg("obtained certificate")
+	return nil
+}
+
+// authorize proves control of an authorization's domain with a DNS-01
+// challenge, removing the TXT record again after
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	z, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("getting authorization: %w", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: CA offered no dns-01 challenge", z.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	// a wildcard's identifier comes without the *.
+	fqdn := "_acme-challenge." + z.Identifier.Value
+	if err := m.opts.Provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("publishing %s: %w", fqdn, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if err := m.opts.Provider.CleanUp(ctx, fqdn, value); err != nil {
+			m.logger.Warn().Err(err).Str("fqdn", fqdn).Msg("removing acme challenge record")
+		}
+	}()
+	m.waitForTXT(ctx, fqdn, value)
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accepting challenge for %s: %w", z.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("authorizing %s: %w", z.Identifier.Value, err)
+	}
+	return nil
+}
+
+// waitForTXT polls DNS until fqdn has value or PropagationTimeout passes.
+// A resolver with a split horizon may never see the public record, so
+// running out isn't an error, the CA has the final say.
+func (m *Manager) waitForTXT(ctx context.Context, fqdn, value string) {
+	ctx, cancel := context.WithTimeout(ctx, m.opts.PropagationTimeout)
+	defer cancel()
+	for {
+		if records, err := net.DefaultResolver.LookupTXT(ctx, fqdn); err == nil && slices.Contains(records, value) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			m.logger.Warn().Str("fqdn", fqdn).Msg("acme challenge record not seen in DNS, asking the CA to check anyway")
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// accountKey reads the account's key from Dir, creating it on first use
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.opts.Dir, "account.key")
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("%s: no private key found", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// writeFile replaces path with data in one rename, creating Dir as needed
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,131 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type CloudflareOptions struct {
+	// Token is an API token with Zone:Read and DNS:Edit on the zones
+	Token  string
+	Client *http.Client
+	// URL of the API, for tests
+	URL string
+}
+
+// Cloudflare is a Provider for zones hosted on Cloudflare
+type Cloudflare struct {
+	opts CloudflareOptions
+}
+
+func NewCloudflare(opts CloudflareOptions) *Cloudflare {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if opts.URL == "" {
+		opts.URL = "https://api.cloudflare.com/client/v4"
+	}
+	return &Cloudflare{opts: opts}
+}
+
+func (c *Cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := map[string]any{"type": "TXT", "name": fqdn, "content": value, "ttl": 120}
+	return c.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", record, nil)
+}
+
+func (c *Cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := c.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var records []struct {
+		ID string `json:"id"`
+	}
+	q := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := c.do(ctx, http.MethodGet, "/zones/"+zone+"/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := c.do(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zone finds the id of the zone holding fqdn, the longest of its parent
+// domains that's a zone on the account
+func (c *Cloudflare) zone(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		q := url.Values{"name": {strings.Join(labels[i:], ".")}}
+		if err := c.do(ctx, http.MethodGet, "/zones?"+q.Encode(), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %s", fqdn)
+}
+
+// do calls the API, decoding the envelope's result into out when set
+func (c *Cloudflare) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.opts.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s %s: %s", method, strings.SplitN(path, "?", 2)[0], resp.Status)
+	}
+	if !envelope.Success {
+		msgs := make([]string, 0, len(envelope.Errors))
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return errors.New("cloudflare: " + strings.Join(msgs, "; "))
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Result, out)
+	}
+	return nil
+}
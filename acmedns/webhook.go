@@ -0,0 +1,66 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type WebhookOptions struct {
+	URL    string // POSTed to at /present and /cleanup
+	Token  string // sent as a bearer token when set
+	Client *http.Client
+}
+
+// Webhook is a Provider handing the records to a service of your own, for
+// DNS hosts without a built in provider. It POSTs {"fqdn": ..., "value": ...}
+// to URL/present and URL/cleanup, as lego's httpreq provider does, so
+// services written for that work with it.
+type Webhook struct {
+	opts WebhookOptions
+}
+
+func NewWebhook(opts WebhookOptions) *Webhook {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	return &Webhook{opts: opts}
+}
+
+func (w *Webhook) Present(ctx context.Context, fqdn, value string) error {
+	return w.post(ctx, "/present", fqdn, value)
+}
+
+func (w *Webhook) CleanUp(ctx context.Context, fqdn, value string) error {
+	return w.post(ctx, "/cleanup", fqdn, value)
+}
+
+func (w *Webhook) post(ctx context.Context, path, fqdn, value string) error {
+	// lego's names are fully qualified, dot and all
+	body, err := json.Marshal(map[string]string{"fqdn": fqdn + ".", "value": value})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.opts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.opts.Token)
+	}
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("dns webhook %s: %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/config"
+	"go-chi-microservice/mail"
+	"go-chi-microservice/users"
+)
+
+// AccountResource is email verification and password reset, both by a
+// single use link emailed to the user
+type AccountResource struct {
+	svc      *users.Service
+	revoker  sessionRevoker // ends every session on a reset
+	tokens   auth.ActionTokenStore
+	mailer   mail.Mailer
+	throttle *auth.Throttle
+	cfg      config.AccountConfig
+}
+
+func NewAccountResource(svc *users.Service, issuer *auth.Issuer, sessions auth.SessionStore, tokens auth.ActionTokenStore, mailer mail.Mailer, throttle *auth.Throttle, cfg config.AccountConfig) *AccountResource {
+	return &AccountResource{svc: svc, revoker: sessionRevoker{issuer: issuer, sessions: sessions}, tokens: tokens, mailer: mailer, throttle: throttle, cfg: cfg}
+}
+
+// Register adds the public endpoints to the /auth router
+func (rs *AccountResource) Register(r chi.Router) {
+	r.Post("/forgot-password", rs.ForgotPassword)
+	r.Post("/reset-password", rs.ResetPassword)
+	r.Post("/verify-email", rs.VerifyEmail)
+}
+
+// UserRoutes are mounted at /users/{userID}/verify-email for signed in
+// users to ask for a verification link
+func (rs *AccountResource) UserRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly, noGuests)
+	r.Post("/", rs.SendVerification)
+	return r
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+func (f *ForgotPasswordRequest) Bind(r *http.Request) error {
+	if f.Email == "" {
+		return errors.New("missing email")
+	}
+	return nil
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (rp *ResetPasswordRequest) Bind(r *http.Request) error {
+	if rp.Token == "" {
+		return errors.New("missing token")
+	}
+	// bcrypt ignores anything past 72 bytes
+	if len(rp.Password) < 8 || len(rp.Password) > 72 {
+		return errors.New("password must be 8 to 72 characters")
+	}
+	return nil
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+func (v *VerifyEmailRequest) Bind(r *http.Request) error {
+	if v.Token == "" {
+		return errors.New("missing token")
+	}
+	return nil
+}
+
+// ForgotPassword emails a reset link. It answers 202 whether or not the
+// address has an account, and sends in the background so the timing
+// doesn't tell either.
+func (rs *AccountResource) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	data := &ForgotPasswordRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		user, err := rs.svc.GetByEmail(ctx, data.Email)
+		if errors.Is(err, users.ErrNotFound) || (err == nil && !user.CanSignIn()) {
+			return
+		}
+		if err == nil {
+			err = rs.send(ctx, user, auth.PurposeResetPassword)
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("sending password reset")
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. Every
+// refresh token and cookie session of the user is revoked and a lockout
+// lifted, whoever had the old password is out.
+func (rs *AccountResource) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	data := &ResetPasswordRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	u, ok := rs.redeem(w, r, data.Token, auth.PurposeResetPassword)
+	if !ok {
+		return
+	}
+	hash, err := auth.HashPassword(data.Password)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	u.PasswordHash, u.PasswordResetRequired = hash, false
+	// the reset link went to the address, so that's verified too
+	u.EmailVerified = true
+	if !rs.update(w, r, u) {
+		return
+	}
+	if err := rs.revoker.revokeUser(r.Context(), u.Id); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	if err := rs.throttle.Succeed(r.Context(), u.Email); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("clearing failed logins")
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "password_reset").Str("user_id", u.Id).Msg("password reset")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VerifyEmail marks the address verified with a token from
+// SendVerification
+func (rs *AccountResource) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	data := &VerifyEmailRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	u, ok := rs.redeem(w, r, data.Token, auth.PurposeVerifyEmail)
+	if !ok {
+		return
+	}
+	u.EmailVerified = true
+	if !rs.update(w, r, u) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendVerification emails the user a link to verify their address
+func (rs *AccountResource) SendVerification(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	if user.EmailVerified {
+		render.Render(w, r, ErrConflict(errors.New("email already verified")))
+		return
+	}
+	if err := rs.send(r.Context(), user, auth.PurposeVerifyEmail); err != nil {
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// send stores a new token for purpose and emails user the link carrying it
+func (rs *AccountResource) send(ctx context.Context, user *users.User, purpose string) error {
+	ttl, page, subject, text := rs.cfg.VerifyTTL, rs.cfg.VerifyURL, "Verify your email",
+		"Open this link to verify your email address:\n\n%s\n\nIt works once and expires in %s."
+	if purpose == auth.PurposeResetPassword {
+		ttl, page, subject, text = rs.cfg.ResetTTL, rs.cfg.ResetURL, "Reset your password",
+			"Open this link to choose a new password:\n\n%s\n\nIt works once and expires in %s. "+
+				"If you didn't ask for this you can ignore it, your password hasn't changed."
+	}
+	token, rec, err := auth.NewActionToken(user.Id, purpose, user.Email, ttl)
+	if err != nil {
+		return err
+	}
+	if err := rs.tokens.Save(ctx, token, rec); err != nil {
+		return err
+	}
+	link, err := url.Parse(page)
+	if err != nil {
+		return err
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+	return rs.mailer.Send(ctx, mail.Message{To: user.Email, Subject: subject, Text: fmt.Sprintf(text, link, ttl)})
+}
+
+// redeem consumes token and returns a copy of its user to change. Tokens
+// for an address the user no longer has are refused.
+func (rs *AccountResource) redeem(w http.ResponseWriter, r *http.Request, token, purpose string) (*users.User, bool) {
+	rec, err := rs.tokens.Consume(r.Context(), token, purpose)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		render.Render(w, r, ErrInvalidRequest(errors.New("invalid or expired token")))
+		return nil, false
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return nil, false
+	}
+	user, err := rs.svc.Get(r.Context(), rec.UserID)
+	if err == nil && (user.Email != rec.Email || user.Disabled) {
+		err = users.ErrNotFound
+	}
+	if errors.Is(err, users.ErrNotFound) {
+		render.Render(w, r, ErrInvalidRequest(errors.New("invalid or expired token")))
+		return nil, false
+	}
+	if err != nil {
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return nil, false
+	}
+	u := *user
+	return &u, true
+}
+
+func (rs *AccountResource) update(w http.ResponseWriter, r *http.Request, u *users.User) bool {
+	err := rs.svc.Update(r.Context(), u)
+	if clientGone(r, err) {
+		return false
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/diagnostics"
+	"go-chi-microservice/maintenance"
+	"go-chi-microservice/streams"
+	"go-chi-microservice/users"
+)
+
+// NewAdminRouter builds the handler for the admin listener. It is kept off
+// the main port so profiling and diagnostics are never publicly reachable.
+func NewAdminRouter(cfg *config.Config, deps Deps) http.Handler {
+	if deps.Streams == nil {
+		deps.Streams = streams.NewRegistry()
+	}
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(timing)
+	r.Use(requestLogger)
+	r.Use(loggerCtx(deps.Logger))
+	r.Use(auditRequests(deps.Audit, adminActor))
+	r.Use(recoverer)
+	r.Use(render.SetContentType(render.ContentTypeJSON))
+	r.Use(payloadVersion(cfg.APIVersion))
+	if cfg.Envelope.Enabled {
+		r.Use(envelope)
+	}
+	operators := map[string]string{}
+	if cfg.Admin.OperatorUser != "" {
+		operators[cfg.Admin.OperatorUser] = cfg.Admin.OperatorPassword
+	}
+	if cfg.Admin.User != "" {
+		// operators get at the rest of the listener too
+		creds := map[string]string{cfg.Admin.User: cfg.Admin.Password}
+		for user, password := range operators {
+			creds[user] = password
+		}
+		r.Use(middleware.BasicAuth("admin", creds))
+	}
+
+	admin := NewAdminResource(deps.Diagnostics, deps.Users, newPaginator(cfg.Pagination), deps.Maintenance).Routes()
+	if deps.Webhooks != nil {
+		admin.Mount("/webhooks", NewWebhooksResource(deps.Webhooks).Routes())
+	}
+	if deps.Events != nil {
+		admin.Mount("/events", NewEventsResource(deps.Events, deps.Streams).Routes())
+	}
+	if deps.AuditStore != nil {
+		admin.Mount("/audit", NewAuditResource(deps.AuditStore, newPaginator(cfg.Pagination)).Routes())
+	}
+	if len(operators) > 0 {
+		var account *AccountResource
+		if deps.Auth != nil && deps.ActionTokens != nil {
+			account = NewAccountResource(deps.Users, deps.Auth, deps.Sessions, deps.ActionTokens, deps.Mailer, nil, cfg.Auth.Account)
+		}
+		ops := NewOperationsResource(deps.Users, deps.Auth, deps.Sessions, account, deps.AuditStore, newPaginator(cfg.Pagination), cfg.Admin.ImpersonationTTL)
+		admin.Group(func(r chi.Router) {
+			r.Use(middleware.BasicAuth("admin operations", operators))
+			ops.Register(r)
+		})
+	}
+	r.Mount("/admin", admin)
+
+	// pprof under /debug/pprof and expvar at /debug/vars
+	r.Mount("/debug", middleware.Profiler())
+	r.Get("/debug/runtime", RuntimeStats)
+	return r
+}
+
+// AdminResource serves the operational /admin endpoints
+type AdminResource struct {
+	diag     *diagnostics.Registry
+	users    *users.Service
+	pages    *paginator
+	logLevel *logLevelControl
+	// maintenance is the API's maintenance switch, nil leaves it out
+	maintenance *maintenance.Switch
+}
+
+func NewAdminResource(diag *diagnostics.Registry, users *users.Service, pages *paginator, maintenance *maintenance.Switch) *AdminResource {
+	return &AdminResource{diag: diag, users: users, pages: pages, logLevel: newLogLevelControl(), maintenance: maintenance}
+}
+
+func (rs *AdminResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/diagnostics", rs.Diagnostics)
+	r.Get("/loglevel", rs.GetLogLevel)
+	r.Put("/loglevel", rs.SetLogLevel)
+	if rs.maintenance != nil {
+		r.Get("/maintenance", rs.GetMaintenance)
+		r.Put("/maintenance", rs.SetMaintenance)
+	}
+	r.Post("/users/import", rs.ImportUsers)
+	r.With(rs.pages.Handler("/admin/users")).Get("/users", rs.ListUsers)
+	r.Get("/users/{userID}", rs.GetUser)
+	r.Post("/users/{userID}/restore", rs.RestoreUser)
+	return r
+}
+
+// Diagnostics reports how this instance is set up
+func (rs *AdminResource) Diagnostics(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, rs.diag.Report())
+}
+
+type runtimeStats struct {
+	Goroutines   int           `json:"goroutines"`
+	CPUs         int           `json:"cpus"`
+	HeapAlloc    uint64        `json:"heap_alloc_bytes"`
+	HeapInuse    uint64        `json:"heap_inuse_bytes"`
+	HeapObjects  uint64        `json:"heap_objects"`
+	Sys          uint64        `json:"sys_bytes"`
+	NumGC        uint32        `json:"num_gc"`
+	LastGC       time.Time     `json:"last_gc"`
+	PauseTotal   time.Duration `json:"pause_total_ns"`
+	NextGCTarget uint64        `json:"next_gc_bytes"`
+}
+
+// RuntimeStats is a quick look at goroutines, heap and GC without pulling a
+// full profile
+func RuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	render.JSON(w, r, runtimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		CPUs:         runtime.NumCPU(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		LastGC:       time.Unix(0, int64(m.LastGC)),
+		PauseTotal:   time.Duration(m.PauseTotalNs),
+		NextGCTarget: m.NextGC,
+	})
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"go-chi-microservice/assets"
+	"go-chi-microservice/config"
+)
+
+// mountAssets serves the static frontend under cfg.Path. Routes registered
+// on r take precedence, so with a Path of / the frontend gets what the API
+// doesn't handle.
+func mountAssets(r chi.Router, cfg config.AssetsConfig) {
+	fsys := assets.Embedded()
+	if cfg.Dir != "" {
+		fsys = os.DirFS(cfg.Dir)
+	}
+	h := assets.NewHandler(fsys, assets.Options{SPA: cfg.SPA, MaxAge: cfg.MaxAge})
+	prefix := "/" + strings.Trim(cfg.Path, "/")
+	served := http.StripPrefix(strings.TrimSuffix(prefix, "/"), withCSP(cfg.ContentSecurityPolicy, h))
+	r.Mount(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// relative links in index.html resolve against the trailing slash
+		if r.URL.Path == prefix && prefix != "/" {
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		served.ServeHTTP(w, r)
+	}))
+}
+
+// withCSP swaps the API's Content-Security-Policy for one a page can live
+// with, "-" drops it
+func withCSP(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy == "-" {
+			w.Header().Del("Content-Security-Policy")
+		} else if policy != "" {
+			w.Header().Set("Content-Security-Policy", policy)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
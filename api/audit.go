@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/audit"
+)
+
+// auditRequests writes an audit entry for every request that may change
+// something, whatever its outcome. The caller is named by authentication
+// deeper in, with audit.SetActor, or by actor when it's known up front.
+// Install it after RealIP and LoggerCtx, and outside Recoverer so a panic is
+// recorded as the 500 it becomes. A nil logger records nothing.
+func auditRequests(logger audit.Logger, actor func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if logger == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, rec := audit.WithRecord(r.Context())
+			if actor != nil {
+				audit.SetActor(ctx, actor(r))
+			}
+			r = r.WithContext(ctx)
+			ww, ok := w.(middleware.WrapResponseWriter)
+			if !ok {
+				ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			}
+			next.ServeHTTP(ww, r)
+
+			e, err := audit.NewEntry()
+			if err == nil {
+				e.Actor, e.Changes = rec.Actor(), rec.Changes()
+				e.Method, e.Path, e.Status = r.Method, r.URL.Path, ww.Status()
+				e.RequestID, e.IP = middleware.GetReqID(ctx), clientAddr(r)
+				if rctx := chi.RouteContext(ctx); rctx != nil {
+					e.Route = rctx.RoutePattern()
+				}
+				// the entry is written even when the client has gone
+				err = logger.Log(context.WithoutCancel(ctx), e)
+			}
+			if err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("writing audit entry")
+			}
+		})
+	}
+}
+
+// adminActor names the admin listener's caller by their basic auth user
+func adminActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return "admin:" + user
+	}
+	return "admin"
+}
+
+// AuditResource serves /admin/audit, the recorded audit entries
+type AuditResource struct {
+	store audit.Store
+	pages *paginator
+}
+
+func NewAuditResource(store audit.Store, pages *paginator) *AuditResource {
+	return &AuditResource{store: store, pages: pages}
+}
+
+func (rs *AuditResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.With(rs.pages.Handler("/admin/audit")).Get("/", rs.List)
+	return r
+}
+
+// List returns the entries picked by ?actor, ?method, ?resource,
+// ?resource_id, ?request_id, ?since and ?until, newest first and paged
+func (rs *AuditResource) List(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	list, err := rs.store.List(r.Context(), f)
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	start, end := pageFrom(r.Context()).Apply(len(list))
+	setTotal(r, len(list))
+	render.Respond(w, r, list[start:end])
+}
+
+// auditFilter reads a filter from query parameters, times in RFC 3339
+func auditFilter(v url.Values) (audit.Filter, error) {
+	f := audit.Filter{
+		Actor:     v.Get("actor"),
+		Method:    strings.ToUpper(v.Get("method")),
+		Resource:  v.Get("resource"),
+		ID:        v.Get("resource_id"),
+		RequestID: v.Get("request_id"),
+	}
+	for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if s := v.Get(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*t = parsed
+		}
+	}
+	return f, nil
+}
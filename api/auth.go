@@ -0,0 +1,303 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/notify"
+	"go-chi-microservice/users"
+)
+
+// AuthResource serves password and OIDC login and token refresh under /auth
+type AuthResource struct {
+	svc                 *users.Service
+	issuer              *auth.Issuer
+	oidc                *auth.OIDC      // nil without an identity provider
+	passkeys            *auth.Passkeys  // nil without passkey logins
+	sessions            *sessionCookies // nil without cookie sessions
+	throttle            *auth.Throttle
+	notifier            *notify.Dispatcher // nil sends no notifications
+	totp                bool               // ask users with an authenticator for a code
+	trustForwardedProto bool
+}
+
+func NewAuthResource(svc *users.Service, issuer *auth.Issuer, oidc *auth.OIDC, passkeys *auth.Passkeys, sessions *sessionCookies, throttle *auth.Throttle, notifier *notify.Dispatcher, totp, trustForwardedProto bool) *AuthResource {
+	return &AuthResource{svc: svc, issuer: issuer, oidc: oidc, passkeys: passkeys, sessions: sessions, throttle: throttle, notifier: notifier, totp: totp, trustForwardedProto: trustForwardedProto}
+}
+
+func (rs *AuthResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Post("/login", rs.Login)
+	r.Post("/refresh", rs.Refresh)
+	r.Post("/logout", rs.Logout)
+	if rs.sessions != nil {
+		r.Post("/session/login", rs.SessionLogin)
+		r.Post("/session/logout", rs.SessionLogout)
+	}
+	if rs.oidc != nil {
+		r.Get("/oidc/login", rs.OIDCLogin)
+		r.Get("/oidc/callback", rs.OIDCCallback)
+	}
+	if rs.passkeys != nil {
+		r.Post("/passkey/login/begin", rs.PasskeyLoginBegin)
+		r.Post("/passkey/login/finish", rs.PasskeyLoginFinish)
+	}
+	return r
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// OTP is the authenticator or a recovery code, for users with two
+	// factor logins on
+	OTP string `json:"otp,omitempty"`
+}
+
+func (l *LoginRequest) Bind(r *http.Request) error {
+	if l.Email == "" || l.Password == "" {
+		return errors.New("missing email or password")
+	}
+	return nil
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (rr *RefreshRequest) Bind(r *http.Request) error {
+	if rr.RefreshToken == "" {
+		return errors.New("missing refresh_token")
+	}
+	return nil
+}
+
+type TokenResponse struct {
+	*auth.Pair
+}
+
+func (tr *TokenResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// tokens must not end up in a shared cache
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+func ErrUnauthorized(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 401,
+		StatusText:     "Unauthorized.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrLoginThrottled is 423 for a locked account and 429 while failed logins
+// are backing off, with Retry-After either way
+func ErrLoginThrottled(w http.ResponseWriter, err *auth.RetryError) render.Renderer {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.After.Seconds()))))
+	if errors.Is(err, auth.ErrLocked) {
+		return &ErrResponse{Err: err, HTTPStatusCode: 423, StatusText: "Locked.", ErrorText: err.Error()}
+	}
+	return &ErrResponse{Err: err, HTTPStatusCode: 429, StatusText: "Too many requests.", ErrorText: err.Error()}
+}
+
+func (rs *AuthResource) Login(w http.ResponseWriter, r *http.Request) {
+	user, ok := rs.checkLogin(w, r, metrics.MethodPassword)
+	if !ok {
+		return
+	}
+	pair, err := rs.issuer.Issue(r.Context(), user.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+// checkLogin verifies the email and password in the request body and counts
+// the attempt under method. Accounts and addresses with recent failures are
+// turned away before the password is looked at. When it fails the error
+// response has been written.
+func (rs *AuthResource) checkLogin(w http.ResponseWriter, r *http.Request, method string) (*users.User, bool) {
+	data := &LoginRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return nil, false
+	}
+	addr := clientAddr(r)
+	logger := zerolog.Ctx(r.Context())
+	var re *auth.RetryError
+	switch err := rs.throttle.Check(r.Context(), data.Email, addr); {
+	case errors.As(err, &re):
+		outcome := metrics.Throttled
+		if errors.Is(err, auth.ErrLocked) {
+			outcome = metrics.Locked
+		}
+		metrics.Login(method, outcome)
+		render.Render(w, r, ErrLoginThrottled(w, re))
+		return nil, false
+	case err != nil:
+		// the shared windows are down, the per instance limits still hold
+		logger.Error().Err(err).Msg("checking login limits")
+	}
+	user, err := rs.svc.GetByEmail(r.Context(), data.Email)
+	switch {
+	case errors.Is(err, users.ErrNotFound):
+		err = auth.CheckMissing(data.Password)
+	case clientGone(r, err):
+		return nil, false
+	case err != nil:
+		render.Render(w, r, ErrStorage(err))
+		return nil, false
+	case !user.CanSignIn():
+		// deprovisioned or suspended, as far as logins go it's gone
+		err = auth.CheckMissing(data.Password)
+	default:
+		err = auth.CheckPassword(user.PasswordHash, data.Password)
+		if err == nil && user.PasswordResetRequired {
+			err = auth.ErrPasswordResetRequired
+		}
+		if err == nil && rs.totp && user.TOTP.Secret != "" {
+			user, err = rs.secondFactor(r, user, data.OTP)
+		}
+	}
+	if errors.Is(err, auth.ErrOTPRequired) {
+		// the password was right, that's not a failure to count
+		w.Header().Set("WWW-Authenticate", `OTP`)
+		render.Render(w, r, ErrUnauthorized(err))
+		return nil, false
+	}
+	if errors.Is(err, auth.ErrPasswordResetRequired) {
+		metrics.Login(method, metrics.Failure)
+		render.Render(w, r, ErrForbidden(err))
+		return nil, false
+	}
+	if err != nil && !errors.Is(err, auth.ErrBadCredentials) {
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return nil, false
+	}
+	if err != nil {
+		metrics.Login(method, metrics.Failure)
+		logger.Info().Str("remote", addr).Msg("failed login")
+		res, ferr := rs.throttle.Fail(r.Context(), data.Email, addr)
+		if ferr != nil {
+			logger.Error().Err(ferr).Msg("counting failed login")
+		}
+		if res.Locked {
+			metrics.SecurityEvent(metrics.EventAccountLocked)
+			logger.Warn().Str("audit", "account_locked").Str("account", data.Email).Str("remote", addr).
+				Dur("duration", rs.throttle.LockoutDuration()).Msg("account locked after failed logins")
+			if user != nil && user.CanSignIn() {
+				rs.notify(r, user, notify.EventAccountLocked, map[string]string{"remote": addr})
+			}
+		}
+		for _, scope := range res.Crossed {
+			metrics.SecurityEvent(metrics.EventLoginLimit + "_" + scope)
+			logger.Warn().Str("audit", "login_limit_reached").Str("scope", scope).Str("account", data.Email).Str("remote", addr).
+				Msg("failed logins reached the limit for the window")
+		}
+		tarpit(r, res.Delay)
+		render.Render(w, r, ErrUnauthorized(err))
+		return nil, false
+	}
+	if err := rs.throttle.Succeed(r.Context(), data.Email); err != nil {
+		logger.Error().Err(err).Msg("clearing failed logins")
+	}
+	metrics.Login(method, metrics.Success)
+	rs.notify(r, user, notify.EventLogin, map[string]string{"method": method, "remote": addr})
+	return user, true
+}
+
+// secondFactor checks the login's code and stores that it's been used,
+// returning the updated user
+func (rs *AuthResource) secondFactor(r *http.Request, user *users.User, code string) (*users.User, error) {
+	if code == "" {
+		return user, auth.ErrOTPRequired
+	}
+	u, ok := useSecondFactor(user, code, time.Now())
+	if !ok {
+		return user, auth.ErrBadCredentials
+	}
+	if err := rs.svc.Update(r.Context(), u); err != nil {
+		return user, err
+	}
+	return u, nil
+}
+
+// notify tells user about event over the channel they picked for it
+func (rs *AuthResource) notify(r *http.Request, user *users.User, event notify.Event, data map[string]string) {
+	if rs.notifier == nil {
+		return
+	}
+	rs.notifier.Dispatch(r.Context(), notify.Notification{UserID: user.Id, Email: user.Email, Phone: user.Phone, Event: event, Data: data})
+}
+
+// tarpit holds up the response to a failed login for d, or until the
+// client gives up
+func tarpit(r *http.Request, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+// clientAddr is the client's ip, RealIP has already taken it from the proxy
+// headers when there are any
+func clientAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (rs *AuthResource) Refresh(w http.ResponseWriter, r *http.Request) {
+	data := &RefreshRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	pair, err := rs.issuer.Refresh(r.Context(), data.RefreshToken)
+	switch {
+	case errors.Is(err, auth.ErrTokenReused):
+		zerolog.Ctx(r.Context()).Warn().Str("remote", r.RemoteAddr).Msg("refresh token reused, session revoked")
+		render.Render(w, r, ErrUnauthorized(auth.ErrInvalidToken))
+		return
+	case errors.Is(err, auth.ErrInvalidToken):
+		render.Render(w, r, ErrUnauthorized(err))
+		return
+	case err != nil:
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+// Logout revokes the session of the refresh token
+func (rs *AuthResource) Logout(w http.ResponseWriter, r *http.Request) {
+	data := &RefreshRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err := rs.issuer.Revoke(r.Context(), data.RefreshToken); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/config"
+	"go-chi-microservice/testsupport"
+	"go-chi-microservice/users"
+)
+
+const (
+	password  = "correct horse battery staple"
+	scimToken = "scim-token-scim-token-scim-token-0"
+)
+
+// authServer issues tokens, with a1 (ada@example.com) able to sign in with
+// password
+func authServer(t *testing.T, configure func(cfg *config.Config)) *testsupport.Server {
+	t.Helper()
+	srv := testsupport.NewServer(t, testsupport.WithConfig(func(cfg *config.Config) {
+		cfg.Auth.Enabled = true
+		cfg.Auth.JWTSecret = strings.Repeat("s", 32)
+		configure(cfg)
+	}))
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SeedUsers(&users.User{Id: "a1", Email: "ada@example.com", PasswordHash: hash})
+	return srv
+}
+
+// login returns a refresh token for ada
+func login(t *testing.T, srv *testsupport.Server) string {
+	t.Helper()
+	var pair auth.Pair
+	srv.Post("/auth/login", map[string]string{"email": "ada@example.com", "password": password}).
+		AssertStatus(200).
+		DecodeJSON(&pair)
+	return pair.RefreshToken
+}
+
+// changeStored changes the stored a1 behind the API's back
+func changeStored(t *testing.T, srv *testsupport.Server, fn func(u *users.User)) {
+	t.Helper()
+	stored, err := srv.Users.Get(users.IncludeDeleted(context.Background()), "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := *stored
+	fn(&u)
+	srv.SeedUsers(&u)
+}
+
+// TestRefreshChecksTheUser checks a refresh token stops working once its
+// user can't sign in, and stays revoked when they're let back in
+func TestRefreshChecksTheUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(u *users.User)
+	}{
+		{name: "suspended", change: func(u *users.User) { u.Suspended = true }},
+		{name: "disabled", change: func(u *users.User) { u.Disabled = true }},
+		{name: "deleted", change: func(u *users.User) { now := time.Now(); u.DeletedAt = &now }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := authServer(t, func(cfg *config.Config) {})
+			first := login(t, srv)
+			second := login(t, srv)
+			changeStored(t, srv, tt.change)
+			srv.Post("/auth/refresh", map[string]string{"refresh_token": first}).AssertStatus(401)
+			changeStored(t, srv, func(u *users.User) { *u = users.User{Id: u.Id, Email: u.Email, PasswordHash: u.PasswordHash} })
+			srv.Post("/auth/refresh", map[string]string{"refresh_token": second}).AssertStatus(401)
+		})
+	}
+}
+
+// TestDeprovisioningRevokesTokens checks deleting a user, or deprovisioning
+// them through SCIM, revokes their refresh tokens there and then
+func TestDeprovisioningRevokesTokens(t *testing.T) {
+	scimAuth := http.Header{"Authorization": {"Bearer " + scimToken}}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		header http.Header
+		status int
+	}{
+		{name: "soft delete", method: "DELETE", path: "/users/a1", header: http.Header{"If-Match": {`"1"`}}, status: 204},
+		{name: "SCIM delete", method: "DELETE", path: "/scim/v2/Users/a1", header: scimAuth, status: 204},
+		{name: "SCIM deactivate", method: "PATCH", path: "/scim/v2/Users/a1", header: scimAuth, status: 200, body: map[string]any{
+			"schemas":    []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+			"Operations": []any{map[string]any{"op": "replace", "path": "active", "value": false}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := authServer(t, func(cfg *config.Config) {
+				cfg.SCIM.Enabled, cfg.SCIM.Token = true, scimToken
+			})
+			token := login(t, srv)
+			srv.Do(tt.method, tt.path, tt.body, tt.header).AssertStatus(tt.status)
+			// let back in, the token stays revoked
+			changeStored(t, srv, func(u *users.User) { u.DeletedAt, u.Disabled = nil, false })
+			srv.Post("/auth/refresh", map[string]string{"refresh_token": token}).AssertStatus(401)
+		})
+	}
+}
+
+// TestPasswordResetEndsSessions checks a reset signs out whoever was
+// signed in, a stolen browser session included
+func TestPasswordResetEndsSessions(t *testing.T) {
+	srv := authServer(t, func(cfg *config.Config) {
+		cfg.Auth.Require = true
+		cfg.Auth.Session.Enabled = true
+		cfg.Auth.Account.Enabled = true
+		cfg.Auth.Account.VerifyURL = "https://app.example.com/verify"
+		cfg.Auth.Account.ResetURL = "https://app.example.com/reset"
+	})
+	cookie := signIn(t, srv)
+	refresh := login(t, srv)
+	srv.Post("/auth/forgot-password", map[string]string{"email": "ada@example.com"}).AssertStatus(202)
+	msg, ok := srv.Mail.Wait("ada@example.com")
+	if !ok {
+		t.Fatal("no reset email sent")
+	}
+	link, err := url.Parse(strings.Fields(msg.Text[strings.Index(msg.Text, "https://"):])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Do("GET", "/users/a1", nil, cookie).AssertStatus(200)
+	srv.Post("/auth/reset-password", map[string]string{"token": link.Query().Get("token"), "password": "a new password"}).
+		AssertStatus(204)
+	srv.Do("GET", "/users/a1", nil, cookie).AssertStatus(401)
+	srv.Post("/auth/refresh", map[string]string{"refresh_token": refresh}).AssertStatus(401)
+}
+
+func TestSessionLogoutChecksCSRF(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  func(csrf string) string // the X-CSRF-Token sent
+		status int
+	}{
+		{name: "matching", token: func(csrf string) string { return csrf }, status: 204},
+		{name: "missing", token: func(string) string { return "" }, status: 403},
+		{name: "mismatched", token: func(csrf string) string { return csrf + "x" }, status: 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := sessionServer(t, false)
+			header := signIn(t, srv)
+			c, err := (&http.Request{Header: header}).Cookie("csrf_token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token := tt.token(c.Value); token != "" {
+				header.Set("X-Csrf-Token", token)
+			}
+			srv.Do("POST", "/auth/session/logout", nil, header).AssertStatus(tt.status)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/golang-jwt/jwt/v5"
+
+	"go-chi-microservice/audit"
+	"go-chi-microservice/auth"
+	"go-chi-microservice/ctxkeys"
+)
+
+// ClaimsFrom returns the verified access token claims of the request, nil
+// for an anonymous one
+func ClaimsFrom(ctx context.Context) *auth.Claims {
+	c, _ := ctxkeys.Value[*auth.Claims](ctx, ctxkeys.Claims)
+	return c
+}
+
+// authenticate verifies a bearer token when one is sent, or else the
+// session cookie, which also needs the CSRF token on state changes and a
+// user who can still sign in. With required set requests without either
+// are turned away too.
+func authenticate(v auth.Verifier, sessions *sessionCookies, required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" && sessions != nil {
+				sess, err := sessions.lookup(r)
+				if err != nil {
+					render.Render(w, r, ErrStorage(err))
+					return
+				}
+				if sess != nil {
+					active, err := sessions.active(r.Context(), sess)
+					if clientGone(r, err) {
+						return
+					}
+					if err != nil {
+						render.Render(w, r, ErrStorage(err))
+						return
+					}
+					if !active {
+						render.Render(w, r, ErrUnauthorized(errors.New("the session's user can't sign in")))
+						return
+					}
+					if err := checkCSRF(r, sess); err != nil {
+						render.Render(w, r, ErrForbidden(err))
+						return
+					}
+					SetReportUser(r.Context(), sess.UserID)
+					audit.SetActor(r.Context(), sess.UserID)
+					ctx := ctxkeys.With(r.Context(), ctxkeys.Session, sess)
+					ctx = ctxkeys.With(ctx, ctxkeys.Claims, &auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: sess.UserID}, Tenant: sess.Tenant})
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+			if header == "" {
+				if required {
+					w.Header().Set("WWW-Authenticate", `Bearer`)
+					msg := "missing bearer token"
+					if sessions != nil {
+						msg += " or session cookie"
+					}
+					render.Render(w, r, ErrUnauthorized(errors.New(msg)))
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			scheme, token, _ := strings.Cut(header, " ")
+			if !strings.EqualFold(scheme, "Bearer") || token == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+				render.Render(w, r, ErrUnauthorized(errors.New("authorization must be a bearer token")))
+				return
+			}
+			if v == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				render.Render(w, r, ErrUnauthorized(errors.New("bearer tokens aren't accepted here")))
+				return
+			}
+			claims, err := v.Verify(r.Context(), token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				render.Render(w, r, ErrUnauthorized(auth.ErrInvalidToken))
+				return
+			}
+			SetReportUser(r.Context(), claims.Subject)
+			audit.SetActor(r.Context(), tokenActor(claims))
+			next.ServeHTTP(w, r.WithContext(ctxkeys.With(r.Context(), ctxkeys.Claims, claims)))
+		})
+	}
+}
+
+// tokenActor names who a token's requests are audited under, the operator
+// as well as the user for an impersonation
+func tokenActor(c *auth.Claims) string {
+	if c.Act != nil {
+		return c.Act.Subject + " as " + c.Subject
+	}
+	return c.Subject
+}
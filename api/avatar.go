@@ -0,0 +1,324 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/egress"
+	"go-chi-microservice/imaging"
+	"go-chi-microservice/storage"
+	"go-chi-microservice/users"
+)
+
+// avatarExtensions are the picture types that can be accepted, by the
+// content type sniffed from the file
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// multipartOverhead is allowed on top of the picture for the multipart
+// boundaries and headers
+const multipartOverhead = 16 << 10
+
+var errAvatarTooLarge = errors.New("avatar is too large")
+
+// AvatarResource serves /users/{userID}/avatar, where users upload the
+// picture shown as their AvatarURL
+type AvatarResource struct {
+	svc       *users.Service
+	store     storage.Storage
+	maxBytes  int64
+	types     map[string]bool
+	fetcher   *egress.Fetcher
+	processor *imaging.Processor
+}
+
+func NewAvatarResource(svc *users.Service, store storage.Storage, maxBytes int64, contentTypes []string) *AvatarResource {
+	types := make(map[string]bool, len(contentTypes))
+	for _, t := range contentTypes {
+		types[t] = true
+	}
+	return &AvatarResource{svc: svc, store: store, maxBytes: maxBytes, types: types}
+}
+
+// EnableURLs lets Put download a picture from a url, held to policy, nil
+// for no checks on where. Call it before Routes.
+func (rs *AvatarResource) EnableURLs(policy *egress.Policy, timeout time.Duration) {
+	types := make([]string, 0, len(rs.types))
+	for t := range rs.types {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	rs.fetcher = egress.NewFetcher(policy, egress.FetchOptions{MaxBytes: rs.maxBytes, Timeout: timeout, ContentTypes: types, MaxRedirects: 3})
+}
+
+// EnableProcessing has each picture processed before it's stored: checked,
+// stripped of its metadata and stored at the processor's sizes, the
+// largest as AvatarURL. Call it before Routes.
+func (rs *AvatarResource) EnableProcessing(p *imaging.Processor) {
+	rs.processor = p
+}
+
+// AvatarURLRequest is the picture to download when Put is given JSON
+type AvatarURLRequest struct {
+	URL string `json:"url"`
+}
+
+func (a *AvatarURLRequest) Bind(r *http.Request) error {
+	_, err := egress.ParseURL(a.URL)
+	return err
+}
+
+// Routes expect UserCtx to have loaded the user
+func (rs *AvatarResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly)
+	r.Put("/", rs.Put)
+	r.Delete("/", rs.Delete)
+	return r
+}
+
+// Put takes the picture in the avatar field of a multipart/form-data body
+// and streams it to storage, then returns the user with its new AvatarURL.
+// With EnableURLs a JSON body can give the url of a picture to download
+// instead, and with EnableProcessing the picture is read into memory and
+// processed before it's stored. Each upload gets a new key, so the URL of a picture never
+// serves another and can be cached for good.
+func (rs *AvatarResource) Put(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, rs.maxBytes+multipartOverhead)
+	if rs.fetcher != nil && render.GetRequestContentType(r) == render.ContentTypeJSON {
+		rs.putURL(w, r, user)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		render.Render(w, r, ErrUnsupportedMediaType(errors.New("expected a multipart/form-data body")))
+		return
+	}
+	var part io.Reader
+	for part == nil {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			render.Render(w, r, ErrInvalidRequest(errors.New("missing avatar field")))
+			return
+		}
+		if err != nil {
+			rs.uploadError(w, r, err, ErrInvalidRequest)
+			return
+		}
+		if p.FormName() == "avatar" {
+			part = p
+		}
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		rs.uploadError(w, r, err, ErrInvalidRequest)
+		return
+	}
+	rs.save(w, r, user, head[:n], part)
+}
+
+// putURL downloads the picture at the url in the body, through the
+// fetcher so it can't be pointed at the internal network
+func (rs *AvatarResource) putURL(w http.ResponseWriter, r *http.Request, user *users.User) {
+	data := &AvatarURLRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	fetched, err := rs.fetcher.Fetch(r.Context(), data.URL)
+	switch {
+	case errors.Is(err, egress.ErrTooLarge):
+		render.Render(w, r, ErrTooLarge(fmt.Errorf("avatar is over %d bytes", rs.maxBytes)))
+		return
+	case errors.Is(err, egress.ErrContentType):
+		render.Render(w, r, ErrUnsupportedMediaType(err))
+		return
+	case clientGone(r, err):
+		return
+	case err != nil:
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("fetching avatar: %w", err)))
+		return
+	}
+	rs.save(w, r, user, fetched.Body, bytes.NewReader(nil))
+}
+
+// save stores the picture starting with head and going on in rest, then
+// points the user at it
+func (rs *AvatarResource) save(w http.ResponseWriter, r *http.Request, user *users.User, head []byte, rest io.Reader) {
+	// the type comes from the content, clients can claim anything
+	contentType := http.DetectContentType(head)
+	ext, ok := avatarExtensions[contentType]
+	if !ok || !rs.types[contentType] {
+		render.Render(w, r, ErrUnsupportedMediaType(fmt.Errorf("avatar can't be %s", contentType)))
+		return
+	}
+	name := make([]byte, 8)
+	if _, err := rand.Read(name); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	base := "avatars/" + user.Id + "/" + hex.EncodeToString(name)
+	body := &capReader{r: io.MultiReader(bytes.NewReader(head), rest), left: rs.maxBytes}
+	key := base + ext
+	if rs.processor != nil {
+		if key, ok = rs.putProcessed(w, r, base, body); !ok {
+			return
+		}
+	} else if err := rs.store.Put(r.Context(), key, body, -1, contentType); err != nil {
+		rs.uploadError(w, r, err, ErrStorage)
+		return
+	}
+	u := *user
+	u.AvatarKey, u.AvatarURL = key, rs.store.URL(key)
+	if err := rs.svc.Update(r.Context(), &u); err != nil {
+		rs.remove(r, key)
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	rs.remove(r, user.AvatarKey)
+	zerolog.Ctx(r.Context()).Info().Str("audit", "avatar_uploaded").Str("user_id", u.Id).Str("key", key).Msg("avatar uploaded")
+	render.Render(w, r, NewUserResponse(&u))
+}
+
+// putProcessed reads the picture into memory, has the processor make its
+// sizes and stores them under base, returning the key of the largest
+func (rs *AvatarResource) putProcessed(w http.ResponseWriter, r *http.Request, base string, body io.Reader) (string, bool) {
+	src, err := io.ReadAll(body)
+	if err != nil {
+		rs.uploadError(w, r, err, ErrInvalidRequest)
+		return "", false
+	}
+	variants, err := rs.processor.Process(r.Context(), src)
+	switch {
+	case errors.Is(err, imaging.ErrInvalid):
+		render.Render(w, r, ErrInvalidRequest(errors.New("avatar isn't a valid image")))
+		return "", false
+	case errors.Is(err, imaging.ErrTooManyPixels):
+		render.Render(w, r, ErrTooLarge(err))
+		return "", false
+	case errors.Is(err, imaging.ErrBusy):
+		w.Header().Set("Retry-After", "1")
+		render.Render(w, r, &ErrResponse{Err: err, HTTPStatusCode: 503, StatusText: "Service unavailable.", ErrorText: err.Error()})
+		return "", false
+	case clientGone(r, err):
+		return "", false
+	case err != nil:
+		render.Render(w, r, ErrStorage(err))
+		return "", false
+	}
+	key := base + "/" + strconv.Itoa(variants[0].Size) + variants[0].Ext
+	for _, v := range variants {
+		vkey := base + "/" + strconv.Itoa(v.Size) + v.Ext
+		if err := rs.store.Put(r.Context(), vkey, bytes.NewReader(v.Data), int64(len(v.Data)), v.ContentType); err != nil {
+			rs.remove(r, key)
+			rs.uploadError(w, r, err, ErrStorage)
+			return "", false
+		}
+	}
+	return key, true
+}
+
+func (rs *AvatarResource) Delete(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	if user.AvatarKey == "" {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	u := *user
+	u.AvatarKey, u.AvatarURL = "", ""
+	if err := rs.svc.Update(r.Context(), &u); err != nil {
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	rs.remove(r, user.AvatarKey)
+	zerolog.Ctx(r.Context()).Info().Str("audit", "avatar_removed").Str("user_id", u.Id).Msg("avatar removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remove deletes a replaced picture. The user no longer points at it, so a
+// failure only leaves an orphan behind and is logged rather than returned.
+func (rs *AvatarResource) remove(r *http.Request, key string) {
+	if key == "" {
+		return
+	}
+	for _, k := range rs.keys(key) {
+		if err := rs.store.Delete(r.Context(), k); err != nil {
+			zerolog.Ctx(r.Context()).Warn().Err(err).Str("key", k).Msg("deleting replaced avatar")
+		}
+	}
+}
+
+// keys are the keys a picture is stored under: key, and for a processed
+// one the other sizes beside it, avatars/<user id>/<name>/<size>.<format>
+func (rs *AvatarResource) keys(key string) []string {
+	keys := []string{key}
+	if rs.processor == nil || strings.Count(key, "/") != 3 {
+		return keys
+	}
+	dir := path.Dir(key)
+	for _, size := range rs.processor.Sizes() {
+		if k := dir + "/" + strconv.Itoa(size) + rs.processor.Ext(); k != key {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// uploadError renders an error from reading or storing the upload, 413 when
+// it was too large and otherwise as other
+func (rs *AvatarResource) uploadError(w http.ResponseWriter, r *http.Request, err error, other func(error) render.Renderer) {
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.Is(err, errAvatarTooLarge) || errors.As(err, &mbe):
+		render.Render(w, r, ErrTooLarge(fmt.Errorf("avatar is over %d bytes", rs.maxBytes)))
+	case clientGone(r, err):
+	default:
+		render.Render(w, r, other(err))
+	}
+}
+
+// capReader fails once more than left bytes have been read, so storage
+// never keeps an oversized picture
+type capReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.left < 0 {
+		return n, errAvatarTooLarge
+	}
+	return n, err
+}
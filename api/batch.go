@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/breaker"
+	"go-chi-microservice/users"
+)
+
+// BatchGetRequest is the body of POST /users/batch-get
+type BatchGetRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// BatchGetResult is one id of a batch get, User when it was found and
+// Error otherwise
+type BatchGetResult struct {
+	Id     string        `json:"id"`
+	Status int           `json:"status"`
+	User   *UserResponse `json:"user,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type BatchGetResponse struct {
+	Results []BatchGetResult `json:"results"`
+}
+
+func (br *BatchGetResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	for _, res := range br.Results {
+		if res.User != nil {
+			res.User.Render(w, r)
+		}
+	}
+	return nil
+}
+
+// BatchGet looks up a list of ids in one repository call, with a result
+// for each id in the order asked
+func (rs *UsersResource) BatchGet(w http.ResponseWriter, r *http.Request) {
+	var req BatchGetRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err := rs.checkBatchSize(len(req.Ids)); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	// an id that doesn't decode is left empty, to be not found
+	ids := make([]string, len(req.Ids))
+	for i, id := range req.Ids {
+		ids[i], _ = decodeID(r.Context(), id)
+	}
+	found, err := rs.svc.GetMany(r.Context(), ids)
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	resp := &BatchGetResponse{Results: make([]BatchGetResult, 0, len(req.Ids))}
+	for i, id := range req.Ids {
+		if u, ok := found[ids[i]]; ok {
+			resp.Results = append(resp.Results, BatchGetResult{Id: id, Status: http.StatusOK, User: NewUserResponse(u)})
+			continue
+		}
+		resp.Results = append(resp.Results, BatchGetResult{Id: id, Status: http.StatusNotFound, Error: users.ErrNotFound.Error()})
+	}
+	render.Render(w, r, resp)
+}
+
+// BatchUser is what a batch operation may set on a user. Credentials,
+// verification and the avatar aren't among them, updates keep what's
+// stored.
+type BatchUser struct {
+	Id        string
+	Email     string
+	Phone     string
+	ManagerId string
+	Disabled  bool
+}
+
+// BatchOperation is one create, update or delete. Create and update take
+// User, delete only Id.
+type BatchOperation struct {
+	Op   string     `json:"op"`
+	Id   string     `json:"id,omitempty"`
+	User *BatchUser `json:"user,omitempty"`
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult is how one operation went, by its index in the request
+type BatchResult struct {
+	Index  int           `json:"index"`
+	Id     string        `json:"id,omitempty"`
+	Status int           `json:"status"`
+	User   *UserResponse `json:"user,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+func (br *BatchResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	for _, res := range br.Results {
+		if res.Status >= 300 {
+			render.Status(r, http.StatusMultiStatus)
+		}
+		if res.User != nil {
+			res.User.Render(w, r)
+		}
+	}
+	return nil
+}
+
+// Batch applies a list of operations in order, each on its own: one that
+// fails is reported with its status and the rest still run, so a 207 may
+// have written some users. Delete deprovisions like SCIM's, the user is
+// disabled and its data stays.
+func (rs *UsersResource) Batch(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeBatchRequest(r, http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err := rs.checkBatchSize(len(req.Operations)); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	resp := &BatchResponse{Results: make([]BatchResult, 0, len(req.Operations))}
+	for i, op := range req.Operations {
+		stored, err := decodeOperation(r.Context(), op)
+		var res BatchResult
+		if err != nil {
+			res = batchFailure(op.Id, err)
+		} else {
+			res = applyOperation(r.Context(), rs.svc, stored, "batch")
+		}
+		if clientGone(r, nil) {
+			return
+		}
+		res.Index = i
+		if res.Status < 300 {
+			zerolog.Ctx(r.Context()).Info().Str("audit", "user_batch_"+op.Op).Str("user_id", res.Id).Msg("user written in batch")
+		}
+		if err == nil {
+			res.Id = encodeID(r.Context(), res.Id)
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	render.Render(w, r, resp)
+}
+
+// decodeBatchRequest reads a BatchRequest, its users sent in the request's
+// payload version
+func decodeBatchRequest(r *http.Request, body io.Reader) (BatchRequest, error) {
+	var raw struct {
+		Operations []struct {
+			BatchOperation
+			User json.RawMessage `json:"user,omitempty"`
+		} `json:"operations"`
+	}
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return BatchRequest{}, err
+	}
+	req := BatchRequest{Operations: make([]BatchOperation, 0, len(raw.Operations))}
+	for _, op := range raw.Operations {
+		if len(op.User) > 0 && string(op.User) != "null" {
+			data, err := usersPayloads.Upgrade(r.Context(), "batch-user", op.User, payloadVersionFrom(r.Context()))
+			if err != nil {
+				return req, err
+			}
+			op.BatchOperation.User = &BatchUser{}
+			if err := json.Unmarshal(data, op.BatchOperation.User); err != nil {
+				return req, err
+			}
+		}
+		req.Operations = append(req.Operations, op.BatchOperation)
+	}
+	return req, nil
+}
+
+// decodeOperation is op with the public ids it was sent with swapped for
+// stored ones. A create's Id is the new user's and is kept as sent.
+func decodeOperation(ctx context.Context, op BatchOperation) (BatchOperation, error) {
+	var err error
+	if op.Id, err = decodeID(ctx, op.Id); err != nil {
+		return op, users.ErrNotFound
+	}
+	if op.User == nil {
+		return op, nil
+	}
+	u := *op.User
+	op.User = &u
+	if op.Op != "create" {
+		if u.Id, err = decodeID(ctx, u.Id); err != nil {
+			return op, users.ErrNotFound
+		}
+	}
+	if u.ManagerId, err = decodeID(ctx, u.ManagerId); err != nil {
+		return op, fmt.Errorf("%w: ManagerId is not a user", users.ErrInvalid)
+	}
+	return op, nil
+}
+
+// applyOperation runs op with svc, creates are counted under via like
+// Service.Create
+func applyOperation(ctx context.Context, svc *users.Service, op BatchOperation, via string) BatchResult {
+	switch op.Op {
+	case "create":
+		if op.User == nil {
+			return BatchResult{Status: http.StatusBadRequest, Error: "create needs a user"}
+		}
+		u := &users.User{Id: op.User.Id, Email: op.User.Email, Phone: op.User.Phone, ManagerId: op.User.ManagerId, Disabled: op.User.Disabled}
+		if err := svc.Create(ctx, u, via); err != nil {
+			return batchFailure(u.Id, err)
+		}
+		return BatchResult{Id: u.Id, Status: http.StatusCreated, User: NewUserResponse(u)}
+	case "update":
+		if op.User == nil || op.User.Id == "" {
+			return BatchResult{Status: http.StatusBadRequest, Error: "update needs a user with an id"}
+		}
+		return updateStored(ctx, svc, op.User.Id, func(u *users.User) {
+			// an email can't be taken away, only changed
+			if op.User.Email != "" {
+				u.Email = op.User.Email
+			}
+			u.Phone, u.ManagerId, u.Disabled = op.User.Phone, op.User.ManagerId, op.User.Disabled
+		})
+	case "delete":
+		if op.Id == "" {
+			return BatchResult{Status: http.StatusBadRequest, Error: "delete needs an id"}
+		}
+		res := updateStored(ctx, svc, op.Id, func(u *users.User) { u.Disabled = true })
+		res.User = nil
+		return res
+	}
+	return BatchResult{Id: op.Id, Status: http.StatusBadRequest, Error: fmt.Sprintf("op %q must be create, update or delete", op.Op)}
+}
+
+// updateStored applies change to a copy of the stored user and writes it
+func updateStored(ctx context.Context, svc *users.Service, id string, change func(*users.User)) BatchResult {
+	stored, err := svc.Get(ctx, id)
+	if err != nil {
+		return batchFailure(id, err)
+	}
+	u := *stored
+	change(&u)
+	if err := svc.Update(ctx, &u); err != nil {
+		return batchFailure(id, err)
+	}
+	return BatchResult{Id: id, Status: http.StatusOK, User: NewUserResponse(&u)}
+}
+
+// batchFailure is the result for an operation that failed with err, the
+// status the same request on its own would have got
+func batchFailure(id string, err error) BatchResult {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, users.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, users.ErrExists), errors.Is(err, users.ErrVersionMismatch):
+		status = http.StatusConflict
+	case errors.Is(err, users.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, breaker.ErrOpen):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	}
+	return BatchResult{Id: id, Status: status, Error: err.Error()}
+}
+
+func (rs *UsersResource) checkBatchSize(n int) error {
+	if n == 0 {
+		return errors.New("the batch is empty")
+	}
+	if n > rs.batchMax {
+		return fmt.Errorf("the batch has %d items, at most %d are allowed", n, rs.batchMax)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+)
+
+// maxBody caps request bodies at max bytes, 0 for no cap. A body declared
+// larger in Content-Length is turned away with a 413 before it's read,
+// one that turns out larger fails to read past the cap with an
+// http.MaxBytesError, which endpoints with their own, lower limit already
+// answer with a 413.
+func maxBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				w.Header().Set("Connection", "close")
+				render.Render(w, r, ErrTooLarge(fmt.Errorf("the body is over %d bytes", max)))
+				return
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, r.Body, max)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decompressBody decodes request bodies sent with Content-Encoding gzip or
+// deflate, answering other encodings with a 415 naming those. The decoded
+// body is capped at max too, so a small body can't inflate without end.
+func decompressBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var body io.ReadCloser
+			var err error
+			switch encoding {
+			case "gzip", "x-gzip":
+				body, err = gzip.NewReader(r.Body)
+			case "deflate":
+				body, err = zlib.NewReader(r.Body)
+			default:
+				w.Header().Set("Accept-Encoding", "gzip, deflate")
+				render.Render(w, r, ErrUnsupportedMediaType(fmt.Errorf("bodies encoded with %s aren't accepted", encoding)))
+				return
+			}
+			if err != nil {
+				render.Render(w, r, ErrInvalidRequest(fmt.Errorf("the %s body doesn't decode: %w", encoding, err)))
+				return
+			}
+			if max > 0 {
+				body = http.MaxBytesReader(w, body, max)
+			}
+			r.Body = body
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
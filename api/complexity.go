@@ -0,0 +1,114 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/expand"
+	"go-chi-microservice/query"
+)
+
+var overBudgetTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_complexity_over_budget_total",
+	Help: "Reads over the complexity budget, by whether they were rejected or downscoped.",
+}, []string{"outcome"})
+
+// complexity scores the costly parts of a read against a budget: nested
+// expansions, each a batch load per level, filter conditions and sorts,
+// and search terms, wildcards above all. The score is sent back in
+// X-Complexity as score/budget.
+type complexity struct {
+	cfg config.ComplexityConfig
+}
+
+func newComplexity(cfg config.ComplexityConfig) *complexity {
+	return &complexity{cfg: cfg}
+}
+
+// readCost is what a read asks for, the zero value of each part when it
+// doesn't use it
+type readCost struct {
+	expand expand.Tree
+	query  query.Query
+	search string
+}
+
+func (c *complexity) score(rc readCost) int {
+	score := c.expandScore(rc.expand, 1)
+	for _, cond := range rc.query.Filter {
+		if cond.Op == "~" {
+			score += c.cfg.ContainsWeight
+		} else {
+			score += c.cfg.FilterWeight
+		}
+	}
+	score += len(rc.query.Sort) * c.cfg.SortWeight
+	for _, term := range strings.Fields(rc.search) {
+		if strings.ContainsAny(term, "*?~/") {
+			score += c.cfg.SearchPatternWeight
+		} else {
+			score += c.cfg.SearchTermWeight
+		}
+	}
+	return score
+}
+
+func (c *complexity) expandScore(t expand.Tree, depth int) int {
+	score := 0
+	for _, sub := range t {
+		score += depth*c.cfg.ExpandWeight + c.expandScore(sub, depth+1)
+	}
+	return score
+}
+
+// admit checks rc against the budget and returns the expansions to serve,
+// fewer than asked for when downscoping had to drop some, listed in
+// X-Complexity-Dropped. A request over budget is answered with a 400 and
+// admit returns false.
+func (c *complexity) admit(w http.ResponseWriter, r *http.Request, rc readCost) (expand.Tree, bool) {
+	if !c.cfg.Enabled {
+		return rc.expand, true
+	}
+	asked := rc.expand
+	score := c.score(rc)
+	if score > c.cfg.Budget && c.cfg.Mode == "downscope" {
+		for depth := rc.expand.Depth() - 1; score > c.cfg.Budget && depth >= 0; depth-- {
+			rc.expand = asked.Prune(depth)
+			score = c.score(rc)
+		}
+		if score <= c.cfg.Budget {
+			overBudgetTotal.WithLabelValues("downscoped").Inc()
+			w.Header().Set("X-Complexity-Dropped", strings.Join(dropped(asked, rc.expand), ","))
+		}
+	}
+	w.Header().Set("X-Complexity", strconv.Itoa(score)+"/"+strconv.Itoa(c.cfg.Budget))
+	if score > c.cfg.Budget {
+		overBudgetTotal.WithLabelValues("rejected").Inc()
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf(
+			"request complexity %d is over the budget of %d: ask for fewer or shallower expansions, filters or search terms", score, c.cfg.Budget)))
+		return nil, false
+	}
+	return rc.expand, true
+}
+
+// dropped lists the paths of asked that kept no longer covers
+func dropped(asked, kept expand.Tree) []string {
+	var paths []string
+	for _, p := range asked.Paths() {
+		node := kept
+		for _, name := range strings.Split(p, ".") {
+			if node = node.Sub(name); node == nil {
+				paths = append(paths, p)
+				break
+			}
+		}
+	}
+	return paths
+}
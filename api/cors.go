@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/cors"
+
+	"go-chi-microservice/config"
+)
+
+// corsHandler builds the CORS middleware from config, mount it on the route
+// groups browsers should be able to reach cross origin
+func corsHandler(cfg config.CORSConfig) func(http.Handler) http.Handler {
+	opts := cors.Options{
+		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowedMethods:   cfg.AllowedMethods,
+		AllowedHeaders:   cfg.AllowedHeaders,
+		ExposedHeaders:   cfg.ExposedHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	}
+	if cfg.DevMode {
+		// reflect whatever origin asks rather than "*" so credentials still work
+		opts.AllowedOrigins = nil
+		opts.AllowOriginFunc = func(r *http.Request, origin string) bool { return true }
+		opts.AllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+		opts.AllowedHeaders = []string{"*"}
+	} else if len(opts.AllowedOrigins) == 0 {
+		// the cors package treats no origins as allow all, we want the opposite
+		opts.AllowOriginFunc = func(r *http.Request, origin string) bool { return false }
+	}
+	return cors.Handler(opts)
+}
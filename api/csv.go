@@ -0,0 +1,323 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/users"
+)
+
+const ContentTypeCSV = "text/csv"
+
+// csvColumn is a user field as a CSV column, set is nil for columns that
+// can't be imported
+type csvColumn struct {
+	get func(*users.User) string
+	set func(*users.User, string) error
+}
+
+// csvColumns are the user's public fields, by their JSON names, in the
+// order a full export has them
+var csvColumns = []string{"Id", "Email", "Phone", "ManagerId", "Disabled", "EmailVerified", "Guest", "AvatarURL"}
+
+var csvColumnsByName = map[string]csvColumn{
+	"id":            {func(u *users.User) string { return u.Id }, func(u *users.User, v string) error { u.Id = v; return nil }},
+	"email":         {func(u *users.User) string { return u.Email }, func(u *users.User, v string) error { u.Email = v; return nil }},
+	"phone":         {func(u *users.User) string { return u.Phone }, func(u *users.User, v string) error { u.Phone = v; return nil }},
+	"managerid":     {func(u *users.User) string { return u.ManagerId }, func(u *users.User, v string) error { u.ManagerId = v; return nil }},
+	"disabled":      {func(u *users.User) string { return strconv.FormatBool(u.Disabled) }, csvBool(func(u *users.User, b bool) { u.Disabled = b })},
+	"emailverified": {func(u *users.User) string { return strconv.FormatBool(u.EmailVerified) }, csvBool(func(u *users.User, b bool) { u.EmailVerified = b })},
+	"guest":         {get: func(u *users.User) string { return strconv.FormatBool(u.Guest) }},
+	"avatarurl":     {get: func(u *users.User) string { return u.AvatarURL }},
+}
+
+// csvBool parses true/false, 1/0 and the like, empty is false
+func csvBool(set func(*users.User, bool)) func(*users.User, string) error {
+	return func(u *users.User, v string) error {
+		if v == "" {
+			set(u, false)
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+		set(u, b)
+		return nil
+	}
+}
+
+// csvHeader resolves column names, ignoring case, to their canonical names
+func csvHeader(names []string) ([]string, error) {
+	canonical := make(map[string]string, len(csvColumns))
+	for _, name := range csvColumns {
+		canonical[strings.ToLower(name)] = name
+	}
+	seen := map[string]bool{}
+	header := make([]string, 0, len(names))
+	for _, name := range names {
+		c, ok := canonical[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q, columns are %s", name, strings.Join(csvColumns, ", "))
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("column %s given twice", c)
+		}
+		seen[c] = true
+		header = append(header, c)
+	}
+	return header, nil
+}
+
+// csvSafe keeps a spreadsheet from running a value as a formula by quoting
+// the leading =, +, -, @, tab or CR with a ', which import takes off again
+// so phone numbers survive a round trip
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+func csvUnsafe(v string) string {
+	if len(v) > 1 && v[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(v[1])) {
+		return v[1:]
+	}
+	return v
+}
+
+type csvEncoder struct {
+	w       *csv.Writer
+	columns []csvColumn
+	row     []string
+}
+
+func (e *csvEncoder) Encode(resp *UserResponse) error {
+	for i, c := range e.columns {
+		e.row[i] = csvSafe(c.get(resp.User))
+	}
+	return e.w.Write(e.row)
+}
+
+func (e *csvEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvFormat serves the collection as CSV for /users.csv
+func (rs *UsersResource) csvFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if format, _ := r.Context().Value(middleware.URLFormatCtxKey).(string); format == "csv" {
+			rs.ExportCSV(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ExportCSV streams every user as CSV with a header row, like ExportUsers.
+// ?columns=Id,Email picks the columns and their order, CSV_COLUMNS by
+// default.
+func (rs *UsersResource) ExportCSV(w http.ResponseWriter, r *http.Request) {
+	names := rs.csv.Columns
+	if q := r.URL.Query().Get("columns"); q != "" {
+		names = strings.Split(q, ",")
+	}
+	header, err := csvHeader(names)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	columns := make([]csvColumn, len(header))
+	for i, name := range header {
+		columns[i] = csvColumnsByName[strings.ToLower(name)]
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	rs.streamUsers(w, r, ContentTypeCSV+"; charset=utf-8", func(out io.Writer) (userEncoder, error) {
+		enc := &csvEncoder{w: csv.NewWriter(out), columns: columns, row: make([]string, len(columns))}
+		return enc, enc.w.Write(header)
+	})
+}
+
+// CSVImportResponse sums up a CSV import, Failed lists the rows that
+// weren't created by their line in the file
+type CSVImportResponse struct {
+	Created int               `json:"created"`
+	Failed  []CSVImportFailed `json:"failed,omitempty"`
+}
+
+type CSVImportFailed struct {
+	Row   int    `json:"row"`
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+func (ir *CSVImportResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if len(ir.Failed) > 0 {
+		render.Status(r, http.StatusMultiStatus)
+	}
+	return nil
+}
+
+// ImportCSV creates the users in a CSV upload, sent as the body with
+// Content-Type text/csv or in the file field of a multipart/form-data
+// body. The first row names the columns, Id and Email are required. Rows
+// that don't parse or validate are reported with the reason and don't stop
+// the rest.
+func (rs *UsersResource) ImportCSV(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, rs.csv.ImportMaxBytes)
+	body, err := csvUpload(r)
+	if err != nil {
+		rs.csvImportError(w, r, err)
+		return
+	}
+	cr := csv.NewReader(body)
+	cr.ReuseRecord = true
+	names, err := cr.Read()
+	if err == io.EOF {
+		render.Render(w, r, ErrInvalidRequest(errors.New("the CSV is empty, the first row must name the columns")))
+		return
+	}
+	if err != nil {
+		rs.csvImportError(w, r, err)
+		return
+	}
+	header, err := csvHeader(names)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	columns := make([]csvColumn, len(header))
+	has := map[string]bool{}
+	for i, name := range header {
+		columns[i] = csvColumnsByName[strings.ToLower(name)]
+		if columns[i].set == nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("column %s can't be imported", name)))
+			return
+		}
+		has[name] = true
+	}
+	if !has["Id"] || !has["Email"] {
+		render.Render(w, r, ErrInvalidRequest(errors.New("the Id and Email columns are required")))
+		return
+	}
+
+	resp := &CSVImportResponse{}
+	var list []*users.User
+	var rows []int // list[i] is from line rows[i]
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			resp.Failed = append(resp.Failed, CSVImportFailed{Row: pe.Line, Error: pe.Err.Error()})
+			continue
+		}
+		if err != nil {
+			rs.csvImportError(w, r, err)
+			return
+		}
+		row, _ := cr.FieldPos(0)
+		u, err := csvUser(header, columns, record)
+		if err == nil {
+			// managers are named by public id, new users by the id they're stored under
+			if u.ManagerId, err = decodeID(r.Context(), u.ManagerId); err != nil {
+				err = errors.New("ManagerId is not a user")
+			}
+		}
+		if err != nil {
+			resp.Failed = append(resp.Failed, CSVImportFailed{Row: row, Id: u.Id, Error: err.Error()})
+			continue
+		}
+		list = append(list, u)
+		rows = append(rows, row)
+	}
+
+	err = rs.svc.CreateMany(r.Context(), list)
+	var be *users.BatchError
+	if err != nil && !errors.As(err, &be) {
+		if clientGone(r, err) {
+			return
+		}
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	resp.Created = len(list)
+	if be != nil {
+		resp.Created -= len(be.Failures)
+		for _, f := range be.Failures {
+			resp.Failed = append(resp.Failed, CSVImportFailed{Row: rows[f.Index], Id: f.Id, Error: f.Err.Error()})
+		}
+	}
+	// rows that didn't parse were found before the rejected ones
+	sort.SliceStable(resp.Failed, func(i, j int) bool { return resp.Failed[i].Row < resp.Failed[j].Row })
+	render.Render(w, r, resp)
+}
+
+// csvUser builds a user from record, the columns checked and set in order
+func csvUser(header []string, columns []csvColumn, record []string) (*users.User, error) {
+	u := &users.User{}
+	for i, c := range columns {
+		if err := c.set(u, csvUnsafe(strings.TrimSpace(record[i]))); err != nil {
+			return u, fmt.Errorf("%s: %w", header[i], err)
+		}
+	}
+	return u, nil
+}
+
+// csvUpload is the CSV in r's body, directly or as the file field of a form
+func csvUpload(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case ContentTypeCSV, "application/csv":
+		return r.Body, nil
+	case "multipart/form-data":
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, errMissingCSVFile
+			}
+			if err != nil {
+				return nil, err
+			}
+			if p.FormName() == "file" {
+				return p, nil
+			}
+		}
+	}
+	return nil, errNotCSV
+}
+
+var (
+	errNotCSV         = errors.New("expected a text/csv or multipart/form-data body")
+	errMissingCSVFile = errors.New("missing file field")
+)
+
+func (rs *UsersResource) csvImportError(w http.ResponseWriter, r *http.Request, err error) {
+	var mbe *http.MaxBytesError
+	switch {
+	case errors.As(err, &mbe):
+		render.Render(w, r, ErrTooLarge(fmt.Errorf("the CSV is over %d bytes", rs.csv.ImportMaxBytes)))
+	case errors.Is(err, errNotCSV):
+		render.Render(w, r, ErrUnsupportedMediaType(err))
+	case clientGone(r, err):
+	default:
+		render.Render(w, r, ErrInvalidRequest(err))
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+// StatusClientClosedRequest is nginx's non-standard 499, recorded when the
+// client went away before a response was written
+const StatusClientClosedRequest = 499
+
+var clientClosedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_client_closed_total",
+	Help: "Requests abandoned by the client before a response was written.",
+}, []string{"route"})
+
+// clientGone reports whether err, or the request context, is because the
+// client disconnected. A deadline firing is a timeout, not a disconnect.
+func clientGone(r *http.Request, err error) bool {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// clientDisconnects records requests whose client disconnected mid flight.
+// Handlers that see clientGone just return without writing, and this marks
+// the request 499 so the request log and metrics show client_closed rather
+// than a misleading 200 or 500. Install it inside Logger.
+func clientDisconnects(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww, ok := w.(middleware.WrapResponseWriter)
+		if !ok {
+			ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		}
+		next.ServeHTTP(ww, r)
+
+		if !clientGone(r, nil) {
+			return
+		}
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		clientClosedTotal.WithLabelValues(route).Inc()
+		zerolog.Ctx(r.Context()).Debug().Str("route", route).Str("request_id", middleware.GetReqID(r.Context())).
+			Str("status", "client_closed").Msg("client disconnected")
+		if ww.Status() == 0 {
+			ww.WriteHeader(StatusClientClosedRequest)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/docs"
+)
+
+// docsExamples serves the recorded examples grouped by route and status.
+// Embedded ones are read once, those from a directory on every request so
+// newly recorded ones show up.
+func docsExamples(cfg config.DocsConfig) http.HandlerFunc {
+	load := func() ([]docs.Route, error) {
+		examples, err := docs.Load(os.DirFS(cfg.ExamplesDir))
+		return docs.Group(examples), err
+	}
+	if cfg.ExamplesDir == "" {
+		load = sync.OnceValues(func() ([]docs.Route, error) {
+			examples, err := docs.Load(docs.Embedded())
+			return docs.Group(examples), err
+		})
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		routes, err := load()
+		if err != nil {
+			render.Render(w, r, ErrStorage(err))
+			return
+		}
+		render.JSON(w, r, routes)
+	}
+}
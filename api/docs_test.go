@@ -0,0 +1,70 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/docs"
+	"go-chi-microservice/testsupport"
+)
+
+// TestExamplesMatchGoldenFiles checks every embedded example was recorded
+// with the golden file it's named after, so the two were updated together
+func TestExamplesMatchGoldenFiles(t *testing.T) {
+	examples, err := docs.Load(docs.Embedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(examples) == 0 {
+		t.Fatal("no examples embedded, run go test ./... -update and commit docs/examples")
+	}
+	for _, ex := range examples {
+		t.Run(ex.Name, func(t *testing.T) {
+			golden, err := os.ReadFile(filepath.Join("testdata", ex.Name+".golden"))
+			if err != nil {
+				t.Fatalf("no golden file for the example: %v", err)
+			}
+			var want bytes.Buffer
+			if err := json.Compact(&want, golden); err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := json.Compact(&got, ex.ResponseBody); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Fatalf("example differs from its golden file, run go test ./... -update\nexample: %s\ngolden:  %s", got.Bytes(), want.Bytes())
+			}
+		})
+	}
+}
+
+func TestDocsExamplesServed(t *testing.T) {
+	srv := testsupport.NewServer(t, testsupport.WithConfig(func(cfg *config.Config) {
+		cfg.Docs.Enabled = true
+	}))
+	var routes []docs.Route
+	srv.Get("/docs/examples").AssertStatus(200).DecodeJSON(&routes)
+	statuses := map[int][]string{}
+	for _, rt := range routes {
+		if rt.Method != "GET" || rt.Route != "/users/{userID}" {
+			continue
+		}
+		for _, st := range rt.Statuses {
+			for _, ex := range st.Examples {
+				statuses[st.Status] = append(statuses[st.Status], ex.Name)
+			}
+		}
+	}
+	if len(statuses[200]) == 0 || len(statuses[404]) == 0 {
+		t.Fatalf("GET /users/{userID} examples = %v, want a 200 and a 404", statuses)
+	}
+}
+
+func TestDocsExamplesOffByDefault(t *testing.T) {
+	testsupport.NewServer(t).Get("/docs/examples").AssertStatus(404)
+}
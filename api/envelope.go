@@ -0,0 +1,121 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/ctxkeys"
+)
+
+// Envelope is what responses are wrapped in with ENVELOPE_ENABLED: the
+// body as data, or as error when it's one, with meta about the response
+// and links to where a client can go from it
+type Envelope struct {
+	Data  any               `json:"data,omitempty"`
+	Error any               `json:"error,omitempty"`
+	Meta  Meta              `json:"meta"`
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// Meta is about the response rather than what it holds. The page is only
+// there for paginated lists, and the total when the handler knows it.
+type Meta struct {
+	RequestID string `json:"request_id,omitempty"`
+	Limit     *int   `json:"limit,omitempty"`
+	Offset    *int   `json:"offset,omitempty"`
+	Total     *int   `json:"total,omitempty"`
+}
+
+// Linker is a response that links to itself and the resources related to
+// it, self and related in the envelope's links when it's the whole body
+type Linker interface {
+	Links(r *http.Request) map[string]string
+}
+
+// envelopeState is what handlers add to a request's envelope with setTotal
+// and setLink
+type envelopeState struct {
+	total *int
+	links map[string]string
+}
+
+// envelope has what render.Render and render.RenderList send wrapped in an
+// Envelope. Bodies written otherwise, health checks, JSON-RPC and SCIM
+// among them, keep their own format.
+func envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &envelopeState{links: map[string]string{}}
+		next.ServeHTTP(w, r.WithContext(ctxkeys.With(r.Context(), ctxkeys.Envelope, st)))
+	})
+}
+
+// setTotal tells the envelope how many items a paginated list has in all,
+// for its meta and next link
+func setTotal(r *http.Request, total int) {
+	if st, ok := ctxkeys.Value[*envelopeState](r.Context(), ctxkeys.Envelope); ok {
+		st.total = &total
+	}
+}
+
+// setLink adds a link to the envelope, or replaces one the response or
+// the pagination made
+func setLink(r *http.Request, rel, href string) {
+	if st, ok := ctxkeys.Value[*envelopeState](r.Context(), ctxkeys.Envelope); ok {
+		st.links[rel] = href
+	}
+}
+
+// envelop wraps v when the request is under envelope, and is v otherwise
+func envelop(r *http.Request, v any) any {
+	st, ok := ctxkeys.Value[*envelopeState](r.Context(), ctxkeys.Envelope)
+	if !ok {
+		return v
+	}
+	env := Envelope{Meta: Meta{RequestID: middleware.GetReqID(r.Context())}, Links: map[string]string{"self": r.URL.RequestURI()}}
+	if e, ok := v.(*ErrResponse); ok {
+		env.Error = e
+	} else {
+		env.Data = v
+	}
+	if l, ok := v.(Linker); ok {
+		for rel, href := range l.Links(r) {
+			env.Links[rel] = href
+		}
+	}
+	if page, ok := ctxkeys.Value[Page](r.Context(), ctxkeys.Page); ok && env.Error == nil {
+		env.Meta.Limit, env.Meta.Offset, env.Meta.Total = &page.Limit, &page.Offset, st.total
+		count := -1
+		if list, ok := v.([]render.Renderer); ok {
+			count = len(list)
+		}
+		pageLinks(r, page, st.total, count, env.Links)
+	}
+	for rel, href := range st.links {
+		env.Links[rel] = href
+	}
+	return env
+}
+
+// pageLinks adds next and prev to links, the list at r with the page
+// moved along. Without the total there's taken to be a next page when
+// this one is full.
+func pageLinks(r *http.Request, page Page, total *int, count int, links map[string]string) {
+	if page.Limit <= 0 {
+		return
+	}
+	at := func(offset int) string {
+		q := r.URL.Query()
+		q.Set("limit", strconv.Itoa(page.Limit))
+		q.Set("offset", strconv.Itoa(offset))
+		return r.URL.Path + "?" + q.Encode()
+	}
+	if total != nil && page.Offset+page.Limit < *total || total == nil && count == page.Limit {
+		links["next"] = at(page.Offset + page.Limit)
+	}
+	if page.Offset > 0 {
+		links["prev"] = at(max(page.Offset-page.Limit, 0))
+	}
+}
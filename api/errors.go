@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/breaker"
+)
+
+type ErrResponse struct {
+	Err            error  `json:"-"`               // low-level runtime error
+	HTTPStatusCode int    `json:"-"`               // http response status code
+	StatusText     string `json:"status"`          // user-level status message
+	ErrorText      string `json:"error,omitempty"` // application-level error message, for debugging
+	RequestID      string `json:"request_id,omitempty"`
+}
+
+func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	e.RequestID = middleware.GetReqID(r.Context())
+	if e.HTTPStatusCode >= 500 {
+		recordError(r, e.Err)
+	}
+	render.Status(r, e.HTTPStatusCode)
+	return nil
+}
+
+func ErrNotFound() render.Renderer {
+	return &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
+}
+
+func ErrInvalidRequest(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 400,
+		StatusText:     "Invalid request.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrConflict is for a request that doesn't fit the resource's current state
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{Err: err, HTTPStatusCode: 409, StatusText: "Conflict.", ErrorText: err.Error()}
+}
+
+// ErrPreconditionFailed is for a conditional write whose If-Match doesn't
+// match the resource as it is now
+func ErrPreconditionFailed(err error) render.Renderer {
+	return &ErrResponse{Err: err, HTTPStatusCode: 412, StatusText: "Precondition failed.", ErrorText: err.Error()}
+}
+
+// ErrPreconditionRequired is for a write that must be conditional but had
+// no If-Match
+func ErrPreconditionRequired(err error) render.Renderer {
+	return &ErrResponse{Err: err, HTTPStatusCode: 428, StatusText: "Precondition required.", ErrorText: err.Error()}
+}
+
+// ErrTooLarge is for a request body over the endpoint's limit
+func ErrTooLarge(err error) render.Renderer {
+	return &ErrResponse{Err: err, HTTPStatusCode: 413, StatusText: "Request entity too large.", ErrorText: err.Error()}
+}
+
+// ErrUnsupportedMediaType is for a body of a type the endpoint doesn't take
+func ErrUnsupportedMediaType(err error) render.Renderer {
+	return &ErrResponse{Err: err, HTTPStatusCode: 415, StatusText: "Unsupported media type.", ErrorText: err.Error()}
+}
+
+// ErrStorage is for a failing backend, 503 when the breaker is failing fast
+// so clients know to back off, 500 otherwise
+func ErrStorage(err error) render.Renderer {
+	if errors.Is(err, breaker.ErrOpen) {
+		return &ErrResponse{Err: err, HTTPStatusCode: 503, StatusText: "Service unavailable."}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout(err)
+	}
+	return &ErrResponse{Err: err, HTTPStatusCode: 500, StatusText: "Internal server error."}
+}
+
+// ErrTimeout is for a request that ran past its deadline
+func ErrTimeout(err error) render.Renderer {
+	return &ErrResponse{Err: err, HTTPStatusCode: 504, StatusText: "Timed out."}
+}
+
+func ErrRender(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 422,
+		StatusText:     "Error rendering response.",
+		ErrorText:      err.Error(),
+	}
+}
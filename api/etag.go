@@ -0,0 +1,121 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/users"
+)
+
+// userETag is the user's version as a strong entity tag
+func userETag(u *users.User) string {
+	return `"` + strconv.FormatInt(u.Version, 10) + `"`
+}
+
+// usersETag is a weak entity tag for a page of users, changing with the
+// request, the collection's size and the version of every user in the page,
+// expanded ones included
+func usersETag(r *http.Request, total int, resps []*UserResponse) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %d %d\n", r.URL.RawQuery, r.Header.Get("Accept"), payloadVersionFrom(r.Context()), total)
+	for _, resp := range resps {
+		for ; resp != nil; resp = resp.Manager {
+			fmt.Fprintf(h, "%s %d\n", resp.Id, resp.Version)
+		}
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// lastModified is the latest UpdatedAt of resps
+func lastModified(resps []*UserResponse) time.Time {
+	var latest time.Time
+	for _, resp := range resps {
+		if resp.UpdatedAt.After(latest) {
+			latest = resp.UpdatedAt
+		}
+	}
+	return latest
+}
+
+// etagMatches reports whether the If-Match or If-None-Match header value
+// lists etag, or is *. The weak comparison If-None-Match uses ignores W/
+// prefixes, the strong one If-Match uses never matches a weak tag.
+func etagMatches(header, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag and Last-Modified validators of a read and
+// answers it with a 304 when the client's copy is current: If-None-Match
+// lists etag or, without one, nothing changed since If-Modified-Since.
+// Last-Modified is left out when modified is zero.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	current := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		current = etagMatches(inm, etag, true)
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		// the header only has whole seconds
+		current = !modified.Truncate(time.Second).After(ims)
+	}
+	if current {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return current
+}
+
+var (
+	errIfMatchRequired = errors.New("If-Match is required, send the ETag the user was read with")
+	errIfMatchFailed   = errors.New("the user was changed since it was read, read it again for its current ETag")
+)
+
+// ifMatch makes writes to the user in the context conditional: the If-Match
+// header must name the current ETag, 412 otherwise, so a client can't
+// overwrite changes it hasn't seen. It's required unless USER_REQUIRE_IF_MATCH
+// is off. A write that races past the check still fails in the repository
+// with users.ErrVersionMismatch.
+func (rs *UsersResource) ifMatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := contextUser(w, r)
+		if !ok {
+			return
+		}
+		im := r.Header.Get("If-Match")
+		switch {
+		case im == "" && rs.requireIfMatch:
+			render.Render(w, r, ErrPreconditionRequired(errIfMatchRequired))
+		case im != "" && !etagMatches(im, userETag(user), false):
+			w.Header().Set("ETag", userETag(user))
+			render.Render(w, r, ErrPreconditionFailed(errIfMatchFailed))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/events"
+	"go-chi-microservice/streams"
+)
+
+// EventsResource serves /admin/events, the recorded user events and the
+// replays of them operators start to rebuild a cache or backfill a consumer
+type EventsResource struct {
+	replayer *events.Replayer
+	streams  *streams.Registry
+}
+
+func NewEventsResource(replayer *events.Replayer, streams *streams.Registry) *EventsResource {
+	return &EventsResource{replayer: replayer, streams: streams}
+}
+
+func (rs *EventsResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", rs.List)
+	r.Get("/stream", rs.Stream)
+	r.Get("/replays", rs.Replays)
+	r.Post("/replays", rs.StartReplay)
+	r.Route("/replays/{replayID}", func(r chi.Router) {
+		r.Get("/", rs.GetReplay)
+		r.Delete("/", rs.CancelReplay)
+	})
+	return r
+}
+
+// List returns the events in the range given by ?from_seq, ?to_seq, ?since
+// and ?until, oldest first, at most ?limit of them
+func (rs *EventsResource) List(w http.ResponseWriter, r *http.Request) {
+	q, err := eventRange(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 1000 {
+			render.Render(w, r, ErrInvalidRequest(errors.New("limit must be 1 to 1000")))
+			return
+		}
+	}
+	list := []events.Event{}
+	errLimit := errors.New("limit reached")
+	err = rs.replayer.Store().Each(r.Context(), q, func(e events.Event) error {
+		list = append(list, e)
+		if len(list) == limit {
+			return errLimit
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLimit) {
+		if clientGone(r, err) {
+			return
+		}
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Respond(w, r, list)
+}
+
+// streamPoll is how often Stream looks for new events, and streamPing how
+// long it lets a stream stay quiet
+const (
+	streamPoll = time.Second
+	streamPing = 15 * time.Second
+)
+
+// Stream sends events as they're recorded, as server-sent events with the
+// sequence number as id. It starts after Last-Event-ID when a client
+// reconnects, at ?from_seq when given, else with the next event recorded.
+// On shutdown the client gets a shutdown event telling it when to
+// reconnect.
+func (rs *EventsResource) Stream(w http.ResponseWriter, r *http.Request) {
+	next, err := streamStart(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if next == 0 {
+		err = rs.replayer.Store().Each(r.Context(), events.Range{}, func(e events.Event) error {
+			next = e.Seq
+			return nil
+		})
+		if clientGone(r, err) {
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrStorage(err))
+			return
+		}
+		next++
+	}
+	s, r := startSSE(w, r, rs.streams)
+	defer s.end()
+	ctx := r.Context()
+	poll, ping := time.NewTicker(streamPoll), time.NewTicker(streamPing)
+	defer poll.Stop()
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.conn.GoingAway():
+			s.goAway()
+			return
+		case <-ping.C:
+			err = s.ping()
+		case <-poll.C:
+			err = rs.replayer.Store().Each(ctx, events.Range{FromSeq: next}, func(e events.Event) error {
+				body, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				if err := s.send(e.Type, strconv.FormatInt(e.Seq, 10), body); err != nil {
+					return err
+				}
+				next = e.Seq + 1
+				return nil
+			})
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("event stream ended")
+			}
+			return
+		}
+	}
+}
+
+// streamStart is the sequence number a stream asks to start at, the one
+// after Last-Event-ID or ?from_seq, 0 when it asks for neither
+func streamStart(r *http.Request) (int64, error) {
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return 0, errors.New("Last-Event-ID must be a sequence number")
+		}
+		return n + 1, nil
+	}
+	if s := r.URL.Query().Get("from_seq"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 {
+			return 0, errors.New("from_seq must be a sequence number")
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+// eventRange reads a range from query parameters, times in RFC 3339
+func eventRange(v url.Values) (events.Range, error) {
+	var q events.Range
+	for name, seq := range map[string]*int64{"from_seq": &q.FromSeq, "to_seq": &q.ToSeq} {
+		if s := v.Get(name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 1 {
+				return q, fmt.Errorf("%s must be a sequence number", name)
+			}
+			*seq = n
+		}
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*t = parsed
+		}
+	}
+	return q, nil
+}
+
+// ReplayRequest starts a replay of the events in the range to Sink, at
+// Rate events a second or the configured maximum
+type ReplayRequest struct {
+	events.Range
+	Sink string  `json:"sink"`
+	Rate float64 `json:"rate,omitempty"`
+}
+
+func (rr *ReplayRequest) Bind(r *http.Request) error {
+	if rr.Sink == "" {
+		return errors.New("missing sink")
+	}
+	if rr.FromSeq < 0 || rr.ToSeq < 0 {
+		return errors.New("from_seq and to_seq can't be negative")
+	}
+	return nil
+}
+
+type ReplayResponse struct {
+	events.Replay
+}
+
+func (rr *ReplayResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// StartReplay starts a replay in the background and answers with a 202, poll
+// the replay for how it's going
+func (rs *EventsResource) StartReplay(w http.ResponseWriter, r *http.Request) {
+	req := &ReplayRequest{}
+	if err := render.Bind(r, req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	replay, err := rs.replayer.Start(req.Sink, req.Range, req.Rate)
+	if errors.Is(err, events.ErrNotFound) {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("%w, sinks are %v", err, rs.replayer.Sinks())))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "events_replayed").Str("replay_id", replay.ID).
+		Str("sink", replay.Sink).Msg("event replay started")
+	render.Status(r, http.StatusAccepted)
+	render.Render(w, r, &ReplayResponse{replay})
+}
+
+// Replays lists recent replays, newest first
+func (rs *EventsResource) Replays(w http.ResponseWriter, r *http.Request) {
+	list := []render.Renderer{}
+	for _, replay := range rs.replayer.List() {
+		list = append(list, &ReplayResponse{replay})
+	}
+	render.RenderList(w, r, list)
+}
+
+func (rs *EventsResource) GetReplay(w http.ResponseWriter, r *http.Request) {
+	replay, err := rs.replayer.Get(chi.URLParam(r, "replayID"))
+	if err != nil {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	render.Render(w, r, &ReplayResponse{replay})
+}
+
+// CancelReplay stops a running replay, events already sent stay sent
+func (rs *EventsResource) CancelReplay(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "replayID")
+	if err := rs.replayer.Cancel(id); err != nil {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "event_replay_cancelled").Str("replay_id", id).Msg("event replay cancelled")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/users"
+)
+
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// exportFlushEvery is how many users are written between flushes, often
+// enough that the client sees progress, rarely enough to fill packets
+const exportFlushEvery = 100
+
+// ExportUsers streams every user as newline delimited JSON, one
+// UserResponse per line, see streamUsers
+func (rs *UsersResource) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	rs.streamUsers(w, r, ContentTypeNDJSON, func(out io.Writer) (userEncoder, error) {
+		return ndjsonEncoder{json.NewEncoder(out)}, nil
+	})
+}
+
+// userEncoder writes an export's users, Flush pushes out anything it
+// buffers
+type userEncoder interface {
+	Encode(resp *UserResponse) error
+	Flush() error
+}
+
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e ndjsonEncoder) Encode(resp *UserResponse) error { return e.enc.Encode(resp) }
+func (e ndjsonEncoder) Flush() error                    { return nil }
+
+// streamUsers writes every user straight from the repository, so the
+// collection is never held in memory. The body is gzipped on the fly when
+// the client accepts it. newEncoder is called once the response starts,
+// it may write a header.
+//
+// The status goes out with the first user, so a backend failing at once
+// still gets a proper error response. One failing midway aborts the
+// connection instead, the client sees a truncated body, or a broken gzip
+// stream, rather than an export that looks complete.
+func (rs *UsersResource) streamUsers(w http.ResponseWriter, r *http.Request, contentType string, newEncoder func(io.Writer) (userEncoder, error)) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	rc := http.NewResponseController(w)
+	var (
+		gz      *gzip.Writer
+		enc     userEncoder
+		written int
+	)
+	start := func() error {
+		w.Header().Set("Content-Type", contentType)
+		var out io.Writer = w
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+		w.WriteHeader(http.StatusOK)
+		var err error
+		enc, err = newEncoder(out)
+		return err
+	}
+	flush := func() error {
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := rc.Flush(); err != nil && err != http.ErrNotSupported {
+			return err
+		}
+		return nil
+	}
+
+	started := false
+	err := rs.svc.Each(r.Context(), func(u *users.User) error {
+		if !started {
+			started = true
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		resp := NewUserResponse(u)
+		if err := resp.Render(w, r); err != nil {
+			return err
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+		if written++; written%exportFlushEvery == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && !started {
+		started = true
+		err = start() // no users, an empty export
+	}
+	if err == nil {
+		err = enc.Flush()
+	}
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		if !started {
+			render.Render(w, r, ErrStorage(err))
+			return
+		}
+		zerolog.Ctx(r.Context()).Error().Err(err).Int("written", written).
+			Str("request_id", middleware.GetReqID(r.Context())).Msg("user export failed midway")
+		panic(http.ErrAbortHandler)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip, by name or *
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		return q > 0
+	}
+	return false
+}
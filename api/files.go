@@ -0,0 +1,143 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/storage"
+	"go-chi-microservice/users"
+)
+
+// unsafeFileChars are replaced in uploaded file names, keys stay plain
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// FilesResource serves /users/{userID}/files, handing out signed URLs that
+// upload and download the user's files straight to and from storage
+type FilesResource struct {
+	store storage.Storage
+	ttl   time.Duration
+}
+
+func NewFilesResource(store storage.Storage, ttl time.Duration) *FilesResource {
+	return &FilesResource{store: store, ttl: ttl}
+}
+
+// Routes expect UserCtx to have loaded the user
+func (rs *FilesResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly, noGuests)
+	r.Post("/upload-url", rs.UploadURL)
+	r.Post("/download-url", rs.DownloadURL)
+	return r
+}
+
+type UploadURLRequest struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func (u *UploadURLRequest) Bind(r *http.Request) error {
+	name := unsafeFileChars.ReplaceAllString(path.Base(u.Name), "_")
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") || len(name) > 128 {
+		return errors.New("name must be a file name up to 128 characters, not starting with a dot")
+	}
+	u.Name = name
+	return nil
+}
+
+type DownloadURLRequest struct {
+	Key string `json:"key"`
+}
+
+func (d *DownloadURLRequest) Bind(r *http.Request) error {
+	if d.Key == "" {
+		return errors.New("missing key")
+	}
+	return nil
+}
+
+// SignedURLResponse is a request the client makes itself, before Expires
+type SignedURLResponse struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Key     string            `json:"key"`
+	Headers map[string]string `json:"headers,omitempty"` // to send as they are
+	Expires time.Time         `json:"expires"`
+}
+
+func (s *SignedURLResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+// UploadURL returns a URL to PUT the file to under a new key in the user's
+// files/<user id>/ prefix. The key is what DownloadURL takes later.
+func (rs *FilesResource) UploadURL(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	data := &UploadURLRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	dir := make([]byte, 8)
+	if _, err := rand.Read(dir); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	key := filesPrefix(user) + hex.EncodeToString(dir) + "/" + data.Name
+	resp := &SignedURLResponse{Method: http.MethodPut, Key: key, Expires: time.Now().Add(rs.ttl)}
+	if data.ContentType != "" {
+		resp.Headers = map[string]string{"Content-Type": data.ContentType}
+	}
+	var err error
+	if resp.URL, err = rs.store.SignedURL(r.Context(), http.MethodPut, key, data.ContentType, rs.ttl); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "upload_url_issued").Str("user_id", user.Id).Str("key", key).Msg("upload url issued")
+	render.Render(w, r, resp)
+}
+
+// DownloadURL returns a URL to GET one of the user's files from
+func (rs *FilesResource) DownloadURL(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	data := &DownloadURLRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if !strings.HasPrefix(data.Key, filesPrefix(user)) {
+		render.Render(w, r, ErrForbidden(errors.New("not one of your files")))
+		return
+	}
+	url, err := rs.store.SignedURL(r.Context(), http.MethodGet, data.Key, "", rs.ttl)
+	if errors.Is(err, storage.ErrInvalidKey) {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &SignedURLResponse{Method: http.MethodGet, URL: url, Key: data.Key, Expires: time.Now().Add(rs.ttl)})
+}
+
+func filesPrefix(user *users.User) string {
+	return "files/" + user.Id + "/"
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/flags"
+	"go-chi-microservice/tenant"
+)
+
+// flagsCtx puts the request's feature flags in its context, evaluated by
+// provider for the caller and their tenant as handlers ask for them. Install
+// it after authenticate and tenantCtx. A nil provider leaves every flag off.
+func flagsCtx(provider flags.Provider) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if provider == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ec := flags.EvalContext{Tenant: tenant.ID(r.Context())}
+			if c := ClaimsFrom(r.Context()); c != nil {
+				ec.UserID = c.Subject
+				if c.Guest {
+					ec.Attributes = map[string]string{"guest": "true"}
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(flags.With(r.Context(), provider, ec)))
+		})
+	}
+}
+
+// requireFlag answers 404 unless the flag key is on, as if the route
+// weren't there
+func requireFlag(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !flags.Enabled(r.Context(), key) {
+				render.Render(w, r, ErrNotFound())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
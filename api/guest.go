@@ -0,0 +1,146 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/users"
+)
+
+// GuestResource lets clients start a session without signing up, and turn
+// it into an account later. A guest is a user with no email or password,
+// its tokens are all there is of it, so a device that loses them loses the
+// guest.
+type GuestResource struct {
+	svc    *users.Service
+	issuer *auth.Issuer
+}
+
+func NewGuestResource(svc *users.Service, issuer *auth.Issuer) *GuestResource {
+	return &GuestResource{svc: svc, issuer: issuer}
+}
+
+// Register adds POST /guest to the /auth router
+func (rs *GuestResource) Register(r chi.Router) {
+	r.Post("/guest", rs.Start)
+}
+
+// UserRoutes are mounted at /users/{userID}/upgrade for a guest to sign up
+func (rs *GuestResource) UserRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly)
+	r.Post("/", rs.Upgrade)
+	return r
+}
+
+type UpgradeRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (u *UpgradeRequest) Bind(r *http.Request) error {
+	if u.Email == "" {
+		return errors.New("missing email")
+	}
+	if len(u.Password) < 8 || len(u.Password) > 72 {
+		return errors.New("password must be 8 to 72 characters")
+	}
+	return nil
+}
+
+// Start creates a guest and returns its tokens, which carry the guest claim
+func (rs *GuestResource) Start(w http.ResponseWriter, r *http.Request) {
+	guest, err := rs.svc.CreateGuest(r.Context())
+	if err != nil {
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	pair, err := rs.issuer.IssueGuest(r.Context(), guest.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+// Upgrade makes the guest a full user with the email and password in the
+// body. The guest's tokens are revoked and full ones returned in their
+// place.
+func (rs *GuestResource) Upgrade(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	if !user.Guest {
+		render.Render(w, r, ErrConflict(errors.New("already a full account")))
+		return
+	}
+	data := &UpgradeRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	hash, err := auth.HashPassword(data.Password)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	u, err := rs.svc.Upgrade(r.Context(), user.Id, data.Email, hash)
+	switch {
+	case errors.Is(err, users.ErrExists):
+		render.Render(w, r, ErrConflict(errors.New("email is already in use")))
+		return
+	case errors.Is(err, users.ErrInvalid):
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	case clientGone(r, err):
+		return
+	case err != nil:
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	if err := rs.issuer.RevokeUser(r.Context(), u.Id); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "guest_upgraded").Str("user_id", u.Id).Msg("guest upgraded to a full account")
+	pair, err := rs.issuer.Issue(r.Context(), u.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+// limitGuests keeps guest tokens to their own /users/{userID}, it goes on
+// routes under /users
+func limitGuests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFrom(r.Context())
+		if claims != nil && claims.Guest && chi.URLParam(r, "userID") != claims.Subject {
+			render.Render(w, r, ErrForbidden(errors.New("guests can only see their own account")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// noGuests turns guest tokens away from what needs a full account, like
+// adding sign in methods
+func noGuests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims := ClaimsFrom(r.Context()); claims != nil && claims.Guest {
+			render.Render(w, r, ErrForbidden(errors.New("sign up first, see /users/{userID}/upgrade")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"go-chi-microservice/config"
+)
+
+// securityHeaders sets the configured security headers on every response
+func securityHeaders(cfg config.HeadersConfig) func(http.Handler) http.Handler {
+	static := map[string]string{
+		"X-Content-Type-Options":  cfg.ContentTypeOptions,
+		"X-Frame-Options":         cfg.FrameOptions,
+		"Referrer-Policy":         cfg.ReferrerPolicy,
+		"Content-Security-Policy": cfg.ContentSecurityPolicy,
+	}
+	for k, v := range static {
+		if v == "" || v == "-" {
+			delete(static, k)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			for k, v := range static {
+				h.Set(k, v)
+			}
+			if cfg.HSTS != "" && cfg.HSTS != "-" && isTLS(r, cfg.TrustForwardedProto) {
+				h.Set("Strict-Transport-Security", cfg.HSTS)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isTLS(r *http.Request, trustForwardedProto bool) bool {
+	return r.TLS != nil || (trustForwardedProto && r.Header.Get("X-Forwarded-Proto") == "https")
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/views"
+)
+
+// htmlPages renders HTML for requests preferring it over JSON. A nil
+// *htmlPages serves JSON only.
+type htmlPages struct {
+	views *views.Renderer
+	csp   string
+}
+
+func newHTMLPages(v *views.Renderer, csp string) *htmlPages {
+	if v == nil {
+		return nil
+	}
+	return &htmlPages{views: v, csp: csp}
+}
+
+// wanted reports whether r should get HTML. Responses then vary by Accept,
+// which is set either way for caches.
+func (h *htmlPages) wanted(w http.ResponseWriter, r *http.Request) bool {
+	if h == nil {
+		return false
+	}
+	varyAccept(w)
+	return negotiate(r, "application/json", "text/html") == "text/html"
+}
+
+// render writes page with the title in the layout, or a JSON error when
+// the template fails
+func (h *htmlPages) render(w http.ResponseWriter, r *http.Request, page, title string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if h.csp != "" {
+		// the API's policy blocks the layout's inline styles
+		w.Header().Set("Content-Security-Policy", h.csp)
+	}
+	if err := h.views.Render(w, page, views.Page{Title: title, Data: data}); err != nil {
+		render.Render(w, r, ErrRender(err))
+	}
+}
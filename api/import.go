@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/users"
+)
+
+// ImportResponse reports a bulk import, Failed lists the users that weren't
+// written by their position in the request
+type ImportResponse struct {
+	Written int            `json:"written"`
+	Failed  []ImportFailed `json:"failed,omitempty"`
+}
+
+type ImportFailed struct {
+	users.ItemError
+	Error string `json:"error"`
+}
+
+func (ir *ImportResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if len(ir.Failed) > 0 {
+		render.Status(r, http.StatusMultiStatus)
+	}
+	return nil
+}
+
+// ImportUsers bulk writes a JSON array of users, creating them, or with
+// ?mode=update replacing existing ones. Users that fail don't stop the rest.
+// Password hashes never go over the wire, so updated users lose theirs.
+func (rs *AdminResource) ImportUsers(w http.ResponseWriter, r *http.Request) {
+	var list []*users.User
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	write := rs.users.CreateMany
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "create":
+	case "update":
+		write = rs.users.UpdateMany
+	default:
+		render.Render(w, r, ErrInvalidRequest(errors.New("mode must be create or update")))
+		return
+	}
+	err := write(r.Context(), list)
+	var be *users.BatchError
+	if err != nil && !errors.As(err, &be) {
+		if clientGone(r, err) {
+			return
+		}
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	resp := &ImportResponse{Written: len(list)}
+	if be != nil {
+		resp.Written -= len(be.Failures)
+		for _, f := range be.Failures {
+			resp.Failed = append(resp.Failed, ImportFailed{ItemError: f, Error: f.Err.Error()})
+		}
+	}
+	render.Render(w, r, resp)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+)
+
+// logLevelControl changes the global log level at runtime, optionally
+// reverting to the configured level after a while so a debug session
+// can't be forgotten about
+type logLevelControl struct {
+	mu       sync.Mutex
+	base     zerolog.Level
+	revertAt time.Time
+	timer    *time.Timer
+}
+
+func newLogLevelControl() *logLevelControl {
+	return &logLevelControl{base: zerolog.GlobalLevel()}
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+	// RevertAfterMinutes puts the starting level back after this long, 0
+	// keeps the new level until the next change
+	RevertAfterMinutes int `json:"revert_after_minutes,omitempty"`
+}
+
+func (l *LogLevelRequest) Bind(r *http.Request) error {
+	if l.Level == "" {
+		return errors.New("missing level")
+	}
+	if l.RevertAfterMinutes < 0 {
+		return errors.New("revert_after_minutes must not be negative")
+	}
+	return nil
+}
+
+type LogLevelResponse struct {
+	Level    string     `json:"level"`
+	Base     string     `json:"base"`
+	RevertAt *time.Time `json:"revert_at,omitempty"`
+}
+
+func (l *LogLevelResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (c *logLevelControl) set(level zerolog.Level, revertAfter time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.revertAt = time.Time{}
+	zerolog.SetGlobalLevel(level)
+	if revertAfter > 0 {
+		c.revertAt = time.Now().Add(revertAfter)
+		var t *time.Timer
+		t = time.AfterFunc(revertAfter, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.timer != t {
+				return
+			}
+			zerolog.SetGlobalLevel(c.base)
+			c.timer = nil
+			c.revertAt = time.Time{}
+		})
+		c.timer = t
+	}
+}
+
+func (c *logLevelControl) status() *LogLevelResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp := &LogLevelResponse{Level: zerolog.GlobalLevel().String(), Base: c.base.String()}
+	if !c.revertAt.IsZero() {
+		at := c.revertAt
+		resp.RevertAt = &at
+	}
+	return resp
+}
+
+func (rs *AdminResource) GetLogLevel(w http.ResponseWriter, r *http.Request) {
+	render.Render(w, r, rs.logLevel.status())
+}
+
+func (rs *AdminResource) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	data := &LogLevelRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	level, err := zerolog.ParseLevel(data.Level)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	revertAfter := time.Duration(data.RevertAfterMinutes) * time.Minute
+	rs.logLevel.set(level, revertAfter)
+	// logged at warn so the change shows up whatever the new level is
+	zerolog.Ctx(r.Context()).Warn().Str("new_level", level.String()).Dur("revert_after", revertAfter).
+		Str("remote", r.RemoteAddr).Msg("log level changed")
+	render.Render(w, r, rs.logLevel.status())
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/maintenance"
+)
+
+// maintenanceExempt keeps answering during maintenance, so health checks
+// pass and the instance is still watched
+var maintenanceExempt = map[string]bool{"/healthz": true, "/metrics": true}
+
+// maintenanceMode answers 503 with Retry-After while the switch is on,
+// except for health checks and metrics. A nil switch is never on.
+func maintenanceMode(sw *maintenance.Switch) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if sw == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if st := sw.State(); st.Enabled && !maintenanceExempt[r.URL.Path] {
+				render.Render(w, r, ErrMaintenance(w, st))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ErrMaintenance is 503 while the API is down for maintenance, with
+// Retry-After
+func ErrMaintenance(w http.ResponseWriter, st maintenance.State) render.Renderer {
+	w.Header().Set("Retry-After", strconv.Itoa(st.RetryAfterSeconds))
+	reason := st.Reason
+	if reason == "" {
+		reason = "down for maintenance"
+	}
+	return &ErrResponse{HTTPStatusCode: 503, StatusText: "Service unavailable.", ErrorText: reason}
+}
+
+// Healthz tells the orchestrator the instance is up, during maintenance too
+func Healthz(sw *maintenance.Switch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, map[string]any{"status": "ok", "maintenance": sw != nil && sw.State().Enabled})
+	}
+}
+
+type MaintenanceRequest struct {
+	Enabled *bool  `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	// RetryAfterSeconds is sent to clients in Retry-After, the current
+	// one when 0
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+}
+
+func (m *MaintenanceRequest) Bind(r *http.Request) error {
+	if m.Enabled == nil {
+		return errors.New("missing enabled")
+	}
+	if m.RetryAfterSeconds < 0 {
+		return errors.New("retry_after_seconds must not be negative")
+	}
+	return nil
+}
+
+type MaintenanceResponse struct {
+	maintenance.State
+}
+
+func (m *MaintenanceResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rs *AdminResource) GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	render.Render(w, r, &MaintenanceResponse{rs.maintenance.State()})
+}
+
+// SetMaintenance flips the maintenance switch, recording who did and why
+func (rs *AdminResource) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	data := &MaintenanceRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	st := maintenance.State{Enabled: *data.Enabled, Reason: data.Reason, By: adminActor(r), RetryAfterSeconds: data.RetryAfterSeconds}
+	if st.RetryAfterSeconds == 0 {
+		st.RetryAfterSeconds = rs.maintenance.State().RetryAfterSeconds
+	}
+	prev := rs.maintenance.Set(st)
+	// logged at warn so it shows up whatever the log level
+	zerolog.Ctx(r.Context()).Warn().Str("audit", "maintenance_changed").Bool("enabled", st.Enabled).Bool("was_enabled", prev.Enabled).
+		Str("by", st.By).Str("reason", st.Reason).Str("remote", clientAddr(r)).Msg("maintenance mode changed")
+	render.Render(w, r, &MaintenanceResponse{rs.maintenance.State()})
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// negotiate picks the offered media type the Accept header ranks highest.
+// Ties go to the earlier offer, as does a request without Accept or one
+// accepting none of the offers, so list the default first.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+type mediaRange struct {
+	typ, sub string
+	q        float64
+}
+
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		media, params, _ := strings.Cut(part, ";")
+		typ, sub, ok := strings.Cut(strings.ToLower(strings.TrimSpace(media)), "/")
+		if !ok {
+			continue
+		}
+		mr := mediaRange{typ: typ, sub: sub, q: 1}
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// acceptQuality is the q of the most specific range matching offer, so
+// text/html;q=0.5 beats */* for text/html whatever */*'s q
+func acceptQuality(ranges []mediaRange, offer string) float64 {
+	typ, sub, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, -1
+	for _, mr := range ranges {
+		s := -1
+		switch {
+		case mr.typ == typ && mr.sub == sub:
+			s = 2
+		case mr.typ == typ && mr.sub == "*":
+			s = 1
+		case mr.typ == "*" && mr.sub == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = mr.q, s
+		}
+	}
+	return q
+}
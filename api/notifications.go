@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/notify"
+)
+
+// NotificationsResource serves /users/{userID}/notifications, where users
+// pick how they hear about each event
+type NotificationsResource struct {
+	notifier *notify.Dispatcher
+}
+
+func NewNotificationsResource(notifier *notify.Dispatcher) *NotificationsResource {
+	return &NotificationsResource{notifier: notifier}
+}
+
+// Routes expect UserCtx to have loaded the user
+func (rs *NotificationsResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly)
+	r.Get("/", rs.GetPreferences)
+	r.Put("/", rs.SetPreferences)
+	return r
+}
+
+type PreferencesRequest struct {
+	Preferences notify.Preferences `json:"preferences"`
+}
+
+func (p *PreferencesRequest) Bind(r *http.Request) error {
+	if len(p.Preferences) == 0 {
+		return errors.New("missing preferences")
+	}
+	return p.Preferences.Validate()
+}
+
+type PreferencesResponse struct {
+	Preferences notify.Preferences `json:"preferences"`
+}
+
+func (p *PreferencesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rs *NotificationsResource) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := rs.notifier.Preferences(r.Context(), user.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &PreferencesResponse{Preferences: prefs})
+}
+
+// SetPreferences changes the channels for the events in the body, the rest
+// stay as they were
+func (rs *NotificationsResource) SetPreferences(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	data := &PreferencesRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err := rs.notifier.SetPreferences(r.Context(), user.Id, data.Preferences); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	rs.GetPreferences(w, r)
+}
+
+// ownerOnly lets signed in users through to their own {userID} only, it
+// goes after UserCtx
+func ownerOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := ClaimsFrom(r.Context())
+		if claims == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			render.Render(w, r, ErrUnauthorized(errors.New("sign in first")))
+			return
+		}
+		user, ok := contextUser(w, r)
+		if !ok {
+			return
+		}
+		if claims.Subject != user.Id {
+			render.Render(w, r, ErrForbidden(errors.New("only the user themselves can do this")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/notify"
+	"go-chi-microservice/users"
+)
+
+// the login state rides in a cookie between /auth/oidc/login and the
+// callback, so any instance can finish a login another one started
+const oidcCookie = "oidc_login"
+
+// OIDCLogin redirects the browser to the identity provider
+func (rs *AuthResource) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	url, ls, err := rs.oidc.Begin()
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	b, _ := json.Marshal(ls)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     "/auth/oidc",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   isTLS(r, rs.trustForwardedProto),
+		// Lax still sends it on the provider's top level redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// OIDCCallback finishes the login, provisioning a user for a new email, and
+// issues tokens like a password login
+func (rs *AuthResource) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	// the state is single use whatever happens next
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/auth/oidc", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		render.Render(w, r, ErrUnauthorized(errors.New(e+": "+q.Get("error_description"))))
+		return
+	}
+	ls, err := loginState(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	id, err := rs.oidc.Finish(r.Context(), ls, q.Get("state"), q.Get("code"))
+	if err != nil {
+		metrics.Login(metrics.MethodOIDC, metrics.Failure)
+		zerolog.Ctx(r.Context()).Info().Err(err).Str("remote", r.RemoteAddr).Msg("failed oidc login")
+		render.Render(w, r, ErrUnauthorized(err))
+		return
+	}
+	user, err := rs.svc.Provision(r.Context(), id.Email)
+	if clientGone(r, err) {
+		return
+	}
+	if errors.Is(err, users.ErrInvalid) {
+		metrics.Login(metrics.MethodOIDC, metrics.Failure)
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	if !user.CanSignIn() {
+		metrics.Login(metrics.MethodOIDC, metrics.Failure)
+		render.Render(w, r, ErrUnauthorized(auth.ErrBadCredentials))
+		return
+	}
+	metrics.Login(metrics.MethodOIDC, metrics.Success)
+	rs.notify(r, user, notify.EventLogin, map[string]string{"method": metrics.MethodOIDC, "remote": clientAddr(r)})
+	pair, err := rs.issuer.Issue(r.Context(), user.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+func loginState(r *http.Request) (*auth.LoginState, error) {
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return nil, errors.New("no login in progress, start at /auth/oidc/login")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil, errors.New("bad login cookie")
+	}
+	ls := &auth.LoginState{}
+	if err := json.Unmarshal(b, ls); err != nil {
+		return nil, errors.New("bad login cookie")
+	}
+	return ls, nil
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/audit"
+	"go-chi-microservice/auth"
+	"go-chi-microservice/tenant"
+	"go-chi-microservice/users"
+)
+
+// OperationsResource is user management for support staff on the admin
+// listener: suspending users, forcing password resets, impersonating a user
+// to see what they see, and their activity in the audit log. It's behind
+// its own operator credentials, and every operation is audited under the
+// operator's name.
+type OperationsResource struct {
+	users            *users.Service
+	issuer           *auth.Issuer     // nil leaves out impersonation
+	revoker          sessionRevoker   // ends sessions on suspend and forced resets
+	account          *AccountResource // emails reset links, nil for none
+	audit            audit.Store      // nil leaves out activity
+	pages            *paginator
+	impersonationTTL time.Duration
+}
+
+func NewOperationsResource(svc *users.Service, issuer *auth.Issuer, sessions auth.SessionStore, account *AccountResource, store audit.Store, pages *paginator, impersonationTTL time.Duration) *OperationsResource {
+	return &OperationsResource{users: svc, issuer: issuer, revoker: sessionRevoker{issuer: issuer, sessions: sessions}, account: account, audit: store, pages: pages, impersonationTTL: impersonationTTL}
+}
+
+// Register adds the operations to the admin router under /users/{userID}
+func (rs *OperationsResource) Register(r chi.Router) {
+	r.Post("/users/{userID}/suspend", rs.Suspend)
+	r.Post("/users/{userID}/unsuspend", rs.Unsuspend)
+	r.Post("/users/{userID}/reset-password", rs.ForcePasswordReset)
+	if rs.issuer != nil {
+		r.Post("/users/{userID}/impersonate", rs.Impersonate)
+	}
+	if rs.audit != nil {
+		r.With(rs.pages.Handler("/admin/users/{userID}/activity")).Get("/users/{userID}/activity", rs.Activity)
+	}
+}
+
+// OperationRequest is why an operator acts on a user, kept in the logs
+type OperationRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (o *OperationRequest) Bind(r *http.Request) error {
+	if o.Reason = strings.TrimSpace(o.Reason); o.Reason == "" {
+		return errors.New("missing reason")
+	}
+	return nil
+}
+
+// Suspend keeps the user from signing in until they're unsuspended and
+// ends their sessions, cookie ones included. Access tokens already out run
+// until they expire.
+func (rs *OperationsResource) Suspend(w http.ResponseWriter, r *http.Request) {
+	data := &OperationRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	u, ok := rs.change(w, r, func(u *users.User) { u.Suspended, u.SuspendedReason = true, data.Reason })
+	if !ok || !rs.revoke(w, r, u) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "user_suspended").Str("user_id", u.Id).
+		Str("reason", data.Reason).Msg("user suspended")
+	render.Render(w, r, NewUserResponse(u))
+}
+
+// Unsuspend lets the user sign in again
+func (rs *OperationsResource) Unsuspend(w http.ResponseWriter, r *http.Request) {
+	u, ok := rs.change(w, r, func(u *users.User) { u.Suspended, u.SuspendedReason = false, "" })
+	if !ok {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "user_unsuspended").Str("user_id", u.Id).Msg("user unsuspended")
+	render.Render(w, r, NewUserResponse(u))
+}
+
+// ForcePasswordReset refuses the user's password until they choose a new
+// one, ends their sessions and emails them a reset link when account
+// emails are set up. Without them the user asks for a link themselves.
+func (rs *OperationsResource) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	u, ok := rs.change(w, r, func(u *users.User) { u.PasswordResetRequired = true })
+	if !ok || !rs.revoke(w, r, u) {
+		return
+	}
+	logger := zerolog.Ctx(r.Context())
+	if rs.account != nil && u.Email != "" {
+		if err := rs.account.send(r.Context(), u, auth.PurposeResetPassword); err != nil {
+			// the password is refused already, the user can ask for a link
+			logger.Error().Err(err).Str("user_id", u.Id).Msg("sending password reset")
+		}
+	}
+	logger.Info().Str("audit", "password_reset_forced").Str("user_id", u.Id).Msg("password reset forced")
+	render.Render(w, r, NewUserResponse(u))
+}
+
+// Impersonate hands the operator an access token acting as the user, in
+// the user's tenant, with no refresh token. Requests made with it are
+// audited as the operator acting as the user.
+func (rs *OperationsResource) Impersonate(w http.ResponseWriter, r *http.Request) {
+	data := &OperationRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	u, ok := rs.target(w, r)
+	if !ok {
+		return
+	}
+	if !u.CanSignIn() {
+		render.Render(w, r, ErrConflict(errors.New("the user can't sign in, unsuspend them first")))
+		return
+	}
+	ctx := r.Context()
+	if u.TenantID != "" {
+		ctx = tenant.With(ctx, u.TenantID)
+	}
+	operator := adminActor(r)
+	pair, err := rs.issuer.Impersonate(ctx, u.Id, operator, rs.impersonationTTL)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	zerolog.Ctx(ctx).Warn().Str("audit", "user_impersonated").Str("user_id", u.Id).Str("operator", operator).
+		Str("reason", data.Reason).Int("expires_in", pair.ExpiresIn).Msg("user impersonated")
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+// Activity lists the audit entries of requests the user made, an operator
+// made as them, or that changed them, newest first and paged. ?since and
+// ?until narrow it down.
+func (rs *OperationsResource) Activity(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	u, ok := rs.target(w, r)
+	if !ok {
+		return
+	}
+	all, err := rs.audit.List(r.Context(), audit.Filter{Since: f.Since, Until: f.Until})
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	list := []audit.Entry{}
+	changed := audit.Filter{Resource: "user", ID: u.Id}
+	for _, e := range all {
+		if e.Actor == u.Id || strings.HasSuffix(e.Actor, " as "+u.Id) || changed.Matches(e) {
+			list = append(list, e)
+		}
+	}
+	start, end := pageFrom(r.Context()).Apply(len(list))
+	setTotal(r, len(list))
+	render.Respond(w, r, list[start:end])
+}
+
+// target loads a copy of the user in the path, soft deleted ones aren't
+// operated on. When it fails the error response has been written.
+func (rs *OperationsResource) target(w http.ResponseWriter, r *http.Request) (*users.User, bool) {
+	u, err := rs.users.Get(r.Context(), chi.URLParam(r, "userID"))
+	if clientGone(r, err) {
+		return nil, false
+	}
+	if errors.Is(err, users.ErrNotFound) {
+		render.Render(w, r, ErrNotFound())
+		return nil, false
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return nil, false
+	}
+	c := *u
+	return &c, true
+}
+
+// change applies fn to the user in the path and stores it
+func (rs *OperationsResource) change(w http.ResponseWriter, r *http.Request, fn func(u *users.User)) (*users.User, bool) {
+	u, ok := rs.target(w, r)
+	if !ok {
+		return nil, false
+	}
+	fn(u)
+	err := rs.users.Update(r.Context(), u)
+	switch {
+	case clientGone(r, err):
+		return nil, false
+	case errors.Is(err, users.ErrNotFound):
+		render.Render(w, r, ErrNotFound())
+		return nil, false
+	case errors.Is(err, users.ErrVersionMismatch):
+		render.Render(w, r, ErrConflict(err))
+		return nil, false
+	case err != nil:
+		render.Render(w, r, ErrStorage(err))
+		return nil, false
+	}
+	return u, true
+}
+
+// revoke ends every session of u, refresh tokens and cookie sessions
+func (rs *OperationsResource) revoke(w http.ResponseWriter, r *http.Request, u *users.User) bool {
+	if err := rs.revoker.revokeUser(r.Context(), u.Id); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return false
+	}
+	return true
+}
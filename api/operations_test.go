@@ -0,0 +1,71 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/testsupport"
+)
+
+// sessionServer has cookie sessions and the operator endpoints on, with a1
+// able to sign in
+func sessionServer(t *testing.T, require bool) *testsupport.Server {
+	t.Helper()
+	return authServer(t, func(cfg *config.Config) {
+		cfg.Auth.Require = require
+		cfg.Auth.Session.Enabled = true
+		cfg.Admin.OperatorUser, cfg.Admin.OperatorPassword = "ops", "ops-password"
+	})
+}
+
+// signIn starts a cookie session for ada and returns the Cookie header
+// sending it
+func signIn(t *testing.T, srv *testsupport.Server) http.Header {
+	t.Helper()
+	res := srv.Post("/auth/session/login", map[string]string{"email": "ada@example.com", "password": password}).AssertStatus(200)
+	header := http.Header{}
+	for _, c := range res.Result().Cookies() {
+		header.Add("Cookie", c.Name+"="+c.Value)
+	}
+	return header
+}
+
+func TestOperationsEndCookieSessions(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "suspend", path: "/admin/users/a1/suspend"},
+		{name: "forced password reset", path: "/admin/users/a1/reset-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// required, so a request with an ended session isn't let
+			// through as an anonymous one
+			srv := sessionServer(t, true)
+			cookie := signIn(t, srv)
+			srv.Do("GET", "/users/a1", nil, cookie).AssertStatus(200)
+			operator := &http.Request{Header: http.Header{}}
+			operator.SetBasicAuth("ops", "ops-password")
+			srv.DoAdmin("POST", tt.path, map[string]string{"reason": "support ticket 42"}, operator.Header).AssertStatus(200)
+			srv.Do("GET", "/users/a1", nil, cookie).AssertStatus(401)
+		})
+	}
+}
+
+// TestSuspendedUserSessionRefused checks the user's status is checked on
+// every request, not only when their sessions are revoked
+func TestSuspendedUserSessionRefused(t *testing.T) {
+	srv := sessionServer(t, false)
+	cookie := signIn(t, srv)
+	u, err := srv.Users.Get(context.Background(), "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suspended := *u
+	suspended.Suspended = true
+	srv.SeedUsers(&suspended)
+	srv.Do("GET", "/users/a1", nil, cookie).AssertStatus(401)
+}
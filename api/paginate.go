@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/ctxkeys"
+)
+
+// Page is the slice of a list a request asked for
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+func pageFrom(ctx context.Context) Page {
+	p, _ := ctxkeys.Value[Page](ctx, ctxkeys.Page)
+	return p
+}
+
+// Apply returns the part of a list of n items the page covers, as bounds
+// for a slice expression
+func (p Page) Apply(n int) (int, int) {
+	start := min(p.Offset, n)
+	if p.Limit <= 0 {
+		return start, n
+	}
+	return start, min(start+p.Limit, n)
+}
+
+// paginator guards list endpoints against unbounded responses
+type paginator struct {
+	cfg config.PaginationConfig
+}
+
+func newPaginator(cfg config.PaginationConfig) *paginator {
+	return &paginator{cfg: cfg}
+}
+
+// Handler parses ?limit and ?offset for route. A missing limit gets the
+// default, or a 400 when limits are required. One over the route's max is a
+// 400, or cut down to the max in cap mode.
+func (p *paginator) Handler(route string) func(http.Handler) http.Handler {
+	max := p.cfg.MaxLimit
+	if m, ok := p.cfg.RouteMaxLimits[route]; ok {
+		max = m
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			page, err := p.page(r, max)
+			if err != nil {
+				render.Render(w, r, ErrInvalidRequest(err))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctxkeys.With(r.Context(), ctxkeys.Page, page)))
+		})
+	}
+}
+
+func (p *paginator) page(r *http.Request, max int) (Page, error) {
+	q := r.URL.Query()
+	page := Page{Limit: min(p.cfg.DefaultLimit, max)}
+	if s := q.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return Page{}, fmt.Errorf("offset must be a whole number, got %q", s)
+		}
+		page.Offset = n
+	}
+	s := q.Get("limit")
+	if s == "" {
+		if p.cfg.RequireLimit {
+			return Page{}, fmt.Errorf("this list is paginated: pass ?limit= between 1 and %d, and ?offset= for later pages", max)
+		}
+		return page, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return Page{}, fmt.Errorf("limit must be a number from 1 to %d, got %q", max, s)
+	}
+	if n > max {
+		if p.cfg.Mode != "cap" {
+			return Page{}, fmt.Errorf("limit %d is over the maximum of %d: fetch more with ?offset=", n, max)
+		}
+		n = max
+	}
+	page.Limit = n
+	return page, nil
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/notify"
+	"go-chi-microservice/users"
+)
+
+// PasskeysResource serves /users/{userID}/passkeys, where users register
+// passkeys to sign in with at /auth/passkey/login instead of a password
+type PasskeysResource struct {
+	svc      *users.Service
+	passkeys *auth.Passkeys
+}
+
+func NewPasskeysResource(svc *users.Service, passkeys *auth.Passkeys) *PasskeysResource {
+	return &PasskeysResource{svc: svc, passkeys: passkeys}
+}
+
+// Routes expect UserCtx to have loaded the user
+func (rs *PasskeysResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly, noGuests)
+	r.Get("/", rs.List)
+	r.Post("/register/begin", rs.RegisterBegin)
+	r.Post("/register/finish", rs.RegisterFinish)
+	r.Delete("/{passkeyID}", rs.Delete)
+	return r
+}
+
+// CeremonyResponse starts a ceremony. Options go to navigator.credentials
+// create or get, the ceremony id comes back with the result.
+type CeremonyResponse struct {
+	Ceremony string `json:"ceremony"`
+	Options  any    `json:"options"`
+}
+
+func (c *CeremonyResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+// CeremonyRequest finishes a ceremony with the authenticator's response as
+// the browser serializes it, PublicKeyCredential.toJSON()
+type CeremonyRequest struct {
+	Ceremony   string          `json:"ceremony"`
+	Credential json.RawMessage `json:"credential"`
+	Name       string          `json:"name,omitempty"` // registration only
+}
+
+func (c *CeremonyRequest) Bind(r *http.Request) error {
+	if c.Ceremony == "" || len(c.Credential) == 0 {
+		return errors.New("missing ceremony or credential")
+	}
+	if len(c.Name) > 64 {
+		return errors.New("name is longer than 64 characters")
+	}
+	return nil
+}
+
+type PasskeyResponse struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+func (p *PasskeyResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newPasskeyResponse(p users.Passkey) *PasskeyResponse {
+	resp := &PasskeyResponse{ID: p.ID, Name: p.Name, Created: p.Created}
+	if !p.LastUsed.IsZero() {
+		resp.LastUsed = &p.LastUsed
+	}
+	return resp
+}
+
+func (rs *PasskeysResource) List(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	list := []render.Renderer{}
+	for _, p := range user.Passkeys {
+		list = append(list, newPasskeyResponse(p))
+	}
+	render.RenderList(w, r, list)
+}
+
+func (rs *PasskeysResource) RegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	pu, err := passkeyUser(user)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	id, creation, err := rs.passkeys.BeginRegistration(pu)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &CeremonyResponse{Ceremony: id, Options: creation})
+}
+
+func (rs *PasskeysResource) RegisterFinish(w http.ResponseWriter, r *http.Request) {
+	data := &CeremonyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	pu, err := passkeyUser(user)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	cred, err := rs.passkeys.FinishRegistration(pu, data.Ceremony, data.Credential)
+	if auth.IsPasskeyRejected(err) {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	b, err := auth.EncodeCredential(cred)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	p := users.Passkey{ID: base64.RawURLEncoding.EncodeToString(cred.ID), Name: data.Name, Created: time.Now(), Credential: b}
+	if p.Name == "" {
+		p.Name = "passkey"
+	}
+	u := *user
+	// a new slice, the stored user's mustn't change under it
+	u.Passkeys = append(append([]users.Passkey{}, user.Passkeys...), p)
+	if !rs.update(w, r, &u) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "passkey_added").Str("user_id", u.Id).Str("passkey_id", p.ID).Msg("passkey added")
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, newPasskeyResponse(p))
+}
+
+func (rs *PasskeysResource) Delete(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	id := chi.URLParam(r, "passkeyID")
+	u := *user
+	u.Passkeys = nil
+	for _, p := range user.Passkeys {
+		if p.ID != id {
+			u.Passkeys = append(u.Passkeys, p)
+		}
+	}
+	if len(u.Passkeys) == len(user.Passkeys) {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	if !rs.update(w, r, &u) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "passkey_removed").Str("user_id", u.Id).Str("passkey_id", id).Msg("passkey removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rs *PasskeysResource) update(w http.ResponseWriter, r *http.Request, u *users.User) bool {
+	err := rs.svc.Update(r.Context(), u)
+	if clientGone(r, err) {
+		return false
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return false
+	}
+	return true
+}
+
+// PasskeyLoginBegin starts a login with any passkey the browser has for
+// this site, the user picks one and no email is needed
+func (rs *AuthResource) PasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	id, assertion, err := rs.passkeys.BeginLogin()
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &CeremonyResponse{Ceremony: id, Options: assertion})
+}
+
+// PasskeyLoginFinish signs the passkey's user in. A passkey is a second
+// factor in itself, so users with an authenticator app aren't asked for a
+// code.
+func (rs *AuthResource) PasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	data := &CeremonyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	var user *users.User
+	cred, err := rs.passkeys.FinishLogin(data.Ceremony, data.Credential, func(userID string) (*auth.PasskeyUser, error) {
+		u, err := rs.svc.Get(r.Context(), userID)
+		if err != nil {
+			return nil, err
+		}
+		if !u.CanSignIn() {
+			return nil, users.ErrNotFound
+		}
+		user = u
+		return passkeyUser(u)
+	})
+	if err != nil {
+		metrics.Login(metrics.MethodPasskey, metrics.Failure)
+		zerolog.Ctx(r.Context()).Info().Err(err).Str("remote", clientAddr(r)).Msg("failed passkey login")
+		render.Render(w, r, ErrUnauthorized(errors.New("passkey not accepted")))
+		return
+	}
+	// store the new sign count, so a cloned passkey shows up
+	u := *user
+	u.Passkeys = append([]users.Passkey{}, user.Passkeys...)
+	credID := base64.RawURLEncoding.EncodeToString(cred.ID)
+	for i := range u.Passkeys {
+		if u.Passkeys[i].ID == credID {
+			if u.Passkeys[i].Credential, err = auth.EncodeCredential(cred); err != nil {
+				render.Render(w, r, ErrStorage(err))
+				return
+			}
+			u.Passkeys[i].LastUsed = time.Now()
+		}
+	}
+	if err := rs.svc.Update(r.Context(), &u); err != nil {
+		if !clientGone(r, err) {
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	metrics.Login(metrics.MethodPasskey, metrics.Success)
+	rs.notify(r, &u, notify.EventLogin, map[string]string{"method": metrics.MethodPasskey, "remote": clientAddr(r)})
+	pair, err := rs.issuer.Issue(r.Context(), u.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &TokenResponse{pair})
+}
+
+// passkeyUser is user as the passkey ceremonies see them
+func passkeyUser(user *users.User) (*auth.PasskeyUser, error) {
+	pu := &auth.PasskeyUser{ID: user.Id, Name: user.Email}
+	for _, p := range user.Passkeys {
+		c, err := auth.DecodeCredential(p.Credential)
+		if err != nil {
+			return nil, err
+		}
+		pu.Credentials = append(pu.Credentials, c)
+	}
+	return pu, nil
+}
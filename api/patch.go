@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/jsonpatch"
+	"go-chi-microservice/users"
+)
+
+const (
+	ContentTypeMergePatch = "application/merge-patch+json"
+	ContentTypeJSONPatch  = "application/json-patch+json"
+)
+
+// PatchUser changes part of a user with a JSON Merge Patch or a JSON Patch,
+// told apart by Content-Type. The patch applies to the user's writable
+// fields, a BatchUser: Id, Email, Phone, ManagerId and Disabled, in the
+// request's payload version. The result must still be a valid user with
+// the same Id, fields it doesn't know are rejected, and it's written like
+// any other update. Like every write to a user it's conditional on the
+// If-Match header, see ifMatch.
+func (rs *UsersResource) PatchUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var patch func(doc, patch []byte) ([]byte, error)
+	switch mediaType {
+	case ContentTypeMergePatch:
+		patch = jsonpatch.Merge
+	case ContentTypeJSONPatch:
+		patch = jsonpatch.Apply
+	default:
+		w.Header().Set("Accept-Patch", ContentTypeMergePatch+", "+ContentTypeJSONPatch)
+		render.Render(w, r, ErrUnsupportedMediaType(errors.New("expected "+ContentTypeMergePatch+" or "+ContentTypeJSONPatch)))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		switch {
+		case errors.As(err, &mbe):
+			render.Render(w, r, ErrTooLarge(err))
+		case clientGone(r, err):
+		default:
+			// a truncated body, or one that didn't decompress
+			render.Render(w, r, ErrInvalidRequest(err))
+		}
+		return
+	}
+	// the patch sees ids as the client does
+	id := encodeID(r.Context(), user.Id)
+	version := payloadVersionFrom(r.Context())
+	doc, err := usersPayloads.Marshal(r.Context(), "batch-user", BatchUser{Id: id, Email: user.Email, Phone: user.Phone, ManagerId: encodeID(r.Context(), user.ManagerId), Disabled: user.Disabled}, version)
+	if err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+	patched, err := patch(doc, body)
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		render.Render(w, r, ErrConflict(err))
+		return
+	}
+	if err == nil {
+		patched, err = usersPayloads.Upgrade(r.Context(), "batch-user", patched, version)
+	}
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	var bu BatchUser
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&bu); err != nil {
+		render.Render(w, r, ErrInvalidRequest(errors.New("the patched user is invalid: "+err.Error())))
+		return
+	}
+	if bu.Id != id {
+		render.Render(w, r, ErrInvalidRequest(errors.New("Id can't be changed")))
+		return
+	}
+	if bu.ManagerId, err = decodeID(r.Context(), bu.ManagerId); err != nil {
+		render.Render(w, r, ErrInvalidRequest(errors.New("ManagerId is not a user")))
+		return
+	}
+	if bu.Email == "" {
+		render.Render(w, r, ErrInvalidRequest(errors.New("Email can't be removed")))
+		return
+	}
+
+	u := *user
+	u.Email, u.Phone, u.ManagerId, u.Disabled = bu.Email, bu.Phone, bu.ManagerId, bu.Disabled
+	if err := rs.svc.Update(r.Context(), &u); err != nil {
+		switch {
+		case clientGone(r, err):
+		case errors.Is(err, users.ErrInvalid):
+			render.Render(w, r, ErrInvalidRequest(err))
+		case errors.Is(err, users.ErrExists):
+			render.Render(w, r, ErrConflict(err))
+		case errors.Is(err, users.ErrNotFound):
+			render.Render(w, r, ErrNotFound())
+		case errors.Is(err, users.ErrVersionMismatch):
+			render.Render(w, r, ErrPreconditionFailed(errIfMatchFailed))
+		default:
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "user_patched").Str("user_id", u.Id).Str("patch", mediaType).Msg("user updated")
+	w.Header().Set("ETag", userETag(&u))
+	render.Render(w, r, NewUserResponse(&u))
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/payload"
+)
+
+// usersPayloads are the versions of the bodies under /users, the user
+// responses and the batch and patch bodies
+var usersPayloads = newUsersPayloads()
+
+func newUsersPayloads() *payload.Versions {
+	v := payload.New(1, UsersAPIVersion)
+	// 2 drops elapsed, the milliseconds since the request came in, which
+	// is in the Server-Timing header for every version
+	v.Register("user", 1, payload.Step{Down: func(ctx context.Context, doc payload.Doc) error {
+		doc["elapsed"] = elapsedFrom(ctx).Milliseconds()
+		return nil
+	}})
+	return v
+}
+
+// CheckAPIVersion is an error unless version is served, for checking
+// API_VERSION_DEFAULT at startup
+func CheckAPIVersion(version int) error {
+	return usersPayloads.Check(version)
+}
+
+// payloadVersion reads the payload version a request speaks from the
+// header, the default without it, and names the version served in the
+// response's
+func payloadVersion(cfg config.APIVersionConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			version := cfg.Default
+			if raw := r.Header.Get(cfg.Header); raw != "" {
+				n, err := strconv.Atoi(raw)
+				if err != nil || usersPayloads.Check(n) != nil {
+					render.Render(w, r, ErrInvalidRequest(fmt.Errorf("%s must be %d to %d", cfg.Header, usersPayloads.Oldest(), usersPayloads.Current())))
+					return
+				}
+				version = n
+			}
+			w.Header().Add("Vary", cfg.Header)
+			w.Header().Set(cfg.Header, strconv.Itoa(version))
+			next.ServeHTTP(w, r.WithContext(ctxkeys.With(r.Context(), ctxkeys.PayloadVersion, version)))
+		})
+	}
+}
+
+// payloadVersionFrom is the payload version of the request, the current
+// one outside payloadVersion
+func payloadVersionFrom(ctx context.Context) int {
+	if v, ok := ctxkeys.Value[int](ctx, ctxkeys.PayloadVersion); ok {
+		return v
+	}
+	return usersPayloads.Current()
+}
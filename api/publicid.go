@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/publicid"
+)
+
+// EnablePublicIDs has /users show ids encoded by codec and take them back
+// in paths and bodies. Call it before Routes.
+func (rs *UsersResource) EnablePublicIDs(codec publicid.Codec) {
+	rs.ids = codec
+}
+
+// publicIDs puts the resource's codec on the request for UserResponse and
+// the handlers to encode and decode with
+func (rs *UsersResource) publicIDs(next http.Handler) http.Handler {
+	if rs.ids == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(ctxkeys.With(r.Context(), ctxkeys.PublicIDs, rs.ids)))
+	})
+}
+
+// decodeUserID swaps the public id in {userID} for the stored one, so
+// everything under it, subresources too, sees the id it always has. An id
+// that doesn't decode is a user that doesn't exist.
+func (rs *UsersResource) decodeUserID(next http.Handler) http.Handler {
+	if rs.ids == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := &chi.RouteContext(r.Context()).URLParams
+		for i, key := range params.Keys {
+			if key != "userID" {
+				continue
+			}
+			id, err := rs.ids.Decode(params.Values[i])
+			if err != nil {
+				render.Render(w, r, ErrNotFound())
+				return
+			}
+			params.Values[i] = id
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// encodeID is id as clients of the request see it, itself when public ids
+// are off
+func encodeID(ctx context.Context, id string) string {
+	codec, ok := ctxkeys.Value[publicid.Codec](ctx, ctxkeys.PublicIDs)
+	if !ok || id == "" {
+		return id
+	}
+	return codec.Encode(id)
+}
+
+// decodeID is the stored id for one a client sent, publicid.ErrInvalid
+// when it doesn't decode
+func decodeID(ctx context.Context, id string) (string, error) {
+	codec, ok := ctxkeys.Value[publicid.Codec](ctx, ctxkeys.PublicIDs)
+	if !ok || id == "" {
+		return id, nil
+	}
+	return codec.Decode(id)
+}
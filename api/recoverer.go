@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+const ContentTypeProblem = "application/problem+json"
+
+var panicsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_panics_total",
+	Help: "Handler panics recovered into a 500, by route.",
+}, []string{"route"})
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// stackFrame is one call on a panicking goroutine's stack, for the log
+type stackFrame struct {
+	Func string `json:"func"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// recoverer turns a panic into a 500 with a problem+json body carrying the
+// request id, logged with its stack frame by frame and counted in
+// http_panics_total. errorReporting, installed inside it, reports the panic
+// to the error tracker. A handler that had started its response can't be
+// answered any more, its connection is aborted instead.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww, ok := w.(middleware.WrapResponseWriter)
+		if !ok {
+			ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		}
+		defer func() {
+			rvr := recover()
+			if rvr == nil {
+				return
+			}
+			if rvr == http.ErrAbortHandler {
+				panic(rvr)
+			}
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			panicsTotal.WithLabelValues(route).Inc()
+			reqID := middleware.GetReqID(r.Context())
+			zerolog.Ctx(r.Context()).Error().Str("panic", fmt.Sprint(rvr)).Str("route", route).
+				Interface("stack", panicStack()).Msg("handler panicked")
+			if ww.Status() != 0 || r.Header.Get("Connection") == "Upgrade" {
+				panic(http.ErrAbortHandler)
+			}
+			ww.Header().Set("Content-Type", ContentTypeProblem)
+			ww.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(ww).Encode(Problem{
+				Type:      "about:blank",
+				Title:     http.StatusText(http.StatusInternalServerError),
+				Status:    http.StatusInternalServerError,
+				Detail:    "The server failed to handle the request. Quote the request id when reporting it.",
+				Instance:  r.URL.Path,
+				RequestID: reqID,
+			})
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// panicStack is the stack of the deferred call recovering a panic, from
+// the frame that panicked down, runtime frames left out
+func panicStack() []stackFrame {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	var stack []stackFrame
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "runtime.") {
+			stack = append(stack, stackFrame{Func: f.Function, File: f.File, Line: f.Line})
+		}
+		if !more {
+			return stack
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/reporting"
+)
+
+// reportState lets code deeper in the request hand details back up to the
+// errorReporting middleware
+type reportState struct {
+	err    error
+	userID string
+}
+
+// recordError notes the error behind a 5xx so the report carries the cause
+// rather than just the status
+func recordError(r *http.Request, err error) {
+	if st, ok := ctxkeys.Value[*reportState](r.Context(), ctxkeys.Report); ok && err != nil {
+		st.err = err
+	}
+}
+
+// SetReportUser tags any report for this request with the caller's id
+func SetReportUser(ctx context.Context, userID string) {
+	if st, ok := ctxkeys.Value[*reportState](ctx, ctxkeys.Report); ok {
+		st.userID = userID
+	}
+}
+
+// errorReporting sends panics and 5xx responses to the reporter. Install it
+// inside recoverer: panics are reported then re-panicked for recoverer to
+// turn into the 500.
+func errorReporting(rep reporting.Reporter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww, ok := w.(middleware.WrapResponseWriter)
+			if !ok {
+				ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			}
+			st := &reportState{}
+			r = r.WithContext(ctxkeys.With(r.Context(), ctxkeys.Report, st))
+
+			defer func() {
+				if rvr := recover(); rvr != nil {
+					if rvr != http.ErrAbortHandler {
+						evt := newReportEvent(r, st, http.StatusInternalServerError)
+						evt.Panic = rvr
+						evt.Stack = debug.Stack()
+						rep.Report(r.Context(), evt)
+					}
+					panic(rvr)
+				}
+			}()
+			next.ServeHTTP(ww, r)
+
+			if ww.Status() >= 500 && !clientGone(r, nil) {
+				evt := newReportEvent(r, st, ww.Status())
+				evt.Err = st.err
+				rep.Report(r.Context(), evt)
+			}
+		})
+	}
+}
+
+func newReportEvent(r *http.Request, st *reportState, status int) *reporting.Event {
+	evt := &reporting.Event{
+		Status:    status,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RequestID: middleware.GetReqID(r.Context()),
+		UserID:    st.userID,
+		Time:      time.Now(),
+	}
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		evt.Route = rctx.RoutePattern()
+	}
+	return evt
+}
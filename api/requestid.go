@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// incoming ids are logged and echoed, so only accept short, plain ones
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/-]{1,128}$`)
+
+// requestID honors a well formed incoming X-Request-Id, or generates one,
+// and echoes it in the response header for client side correlation
+func requestID(next http.Handler) http.Handler {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+	withID := middleware.RequestID(echo)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(middleware.RequestIDHeader); id != "" && !validRequestID.MatchString(id) {
+			r.Header.Del(middleware.RequestIDHeader)
+		}
+		withID.ServeHTTP(w, r)
+	})
+}
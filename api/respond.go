@@ -0,0 +1,200 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Response encodings, picked by the URL's format extension, e.g.
+// /users/a1.xml, or else the Accept header. JSON is the default.
+const (
+	ContentTypeXML     = "application/xml"
+	ContentTypeMsgpack = "application/msgpack"
+)
+
+// offered are the Accept types each encoding answers, JSON first as the
+// default
+var offered = []string{"application/json", ContentTypeXML, "text/xml", ContentTypeMsgpack, "application/x-msgpack", "application/vnd.msgpack"}
+
+var encodings = map[string]string{
+	"application/json":        "json",
+	ContentTypeXML:            "xml",
+	"text/xml":                "xml",
+	ContentTypeMsgpack:        "msgpack",
+	"application/x-msgpack":   "msgpack",
+	"application/vnd.msgpack": "msgpack",
+}
+
+func init() {
+	render.Respond = respond
+}
+
+// respond replaces render's responder, so every render.Render and
+// render.RenderList goes out in the encoding the request asked for. XML
+// and MessagePack are made from the JSON, so they have the same fields
+// under the same names and leave out the same ones, json:"-" secrets
+// included. Under envelope they're wrapped in an Envelope first.
+func respond(w http.ResponseWriter, r *http.Request, v any) {
+	v = envelop(r, v)
+	encoding := responseEncoding(w, r)
+	if encoding == "json" {
+		render.JSON(w, r, v)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	contentType := ContentTypeMsgpack
+	if encoding == "xml" {
+		contentType = ContentTypeXML + "; charset=utf-8"
+		err = jsonToXML(&buf, data)
+	} else {
+		err = jsonToMsgpack(&buf, data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if status, ok := r.Context().Value(render.StatusCtxKey).(int); ok {
+		w.WriteHeader(status)
+	}
+	w.Write(buf.Bytes())
+}
+
+// responseEncoding is json, xml or msgpack. An extension other than those
+// is left to the routes, and gets JSON.
+func responseEncoding(w http.ResponseWriter, r *http.Request) string {
+	if ext, _ := r.Context().Value(middleware.URLFormatCtxKey).(string); ext != "" {
+		switch ext {
+		case "xml", "msgpack":
+			return ext
+		}
+		return "json"
+	}
+	varyAccept(w)
+	return encodings[negotiate(r, offered...)]
+}
+
+// varyAccept marks a response as depending on Accept, once
+func varyAccept(w http.ResponseWriter) {
+	for _, v := range w.Header().Values("Vary") {
+		if strings.EqualFold(v, "Accept") {
+			return
+		}
+	}
+	w.Header().Add("Vary", "Accept")
+}
+
+// jsonToXML writes a JSON document as XML in a <response> element. Object
+// members become elements named after their keys, array elements <item>
+// elements, and nulls are left out.
+func jsonToXML(w io.Writer, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if err := xmlValue(dec, enc, "response"); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func xmlValue(dec *json.Decoder, enc *xml.Encoder, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch t := tok.(type) {
+	case nil:
+		return nil
+	case json.Delim:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for dec.More() {
+			child := "item"
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child = xmlName(key.(string))
+			}
+			if err := xmlValue(dec, enc, child); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil { // the closing delimiter
+			return err
+		}
+		return enc.EncodeToken(start.End())
+	default:
+		return enc.EncodeElement(fmt.Sprint(t), start)
+	}
+}
+
+// xmlName makes a JSON key a valid element name, replacing what an XML
+// name can't hold with _
+func xmlName(key string) string {
+	name := []rune(key)
+	for i, r := range name {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r) && r != '-' && r != '.') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return "_"
+	}
+	return string(name)
+}
+
+// jsonToMsgpack writes a JSON document as MessagePack, with whole numbers
+// as integers and map keys sorted so the same value encodes the same way
+func jsonToMsgpack(w io.Writer, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	enc := msgpack.NewEncoder(w)
+	enc.SetSortMapKeys(true)
+	return enc.Encode(msgpackValue(v))
+}
+
+func msgpackValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i, e := range v {
+			v[i] = msgpackValue(e)
+		}
+	case map[string]any:
+		for k, e := range v {
+			v[k] = msgpackValue(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,176 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"go-chi-microservice/testsupport"
+	"go-chi-microservice/users"
+)
+
+// decoders read a response body in each encoding into a generic value, with
+// XML's elements as a map of their children's text
+var decoders = map[string]func(t *testing.T, body []byte) map[string]any{
+	"json": func(t *testing.T, body []byte) map[string]any {
+		var v map[string]any
+		if err := json.Unmarshal(body, &v); err != nil {
+			t.Fatalf("decoding JSON: %v\n%s", err, body)
+		}
+		return v
+	},
+	"xml": func(t *testing.T, body []byte) map[string]any {
+		v := map[string]any{}
+		dec := xml.NewDecoder(bytes.NewReader(body))
+		var name string
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				break
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				name = tok.Name.Local
+			case xml.CharData:
+				if name != "" && strings.TrimSpace(string(tok)) != "" {
+					v[name] = string(tok)
+				}
+			case xml.EndElement:
+				name = ""
+			}
+		}
+		if len(v) == 0 {
+			t.Fatalf("no elements in the XML:\n%s", body)
+		}
+		return v
+	},
+	"msgpack": func(t *testing.T, body []byte) map[string]any {
+		var v map[string]any
+		if err := msgpack.Unmarshal(body, &v); err != nil {
+			t.Fatalf("decoding MessagePack: %v", err)
+		}
+		return v
+	},
+}
+
+func TestResponseEncodings(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		encoding    string
+		contentType string
+	}{
+		{name: "no Accept", path: "/users/b2", encoding: "json", contentType: "application/json"},
+		{name: "any", path: "/users/b2", accept: "*/*", encoding: "json", contentType: "application/json"},
+		{name: "json", path: "/users/b2", accept: "application/json", encoding: "json", contentType: "application/json"},
+		{name: "xml", path: "/users/b2", accept: "application/xml", encoding: "xml", contentType: "application/xml; charset=utf-8"},
+		{name: "text xml", path: "/users/b2", accept: "text/xml", encoding: "xml", contentType: "application/xml; charset=utf-8"},
+		{name: "msgpack", path: "/users/b2", accept: "application/msgpack", encoding: "msgpack", contentType: "application/msgpack"},
+		{name: "x-msgpack", path: "/users/b2", accept: "application/x-msgpack", encoding: "msgpack", contentType: "application/msgpack"},
+		{name: "by quality", path: "/users/b2", accept: "application/json;q=0.5, application/xml", encoding: "xml", contentType: "application/xml; charset=utf-8"},
+		{name: "nothing offered", path: "/users/b2", accept: "image/png", encoding: "json", contentType: "application/json"},
+		{name: "xml extension", path: "/users/b2.xml", accept: "application/json", encoding: "xml", contentType: "application/xml; charset=utf-8"},
+		{name: "msgpack extension", path: "/users/b2.msgpack", encoding: "msgpack", contentType: "application/msgpack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := testsupport.NewServer(t)
+			srv.SeedUsers(&users.User{Id: "b2", Email: "bob@example.com", Phone: "+15005550006", Version: 3,
+				PasswordHash: "$2a$10$abcdefghijklmnopqrstuu8Yx3n5mL0wQf8gVbq3rQm1uXJ0mGk2"})
+			header := http.Header{}
+			if tt.accept != "" {
+				header.Set("Accept", tt.accept)
+			}
+			res := srv.Do("GET", tt.path, nil, header).AssertStatus(200).AssertHeader("Content-Type", tt.contentType)
+			if strings.Contains(res.Body.String(), "abcdefghijklmnopqrstuu8Yx3n5mL0wQf8gVbq3rQm1uXJ0mGk2") {
+				t.Fatal("the password hash was encoded")
+			}
+			got := decoders[tt.encoding](t, res.Body.Bytes())
+			want := map[string]any{"Id": "b2", "Email": "bob@example.com", "Phone": "+15005550006"}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// TestEncodingsAgree checks XML and MessagePack carry what the JSON does,
+// numbers as numbers in MessagePack
+func TestEncodingsAgree(t *testing.T) {
+	srv := testsupport.NewServer(t)
+	srv.SeedUsers(&users.User{Id: "b2", Email: "bob@example.com", Version: 3, Disabled: true})
+	get := func(accept string) []byte {
+		return srv.Do("GET", "/users/b2", nil, http.Header{"Accept": {accept}}).AssertStatus(200).Body.Bytes()
+	}
+	fromJSON := decoders["json"](t, get("application/json"))
+	fromMsgpack := decoders["msgpack"](t, get("application/msgpack"))
+	// timed per request, so the two needn't agree
+	delete(fromJSON, "elapsed")
+	delete(fromMsgpack, "elapsed")
+	if len(fromJSON) != len(fromMsgpack) {
+		t.Fatalf("JSON has %d fields, MessagePack %d", len(fromJSON), len(fromMsgpack))
+	}
+	for k, v := range fromJSON {
+		m := fromMsgpack[k]
+		if n, ok := v.(float64); ok {
+			rv := reflect.ValueOf(m)
+			if !(rv.CanInt() && rv.Int() == int64(n) || rv.CanUint() && rv.Uint() == uint64(n)) {
+				t.Errorf("%s = %#v in MessagePack, want the integer %v", k, m, n)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v, m) {
+			t.Errorf("%s = %#v in MessagePack, %#v in JSON", k, m, v)
+		}
+	}
+	fromXML := decoders["xml"](t, get("application/xml"))
+	for k, want := range map[string]string{"Id": "b2", "Email": "bob@example.com", "Version": "3", "Disabled": "true"} {
+		if fromXML[k] != want {
+			t.Errorf("%s = %v in XML, want %s", k, fromXML[k], want)
+		}
+	}
+}
+
+func TestErrorsInTheAskedEncoding(t *testing.T) {
+	for accept, contentType := range map[string]string{
+		"application/json":    "application/json",
+		"application/xml":     "application/xml; charset=utf-8",
+		"application/msgpack": "application/msgpack",
+	} {
+		t.Run(accept, func(t *testing.T) {
+			srv := testsupport.NewServer(t)
+			res := srv.Do("GET", "/users/zz", nil, http.Header{"Accept": {accept}}).
+				AssertStatus(404).
+				AssertHeader("Content-Type", contentType)
+			enc := map[string]string{"application/json": "json", "application/xml": "xml", "application/msgpack": "msgpack"}[accept]
+			if got := decoders[enc](t, res.Body.Bytes())["status"]; got != "Resource not found." {
+				t.Fatalf("status = %v", got)
+			}
+		})
+	}
+}
+
+func TestVaryAccept(t *testing.T) {
+	srv := testsupport.NewServer(t)
+	srv.SeedUsers(&users.User{Id: "b2", Email: "bob@example.com"})
+	res := srv.Do("GET", "/users/b2", nil, http.Header{"Accept": {"application/xml"}}).AssertStatus(200)
+	if n := strings.Count(strings.Join(res.Header().Values("Vary"), ","), "Accept"); n != 1 {
+		t.Fatalf("Vary = %q, want Accept once", res.Header().Values("Vary"))
+	}
+	// the extension decides, so the response doesn't vary by Accept
+	res = srv.Do("GET", "/users/b2.xml", nil, nil).AssertStatus(200)
+	for _, v := range res.Header().Values("Vary") {
+		if strings.Contains(v, "Accept") && !strings.Contains(v, "Accept-") {
+			t.Fatalf("Vary = %q for an extension", res.Header().Values("Vary"))
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/audit"
+	"go-chi-microservice/auth"
+	"go-chi-microservice/compress"
+	"go-chi-microservice/config"
+	"go-chi-microservice/diagnostics"
+	"go-chi-microservice/egress"
+	"go-chi-microservice/events"
+	"go-chi-microservice/flags"
+	"go-chi-microservice/imaging"
+	"go-chi-microservice/mail"
+	"go-chi-microservice/maintenance"
+	"go-chi-microservice/notify"
+	"go-chi-microservice/publicid"
+	"go-chi-microservice/redact"
+	"go-chi-microservice/reporting"
+	"go-chi-microservice/search"
+	"go-chi-microservice/slowconn"
+	"go-chi-microservice/storage"
+	"go-chi-microservice/streams"
+	"go-chi-microservice/users"
+	"go-chi-microservice/version"
+	"go-chi-microservice/views"
+	"go-chi-microservice/webhooks"
+)
+
+// UsersAPIVersion is the current version of the REST API under /users,
+// bump it with a change existing clients would notice and register the
+// steps older clients need in usersPayloads
+const UsersAPIVersion = 2
+
+// Deps are the services the http layer is built on
+type Deps struct {
+	Logger      *zerolog.Logger
+	Users       *users.Service
+	Diagnostics *diagnostics.Registry
+	Reporter    reporting.Reporter
+	Auth        *auth.Issuer       // nil leaves /auth unmounted
+	OIDC        *auth.OIDC         // nil leaves out /auth/oidc
+	Passkeys    *auth.Passkeys     // nil leaves out passkey logins
+	Verifier    auth.Verifier      // checks bearer tokens on /users, nil for none
+	Sessions    auth.SessionStore  // browser cookie sessions, nil for none
+	Notifier    *notify.Dispatcher // nil leaves out notifications and their preferences
+	Mailer      mail.Mailer
+	// ActionTokens keeps emailed verification and reset links, nil leaves
+	// those flows out
+	ActionTokens auth.ActionTokenStore
+	Webhooks     *webhooks.Deliverer // nil leaves out /admin/webhooks
+	Storage      storage.Storage     // uploaded files, nil leaves out uploads
+	// Limiter counts failed logins over sliding windows, in memory when nil
+	Limiter auth.LimiterStore
+	Views   *views.Renderer  // HTML pages for browsers, nil serves JSON only
+	Events  *events.Replayer // recorded user events, nil leaves out /admin/events
+	Search  search.Search    // full text search at /users/search, nil leaves it out
+	// Audit records mutating requests on both listeners, nil records none
+	Audit audit.Logger
+	// AuditStore lists the recorded entries at /admin/audit, nil leaves it out
+	AuditStore audit.Store
+	// Streams tracks event streams so shutdown can end them, one of its own
+	// when nil
+	Streams *streams.Registry
+	// Flags decides feature flags per request, nil leaves them all off
+	Flags flags.Provider
+	// Maintenance takes the API down for maintenance, switched on the admin
+	// listener, nil for never
+	Maintenance *maintenance.Switch
+	// PublicIDs encrypts ids for the resources PUBLIC_IDS_RESOURCES lists,
+	// nil shows stored ids everywhere
+	PublicIDs publicid.Codec
+	// Egress checks URLs users supply before they're fetched, nil for no
+	// checks
+	Egress *egress.Policy
+	// Images processes uploaded avatars, nil stores them as they are
+	Images *imaging.Processor
+}
+
+// NewRouter builds the http handler for the whole service
+func NewRouter(cfg *config.Config, deps Deps) http.Handler {
+	if deps.Reporter == nil {
+		deps.Reporter = reporting.Nop{}
+	}
+	r := chi.NewRouter()
+	// use installs a middleware and records it for the diagnostics report
+	use := func(name string, mw func(http.Handler) http.Handler) {
+		r.Use(mw)
+		deps.Diagnostics.AddMiddleware(name)
+	}
+	timeout := timeoutBudget(r, cfg.RequestTimeout, cfg.RouteTimeouts, cfg.TimeoutHeader)
+	use("RequestID", requestID)                           // add an id to context, honoring X-Request-Id
+	use("ServerTiming", timing)                           // time taken in Server-Timing, and for responses to report
+	use("RealIP", middleware.RealIP)                      // do the True-Client-IP, X-Real-IP or the X-Forwarded-For dance
+	use("Logger", requestLogger)                          // log requests, secrets in the url masked
+	use("LoggerCtx", loggerCtx(deps.Logger))              // app logger for zerolog.Ctx(r.Context())
+	use("Maintenance", maintenanceMode(deps.Maintenance)) // 503 but for health checks while down for maintenance
+	use("Audit", auditRequests(deps.Audit, nil))          // an audit entry for each mutating request, when enabled
+	use("ClientDisconnects", clientDisconnects)           // 499 when the client goes away
+	use("Recoverer", recoverer)                           // panics logged and answered with a problem+json 500
+	use("ErrorReporting", errorReporting(deps.Reporter))  // panics and 5xx to the error tracker
+	use("Timeout", timeout)                               // per route and client budgets, 504 once spent
+	use("MaxBody", maxBody(cfg.MaxBodyBytes))
+	if cfg.Compression.Enabled {
+		use("Compress", compress.Handler(compress.Options{Encodings: cfg.Compression.Encodings, Level: cfg.Compression.Level,
+			MinSize: cfg.Compression.MinSize, ContentTypes: cfg.Compression.ContentTypes}))
+	}
+	if cfg.SlowClient.Enabled {
+		use("MinBodyRate", slowconn.MinBodyRate(slowconn.Options{MinRate: cfg.SlowClient.MinRate, Grace: cfg.SlowClient.Grace}))
+	}
+	if cfg.Compression.RequestBodies {
+		use("Decompress", decompressBody(cfg.MaxBodyBytes))
+	}
+	use("URLFormat", middleware.URLFormat)
+	use("SecurityHeaders", securityHeaders(cfg.Headers))
+	use("SetContentType", render.SetContentType(render.ContentTypeJSON))
+	use("PayloadVersion", payloadVersion(cfg.APIVersion)) // the payload version from API-Version
+	if cfg.Envelope.Enabled {
+		use("Envelope", envelope) // bodies wrapped in data, meta and links
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Golang Chi microservice template"))
+	})
+
+	r.Get("/healthz", Healthz(deps.Maintenance))
+
+	r.Get("/version", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, version.Get())
+	})
+
+	r.Handle("/metrics", promhttp.Handler())
+
+	if cfg.Docs.Enabled {
+		r.Get("/docs/examples", docsExamples(cfg.Docs))
+	}
+	deps.Diagnostics.AddModule("docs", cfg.Docs.Enabled, map[string]any{"embedded": cfg.Docs.ExamplesDir == ""})
+
+	sessions := newSessionCookies(deps.Sessions, deps.Users, cfg.Auth.Session, cfg.Headers.TrustForwardedProto)
+	ur := r.With(corsHandler(cfg.CORS))
+	if deps.Verifier != nil || sessions != nil {
+		ur = ur.With(authenticate(deps.Verifier, sessions, cfg.Auth.Require))
+	}
+	tenants := tenantCtx(cfg.Tenancy)
+	ur = ur.With(tenants, flagsCtx(deps.Flags))
+	usersRes := NewUsersResource(deps.Users, cfg.ExpandMaxDepth, newStaleCache(cfg.Stale), newPaginator(cfg.Pagination), newComplexity(cfg.Complexity), newHTMLPages(deps.Views, cfg.HTML.ContentSecurityPolicy), cfg.CSV, cfg.Batch.MaxItems, cfg.UserRules.RequireIfMatch)
+	if deps.Search != nil {
+		usersRes.EnableSearch(deps.Search)
+	}
+	if deps.Auth != nil || deps.Sessions != nil {
+		usersRes.EnableRevocation(deps.Auth, deps.Sessions)
+	}
+	if deps.PublicIDs != nil && slices.Contains(cfg.PublicIDs.Resources, "users") {
+		usersRes.EnablePublicIDs(deps.PublicIDs)
+	}
+	if deps.Notifier != nil {
+		usersRes.MountUser("/notifications", NewNotificationsResource(deps.Notifier).Routes())
+	}
+	if deps.Storage != nil && cfg.Avatar.Enabled {
+		avatars := NewAvatarResource(deps.Users, deps.Storage, cfg.Avatar.MaxBytes, cfg.Avatar.ContentTypes)
+		if cfg.Avatar.URLs {
+			avatars.EnableURLs(deps.Egress, cfg.Avatar.FetchTimeout)
+		}
+		if deps.Images != nil {
+			avatars.EnableProcessing(deps.Images)
+		}
+		usersRes.MountUser("/avatar", avatars.Routes())
+	}
+	if deps.Storage != nil && cfg.Files.Enabled {
+		usersRes.MountUser("/files", NewFilesResource(deps.Storage, cfg.Files.URLTTL).Routes())
+	}
+	if deps.Auth != nil && cfg.Auth.TOTP.Enabled {
+		usersRes.MountUser("/totp", NewTOTPResource(deps.Users, cfg.Auth.Issuer).Routes())
+	}
+	var guests *GuestResource
+	if deps.Auth != nil && cfg.Auth.Guest.Enabled {
+		guests = NewGuestResource(deps.Users, deps.Auth)
+		usersRes.MountUser("/upgrade", guests.UserRoutes())
+	}
+	if deps.Auth != nil && deps.Passkeys != nil {
+		usersRes.MountUser("/passkeys", NewPasskeysResource(deps.Users, deps.Passkeys).Routes())
+	}
+	// one throttle for logins and resets, so a password reset lifts a lockout
+	var throttle *auth.Throttle
+	var account *AccountResource
+	if deps.Auth != nil {
+		if deps.Limiter == nil {
+			deps.Limiter = auth.NewMemoryLimiterStore()
+		}
+		throttle = auth.NewThrottle(auth.ThrottleOptions{
+			LockoutThreshold: cfg.Auth.LockoutThreshold,
+			LockoutDuration:  cfg.Auth.LockoutDuration,
+			Backoff:          cfg.Auth.LoginBackoff,
+			MaxBackoff:       cfg.Auth.LoginMaxBackoff,
+			IPFreeFailures:   cfg.Auth.IPFreeFailures,
+			Windows:          deps.Limiter,
+			Window:           cfg.Auth.Limiter.Window,
+			AccountLimit:     cfg.Auth.Limiter.AccountLimit,
+			IPLimit:          cfg.Auth.Limiter.IPLimit,
+			Delay:            cfg.Auth.LoginDelay,
+			MaxDelay:         cfg.Auth.LoginMaxDelay,
+		})
+		if deps.ActionTokens != nil {
+			account = NewAccountResource(deps.Users, deps.Auth, deps.Sessions, deps.ActionTokens, deps.Mailer, throttle, cfg.Auth.Account)
+			usersRes.MountUser("/verify-email", account.UserRoutes())
+		}
+	}
+	ur.Mount("/users", usersRes.Routes())
+	deps.Diagnostics.AddAPI("users", strconv.Itoa(UsersAPIVersion), "/users")
+	ur.With(requireFlag("users-me"), usersRes.publicIDs).Get("/me", usersRes.Me)
+	if cfg.RPC.Enabled {
+		ur.Mount(cfg.RPC.Path, NewRPCResource(deps.Users, cfg.Batch.MaxItems, cfg.Pagination.DefaultLimit, cfg.Pagination.MaxLimit).Routes())
+		deps.Diagnostics.AddAPI("json-rpc", "2.0", cfg.RPC.Path)
+	}
+	deps.Diagnostics.AddModule("rpc", cfg.RPC.Enabled, map[string]any{"path": cfg.RPC.Path})
+
+	if deps.Auth != nil {
+		ar := NewAuthResource(deps.Users, deps.Auth, deps.OIDC, deps.Passkeys, sessions, throttle, deps.Notifier, cfg.Auth.TOTP.Enabled, cfg.Headers.TrustForwardedProto).Routes()
+		if account != nil {
+			account.Register(ar)
+		}
+		if guests != nil {
+			guests.Register(ar)
+		}
+		r.With(tenants).Mount("/auth", ar)
+	}
+	deps.Diagnostics.AddModule("auth", deps.Auth != nil, map[string]any{
+		"oidc": deps.OIDC != nil, "sessions": sessions != nil, "totp": cfg.Auth.TOTP.Enabled,
+		"passkeys": deps.Passkeys != nil, "account": account != nil, "guests": guests != nil,
+	})
+
+	// the disk backend serves its own files, S3 ones are read from the bucket
+	if disk, ok := deps.Storage.(*storage.Disk); ok {
+		if u, err := url.Parse(cfg.Storage.DiskURL); err == nil && u.Path != "" {
+			prefix := strings.TrimSuffix(u.Path, "/")
+			r.Mount(prefix, http.StripPrefix(prefix, disk))
+		}
+	}
+	deps.Diagnostics.AddModule("avatar", deps.Storage != nil && cfg.Avatar.Enabled, map[string]any{"max_bytes": cfg.Avatar.MaxBytes, "urls": cfg.Avatar.URLs, "process": deps.Images != nil})
+	deps.Diagnostics.AddModule("files", deps.Storage != nil && cfg.Files.Enabled, map[string]any{"url_ttl": cfg.Files.URLTTL.String()})
+
+	if cfg.SCIM.Enabled {
+		scimRes := NewSCIMResource(deps.Users, cfg.SCIM.Token, cfg.Pagination.DefaultLimit, cfg.Pagination.MaxLimit)
+		if deps.Auth != nil || deps.Sessions != nil {
+			scimRes.EnableRevocation(deps.Auth, deps.Sessions)
+		}
+		r.With(tenants).Mount(scimPath, scimRes.Routes())
+		deps.Diagnostics.AddAPI("scim", "2.0", scimPath)
+	}
+	deps.Diagnostics.AddModule("scim", cfg.SCIM.Enabled, nil)
+	deps.Diagnostics.AddModule("tenancy", cfg.Tenancy.Enabled, map[string]any{"sources": cfg.Tenancy.Sources, "default": cfg.Tenancy.Default})
+
+	if cfg.Assets.Enabled {
+		mountAssets(r, cfg.Assets)
+	}
+	deps.Diagnostics.AddModule("assets", cfg.Assets.Enabled, map[string]any{
+		"path": cfg.Assets.Path, "embedded": cfg.Assets.Dir == "", "spa": cfg.Assets.SPA,
+	})
+
+	deps.Diagnostics.AddModule("complexity", cfg.Complexity.Enabled, map[string]any{"budget": cfg.Complexity.Budget, "mode": cfg.Complexity.Mode})
+	deps.Diagnostics.AddModule("stale_cache", cfg.Stale.Enabled, map[string]any{"max_age": cfg.Stale.MaxAge.String()})
+	deps.Diagnostics.AddModule("cors", true, map[string]any{
+		"allowed_origins": cfg.CORS.AllowedOrigins,
+		"dev_mode":        cfg.CORS.DevMode,
+	})
+	return r
+}
+
+// requestLogger is middleware.Logger with secrets in the logged url masked,
+// e.g. the signature of a signed upload url or an oidc code
+var requestLogger = middleware.RequestLogger(redactingFormatter{
+	&middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+})
+
+type redactingFormatter struct {
+	next middleware.LogFormatter
+}
+
+func (f redactingFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	r = r.WithContext(r.Context())
+	r.RequestURI = redact.String(r.RequestURI)
+	return f.next.NewLogEntry(r)
+}
+
+// loggerCtx makes a request scoped logger, tagged with the request id,
+// available to handlers via zerolog.Ctx
+func loggerCtx(logger *zerolog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := logger.With().Str("request_id", middleware.GetReqID(r.Context())).Logger()
+			next.ServeHTTP(w, r.WithContext(l.WithContext(r.Context())))
+		})
+	}
+}
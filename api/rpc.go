@@ -0,0 +1,291 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/users"
+)
+
+// JSON-RPC 2.0 error codes, the standard ones and, from the range the spec
+// leaves to servers, those mirroring the REST statuses
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcNotFound       = -32004 // 404
+	rpcConflict       = -32009 // 409
+	rpcUnavailable    = -32003 // 503
+	rpcTimeout        = -32005 // 504
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	// ID is nil for a notification, which gets no response, and the JSON
+	// null for a request with a null id, which does
+	ID json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+func rpcErrorf(code int, format string, args ...any) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// rpcMethod runs a call with its decoded params, an error that isn't an
+// *rpcError is an internal error
+type rpcMethod func(r *http.Request, params json.RawMessage) (any, error)
+
+// RPCResource serves the users service over JSON-RPC 2.0 at a single
+// endpoint, for clients that would rather call methods than map them to
+// REST. The methods behave like their REST counterparts.
+type RPCResource struct {
+	svc          *users.Service
+	maxBatch     int
+	defaultLimit int
+	maxLimit     int
+	methods      map[string]rpcMethod
+}
+
+func NewRPCResource(svc *users.Service, maxBatch, defaultLimit, maxLimit int) *RPCResource {
+	rs := &RPCResource{svc: svc, maxBatch: maxBatch, defaultLimit: defaultLimit, maxLimit: maxLimit}
+	rs.methods = map[string]rpcMethod{
+		"users.get":    rs.get,
+		"users.list":   rs.list,
+		"users.create": rs.write("create"),
+		"users.update": rs.write("update"),
+		"users.delete": rs.write("delete"),
+	}
+	return rs
+}
+
+func (rs *RPCResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(noGuests)
+	r.Post("/", rs.Serve)
+	return r
+}
+
+// Serve answers a call, or a batch of them as a JSON array. Calls in a
+// batch run in order and each gets its own response, or none for a
+// notification; a batch of only notifications is a 204.
+func (rs *RPCResource) Serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			render.Render(w, r, ErrTooLarge(err))
+		}
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			render.JSON(w, r, rpcFailure(nil, rpcErrorf(rpcParseError, "parse error: %v", err)))
+			return
+		}
+		if resp := rs.call(r, req); resp != nil {
+			render.JSON(w, r, resp)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		render.JSON(w, r, rpcFailure(nil, rpcErrorf(rpcParseError, "parse error: %v", err)))
+		return
+	}
+	if len(batch) == 0 {
+		render.JSON(w, r, rpcFailure(nil, rpcErrorf(rpcInvalidRequest, "the batch is empty")))
+		return
+	}
+	if len(batch) > rs.maxBatch {
+		render.JSON(w, r, rpcFailure(nil, rpcErrorf(rpcInvalidRequest, "the batch has %d calls, at most %d are allowed", len(batch), rs.maxBatch)))
+		return
+	}
+	resps := make([]*rpcResponse, 0, len(batch))
+	for _, raw := range batch {
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			resps = append(resps, rpcFailure(nil, rpcErrorf(rpcInvalidRequest, "invalid request: %v", err)))
+			continue
+		}
+		if resp := rs.call(r, req); resp != nil {
+			resps = append(resps, resp)
+		}
+		if clientGone(r, nil) {
+			return
+		}
+	}
+	if len(resps) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	render.JSON(w, r, resps)
+}
+
+// call runs one request, the response is nil for a notification
+func (rs *RPCResource) call(r *http.Request, req rpcRequest) *rpcResponse {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcFailure(req.ID, rpcErrorf(rpcInvalidRequest, `invalid request: jsonrpc must be "2.0" and method set`))
+	}
+	method, ok := rs.methods[req.Method]
+	if !ok {
+		return rs.reply(req, nil, rpcErrorf(rpcMethodNotFound, "method %q not found", req.Method))
+	}
+	result, err := method(r, req.Params)
+	var re *rpcError
+	if err != nil && !errors.As(err, &re) {
+		// the details stay in the log, as with a REST 500
+		zerolog.Ctx(r.Context()).Error().Err(err).Str("method", req.Method).
+			Str("request_id", middleware.GetReqID(r.Context())).Msg("rpc call failed")
+		re = rpcErrorf(rpcInternalError, "internal error")
+	}
+	return rs.reply(req, result, re)
+}
+
+func (rs *RPCResource) reply(req rpcRequest, result any, re *rpcError) *rpcResponse {
+	if req.ID == nil {
+		return nil
+	}
+	if re != nil {
+		return rpcFailure(req.ID, re)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return rpcFailure(req.ID, rpcErrorf(rpcInternalError, "internal error"))
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: data, ID: req.ID}
+}
+
+func rpcFailure(id json.RawMessage, err *rpcError) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+// rpcParams decodes params into v, by name only, rejecting unknown ones
+func rpcParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return rpcErrorf(rpcInvalidParams, "invalid params: %v", err)
+	}
+	return nil
+}
+
+// rpcStatusCodes turns the status a REST call would have got into an error
+// code
+var rpcStatusCodes = map[int]int{
+	http.StatusBadRequest:         rpcInvalidParams,
+	http.StatusNotFound:           rpcNotFound,
+	http.StatusConflict:           rpcConflict,
+	http.StatusServiceUnavailable: rpcUnavailable,
+	http.StatusGatewayTimeout:     rpcTimeout,
+}
+
+// rpcErrorFor is the error for a failed operation, anything without a code
+// of its own is left to call to report as internal
+func rpcErrorFor(res BatchResult) error {
+	if code, ok := rpcStatusCodes[res.Status]; ok {
+		return &rpcError{Code: code, Message: res.Error}
+	}
+	return errors.New(res.Error)
+}
+
+// get takes {"id": "..."} and returns the user
+func (rs *RPCResource) get(r *http.Request, params json.RawMessage) (any, error) {
+	var p struct {
+		Id string `json:"id"`
+	}
+	if err := rpcParams(params, &p); err != nil {
+		return nil, err
+	}
+	u, err := rs.svc.Get(r.Context(), p.Id)
+	if err != nil {
+		return nil, rpcErrorFor(batchFailure(p.Id, err))
+	}
+	resp := NewUserResponse(u)
+	resp.Render(nil, r)
+	return resp, nil
+}
+
+// list takes {"limit": n, "offset": n}, both optional, and returns that
+// page of users
+func (rs *RPCResource) list(r *http.Request, params json.RawMessage) (any, error) {
+	p := struct {
+		Limit  int `json:"limit"`
+		Offset int `json:"offset"`
+	}{Limit: rs.defaultLimit}
+	if err := rpcParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Limit < 1 || p.Limit > rs.maxLimit || p.Offset < 0 {
+		return nil, rpcErrorf(rpcInvalidParams, "invalid params: limit must be 1 to %d and offset not negative", rs.maxLimit)
+	}
+	list, err := rs.svc.List(r.Context())
+	if err != nil {
+		return nil, rpcErrorFor(batchFailure("", err))
+	}
+	start, end := Page{Limit: p.Limit, Offset: p.Offset}.Apply(len(list))
+	resps := NewUserListResponse(list[start:end])
+	for _, resp := range resps {
+		resp.Render(nil, r)
+	}
+	return resps, nil
+}
+
+// write runs a batch operation: create and update take {"user": {...}},
+// delete {"id": "..."}, see BatchOperation
+func (rs *RPCResource) write(op string) rpcMethod {
+	return func(r *http.Request, params json.RawMessage) (any, error) {
+		o := BatchOperation{Op: op}
+		if err := rpcParams(params, &struct {
+			Id   *string     `json:"id"`
+			User **BatchUser `json:"user"`
+		}{&o.Id, &o.User}); err != nil {
+			return nil, err
+		}
+		res := applyOperation(r.Context(), rs.svc, o, "rpc")
+		if res.Status >= 300 {
+			return nil, rpcErrorFor(res)
+		}
+		if res.User == nil {
+			return nil, nil
+		}
+		res.User.Render(nil, r)
+		return res.User, nil
+	}
+}
@@ -0,0 +1,296 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/scim"
+	"go-chi-microservice/users"
+)
+
+// scimPath is where SCIMResource is mounted
+const scimPath = "/scim/v2"
+
+// SCIMResource serves /scim/v2 for identity providers to provision users.
+// Deprovisioned users are disabled rather than deleted, and their sessions
+// ended.
+type SCIMResource struct {
+	svc          *users.Service
+	token        string
+	defaultCount int
+	maxCount     int
+	revoker      sessionRevoker
+}
+
+func NewSCIMResource(svc *users.Service, token string, defaultCount, maxCount int) *SCIMResource {
+	return &SCIMResource{svc: svc, token: token, defaultCount: defaultCount, maxCount: maxCount}
+}
+
+// EnableRevocation has deprovisioning end the user's sessions, refresh
+// tokens at issuer and cookie sessions in sessions, either may be nil. Call
+// it before Routes.
+func (rs *SCIMResource) EnableRevocation(issuer *auth.Issuer, sessions auth.SessionStore) {
+	rs.revoker = sessionRevoker{issuer: issuer, sessions: sessions}
+}
+
+func (rs *SCIMResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(rs.bearerToken)
+	r.Get("/ServiceProviderConfig", rs.ServiceProviderConfig)
+	r.Get("/Users", rs.ListUsers)
+	r.Post("/Users", rs.CreateUser)
+	r.Route("/Users/{id}", func(r chi.Router) {
+		r.Use(rs.userCtx)
+		r.Get("/", rs.GetUser)
+		r.Patch("/", rs.PatchUser)
+		r.Delete("/", rs.DeleteUser)
+	})
+	return r
+}
+
+// bearerToken checks for the shared token configured in the identity
+// provider
+func (rs *SCIMResource) bearerToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + rs.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			writeSCIMError(w, r, &scim.Error{Status: http.StatusUnauthorized, Detail: "missing or wrong bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rs *SCIMResource) ServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, http.StatusOK, scim.ServiceProviderConfig(rs.maxCount))
+}
+
+// ListUsers filters users with ?filter= and pages them with the 1 based
+// ?startIndex= and ?count=
+func (rs *SCIMResource) ListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := scim.ParseFilter(q.Get("filter"))
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	start, err := scimInt(q.Get("startIndex"), 1)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	count, err := scimInt(q.Get("count"), rs.defaultCount)
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	// out of range values are clamped rather than rejected, per RFC 7644
+	start = max(start, 1)
+	count = min(max(count, 0), rs.maxCount)
+
+	list, err := rs.svc.List(r.Context())
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	var matched []*users.User
+	for _, u := range list {
+		if filter.Match(u) {
+			matched = append(matched, u)
+		}
+	}
+	page := matched[min(start-1, len(matched)):min(start-1+count, len(matched))]
+	resp := &scim.ListResponse{
+		Schemas:      []string{scim.ListSchema},
+		TotalResults: len(matched),
+		StartIndex:   start,
+		ItemsPerPage: len(page),
+		Resources:    make([]*scim.User, 0, len(page)),
+	}
+	for _, u := range page {
+		resp.Resources = append(resp.Resources, scim.FromUser(u, scimBase(r)))
+	}
+	writeSCIM(w, http.StatusOK, resp)
+}
+
+func (rs *SCIMResource) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var su scim.User
+	if err := decodeSCIM(w, r, &su); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	// ids are ours to assign
+	su.ID = ""
+	u, err := su.ToUser()
+	if err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	if err := rs.svc.Create(r.Context(), u, "scim"); err != nil {
+		if clientGone(r, err) {
+			return
+		}
+		writeSCIMError(w, r, err)
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "scim_create").Str("user_id", u.Id).Msg("user provisioned")
+	resp := scim.FromUser(u, scimBase(r))
+	w.Header().Set("Location", resp.Meta.Location)
+	writeSCIM(w, http.StatusCreated, resp)
+}
+
+func (rs *SCIMResource) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := scimUser(w, r)
+	if !ok {
+		return
+	}
+	writeSCIM(w, http.StatusOK, scim.FromUser(user, scimBase(r)))
+}
+
+// PatchUser applies the operations to a copy of the user and stores it,
+// ending their sessions when it sets active to false
+func (rs *SCIMResource) PatchUser(w http.ResponseWriter, r *http.Request) {
+	var op scim.PatchOp
+	if err := decodeSCIM(w, r, &op); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	stored, ok := scimUser(w, r)
+	if !ok {
+		return
+	}
+	u := *stored
+	if err := op.Apply(&u); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	if err := rs.svc.Update(r.Context(), &u); err != nil {
+		if clientGone(r, err) {
+			return
+		}
+		writeSCIMError(w, r, err)
+		return
+	}
+	if u.Disabled && !stored.Disabled {
+		if err := rs.revoker.revokeUser(r.Context(), u.Id); err != nil {
+			writeSCIMError(w, r, err)
+			return
+		}
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "scim_patch").Str("user_id", u.Id).Bool("active", !u.Disabled).Msg("user updated")
+	writeSCIM(w, http.StatusOK, scim.FromUser(&u, scimBase(r)))
+}
+
+// DeleteUser deprovisions the user by disabling it and ending its
+// sessions, its data stays
+func (rs *SCIMResource) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	stored, ok := scimUser(w, r)
+	if !ok {
+		return
+	}
+	u := *stored
+	u.Disabled = true
+	if err := rs.svc.Update(r.Context(), &u); err != nil {
+		if clientGone(r, err) {
+			return
+		}
+		writeSCIMError(w, r, err)
+		return
+	}
+	if err := rs.revoker.revokeUser(r.Context(), u.Id); err != nil {
+		writeSCIMError(w, r, err)
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "scim_delete").Str("user_id", u.Id).Msg("user deprovisioned")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userCtx loads {id} like UsersResource.UserCtx, answering with SCIM errors
+func (rs *SCIMResource) userCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := rs.svc.Get(r.Context(), chi.URLParam(r, "id"))
+		if clientGone(r, err) {
+			return
+		}
+		if err != nil {
+			writeSCIMError(w, r, err)
+			return
+		}
+		ctx := ctxkeys.With(r.Context(), ctxkeys.User, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// scimBase is the URL of /scim/v2 as this request reached it, for resource
+// locations
+func scimBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + scimPath
+}
+
+func scimInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, &scim.Error{Status: http.StatusBadRequest, Type: "invalidValue", Detail: "startIndex and count must be integers"}
+	}
+	return n, nil
+}
+
+func decodeSCIM(w http.ResponseWriter, r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		return &scim.Error{Status: http.StatusBadRequest, Type: "invalidSyntax", Detail: err.Error()}
+	}
+	return nil
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", scim.ContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeSCIMError maps err to a SCIM error response, storage failures are
+// reported like any other 5xx
+func writeSCIMError(w http.ResponseWriter, r *http.Request, err error) {
+	var se *scim.Error
+	switch {
+	case errors.As(err, &se):
+	case errors.Is(err, users.ErrNotFound):
+		se = &scim.Error{Status: http.StatusNotFound, Detail: "user not found"}
+	case errors.Is(err, users.ErrExists):
+		se = &scim.Error{Status: http.StatusConflict, Type: "uniqueness", Detail: err.Error()}
+	case errors.Is(err, users.ErrInvalid):
+		se = &scim.Error{Status: http.StatusBadRequest, Type: "invalidValue", Detail: err.Error()}
+	default:
+		recordError(r, err)
+		se = &scim.Error{Status: http.StatusInternalServerError, Detail: "internal server error"}
+	}
+	writeSCIM(w, se.Status, se.Response())
+}
+
+// scimUser is contextUser answering in SCIM's error format
+func scimUser(w http.ResponseWriter, r *http.Request) (*users.User, bool) {
+	user, ok := userFrom(r.Context())
+	if !ok {
+		writeSCIMError(w, r, errNoUser)
+	}
+	return user, ok
+}
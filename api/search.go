@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/search"
+)
+
+// maxSearchQuery bounds ?q, a long query string is a lot of clauses
+const maxSearchQuery = 256
+
+// EnableSearch serves /users/search from index. Call it before Routes.
+func (rs *UsersResource) EnableSearch(index search.Search) {
+	rs.search = index
+}
+
+// SearchResponse is a page of users matching a search, best first, and how
+// many matched in all
+type SearchResponse struct {
+	Total int          `json:"total"`
+	Users []*SearchHit `json:"users"`
+}
+
+type SearchHit struct {
+	*UserResponse
+	Score float64 `json:"score"`
+}
+
+// MarshalJSON adds the score to the user, whose MarshalJSON would stand in
+// for the hit's otherwise
+func (h *SearchHit) MarshalJSON() ([]byte, error) {
+	user, err := h.UserResponse.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	score, err := json.Marshal(h.Score)
+	if err != nil {
+		return nil, err
+	}
+	hit := append(user[:len(user)-1:len(user)-1], `,"score":`...)
+	return append(append(hit, score...), '}'), nil
+}
+
+func (sr *SearchResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	for _, hit := range sr.Users {
+		hit.UserResponse.Render(w, r)
+	}
+	return nil
+}
+
+// SearchUsers finds users by ?q in the search index, paged by ?limit and
+// ?offset, and loads them from the repository. Users the index has but the
+// repository no longer does are left out.
+func (rs *UsersResource) SearchUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		render.Render(w, r, ErrInvalidRequest(errors.New("missing ?q= to search for")))
+		return
+	}
+	if len(q) > maxSearchQuery {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("q is at most %d bytes", maxSearchQuery)))
+		return
+	}
+	if _, ok := rs.complexity.admit(w, r, readCost{search: q}); !ok {
+		return
+	}
+	page := pageFrom(r.Context())
+	res, err := rs.search.Query(r.Context(), q, page.Limit, page.Offset)
+	if clientGone(r, err) {
+		return
+	}
+	if errors.Is(err, search.ErrInvalidQuery) {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	ids := make([]string, 0, len(res.Hits))
+	for _, h := range res.Hits {
+		ids = append(ids, h.ID)
+	}
+	found, err := rs.svc.GetMany(r.Context(), ids)
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	setTotal(r, res.Total)
+	resp := &SearchResponse{Total: res.Total, Users: make([]*SearchHit, 0, len(res.Hits))}
+	for _, h := range res.Hits {
+		if u, ok := found[h.ID]; ok {
+			resp.Users = append(resp.Users, &SearchHit{UserResponse: NewUserResponse(u), Score: h.Score})
+		}
+	}
+	render.Render(w, r, resp)
+}
@@ -0,0 +1,72 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/testsupport"
+	"go-chi-microservice/users"
+)
+
+// TestSearchStaysInTheTenant checks a search neither finds nor counts the
+// users of other tenants, so its pages are full and its total is the
+// tenant's own
+func TestSearchStaysInTheTenant(t *testing.T) {
+	tests := []struct {
+		tenant string
+		query  string
+		total  int
+		page   int
+	}{
+		{tenant: "acme", query: "example", total: 2, page: 2},
+		{tenant: "acme", query: "example&limit=1", total: 2, page: 1},
+		{tenant: "acme", query: "globex", total: 0, page: 0},
+		{tenant: "acme", query: "tenant:globex", total: 0, page: 0},
+		{tenant: "globex", query: "example", total: 10, page: 10},
+		{tenant: "initech", query: "example", total: 0, page: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant+" "+tt.query, func(t *testing.T) {
+			srv := tenantsServer(t)
+			var got struct {
+				Total int
+				Users []struct {
+					Id       string
+					TenantID string
+				}
+			}
+			srv.Do("GET", "/users/search?q="+tt.query, nil, http.Header{"X-Tenant-Id": {tt.tenant}}).
+				AssertStatus(200).
+				DecodeJSON(&got)
+			if got.Total != tt.total || len(got.Users) != tt.page {
+				t.Fatalf("total %d with %d on the page, want %d with %d", got.Total, len(got.Users), tt.total, tt.page)
+			}
+			for _, u := range got.Users {
+				if u.TenantID != tt.tenant {
+					t.Fatalf("found %s of tenant %q", u.Id, u.TenantID)
+				}
+			}
+		})
+	}
+}
+
+// tenantsServer has search on and tenants named by header, with acme's two
+// users and ten of globex's matching the same words. Sorted ahead of or
+// between acme's, globex's would take up acme's pages.
+func tenantsServer(t *testing.T) *testsupport.Server {
+	t.Helper()
+	srv := testsupport.NewServer(t, testsupport.WithConfig(func(cfg *config.Config) {
+		cfg.Search.Enabled = true
+		cfg.Tenancy.Enabled, cfg.Tenancy.Sources = true, []string{"header"}
+	}))
+	for i := 0; i < 10; i++ {
+		srv.SeedUsers(&users.User{Id: fmt.Sprintf("g%d", i), Email: fmt.Sprintf("deadbug%d@globex.example.com", i), TenantID: "globex"})
+	}
+	srv.SeedUsers(
+		&users.User{Id: "a1", Email: "deadbug@acme.example.com", TenantID: "acme"},
+		&users.User{Id: "a2", Email: "deadbug.two@acme.example.com", TenantID: "acme"},
+	)
+	return srv
+}
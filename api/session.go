@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/config"
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/tenant"
+	"go-chi-microservice/users"
+)
+
+// csrfCookie is readable by scripts so they can copy it into csrfHeader,
+// which a cross site form can't set
+const (
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// sessionCookies is browser login: an HttpOnly cookie naming a server side
+// session, with a double submit CSRF token guarding state changes
+type sessionCookies struct {
+	store               auth.SessionStore
+	users               *users.Service
+	name                string
+	ttl                 time.Duration
+	trustForwardedProto bool
+}
+
+func newSessionCookies(store auth.SessionStore, svc *users.Service, cfg config.SessionConfig, trustForwardedProto bool) *sessionCookies {
+	if store == nil {
+		return nil
+	}
+	return &sessionCookies{store: store, users: svc, name: cfg.CookieName, ttl: cfg.TTL, trustForwardedProto: trustForwardedProto}
+}
+
+func (sc *sessionCookies) start(w http.ResponseWriter, r *http.Request, userID string) (*auth.Session, error) {
+	sess, err := auth.NewSession(userID, sc.ttl)
+	if err != nil {
+		return nil, err
+	}
+	sess.Tenant = tenant.ID(r.Context())
+	if err := sc.store.Save(r.Context(), sess); err != nil {
+		return nil, err
+	}
+	secure := isTLS(r, sc.trustForwardedProto)
+	http.SetCookie(w, &http.Cookie{
+		Name: sc.name, Value: sess.ID, Path: "/", Expires: sess.Expires,
+		HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookie, Value: sess.CSRF, Path: "/", Expires: sess.Expires,
+		Secure: secure, SameSite: http.SameSiteStrictMode,
+	})
+	return sess, nil
+}
+
+func (sc *sessionCookies) end(w http.ResponseWriter, r *http.Request, sess *auth.Session) error {
+	http.SetCookie(w, &http.Cookie{Name: sc.name, Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Path: "/", MaxAge: -1})
+	return sc.store.Delete(r.Context(), sess.ID)
+}
+
+// lookup returns the request's session, nil when it has no session cookie
+// or the session is gone
+func (sc *sessionCookies) lookup(r *http.Request) (*auth.Session, error) {
+	c, err := r.Cookie(sc.name)
+	if err != nil || c.Value == "" {
+		return nil, nil
+	}
+	sess, err := sc.store.Get(r.Context(), c.Value)
+	if errors.Is(err, auth.ErrNoSession) {
+		return nil, nil
+	}
+	return sess, err
+}
+
+// active reports whether the user of sess may still use it, they haven't
+// been deleted, suspended or disabled since it started
+func (sc *sessionCookies) active(ctx context.Context, sess *auth.Session) (bool, error) {
+	if sess.Tenant != "" {
+		ctx = tenant.With(ctx, sess.Tenant)
+	}
+	return sc.users.Active(ctx, sess.UserID)
+}
+
+// sessionRevoker ends every session of a user, their refresh tokens and
+// their cookie sessions, whichever are set up
+type sessionRevoker struct {
+	issuer   *auth.Issuer      // nil when tokens aren't issued here
+	sessions auth.SessionStore // nil without cookie sessions
+}
+
+func (sr sessionRevoker) revokeUser(ctx context.Context, userID string) error {
+	if sr.issuer != nil {
+		if err := sr.issuer.RevokeUser(ctx, userID); err != nil {
+			return err
+		}
+	}
+	if sr.sessions != nil {
+		return sr.sessions.RevokeUser(ctx, userID)
+	}
+	return nil
+}
+
+func sessionFrom(ctx context.Context) *auth.Session {
+	s, _ := ctxkeys.Value[*auth.Session](ctx, ctxkeys.Session)
+	return s
+}
+
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// checkCSRF is the double submit check for a request authenticated by its
+// session cookie. Bearer token requests don't need it, browsers never send
+// those on their own.
+func checkCSRF(r *http.Request, sess *auth.Session) error {
+	if !unsafeMethod(r.Method) {
+		return nil
+	}
+	header := r.Header.Get(csrfHeader)
+	c, err := r.Cookie(csrfCookie)
+	// compared in constant time, the token is as good as the session to
+	// whoever can guess it
+	want := []byte(sess.CSRF)
+	if header == "" || err != nil ||
+		subtle.ConstantTimeCompare([]byte(c.Value), want) != 1 ||
+		subtle.ConstantTimeCompare([]byte(header), want) != 1 {
+		return errors.New("missing or mismatched " + csrfHeader + " header")
+	}
+	return nil
+}
+
+func ErrForbidden(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden.",
+		ErrorText:      err.Error(),
+	}
+}
+
+type SessionResponse struct {
+	UserID    string    `json:"user_id"`
+	CSRFToken string    `json:"csrf_token"` // send back in X-CSRF-Token
+	Expires   time.Time `json:"expires"`
+}
+
+func (sr *SessionResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+// SessionLogin is Login for browsers: the session goes in a cookie rather
+// than tokens in the body
+func (rs *AuthResource) SessionLogin(w http.ResponseWriter, r *http.Request) {
+	user, ok := rs.checkLogin(w, r, metrics.MethodSession)
+	if !ok {
+		return
+	}
+	sess, err := rs.sessions.start(w, r, user.Id)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, &SessionResponse{UserID: user.Id, CSRFToken: sess.CSRF, Expires: sess.Expires})
+}
+
+// SessionLogout ends the cookie session, it's CSRF checked like any other
+// state change
+func (rs *AuthResource) SessionLogout(w http.ResponseWriter, r *http.Request) {
+	sess, err := rs.sessions.lookup(r)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	if sess == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := checkCSRF(r, sess); err != nil {
+		render.Render(w, r, ErrForbidden(err))
+		return
+	}
+	if err := rs.sessions.end(w, r, sess); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/users"
+)
+
+// EnableRevocation has deletes end the user's sessions, refresh tokens at
+// issuer and cookie sessions in sessions, either may be nil. Call it
+// before Routes.
+func (rs *UsersResource) EnableRevocation(issuer *auth.Issuer, sessions auth.SessionStore) {
+	rs.revoker = sessionRevoker{issuer: issuer, sessions: sessions}
+}
+
+// DeleteUser soft deletes the user, see users.Service.Delete, and ends
+// their sessions. It can be restored through the admin listener until it's
+// purged.
+func (rs *UsersResource) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	stored, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	u := *stored
+	if err := rs.svc.Delete(r.Context(), &u); err != nil {
+		switch {
+		case clientGone(r, err):
+		case errors.Is(err, users.ErrNotFound):
+			render.Render(w, r, ErrNotFound())
+		case errors.Is(err, users.ErrVersionMismatch):
+			render.Render(w, r, ErrPreconditionFailed(errIfMatchFailed))
+		default:
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	if err := rs.revoker.revokeUser(r.Context(), u.Id); err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "user_deleted").Str("user_id", u.Id).Msg("user deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refuseIncludeDeleted turns away ?include_deleted on the public API, soft
+// deleted users are only shown to admins
+func refuseIncludeDeleted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("include_deleted") {
+			render.Render(w, r, ErrForbidden(errors.New("include_deleted is for admins, see /admin/users on the admin listener")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// includeDeleted makes the request's reads return soft deleted users too
+// when ?include_deleted=true
+func includeDeleted(r *http.Request) *http.Request {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return r
+	}
+	return r.WithContext(users.IncludeDeleted(r.Context()))
+}
+
+// ListUsers lists users for admins, soft deleted ones too with
+// ?include_deleted=true
+func (rs *AdminResource) ListUsers(w http.ResponseWriter, r *http.Request) {
+	r = includeDeleted(r)
+	list, err := rs.users.List(r.Context())
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	start, end := pageFrom(r.Context()).Apply(len(list))
+	setTotal(r, len(list))
+	render.RenderList(w, r, renderers(NewUserListResponse(list[start:end])))
+}
+
+// GetUser shows a user to admins, a soft deleted one too with
+// ?include_deleted=true
+func (rs *AdminResource) GetUser(w http.ResponseWriter, r *http.Request) {
+	r = includeDeleted(r)
+	u, err := rs.users.Get(r.Context(), chi.URLParam(r, "userID"))
+	if clientGone(r, err) {
+		return
+	}
+	if errors.Is(err, users.ErrNotFound) {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	render.Render(w, r, NewUserResponse(u))
+}
+
+// RestoreUser undoes a soft delete, a 409 when another user has taken the
+// email since. Restoring a user that isn't deleted changes nothing.
+func (rs *AdminResource) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "userID")
+	u, err := rs.users.Restore(r.Context(), id)
+	if err != nil {
+		switch {
+		case clientGone(r, err):
+		case errors.Is(err, users.ErrNotFound):
+			render.Render(w, r, ErrNotFound())
+		case errors.Is(err, users.ErrExists), errors.Is(err, users.ErrVersionMismatch):
+			render.Render(w, r, ErrConflict(err))
+		default:
+			render.Render(w, r, ErrStorage(err))
+		}
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "user_restored").Str("user_id", id).Msg("user restored")
+	render.Render(w, r, NewUserResponse(u))
+}
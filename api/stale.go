@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/config"
+)
+
+var staleServedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "http_stale_responses_total",
+	Help: "Cached responses served in place of a failed read.",
+})
+
+// staleCache keeps the last good response of each read so it can be served,
+// marked stale, while the backend is failing. Responses are buffered as the
+// handler writes them, so only hang it on read endpoints with modest bodies.
+type staleCache struct {
+	cfg config.StaleConfig
+
+	mu      sync.Mutex
+	entries map[string]*staleEntry
+}
+
+type staleEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+func newStaleCache(cfg config.StaleConfig) *staleCache {
+	return &staleCache{cfg: cfg, entries: map[string]*staleEntry{}}
+}
+
+// staleKey separates callers by credentials so a stale response is never
+// served to someone other than who it was made for
+func staleKey(r *http.Request) string {
+	auth := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("Accept") + " " + strconv.Itoa(payloadVersionFrom(r.Context())) + " " + hex.EncodeToString(auth[:8])
+}
+
+func (c *staleCache) Handler(next http.Handler) http.Handler {
+	if !c.cfg.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status == StatusClientClosedRequest {
+			return
+		}
+
+		key := staleKey(r)
+		if rec.status >= 500 {
+			if e := c.get(key); e != nil {
+				c.serveStale(w, r, e)
+				return
+			}
+		} else if rec.status < 300 && rec.body.Len() <= c.cfg.MaxBodyBytes {
+			c.put(key, rec)
+		}
+		rec.flush(w)
+	})
+}
+
+func (c *staleCache) get(key string) *staleEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(e.stored) > c.cfg.MaxAge {
+		delete(c.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (c *staleCache) put(key string, rec *bufferedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.cfg.MaxEntries {
+		c.evictOldest()
+	}
+	c.entries[key] = &staleEntry{
+		status: rec.status,
+		header: rec.header.Clone(),
+		body:   append([]byte(nil), rec.body.Bytes()...),
+		stored: time.Now(),
+	}
+}
+
+// evictOldest drops the least recently stored entry. c.mu must be held.
+func (c *staleCache) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for k, e := range c.entries {
+		if oldestKey == "" || e.stored.Before(oldest) {
+			oldestKey, oldest = k, e.stored
+		}
+	}
+	delete(c.entries, oldestKey)
+}
+
+func (c *staleCache) serveStale(w http.ResponseWriter, r *http.Request, e *staleEntry) {
+	staleServedTotal.Inc()
+	age := time.Since(e.stored)
+	zerolog.Ctx(r.Context()).Warn().Dur("age", age).Msg("serving stale response")
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("Warning", `110 - "Response is Stale"`)
+	h.Set("Age", strconv.Itoa(int(age.Seconds())))
+	h.Set("X-Stale-Since", e.stored.UTC().Format(http.TimeFormat))
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// bufferedResponse holds a response back until the handler is done so it
+// can be swapped for a stale one
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.wroteHeader {
+		return
+	}
+	b.status = status
+	b.wroteHeader = true
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) flush(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range b.header {
+		h[k] = v
+	}
+	if b.wroteHeader {
+		w.WriteHeader(b.status)
+	}
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-chi-microservice/streams"
+)
+
+// sseRetry is the reconnect delay a client is told to use when the server
+// goes away, long enough for a load balancer to move it to another instance
+const sseRetry = 2 * time.Second
+
+// sse writes a server-sent event stream, registered with the stream
+// registry so shutdown can end it
+type sse struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	conn *streams.Conn
+}
+
+// startSSE answers r with an event stream. The handler runs the stream
+// under r's returned context, cancelled when shutdown forces the stream
+// closed, until done or conn.GoingAway, and must call end when it returns.
+func startSSE(w http.ResponseWriter, r *http.Request, reg *streams.Registry) (*sse, *http.Request) {
+	conn, ctx := reg.Open(r.Context(), "sse")
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // keep nginx from holding events back
+	w.WriteHeader(http.StatusOK)
+	s := &sse{w: w, rc: http.NewResponseController(w), conn: conn}
+	// a stream outlives the server's WriteTimeout
+	s.rc.SetWriteDeadline(time.Time{})
+	s.rc.Flush()
+	return s, r.WithContext(ctx)
+}
+
+// send writes one event, id is what the client sends back in
+// Last-Event-ID when it reconnects
+func (s *sse) send(event, id string, data []byte) error {
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// ping writes a comment, so proxies don't close a quiet stream as idle
+func (s *sse) ping() error {
+	return s.write(": ping\n\n")
+}
+
+func (s *sse) write(msg string) error {
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// goAway tells the client the server is shutting down and when to
+// reconnect, resuming after the last id it got
+func (s *sse) goAway() error {
+	return s.write(fmt.Sprintf("event: shutdown\nretry: %d\ndata: {}\n\n", sseRetry.Milliseconds()))
+}
+
+func (s *sse) end() {
+	s.conn.Close()
+}
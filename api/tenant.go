@@ -0,0 +1,120 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/tenant"
+)
+
+// tenantCtx resolves the tenant of each request from the configured
+// sources, the first that names one wins, and puts it in the context for
+// the repository to scope to, tags the request's logs with it and counts
+// the request for it. A token's tenant claim must agree with whatever
+// named the tenant, so a token can't be used against another tenant.
+// Install it after authenticate for the claim source to see the token.
+func tenantCtx(cfg config.TenancyConfig) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(cfg.Allowed))
+	for _, id := range cfg.Allowed {
+		allowed[id] = true
+	}
+	return func(next http.Handler) http.Handler {
+		if !cfg.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := resolveTenant(r, cfg)
+			if err != nil {
+				render.Render(w, r, ErrForbidden(err))
+				return
+			}
+			if id == "" {
+				render.Render(w, r, ErrInvalidRequest(fmt.Errorf("no tenant: %s", tenantSources(cfg))))
+				return
+			}
+			if !tenant.Valid(id) || (len(allowed) > 0 && !allowed[id]) {
+				render.Render(w, r, ErrNotFound())
+				return
+			}
+			ctx := tenant.With(r.Context(), id)
+			logger := zerolog.Ctx(ctx).With().Str("tenant", id).Logger()
+			ctx = logger.WithContext(ctx)
+			ww, ok := w.(middleware.WrapResponseWriter)
+			if !ok {
+				ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			}
+			next.ServeHTTP(ww, r.WithContext(ctx))
+			metrics.TenantRequest(id, ww.Status())
+		})
+	}
+}
+
+// resolveTenant returns the tenant the request names, the default when it
+// names none, and an error when its token is for another one
+func resolveTenant(r *http.Request, cfg config.TenancyConfig) (string, error) {
+	var id, claimed string
+	if c := ClaimsFrom(r.Context()); c != nil {
+		claimed = c.Tenant
+	}
+	for _, source := range cfg.Sources {
+		if id != "" {
+			break
+		}
+		switch source {
+		case "subdomain":
+			id = subdomain(r.Host, cfg.BaseDomain)
+		case "header":
+			id = strings.TrimSpace(r.Header.Get(cfg.Header))
+		case "claim":
+			id = claimed
+		}
+	}
+	if id == "" {
+		id = cfg.Default
+	}
+	if claimed != "" && claimed != id {
+		return "", errors.New("the token is for another tenant")
+	}
+	return id, nil
+}
+
+// subdomain is the label of host just under base, empty when host isn't
+// a direct subdomain of it
+func subdomain(host, base string) string {
+	if base == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(base))
+	if !ok || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
+
+// tenantSources tells a client how to name a tenant
+func tenantSources(cfg config.TenancyConfig) string {
+	var ways []string
+	for _, source := range cfg.Sources {
+		switch source {
+		case "subdomain":
+			ways = append(ways, "use a subdomain of "+cfg.BaseDomain)
+		case "header":
+			ways = append(ways, "send "+cfg.Header)
+		case "claim":
+			ways = append(ways, "use a token with a tenant claim")
+		}
+	}
+	return strings.Join(ways, ", or ")
+}
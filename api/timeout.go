@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+)
+
+// timeoutBudget puts each request under a deadline, 504 once it passes:
+// its route's timeout from perRoute, else def, cut short by the client's
+// own budget when it sends one in header. The deadline is on the request
+// context, so the store and downstream calls made with it stop at it too.
+//
+// perRoute is keyed by route as `routes` prints it, /users/{userID}/avatar,
+// optionally after a method, POST /users/import. 0 leaves a route without
+// a timeout, for streams and long exports.
+func timeoutBudget(routes chi.Routes, def time.Duration, perRoute map[string]time.Duration, header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			budget := def
+			if len(perRoute) > 0 {
+				route := matchRoute(routes, r)
+				if d, ok := perRoute[r.Method+" "+route]; ok {
+					budget = d
+				} else if d, ok := perRoute[route]; ok {
+					budget = d
+				}
+			}
+			if d, ok := clientBudget(r, header); ok && (budget == 0 || d < budget) {
+				budget = d
+			}
+			if budget == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+			ww, ok := w.(middleware.WrapResponseWriter)
+			if !ok {
+				ww = middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			}
+			next.ServeHTTP(ww, r.WithContext(ctx))
+			// a handler that gave up at the deadline without answering gets
+			// the 504 here, one that answered keeps its response
+			if ctx.Err() == context.DeadlineExceeded && ww.Status() == 0 {
+				render.Render(ww, r, ErrTimeout(ctx.Err()))
+			}
+		})
+	}
+}
+
+// matchRoute is the pattern of the route r goes to, as `routes` prints it,
+// found ahead of routing since the timeout wraps it
+func matchRoute(routes chi.Routes, r *http.Request) string {
+	rctx := chi.NewRouteContext()
+	if !routes.Match(rctx, r.Method, r.URL.Path) {
+		return ""
+	}
+	route := strings.Replace(rctx.RoutePattern(), "/*/", "/", -1)
+	if len(route) > 1 {
+		route = strings.TrimSuffix(route, "/")
+	}
+	return route
+}
+
+// clientBudget is the time the client gives the request in header, as
+// seconds, 2.5, or a duration, 2500ms. Anything else, or a budget that's
+// already spent, is ignored.
+func clientBudget(r *http.Request, header string) (time.Duration, bool) {
+	if header == "" || header == "-" {
+		return 0, false
+	}
+	v := strings.TrimSpace(r.Header.Get(header))
+	if v == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	return d, d > 0
+}
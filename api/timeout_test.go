@@ -0,0 +1,83 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/testsupport"
+)
+
+// TestHungBackendTimesOut checks a request whose store calls hang is
+// answered with a 504 at its deadline, and that none of those calls is left
+// running once it has been
+func TestHungBackendTimesOut(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(cfg *config.Config)
+		header http.Header
+	}{
+		{name: "request timeout", config: func(cfg *config.Config) {
+			cfg.RequestTimeout = 50 * time.Millisecond
+			cfg.UserRepo.DeadlineReserve = 10 * time.Millisecond
+		}},
+		{name: "statement timeout", config: func(cfg *config.Config) {
+			cfg.UserRepo.StatementTimeout = 30 * time.Millisecond
+		}},
+		{name: "client budget", config: func(cfg *config.Config) {}, header: http.Header{"X-Request-Timeout": {"50ms"}}},
+		{name: "no reserve", config: func(cfg *config.Config) {
+			cfg.RequestTimeout = 50 * time.Millisecond
+			cfg.UserRepo.DeadlineReserve = 0
+		}},
+	}
+	paths := []string{"/users", "/users/a1"}
+	for _, tt := range tests {
+		for _, path := range paths {
+			t.Run(tt.name+" "+path, func(t *testing.T) {
+				srv := testsupport.NewServer(t, testsupport.WithConfig(tt.config))
+				seed(srv)
+				srv.Users.Hang(true)
+				start := time.Now()
+				var got struct{ Status string }
+				srv.Do("GET", path, nil, tt.header).AssertStatus(504).DecodeJSON(&got)
+				if got.Status != "Timed out." {
+					t.Fatalf("status = %q, want the timeout error", got.Status)
+				}
+				if took := time.Since(start); took > time.Second {
+					t.Fatalf("answered after %v", took)
+				}
+				if n := srv.Users.InFlight(); n != 0 {
+					t.Fatalf("%d store calls still running after the 504", n)
+				}
+			})
+		}
+	}
+}
+
+// TestStatementTimeoutLeavesTheRequestTime checks that with a reserve the
+// store gives up first, so the handler answers before the request deadline
+func TestStatementTimeoutLeavesTheRequestTime(t *testing.T) {
+	srv := testsupport.NewServer(t, testsupport.WithConfig(func(cfg *config.Config) {
+		cfg.RequestTimeout = 200 * time.Millisecond
+		cfg.UserRepo.DeadlineReserve = 150 * time.Millisecond
+	}))
+	seed(srv)
+	srv.Users.Hang(true)
+	start := time.Now()
+	srv.Get("/users/a1").AssertStatus(504)
+	if took := time.Since(start); took >= 200*time.Millisecond {
+		t.Fatalf("answered after %v, at the request deadline rather than before it", took)
+	}
+}
+
+func TestBackendRecovers(t *testing.T) {
+	srv := testsupport.NewServer(t, testsupport.WithConfig(func(cfg *config.Config) {
+		cfg.UserRepo.StatementTimeout = 20 * time.Millisecond
+	}))
+	seed(srv)
+	srv.Users.Hang(true)
+	srv.Get("/users/a1").AssertStatus(504)
+	srv.Users.Hang(false)
+	srv.Get("/users/a1").AssertStatus(200)
+}
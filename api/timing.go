@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-chi-microservice/ctxkeys"
+)
+
+// timing notes when a request came in, for responses to report the time
+// taken with elapsedFrom, and sends it in a Server-Timing header as the
+// time to the response's header, app;dur= in milliseconds
+func timing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tw := &timingWriter{ResponseWriter: w, start: start}
+		next.ServeHTTP(tw, r.WithContext(ctxkeys.With(r.Context(), ctxkeys.Start, start)))
+	})
+}
+
+// elapsedFrom is the time since the request in ctx came in, zero outside
+// timing
+func elapsedFrom(ctx context.Context) time.Duration {
+	start, ok := ctxkeys.Value[time.Time](ctx, ctxkeys.Start)
+	if !ok {
+		return 0
+	}
+	return time.Since(start)
+}
+
+// timingWriter adds Server-Timing as the header is written
+type timingWriter struct {
+	http.ResponseWriter
+	start   time.Time
+	written bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.written && status >= 200 {
+		tw.written = true
+		dur := float64(time.Since(tw.start).Microseconds()) / 1000
+		tw.Header().Add("Server-Timing", "app;dur="+strconv.FormatFloat(dur, 'f', -1, 64))
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(p []byte) (int, error) {
+	if !tw.written {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *timingWriter) Flush() {
+	if !tw.written {
+		tw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *timingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(tw.ResponseWriter).Hijack()
+}
+
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/auth"
+	"go-chi-microservice/users"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+// TOTPResource serves /users/{userID}/totp, where users set up an
+// authenticator app as a second factor for password logins. It's all behind
+// AUTH_TOTP_ENABLED, remove this file, totp.go in auth and the check in
+// checkLogin to drop it from a service.
+type TOTPResource struct {
+	svc    *users.Service
+	issuer string // shown in the authenticator app
+}
+
+func NewTOTPResource(svc *users.Service, issuer string) *TOTPResource {
+	return &TOTPResource{svc: svc, issuer: issuer}
+}
+
+// Routes expect UserCtx to have loaded the user
+func (rs *TOTPResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ownerOnly, noGuests)
+	r.Get("/", rs.Status)
+	r.Post("/enroll", rs.Enroll)
+	r.Post("/confirm", rs.Confirm)
+	r.Post("/recovery-codes", rs.RegenerateRecoveryCodes)
+	r.Delete("/", rs.Disable)
+	return r
+}
+
+type TOTPStatusResponse struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+func (ts *TOTPStatusResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI to show as a QR code
+}
+
+func (te *TOTPEnrollResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (rc *RecoveryCodesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	return nil
+}
+
+// CodeRequest carries a code from the authenticator app, or for managing an
+// existing enrollment a recovery code
+type CodeRequest struct {
+	Code string `json:"code"`
+}
+
+func (c *CodeRequest) Bind(r *http.Request) error {
+	if c.Code == "" {
+		return errors.New("missing code")
+	}
+	return nil
+}
+
+func (rs *TOTPResource) Status(w http.ResponseWriter, r *http.Request) {
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	render.Render(w, r, &TOTPStatusResponse{Enabled: user.TOTP.Secret != "", RecoveryCodesLeft: len(user.TOTP.RecoveryCodes)})
+}
+
+// Enroll hands out a new secret. Two factor logins don't start until the
+// app's first code is sent to Confirm.
+func (rs *TOTPResource) Enroll(w http.ResponseWriter, r *http.Request) {
+	stored, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	u := *stored
+	if u.TOTP.Secret != "" {
+		render.Render(w, r, ErrConflict(errors.New("an authenticator is already enrolled, disable it first")))
+		return
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	u.TOTP.Pending = secret
+	if !rs.update(w, r, &u) {
+		return
+	}
+	render.Render(w, r, &TOTPEnrollResponse{Secret: secret, URI: auth.TOTPURI(rs.issuer, u.Email, secret)})
+}
+
+// Confirm turns on two factor logins once the code shows the app has the
+// pending secret, returning the recovery codes. They're only ever shown
+// here.
+func (rs *TOTPResource) Confirm(w http.ResponseWriter, r *http.Request) {
+	data := &CodeRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	stored, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	u := *stored
+	if u.TOTP.Pending == "" {
+		render.Render(w, r, ErrConflict(errors.New("no enrollment in progress, start at enroll")))
+		return
+	}
+	step, ok := auth.CheckTOTP(u.TOTP.Pending, data.Code, time.Now(), 0)
+	if !ok {
+		render.Render(w, r, ErrInvalidRequest(errors.New("wrong code")))
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	u.TOTP = users.TOTP{Secret: u.TOTP.Pending, LastStep: step, RecoveryCodes: hashes}
+	if !rs.update(w, r, &u) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "totp_enabled").Str("user_id", u.Id).Msg("two factor login enabled")
+	render.Render(w, r, &RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, the old ones stop
+// working
+func (rs *TOTPResource) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	u, ok := rs.checkCode(w, r)
+	if !ok {
+		return
+	}
+	codes, hashes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	u.TOTP.RecoveryCodes = hashes
+	if !rs.update(w, r, u) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "totp_recovery_codes").Str("user_id", u.Id).Msg("recovery codes regenerated")
+	render.Render(w, r, &RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// Disable turns two factor logins off
+func (rs *TOTPResource) Disable(w http.ResponseWriter, r *http.Request) {
+	u, ok := rs.checkCode(w, r)
+	if !ok {
+		return
+	}
+	u.TOTP = users.TOTP{}
+	if !rs.update(w, r, u) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "totp_disabled").Str("user_id", u.Id).Msg("two factor login disabled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCode makes changes to an enrollment need a current code, so a stolen
+// access token alone can't turn the second factor off. It returns a copy of
+// the user with the code used up.
+func (rs *TOTPResource) checkCode(w http.ResponseWriter, r *http.Request) (*users.User, bool) {
+	data := &CodeRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return nil, false
+	}
+	user, ok := contextUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if user.TOTP.Secret == "" {
+		render.Render(w, r, ErrConflict(errors.New("no authenticator enrolled")))
+		return nil, false
+	}
+	u, ok := useSecondFactor(user, data.Code, time.Now())
+	if !ok {
+		render.Render(w, r, ErrInvalidRequest(errors.New("wrong code")))
+		return nil, false
+	}
+	return u, true
+}
+
+func (rs *TOTPResource) update(w http.ResponseWriter, r *http.Request, u *users.User) bool {
+	err := rs.svc.Update(r.Context(), u)
+	if clientGone(r, err) {
+		return false
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return false
+	}
+	return true
+}
+
+// useSecondFactor checks code as an authenticator code, or failing that a
+// recovery code, returning a copy of user with the code used up. The
+// caller stores the copy so the code can't be used again.
+func useSecondFactor(user *users.User, code string, now time.Time) (*users.User, bool) {
+	u := *user
+	if step, ok := auth.CheckTOTP(u.TOTP.Secret, code, now, u.TOTP.LastStep); ok {
+		u.TOTP.LastStep = step
+		return &u, true
+	}
+	rest, ok := auth.UseRecoveryCode(u.TOTP.RecoveryCodes, code)
+	if !ok {
+		return nil, false
+	}
+	u.TOTP.RecoveryCodes = rest
+	return &u, true
+}
@@ -0,0 +1,356 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/expand"
+	"go-chi-microservice/publicid"
+	"go-chi-microservice/query"
+	"go-chi-microservice/search"
+	"go-chi-microservice/users"
+)
+
+// UsersResource serves the /users endpoints
+type UsersResource struct {
+	svc            *users.Service
+	stale          *staleCache
+	pages          *paginator
+	complexity     *complexity
+	subresources   []subresource
+	expanders      *expand.Registry[*UserResponse]
+	expandMaxDepth int
+	html           *htmlPages
+	csv            config.CSVConfig
+	batchMax       int
+	requireIfMatch bool
+	search         search.Search  // nil leaves out /users/search
+	ids            publicid.Codec // nil shows stored ids
+	revoker        sessionRevoker // ends the sessions of deleted users
+}
+
+func NewUsersResource(svc *users.Service, expandMaxDepth int, stale *staleCache, pages *paginator, complexity *complexity, html *htmlPages, csv config.CSVConfig, batchMax int, requireIfMatch bool) *UsersResource {
+	rs := &UsersResource{
+		svc:            svc,
+		stale:          stale,
+		pages:          pages,
+		complexity:     complexity,
+		html:           html,
+		csv:            csv,
+		batchMax:       batchMax,
+		requireIfMatch: requireIfMatch,
+		expanders:      expand.NewRegistry[*UserResponse](),
+		expandMaxDepth: expandMaxDepth,
+	}
+	rs.expanders.Register("manager", rs.expandManager)
+	return rs
+}
+
+// subresource is a router mounted beneath a user
+type subresource struct {
+	path   string
+	routes http.Handler
+}
+
+// MountUser adds routes under /users/{userID}/path, with the user loaded
+// by UserCtx. Call it before Routes.
+func (rs *UsersResource) MountUser(path string, routes http.Handler) {
+	rs.subresources = append(rs.subresources, subresource{path: path, routes: routes})
+}
+
+func (rs *UsersResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(rs.loaderCtx, rs.publicIDs, refuseIncludeDeleted)
+	r.With(limitGuests, rs.csvFormat, rs.pages.Handler("/users"), rs.stale.Handler).Get("/", rs.ListUsers)
+	r.With(limitGuests).Get("/export", rs.ExportUsers)
+	if rs.search != nil {
+		r.With(limitGuests, rs.pages.Handler("/users/search")).Get("/search", rs.SearchUsers)
+	}
+	r.With(noGuests).Post("/batch-get", rs.BatchGet)
+	r.With(noGuests).Post("/batch", rs.Batch)
+	if rs.csv.ImportEnabled {
+		r.With(noGuests).Post("/import", rs.ImportCSV)
+	}
+
+	// Subrouters:
+	r.Route("/{userID}", func(r chi.Router) {
+		// decoded first, limitGuests compares the internal id with the token's
+		r.Use(rs.decodeUserID, limitGuests)
+		r.With(rs.stale.Handler, rs.UserCtx).Get("/", rs.GetUser)
+		r.Group(func(r chi.Router) {
+			// writes are conditional on the user's ETag
+			r.Use(noGuests, rs.UserCtx, rs.ifMatch)
+			r.Patch("/", rs.PatchUser)
+			r.Delete("/", rs.DeleteUser)
+		})
+		for _, sub := range rs.subresources {
+			r.With(rs.UserCtx).Mount(sub.path, sub.routes)
+		}
+	})
+	return r
+}
+
+type UserResponse struct {
+	*users.User
+	Manager *UserResponse `json:"manager,omitempty"`
+
+	encoded bool            // User's ids are public ones, see publicIDs
+	version int             // the payload version to encode in, see payloadVersion
+	ctx     context.Context // the request's, for the payload steps
+}
+
+func (rd *UserResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	rd.version, rd.ctx = payloadVersionFrom(r.Context()), r.Context()
+	if !rd.encoded {
+		// a copy, the stored user may be cached or rendered again
+		u := *rd.User
+		u.Id, u.ManagerId = encodeID(r.Context(), u.Id), encodeID(r.Context(), u.ManagerId)
+		rd.User, rd.encoded = &u, true
+	}
+	if rd.Manager != nil {
+		return rd.Manager.Render(w, r)
+	}
+	return nil
+}
+
+// Links are the user's own and its manager's and avatar's, for the
+// envelope
+func (rd *UserResponse) Links(r *http.Request) map[string]string {
+	links := map[string]string{"self": "/users/" + rd.Id}
+	if rd.ManagerId != "" {
+		links["manager"] = "/users/" + rd.ManagerId
+	}
+	if rd.AvatarURL != "" {
+		links["avatar"] = rd.AvatarURL
+	}
+	return links
+}
+
+// MarshalJSON encodes the user in the payload version Render was called
+// for, the current one when it wasn't
+func (rd *UserResponse) MarshalJSON() ([]byte, error) {
+	type plain UserResponse // without this method
+	version, ctx := rd.version, rd.ctx
+	if version == 0 {
+		version, ctx = usersPayloads.Current(), context.Background()
+	}
+	return usersPayloads.Marshal(ctx, "user", (*plain)(rd), version)
+}
+
+func (rs *UsersResource) ListUsers(w http.ResponseWriter, r *http.Request) {
+	tree, err := expand.Parse(r.URL.Query().Get("expand"), rs.expandMaxDepth)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	q, err := query.Parse(r.URL.Query().Get("filter"), r.URL.Query().Get("sort"), users.Fields)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	tree, ok := rs.complexity.admit(w, r, readCost{expand: tree, query: q})
+	if !ok {
+		return
+	}
+	var list []*users.User
+	if q.IsZero() {
+		list, err = rs.svc.List(r.Context())
+	} else {
+		list, err = rs.svc.Find(r.Context(), q)
+	}
+	if clientGone(r, err) {
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	// the repository can't page yet, so the limit only bounds the response
+	start, end := pageFrom(r.Context()).Apply(len(list))
+	setTotal(r, len(list))
+	resps := NewUserListResponse(list[start:end])
+	if err := rs.expanders.Expand(r.Context(), resps, tree); err != nil {
+		if clientGone(r, err) {
+			return
+		}
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if notModified(w, r, usersETag(r, len(list), resps), lastModified(resps)) {
+		return
+	}
+	if rs.html.wanted(w, r) {
+		for _, resp := range resps {
+			resp.Render(w, r)
+		}
+		rs.html.render(w, r, "users/list", "Users", struct{ Users []*UserResponse }{resps})
+		return
+	}
+	if err := render.RenderList(w, r, renderers(resps)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func (rs *UsersResource) GetUser(w http.ResponseWriter, r *http.Request) {
+	tree, err := expand.Parse(r.URL.Query().Get("expand"), rs.expandMaxDepth)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	tree, ok := rs.complexity.admit(w, r, readCost{expand: tree})
+	if !ok {
+		return
+	}
+	user, ok := contextUser(w, r)
+	if !ok {
+		return
+	}
+	if notModified(w, r, userETag(user), user.UpdatedAt) {
+		return
+	}
+	resp := NewUserResponse(user)
+	if err := rs.expanders.Expand(r.Context(), []*UserResponse{resp}, tree); err != nil {
+		if clientGone(r, err) {
+			return
+		}
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if rs.html.wanted(w, r) {
+		resp.Render(w, r)
+		rs.html.render(w, r, "users/show", user.Email, resp)
+		return
+	}
+	if err := render.Render(w, r, resp); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+// Me serves the caller's own user, as GET /users/{userID} with their id
+// would. It's behind the users-me flag while it's rolled out.
+func (rs *UsersResource) Me(w http.ResponseWriter, r *http.Request) {
+	c := ClaimsFrom(r.Context())
+	if c == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		render.Render(w, r, ErrUnauthorized(errors.New("sign in to see your own user")))
+		return
+	}
+	user, err := rs.svc.Get(r.Context(), c.Subject)
+	if clientGone(r, err) {
+		return
+	}
+	if errors.Is(err, users.ErrNotFound) {
+		render.Render(w, r, ErrNotFound())
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	ctx := ctxkeys.With(r.Context(), ctxkeys.User, user)
+	rs.loaderCtx(http.HandlerFunc(rs.GetUser)).ServeHTTP(w, r.WithContext(ctx))
+}
+
+// UserCtx convenience middleware for user specific endpoints
+func (rs *UsersResource) UserCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		user, err := rs.svc.Get(r.Context(), userID)
+		if clientGone(r, err) {
+			return
+		}
+		if errors.Is(err, users.ErrNotFound) {
+			render.Render(w, r, ErrNotFound())
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrStorage(err))
+			return
+		}
+		ctx := ctxkeys.With(r.Context(), ctxkeys.User, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// errNoUser is a handler mounted without UserCtx in front of it
+var errNoUser = errors.New("no user in the request context")
+
+// userFrom is the user UserCtx loaded, ok is false when there's none
+func userFrom(ctx context.Context) (*users.User, bool) {
+	user, ok := ctxkeys.Value[*users.User](ctx, ctxkeys.User)
+	return user, ok && user != nil
+}
+
+// contextUser is the user UserCtx loaded, answering a 500 when there's none
+func contextUser(w http.ResponseWriter, r *http.Request) (*users.User, bool) {
+	user, ok := userFrom(r.Context())
+	if !ok {
+		render.Render(w, r, ErrStorage(errNoUser))
+	}
+	return user, ok
+}
+
+// loaderCtx gives each request its own batching user loader
+func (rs *UsersResource) loaderCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(rs.svc.WithLoader(r.Context())))
+	})
+}
+
+// expandManager embeds each user's manager, batch loading all managers for
+// the page in one call and then expanding the next level on those
+func (rs *UsersResource) expandManager(ctx context.Context, items []*UserResponse, next expand.Tree) error {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ManagerId)
+	}
+	managers, err := rs.svc.GetMany(ctx, ids)
+	if err != nil {
+		return err
+	}
+	expanded := make([]*UserResponse, 0, len(managers))
+	byId := make(map[string]*UserResponse, len(managers))
+	for _, item := range items {
+		m, ok := managers[item.ManagerId]
+		if !ok {
+			continue
+		}
+		resp, ok := byId[m.Id]
+		if !ok {
+			resp = NewUserResponse(m)
+			byId[m.Id] = resp
+			expanded = append(expanded, resp)
+		}
+		item.Manager = resp
+	}
+	return rs.expanders.Expand(ctx, expanded, next)
+}
+
+func NewUserListResponse(list []*users.User) []*UserResponse {
+	resps := make([]*UserResponse, 0, len(list))
+	for _, user := range list {
+		resps = append(resps, NewUserResponse(user))
+	}
+	return resps
+}
+
+func NewUserResponse(user *users.User) *UserResponse {
+	return &UserResponse{User: user}
+}
+
+func renderers(resps []*UserResponse) []render.Renderer {
+	list := make([]render.Renderer, 0, len(resps))
+	for _, resp := range resps {
+		list = append(list, resp)
+	}
+	return list
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/egress"
+	"go-chi-microservice/webhooks"
+)
+
+// WebhooksResource serves /admin/webhooks, where operators subscribe other
+// services to user events and see how deliveries went
+type WebhooksResource struct {
+	deliverer *webhooks.Deliverer
+}
+
+func NewWebhooksResource(deliverer *webhooks.Deliverer) *WebhooksResource {
+	return &WebhooksResource{deliverer: deliverer}
+}
+
+func (rs *WebhooksResource) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", rs.List)
+	r.Post("/", rs.Create)
+	r.Route("/{subscriptionID}", func(r chi.Router) {
+		r.Get("/", rs.Get)
+		r.Delete("/", rs.Delete)
+		r.Get("/deliveries", rs.Deliveries)
+		r.Post("/test", rs.Test)
+	})
+	return r
+}
+
+type SubscriptionRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (s *SubscriptionRequest) Bind(r *http.Request) error {
+	if _, err := egress.ParseURL(s.URL); err != nil {
+		return err
+	}
+	if len(s.Events) == 0 {
+		return fmt.Errorf("missing events, one or more of %v", webhooks.Events)
+	}
+	for _, e := range s.Events {
+		if !slices.Contains(webhooks.Events, e) {
+			return fmt.Errorf("unknown event %q, not one of %v", e, webhooks.Events)
+		}
+	}
+	return nil
+}
+
+type SubscriptionResponse struct {
+	*webhooks.Subscription
+	// Secret is only returned when the subscription is created
+	Secret string `json:"secret,omitempty"`
+}
+
+func (s *SubscriptionResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if s.Secret != "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	return nil
+}
+
+type DeliveryResponse struct {
+	webhooks.Delivery
+}
+
+func (d *DeliveryResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rs *WebhooksResource) List(w http.ResponseWriter, r *http.Request) {
+	subs, err := rs.deliverer.Store().ListSubscriptions(r.Context())
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	list := []render.Renderer{}
+	for _, s := range subs {
+		list = append(list, &SubscriptionResponse{Subscription: s})
+	}
+	render.RenderList(w, r, list)
+}
+
+// Create subscribes the url in the body. The response carries the secret
+// deliveries are signed with, it can't be read back later.
+func (rs *WebhooksResource) Create(w http.ResponseWriter, r *http.Request) {
+	data := &SubscriptionRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	s, err := rs.deliverer.Subscribe(r.Context(), data.URL, data.Events)
+	if errors.Is(err, egress.ErrBlocked) || errors.Is(err, egress.ErrInvalidURL) {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		render.Render(w, r, ErrStorage(err))
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "webhook_subscribed").Str("subscription_id", s.ID).Str("url", s.URL).Msg("webhook subscription added")
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &SubscriptionResponse{Subscription: s, Secret: s.Secret})
+}
+
+func (rs *WebhooksResource) Get(w http.ResponseWriter, r *http.Request) {
+	s, err := rs.deliverer.Store().GetSubscription(r.Context(), chi.URLParam(r, "subscriptionID"))
+	if !rs.found(w, r, err) {
+		return
+	}
+	render.Render(w, r, &SubscriptionResponse{Subscription: s})
+}
+
+func (rs *WebhooksResource) Delete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "subscriptionID")
+	if !rs.found(w, r, rs.deliverer.Store().DeleteSubscription(r.Context(), id)) {
+		return
+	}
+	zerolog.Ctx(r.Context()).Info().Str("audit", "webhook_unsubscribed").Str("subscription_id", id).Msg("webhook subscription removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Deliveries lists the subscription's recent deliveries, newest first
+func (rs *WebhooksResource) Deliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := rs.deliverer.Store().ListDeliveries(r.Context(), chi.URLParam(r, "subscriptionID"))
+	if !rs.found(w, r, err) {
+		return
+	}
+	list := []render.Renderer{}
+	for _, d := range deliveries {
+		list = append(list, &DeliveryResponse{d})
+	}
+	render.RenderList(w, r, list)
+}
+
+// Test sends the subscription a ping and returns the delivery. A failed
+// ping is still a 200, the delivery's status and error say what happened.
+func (rs *WebhooksResource) Test(w http.ResponseWriter, r *http.Request) {
+	d, err := rs.deliverer.Test(r.Context(), chi.URLParam(r, "subscriptionID"))
+	if !rs.found(w, r, err) {
+		return
+	}
+	render.Render(w, r, &DeliveryResponse{d})
+}
+
+// found renders err unless it's nil, 404 for an unknown subscription
+func (rs *WebhooksResource) found(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, webhooks.ErrNotFound):
+		render.Render(w, r, ErrNotFound())
+		return false
+	case err != nil:
+		render.Render(w, r, ErrStorage(err))
+		return false
+	}
+	return true
+}
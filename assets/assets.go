@@ -0,0 +1,167 @@
+// Package assets serves a static frontend, by default the files under
+// assets/dist embedded in the binary. Replace dist with a frontend's build
+// output and it ships inside the service.
+package assets
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed dist
+var embedded embed.FS
+
+// Embedded returns the files in assets/dist
+func Embedded() fs.FS {
+	sub, err := fs.Sub(embedded, "dist")
+	if err != nil {
+		panic(err) // dist is always embedded
+	}
+	return sub
+}
+
+// fingerprinted matches names carrying a content hash, e.g. app.3f9a1c2b.js
+// or index-Bx3kL9aF.js, which change whenever their content does
+var fingerprinted = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})\.[A-Za-z0-9]+$`)
+
+type Options struct {
+	// SPA serves index.html for paths matching no file that have no
+	// extension, so client side routes survive a reload
+	SPA bool
+	// MaxAge is how long browsers may cache files without a content hash
+	// in their name before revalidating, zero revalidates every time.
+	// Fingerprinted files are cached for a year, index.html never.
+	MaxAge time.Duration
+}
+
+// Handler serves files from an fs.FS with an ETag from their content, so
+// revalidating an unchanged file costs a 304. Directories aren't listed and
+// dot files aren't served.
+type Handler struct {
+	fsys fs.FS
+	opts Options
+
+	mu    sync.Mutex
+	etags map[string]string // by name, size and mod time
+}
+
+func NewHandler(fsys fs.FS, opts Options) *Handler {
+	return &Handler{fsys: fsys, opts: opts, etags: map[string]string{}}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	f, info, err := h.open(name)
+	if errors.Is(err, fs.ErrNotExist) && h.opts.SPA && path.Ext(name) == "" {
+		name = "index.html"
+		f, info, err = h.open(name)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "file is not seekable", http.StatusInternalServerError)
+		return
+	}
+	etag, err := h.etag(name, info, rs)
+	if err != nil {
+		http.Error(w, "reading file failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", h.cacheControl(name))
+	// ServeContent answers If-None-Match from the ETag, and ranges
+	http.ServeContent(w, r, info.Name(), info.ModTime(), rs)
+}
+
+// open opens name, or the index.html in it when it's a directory
+func (h *Handler) open(name string) (fs.File, fs.FileInfo, error) {
+	if name == "" {
+		name = "index.html"
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		if name == "index.html" {
+			return nil, nil, fs.ErrNotExist
+		}
+		return h.open(path.Join(name, "index.html"))
+	}
+	return f, info, nil
+}
+
+// etag hashes the file's content the first time it's served, and again
+// only when its size or mod time changes, e.g. serving a directory in
+// development
+func (h *Handler) etag(name string, info fs.FileInfo, rs io.ReadSeeker) (string, error) {
+	key := name + "\x00" + strconv.FormatInt(info.Size(), 10) + "\x00" + info.ModTime().String()
+	h.mu.Lock()
+	etag, ok := h.etags[key]
+	h.mu.Unlock()
+	if ok {
+		return etag, nil
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, rs); err != nil {
+		return "", err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag = `"` + hex.EncodeToString(sum.Sum(nil)[:12]) + `"`
+	h.mu.Lock()
+	h.etags[key] = etag
+	h.mu.Unlock()
+	return etag, nil
+}
+
+func (h *Handler) cacheControl(name string) string {
+	switch {
+	case path.Base(name) == "index.html":
+		return "no-cache"
+	case isFingerprinted(name):
+		return "public, max-age=31536000, immutable"
+	case h.opts.MaxAge > 0:
+		return "public, max-age=" + strconv.Itoa(int(h.opts.MaxAge.Seconds()))
+	}
+	return "no-cache"
+}
+
+// isFingerprinted wants a digit in the hash, so a long word such as
+// settings in app-settings.js isn't taken for one
+func isFingerprinted(name string) bool {
+	m := fingerprinted.FindStringSubmatch(path.Base(name))
+	return m != nil && strings.ContainsAny(m[1], "0123456789")
+}
@@ -0,0 +1,208 @@
+// Package audit records who changed what: one entry for every mutating
+// request, with the caller, the request id and address, and the fields each
+// write changed, before and after. Entries go to one or more sinks, a store
+// that /admin/audit lists them from and an append only log file.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go-chi-microservice/ctxkeys"
+)
+
+type Entry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor,omitempty"` // the caller's user id, or the admin user, empty when anonymous
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route,omitempty"` // the matched pattern, e.g. /users/{userID}
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Changes   []Change  `json:"changes,omitempty"`
+}
+
+// NewEntry starts an entry with a fresh id at the current time
+func NewEntry() (Entry, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return Entry{}, err
+	}
+	return Entry{ID: hex.EncodeToString(b), Time: time.Now()}, nil
+}
+
+// Change is what a request did to one resource
+type Change struct {
+	Resource string        `json:"resource"`
+	ID       string        `json:"id"`
+	Fields   []FieldChange `json:"fields"`
+}
+
+// FieldChange is a field's JSON value before and after a write, Before is
+// empty for a new field and After for a removed one
+type FieldChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Logger is a sink entries are written to
+type Logger interface {
+	Log(ctx context.Context, e Entry) error
+}
+
+// Store is a Logger entries can be read back from
+type Store interface {
+	Logger
+	// List returns the entries f matches, newest first
+	List(ctx context.Context, f Filter) ([]Entry, error)
+}
+
+// Filter picks entries, empty fields match any. Since and Until are
+// inclusive.
+type Filter struct {
+	Actor     string
+	Method    string
+	Resource  string
+	ID        string // of a changed resource
+	RequestID string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f Filter) Matches(e Entry) bool {
+	if (f.Actor != "" && e.Actor != f.Actor) ||
+		(f.Method != "" && e.Method != f.Method) ||
+		(f.RequestID != "" && e.RequestID != f.RequestID) ||
+		(!f.Since.IsZero() && e.Time.Before(f.Since)) ||
+		(!f.Until.IsZero() && e.Time.After(f.Until)) {
+		return false
+	}
+	if f.Resource == "" && f.ID == "" {
+		return true
+	}
+	for _, c := range e.Changes {
+		if (f.Resource == "" || c.Resource == f.Resource) && (f.ID == "" || c.ID == f.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Multi writes entries to every logger, trying them all before returning
+// their errors joined
+type Multi []Logger
+
+func (m Multi) Log(ctx context.Context, e Entry) error {
+	var errs []error
+	for _, l := range m {
+		if err := l.Log(ctx, e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Record collects the details of a request that are only known deeper in
+// it, the caller and the changes, for the middleware writing its entry
+type Record struct {
+	mu      sync.Mutex
+	actor   string
+	changes []Change
+}
+
+// WithRecord returns a context carrying a fresh Record
+func WithRecord(ctx context.Context) (context.Context, *Record) {
+	rec := &Record{}
+	return ctxkeys.With(ctx, ctxkeys.AuditRecord, rec), rec
+}
+
+// SetActor names the caller of the request in ctx, a no-op outside an
+// audited request
+func SetActor(ctx context.Context, actor string) {
+	if rec, ok := ctxkeys.Value[*Record](ctx, ctxkeys.AuditRecord); ok {
+		rec.mu.Lock()
+		rec.actor = actor
+		rec.mu.Unlock()
+	}
+}
+
+// RecordChange notes the fields that differ between before and after, both
+// marshalled to JSON objects, with nil for a created or removed resource.
+// It's a no-op outside an audited request or when nothing changed.
+func RecordChange(ctx context.Context, resource, id string, before, after any) error {
+	rec, ok := ctxkeys.Value[*Record](ctx, ctxkeys.AuditRecord)
+	if !ok {
+		return nil
+	}
+	fields, err := Diff(before, after)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.changes = append(rec.changes, Change{Resource: resource, ID: id, Fields: fields})
+	return nil
+}
+
+// Actor is the caller set with SetActor
+func (rec *Record) Actor() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.actor
+}
+
+// Changes are those noted with RecordChange, in order
+func (rec *Record) Changes() []Change {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]Change(nil), rec.changes...)
+}
+
+// Diff compares the top level fields of before and after as JSON, sorted by
+// name. A nil pointer marshals to null and counts as no fields.
+func Diff(before, after any) ([]FieldChange, error) {
+	b, err := fieldsOf(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := fieldsOf(after)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(a)+len(b))
+	for name := range b {
+		names = append(names, name)
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var fields []FieldChange
+	for _, name := range names {
+		if !bytes.Equal(b[name], a[name]) {
+			fields = append(fields, FieldChange{Field: name, Before: b[name], After: a[name]})
+		}
+	}
+	return fields, nil
+}
+
+func fieldsOf(v any) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	return fields, json.Unmarshal(raw, &fields)
+}
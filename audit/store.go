@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MemoryStore keeps the latest entries of a single instance, older ones
+// are dropped
+type MemoryStore struct {
+	keep int
+
+	mu      sync.RWMutex
+	entries []Entry
+}
+
+func NewMemoryStore(keep int) *MemoryStore {
+	if keep <= 0 {
+		keep = 10000
+	}
+	return &MemoryStore{keep: keep}
+}
+
+func (m *MemoryStore) Log(ctx context.Context, e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	if over := len(m.entries) - m.keep; over > 0 {
+		m.entries = append(m.entries[:0:0], m.entries[over:]...)
+	}
+	return nil
+}
+
+func (m *MemoryStore) List(ctx context.Context, f Filter) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := []Entry{}
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if f.Matches(m.entries[i]) {
+			list = append(list, m.entries[i])
+		}
+	}
+	return list, nil
+}
+
+// RedisStore shares entries between instances in a redis list, newest
+// first and trimmed to the latest keep
+type RedisStore struct {
+	client *redis.Client
+	keep   int64
+}
+
+// NewRedisStore connects to url, e.g. redis://localhost:6379/0
+func NewRedisStore(url string, keep int) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	if keep <= 0 {
+		keep = 10000
+	}
+	return &RedisStore{client: redis.NewClient(opts), keep: int64(keep)}, nil
+}
+
+const redisKey = "audit"
+
+func (r *RedisStore) Log(ctx context.Context, e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.LPush(ctx, redisKey, b)
+		p.LTrim(ctx, redisKey, 0, r.keep-1)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisStore) List(ctx context.Context, f Filter) ([]Entry, error) {
+	raw, err := r.client.LRange(ctx, redisKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []Entry{}
+	for _, s := range raw {
+		var e Entry
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			return nil, fmt.Errorf("audit entry: %w", err)
+		}
+		if f.Matches(e) {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+// Ping checks the connection, for startup
+func (r *RedisStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
+
+// FileLogger appends entries to w as JSON lines, for shipping to a log
+// pipeline or keeping as an append only trail
+type FileLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewFileLogger(w io.Writer) *FileLogger {
+	return &FileLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *FileLogger) Log(ctx context.Context, e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(e)
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// what an action token can be used for
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+)
+
+// ActionToken is a single use token emailed to a user to prove they can
+// read mail sent to Email. Email is kept so a token stops working if the
+// address changes before it's used.
+type ActionToken struct {
+	UserID  string    `json:"user_id"`
+	Purpose string    `json:"purpose"`
+	Email   string    `json:"email"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewActionToken makes a token for purpose lasting ttl, returning the
+// secret to email and the record to store under it
+func NewActionToken(userID, purpose, email string, ttl time.Duration) (string, ActionToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", ActionToken{}, err
+	}
+	return token, ActionToken{UserID: userID, Purpose: purpose, Email: email, Expires: time.Now().Add(ttl)}, nil
+}
+
+// ActionTokenStore keeps action tokens hashed. Consume returns and deletes
+// a token, failing with ErrInvalidToken for unknown, expired or used tokens
+// and ones for another purpose.
+type ActionTokenStore interface {
+	Save(ctx context.Context, token string, t ActionToken) error
+	Consume(ctx context.Context, token, purpose string) (ActionToken, error)
+}
+
+// MemoryActionTokenStore is an ActionTokenStore for a single instance,
+// emailed links stop working on restart
+type MemoryActionTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]ActionToken // by hashed token
+}
+
+func NewMemoryActionTokenStore() *MemoryActionTokenStore {
+	return &MemoryActionTokenStore{tokens: map[string]ActionToken{}}
+}
+
+func (m *MemoryActionTokenStore) Save(ctx context.Context, token string, t ActionToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for h, old := range m.tokens {
+		if now.After(old.Expires) {
+			delete(m.tokens, h)
+		}
+	}
+	m.tokens[hashToken(token)] = t
+	return nil
+}
+
+func (m *MemoryActionTokenStore) Consume(ctx context.Context, token, purpose string) (ActionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := hashToken(token)
+	t, ok := m.tokens[h]
+	if !ok || t.Purpose != purpose {
+		return ActionToken{}, ErrInvalidToken
+	}
+	delete(m.tokens, h)
+	if time.Now().After(t.Expires) {
+		return ActionToken{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// RedisActionTokenStore shares action tokens between instances, expiry is
+// left to redis key TTLs
+type RedisActionTokenStore struct {
+	client *redis.Client
+}
+
+// NewRedisActionTokenStore connects to url, e.g. redis://localhost:6379/0
+func NewRedisActionTokenStore(url string) (*RedisActionTokenStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	return &RedisActionTokenStore{client: redis.NewClient(opts)}, nil
+}
+
+func (r *RedisActionTokenStore) key(token string) string {
+	return "action_token:" + hashToken(token)
+}
+
+func (r *RedisActionTokenStore) Save(ctx context.Context, token string, t ActionToken) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.key(token), b, time.Until(t.Expires)).Err()
+}
+
+// Consume uses GETDEL so two instances can't both redeem a token
+func (r *RedisActionTokenStore) Consume(ctx context.Context, token, purpose string) (ActionToken, error) {
+	b, err := r.client.GetDel(ctx, r.key(token)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ActionToken{}, ErrInvalidToken
+	}
+	if err != nil {
+		return ActionToken{}, err
+	}
+	var t ActionToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return ActionToken{}, err
+	}
+	if t.Purpose != purpose {
+		return ActionToken{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+// Ping checks the connection, for startup
+func (r *RedisActionTokenStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *RedisActionTokenStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+// Verifier checks an access token and returns its claims
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*Claims, error)
+}
+
+// Verifiers tries each verifier in turn, so tokens from this service and
+// from an external provider are both accepted
+type Verifiers []Verifier
+
+func (vs Verifiers) Verify(ctx context.Context, token string) (*Claims, error) {
+	err := ErrInvalidToken
+	for _, v := range vs {
+		var claims *Claims
+		if claims, err = v.Verify(ctx, token); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
+
+type JWKSOptions struct {
+	URL      string
+	Issuer   string
+	Audience string // checked against aud when set
+	// Refresh is how often keys are refetched in the background. An unknown
+	// kid also triggers a fetch, at most once per MinRefresh.
+	Refresh    time.Duration
+	MinRefresh time.Duration
+	ClockSkew  time.Duration // leeway for exp, nbf and iat
+	Client     *http.Client
+}
+
+// JWKS verifies tokens signed by an external identity provider against the
+// keys it publishes, following its key rotation
+type JWKS struct {
+	opts   JWKSOptions
+	logger *zerolog.Logger
+
+	mu          sync.RWMutex
+	keys        map[string]jose.JSONWebKey // by kid
+	lastFetch   time.Time
+	lastAttempt time.Time
+}
+
+func NewJWKS(opts JWKSOptions, logger *zerolog.Logger) *JWKS {
+	if opts.Refresh <= 0 {
+		opts.Refresh = time.Hour
+	}
+	if opts.MinRefresh <= 0 {
+		opts.MinRefresh = 30 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &JWKS{opts: opts, logger: logger, keys: map[string]jose.JSONWebKey{}}
+}
+
+// Fetch loads the keys, done once at startup before Run takes over
+func (j *JWKS) Fetch(ctx context.Context) error {
+	return j.fetch(ctx)
+}
+
+// Run refetches the keys every Refresh until ctx is done. A failed refresh
+// keeps the old keys.
+func (j *JWKS) Run(ctx context.Context) {
+	t := time.NewTicker(j.opts.Refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := j.fetch(ctx); err != nil {
+				j.logger.Warn().Err(err).Str("url", j.opts.URL).Msg("jwks refresh failed, keeping old keys")
+			}
+		}
+	}
+}
+
+func (j *JWKS) fetch(ctx context.Context) error {
+	j.mu.Lock()
+	j.lastAttempt = time.Now()
+	j.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.opts.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching jwks: %s", resp.Status)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding jwks: %w", err)
+	}
+	keys := make(map[string]jose.JSONWebKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use == "" || k.Use == "sig" {
+			keys[k.KeyID] = k
+		}
+	}
+	j.mu.Lock()
+	j.keys, j.lastFetch = keys, time.Now()
+	j.mu.Unlock()
+	return nil
+}
+
+// key finds the key for kid, refetching when it's unknown since the
+// provider has likely rotated
+func (j *JWKS) key(ctx context.Context, kid string) (any, error) {
+	j.mu.RLock()
+	k, ok := j.keys[kid]
+	due := time.Since(j.lastAttempt) >= j.opts.MinRefresh
+	j.mu.RUnlock()
+	if !ok && due {
+		if err := j.fetch(ctx); err != nil {
+			j.logger.Warn().Err(err).Str("url", j.opts.URL).Msg("jwks fetch for unknown kid failed")
+		}
+		j.mu.RLock()
+		k, ok = j.keys[kid]
+		j.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k.Key, nil
+}
+
+func (j *JWKS) Verify(ctx context.Context, token string) (*Claims, error) {
+	opts := []jwt.ParserOption{
+		// asymmetric algorithms only, an HMAC token "signed" with a public
+		// key must not pass
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(j.opts.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(j.opts.ClockSkew),
+		jwt.WithIssuedAt(),
+	}
+	if j.opts.Audience != "" {
+		opts = append(opts, jwt.WithAudience(j.opts.Audience))
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no kid")
+		}
+		return j.key(ctx, kid)
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LimiterStore counts events under a key over a sliding window, e.g.
+// failed logins for an account in the last hour. Backed by redis the counts
+// are shared by every instance.
+type LimiterStore interface {
+	// Add records an event under key now and returns how many there have
+	// been in the window ending now, this one included
+	Add(ctx context.Context, key string, window time.Duration) (int, error)
+	// Count returns how many events there have been in the window ending
+	// now, and when the oldest of them leaves it
+	Count(ctx context.Context, key string, window time.Duration) (int, time.Time, error)
+	// Reset forgets key's events
+	Reset(ctx context.Context, key string) error
+}
+
+// MemoryLimiterStore is a LimiterStore for a single instance, it keeps
+// every event's time until it leaves the window
+type MemoryLimiterStore struct {
+	mu        sync.Mutex
+	events    map[string][]time.Time // oldest first
+	windows   map[string]time.Duration
+	lastSweep time.Time
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{events: map[string][]time.Time{}, windows: map[string]time.Duration{}}
+}
+
+func (m *MemoryLimiterStore) Add(ctx context.Context, key string, window time.Duration) (int, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+	events := append(m.prune(key, window, now), now)
+	m.events[key], m.windows[key] = events, window
+	return len(events), nil
+}
+
+func (m *MemoryLimiterStore) Count(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := m.prune(key, window, now)
+	if len(events) == 0 {
+		return 0, time.Time{}, nil
+	}
+	return len(events), events[0].Add(window), nil
+}
+
+func (m *MemoryLimiterStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.events, key)
+	delete(m.windows, key)
+	return nil
+}
+
+// prune drops key's events that have left the window
+func (m *MemoryLimiterStore) prune(key string, window time.Duration, now time.Time) []time.Time {
+	events := m.events[key]
+	i := 0
+	for i < len(events) && !events[i].After(now.Add(-window)) {
+		i++
+	}
+	if i == len(events) {
+		delete(m.events, key)
+		delete(m.windows, key)
+		return nil
+	}
+	events = events[i:]
+	m.events[key] = events
+	return events
+}
+
+// sweep drops keys with nothing left in their window, at most once a minute
+func (m *MemoryLimiterStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, window := range m.windows {
+		m.prune(key, window, now)
+	}
+}
+
+// RedisLimiterStore shares counts between instances. Each key is a sorted
+// set of events scored by time, trimmed to the window as it's used and
+// expiring once the window has passed.
+type RedisLimiterStore struct {
+	client *redis.Client
+}
+
+// NewRedisLimiterStore connects to url, e.g. redis://localhost:6379/0
+func NewRedisLimiterStore(url string) (*RedisLimiterStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	return &RedisLimiterStore{client: redis.NewClient(opts)}, nil
+}
+
+func (r *RedisLimiterStore) key(key string) string {
+	return "limiter:" + key
+}
+
+func (r *RedisLimiterStore) Add(ctx context.Context, key string, window time.Duration) (int, error) {
+	now := time.Now()
+	// members must be unique, two instances can add in the same nanosecond
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	member := strconv.FormatInt(now.UnixNano(), 10) + "-" + hex.EncodeToString(b)
+	var card *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRemRangeByScore(ctx, r.key(key), "-inf", strconv.FormatInt(now.Add(-window).UnixNano(), 10))
+		p.ZAdd(ctx, r.key(key), redis.Z{Score: float64(now.UnixNano()), Member: member})
+		card = p.ZCard(ctx, r.key(key))
+		p.PExpire(ctx, r.key(key), window)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(card.Val()), nil
+}
+
+func (r *RedisLimiterStore) Count(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	now := time.Now()
+	var card *redis.IntCmd
+	var oldest *redis.ZSliceCmd
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRemRangeByScore(ctx, r.key(key), "-inf", strconv.FormatInt(now.Add(-window).UnixNano(), 10))
+		card = p.ZCard(ctx, r.key(key))
+		oldest = p.ZRangeWithScores(ctx, r.key(key), 0, 0)
+		return nil
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if card.Val() == 0 || len(oldest.Val()) == 0 {
+		return 0, time.Time{}, nil
+	}
+	return int(card.Val()), time.Unix(0, int64(oldest.Val()[0].Score)).Add(window), nil
+}
+
+func (r *RedisLimiterStore) Reset(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.key(key)).Err()
+}
+
+// Ping checks the connection, for startup
+func (r *RedisLimiterStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *RedisLimiterStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var ErrEmailNotVerified = errors.New("identity provider has not verified the email")
+
+type OIDCOptions struct {
+	IssuerURL    string // discovery runs against IssuerURL/.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // must point at /auth/oidc/callback
+	Scopes       []string
+}
+
+// OIDC signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE
+type OIDC struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Identity is who the provider says signed in
+type Identity struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// NewOIDC discovers the provider's endpoints and keys, so it needs the
+// provider reachable
+func NewOIDC(ctx context.Context, opts OIDCOptions) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, opts.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	scopes := append([]string{oidc.ScopeOpenID}, opts.Scopes...)
+	return &OIDC{
+		oauth: oauth2.Config{
+			ClientID:     opts.ClientID,
+			ClientSecret: opts.ClientSecret,
+			RedirectURL:  opts.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: opts.ClientID}),
+	}, nil
+}
+
+// LoginState is what has to survive the round trip to the provider
+type LoginState struct {
+	State    string
+	Nonce    string
+	Verifier string // PKCE code verifier
+}
+
+// Begin starts a login, returning the provider URL to send the browser to
+// and the state to check the callback against
+func (o *OIDC) Begin() (string, *LoginState, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	ls := &LoginState{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier()}
+	url := o.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(ls.Verifier))
+	return url, ls, nil
+}
+
+// Finish exchanges the callback's code and verifies the ID token against
+// the state from Begin. Only identities with a verified email are returned,
+// the email is what links them to a user.
+func (o *OIDC) Finish(ctx context.Context, ls *LoginState, state, code string) (*Identity, error) {
+	if state == "" || state != ls.State {
+		return nil, fmt.Errorf("%w: state mismatch", ErrInvalidToken)
+	}
+	tok, err := o.oauth.Exchange(ctx, code, oauth2.VerifierOption(ls.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("oidc code exchange: %w", err)
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no id_token in token response", ErrInvalidToken)
+	}
+	idToken, err := o.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if idToken.Nonce != ls.Nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	id := &Identity{}
+	if err := idToken.Claims(id); err != nil {
+		return nil, err
+	}
+	if id.Email == "" || !id.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	return id, nil
+}
@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ErrCeremony is an unknown, expired or already finished passkey ceremony
+var ErrCeremony = errors.New("unknown or expired passkey ceremony")
+
+type PasskeyOptions struct {
+	RPID    string   // the site's domain, e.g. example.com, passkeys are bound to it
+	RPName  string   // shown by the authenticator
+	Origins []string // where the frontend runs, e.g. https://app.example.com
+	Timeout time.Duration
+}
+
+// PasskeyUser is who a ceremony is for, with the passkeys they already have
+type PasskeyUser struct {
+	ID          string
+	Name        string // the email, shown by the authenticator
+	Credentials []webauthn.Credential
+}
+
+func (u *PasskeyUser) WebAuthnID() []byte                         { return []byte(u.ID) }
+func (u *PasskeyUser) WebAuthnName() string                       { return u.Name }
+func (u *PasskeyUser) WebAuthnDisplayName() string                { return u.Name }
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential { return u.Credentials }
+func (u *PasskeyUser) WebAuthnIcon() string                       { return "" }
+
+// Passkeys runs WebAuthn registration and login ceremonies. Each begins
+// with a challenge kept here under a ceremony id for the client to send back
+// with the authenticator's response, so both halves must reach the same
+// instance.
+type Passkeys struct {
+	wa      *webauthn.WebAuthn
+	timeout time.Duration
+
+	mu         sync.Mutex
+	ceremonies map[string]ceremony // by hashed ceremony id
+}
+
+type ceremony struct {
+	session webauthn.SessionData
+	expires time.Time
+}
+
+func NewPasskeys(opts PasskeyOptions) (*Passkeys, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Minute
+	}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          opts.RPID,
+		RPDisplayName: opts.RPName,
+		RPOrigins:     opts.Origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Timeout: opts.Timeout, TimeoutUVD: opts.Timeout},
+			Registration: webauthn.TimeoutConfig{Timeout: opts.Timeout, TimeoutUVD: opts.Timeout},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Passkeys{wa: wa, timeout: opts.Timeout, ceremonies: map[string]ceremony{}}, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create.
+// Passkeys are discoverable credentials, so logins don't need an email
+// first, and the user's existing ones are excluded.
+func (p *Passkeys) BeginRegistration(u *PasskeyUser) (string, *protocol.CredentialCreation, error) {
+	exclude := make([]protocol.CredentialDescriptor, len(u.Credentials))
+	for i, c := range u.Credentials {
+		exclude[i] = c.Descriptor()
+	}
+	creation, session, err := p.wa.BeginRegistration(u,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclude))
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := p.save(session)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, creation, nil
+}
+
+// FinishRegistration checks the authenticator's response to the ceremony
+// and returns the new credential to store
+func (p *Passkeys) FinishRegistration(u *PasskeyUser, ceremonyID string, response []byte) (*webauthn.Credential, error) {
+	session, err := p.take(ceremonyID)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, err
+	}
+	return p.wa.CreateCredential(u, session, parsed)
+}
+
+// BeginLogin returns the options for navigator.credentials.get
+func (p *Passkeys) BeginLogin() (string, *protocol.CredentialAssertion, error) {
+	assertion, session, err := p.wa.BeginDiscoverableLogin()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := p.save(session)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, assertion, nil
+}
+
+// FinishLogin checks the authenticator's response to the ceremony. lookup
+// finds the user by the id their passkey carries. It returns the credential
+// used, its sign count updated for storing.
+func (p *Passkeys) FinishLogin(ceremonyID string, response []byte, lookup func(userID string) (*PasskeyUser, error)) (*webauthn.Credential, error) {
+	session, err := p.take(ceremonyID)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, err
+	}
+	cred, err := p.wa.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		return lookup(string(userHandle))
+	}, session, parsed)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Authenticator.CloneWarning {
+		return nil, errors.New("passkey sign count went backwards, it may have been cloned")
+	}
+	return cred, nil
+}
+
+// IsPasskeyRejected reports whether err is the client's fault, a response
+// that doesn't check out rather than something going wrong here
+func IsPasskeyRejected(err error) bool {
+	var pe *protocol.Error
+	return errors.Is(err, ErrCeremony) || errors.As(err, &pe)
+}
+
+func (p *Passkeys) save(session *webauthn.SessionData) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for h, c := range p.ceremonies {
+		if now.After(c.expires) {
+			delete(p.ceremonies, h)
+		}
+	}
+	p.ceremonies[hashToken(id)] = ceremony{session: *session, expires: now.Add(p.timeout)}
+	return id, nil
+}
+
+// take returns and forgets a ceremony, each challenge is answered once
+func (p *Passkeys) take(id string) (webauthn.SessionData, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := hashToken(id)
+	c, ok := p.ceremonies[h]
+	delete(p.ceremonies, h)
+	if !ok || time.Now().After(c.expires) {
+		return webauthn.SessionData{}, ErrCeremony
+	}
+	return c.session, nil
+}
+
+// EncodeCredential and DecodeCredential convert a credential to and from
+// the bytes kept with the user
+func EncodeCredential(c *webauthn.Credential) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func DecodeCredential(b []byte) (webauthn.Credential, error) {
+	var c webauthn.Credential
+	err := json.Unmarshal(b, &c)
+	return c, err
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrBadCredentials is returned for an unknown user or a wrong password
+// alike, so a login can't be used to probe for accounts
+var ErrBadCredentials = errors.New("invalid email or password")
+
+// ErrPasswordResetRequired means the password was right but an operator
+// has asked for a new one, chosen with a reset link
+var ErrPasswordResetRequired = errors.New("password reset required, ask for a reset link")
+
+// HashPassword hashes password with bcrypt for storing in User.PasswordHash
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// CheckPassword compares password against a hash from HashPassword
+func CheckPassword(hash, password string) error {
+	if hash == "" {
+		return ErrBadCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+// dummyHash is compared against when the user doesn't exist, so a login
+// for an unknown email takes as long as a wrong password
+var dummyHash, _ = HashPassword("not a real password")
+
+// CheckMissing burns the same time as CheckPassword and fails
+func CheckMissing(password string) error {
+	bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+	return ErrBadCredentials
+}
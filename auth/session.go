@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrNoSession = errors.New("no such session")
+
+// Session is a browser login kept server side, the cookie only carries ID.
+// CSRF is the token state changing requests must echo back.
+type Session struct {
+	ID      string    `json:"-"` // only stored hashed
+	UserID  string    `json:"user_id"`
+	Tenant  string    `json:"tenant,omitempty"`
+	CSRF    string    `json:"csrf"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewSession starts a session for userID lasting ttl
+func NewSession(userID string, ttl time.Duration) (*Session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ID: id, UserID: userID, CSRF: csrf, Expires: time.Now().Add(ttl)}, nil
+}
+
+// SessionStore keeps cookie sessions. Get fails with ErrNoSession for
+// unknown and expired ids.
+type SessionStore interface {
+	Save(ctx context.Context, s *Session) error
+	Get(ctx context.Context, id string) (*Session, error)
+	Delete(ctx context.Context, id string) error
+	// RevokeUser ends every session of userID, e.g. when they're suspended
+	RevokeUser(ctx context.Context, userID string) error
+}
+
+// MemorySessionStore is a SessionStore for a single instance
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session // by hashed id
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]*Session{}}
+}
+
+func (m *MemorySessionStore) Save(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, old := range m.sessions {
+		if now.After(old.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+	m.sessions[hashToken(s.ID)] = s
+	return nil
+}
+
+func (m *MemorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[hashToken(id)]
+	if !ok || time.Now().After(s.Expires) {
+		return nil, ErrNoSession
+	}
+	return s, nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, hashToken(id))
+	return nil
+}
+
+func (m *MemorySessionStore) RevokeUser(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// RedisSessionStore shares sessions between instances, expiry is left to
+// redis key TTLs. Each user has a set of their session keys so
+// RevokeUser can find them, it lasts as long as their latest session.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+// NewRedisSessionStore connects to url, e.g. redis://localhost:6379/0
+func NewRedisSessionStore(url string) (*RedisSessionStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	return &RedisSessionStore{client: redis.NewClient(opts)}, nil
+}
+
+func (r *RedisSessionStore) key(id string) string {
+	return "session:" + hashToken(id)
+}
+
+func (r *RedisSessionStore) userKey(userID string) string {
+	return "user_sessions:" + userID
+}
+
+func (r *RedisSessionStore) Save(ctx context.Context, s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(s.Expires)
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, r.key(s.ID), b, ttl)
+		p.SAdd(ctx, r.userKey(s.UserID), r.key(s.ID))
+		p.PExpire(ctx, r.userKey(s.UserID), ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	b, err := r.client.Get(ctx, r.key(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{ID: id}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *RedisSessionStore) Delete(ctx context.Context, id string) error {
+	return r.client.Del(ctx, r.key(id)).Err()
+}
+
+// RevokeUser deletes the sessions in the user's set, keys of sessions
+// already gone are deleted again harmlessly
+func (r *RedisSessionStore) RevokeUser(ctx context.Context, userID string) error {
+	keys, err := r.client.SMembers(ctx, r.userKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	return r.client.Del(ctx, append(keys, r.userKey(userID))...).Err()
+}
+
+// Ping checks the connection, for startup
+func (r *RedisSessionStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *RedisSessionStore) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RefreshRecord is a stored refresh token. Family ties together every token
+// rotated from one login.
+type RefreshRecord struct {
+	Hash    string
+	Family  string
+	UserID  string
+	Guest   bool
+	Tenant  string
+	Expires time.Time
+	Used    bool
+}
+
+// RefreshStore keeps refresh tokens server side so they can be rotated and
+// revoked
+type RefreshStore interface {
+	Save(ctx context.Context, rec RefreshRecord) error
+	// Consume marks the token used and returns it. A token that was already
+	// used revokes its family and fails with ErrTokenReused, an unknown,
+	// revoked or expired one with ErrInvalidToken.
+	Consume(ctx context.Context, hash string, now time.Time) (RefreshRecord, error)
+	// RevokeFamily revokes every token in the family of the token with hash
+	RevokeFamily(ctx context.Context, hash string) error
+	// RevokeUser revokes every token of userID
+	RevokeUser(ctx context.Context, userID string) error
+}
+
+// MemoryRefreshStore is a RefreshStore for a single instance, sessions
+// don't survive a restart
+type MemoryRefreshStore struct {
+	mu      sync.Mutex
+	records map[string]RefreshRecord
+}
+
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{records: map[string]RefreshRecord{}}
+}
+
+func (s *MemoryRefreshStore) Save(ctx context.Context, rec RefreshRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// expired tokens are dropped as new ones come in, used ones are kept
+	// until then to catch reuse
+	now := time.Now()
+	for h, r := range s.records {
+		if now.After(r.Expires) {
+			delete(s.records, h)
+		}
+	}
+	s.records[rec.Hash] = rec
+	return nil
+}
+
+func (s *MemoryRefreshStore) Consume(ctx context.Context, hash string, now time.Time) (RefreshRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[hash]
+	if !ok || now.After(rec.Expires) {
+		return RefreshRecord{}, ErrInvalidToken
+	}
+	if rec.Used {
+		s.revokeFamily(rec.Family)
+		return RefreshRecord{}, ErrTokenReused
+	}
+	rec.Used = true
+	s.records[hash] = rec
+	return rec, nil
+}
+
+func (s *MemoryRefreshStore) RevokeFamily(ctx context.Context, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[hash]; ok {
+		s.revokeFamily(rec.Family)
+	}
+	return nil
+}
+
+func (s *MemoryRefreshStore) RevokeUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, r := range s.records {
+		if r.UserID == userID {
+			delete(s.records, h)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshStore) revokeFamily(family string) {
+	for h, r := range s.records {
+		if r.Family == family {
+			delete(s.records, h)
+		}
+	}
+}
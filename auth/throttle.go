@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLocked means the account had too many failed logins and is locked
+	// for a while
+	ErrLocked = errors.New("account temporarily locked")
+	// ErrThrottled means logins for the account or from the address are
+	// being slowed down after failures
+	ErrThrottled = errors.New("too many failed logins")
+)
+
+// RetryError is ErrLocked or ErrThrottled along with when to try again
+type RetryError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", e.Err, e.After.Round(time.Second))
+}
+
+func (e *RetryError) Unwrap() error { return e.Err }
+
+type ThrottleOptions struct {
+	LockoutThreshold int           // failures in a row that lock an account
+	LockoutDuration  time.Duration // how long a lock lasts, also how long failures are remembered
+	Backoff          time.Duration // delay after a failure, doubled for each one after
+	MaxBackoff       time.Duration
+	IPFreeFailures   int // failures an address gets before it is slowed down, offices share addresses
+
+	// Windows counts failures per account and per address over Window, in a
+	// store shared between instances so an attack spread over them is seen
+	// whole. Past AccountLimit or IPLimit failures logins are refused until
+	// the oldest leaves the window. Nil, or a zero limit, leaves that out.
+	Windows      LimiterStore
+	Window       time.Duration
+	AccountLimit int
+	IPLimit      int
+
+	// Delay holds up the response to a failed login, doubled for each
+	// failure before it and capped at MaxDelay, so guessing is slow even
+	// for clients ignoring Retry-After
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// scopes of a sliding window limit
+const (
+	ScopeAccount = "account"
+	ScopeIP      = "ip"
+)
+
+// FailResult is what a failed login led to
+type FailResult struct {
+	Locked bool // the account was just locked
+	// Crossed are the scopes whose window limit this failure reached, so
+	// each crossing is reported once
+	Crossed []string
+	// Delay is how long to hold up the response
+	Delay time.Duration
+}
+
+// Throttle counts failed logins per account and per client address. Each
+// failure makes the next attempt wait longer and enough of them lock the
+// account. Locks and backoff are in memory, so they're per instance, the
+// sliding windows are in the Windows store.
+type Throttle struct {
+	opts ThrottleOptions
+	now  func() time.Time
+
+	mu        sync.Mutex
+	accounts  map[string]*failures
+	addrs     map[string]*failures
+	lastSweep time.Time
+}
+
+type failures struct {
+	count  int
+	last   time.Time
+	locked time.Time // zero unless locked
+}
+
+func NewThrottle(opts ThrottleOptions) *Throttle {
+	return &Throttle{
+		opts:     opts,
+		now:      time.Now,
+		accounts: map[string]*failures{},
+		addrs:    map[string]*failures{},
+	}
+}
+
+func (t *Throttle) LockoutDuration() time.Duration { return t.opts.LockoutDuration }
+
+// Check returns a *RetryError when a login for account from addr shouldn't
+// be attempted yet, other errors are the Windows store failing
+func (t *Throttle) Check(ctx context.Context, account, addr string) error {
+	if err := t.checkLocal(account, addr); err != nil {
+		return err
+	}
+	for _, w := range t.windows(account, addr) {
+		n, clears, err := t.opts.Windows.Count(ctx, w.key, t.opts.Window)
+		if err != nil {
+			return err
+		}
+		if n >= w.limit {
+			return &RetryError{Err: ErrThrottled, After: max(clears.Sub(t.now()), time.Second)}
+		}
+	}
+	return nil
+}
+
+func (t *Throttle) checkLocal(account, addr string) error {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f := t.accounts[accountKey(account)]; f != nil {
+		if !f.locked.IsZero() {
+			if until := f.locked.Add(t.opts.LockoutDuration); now.Before(until) {
+				return &RetryError{Err: ErrLocked, After: until.Sub(now)}
+			}
+		} else if wait := t.wait(f, 0, now); wait > 0 {
+			return &RetryError{Err: ErrThrottled, After: wait}
+		}
+	}
+	if f := t.addrs[addr]; f != nil {
+		if wait := t.wait(f, t.opts.IPFreeFailures, now); wait > 0 {
+			return &RetryError{Err: ErrThrottled, After: wait}
+		}
+	}
+	return nil
+}
+
+// Fail records a failed login. The result is still good when the Windows
+// store fails, the error is for logging.
+func (t *Throttle) Fail(ctx context.Context, account, addr string) (FailResult, error) {
+	var res FailResult
+	accountFails, addrFails := t.failLocal(account, addr, &res)
+	var err error
+	for _, w := range t.windows(account, addr) {
+		n, werr := t.opts.Windows.Add(ctx, w.key, t.opts.Window)
+		if werr != nil {
+			err = werr
+			continue
+		}
+		if n == w.limit {
+			res.Crossed = append(res.Crossed, w.scope)
+		}
+		if w.scope == ScopeAccount {
+			accountFails = max(accountFails, n)
+		} else {
+			addrFails = max(addrFails, n)
+		}
+	}
+	res.Delay = t.delay(max(accountFails, addrFails-t.opts.IPFreeFailures))
+	return res, err
+}
+
+// failLocal records the failure in memory and returns the account's and
+// the address's failures
+func (t *Throttle) failLocal(account, addr string, res *FailResult) (int, int) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+
+	f := t.record(t.accounts, accountKey(account), now)
+	a := t.record(t.addrs, addr, now)
+	if f.locked.IsZero() && f.count >= t.opts.LockoutThreshold {
+		f.locked = now
+		res.Locked = true
+	}
+	return f.count, a.count
+}
+
+// Succeed clears the account's failures. The address keeps its count, one
+// good password doesn't vouch for everything else coming from it.
+func (t *Throttle) Succeed(ctx context.Context, account string) error {
+	t.mu.Lock()
+	delete(t.accounts, accountKey(account))
+	t.mu.Unlock()
+	if t.opts.Windows == nil || t.opts.AccountLimit <= 0 {
+		return nil
+	}
+	return t.opts.Windows.Reset(ctx, windowKey(ScopeAccount, accountKey(account)))
+}
+
+// delay is the response delay after the nth failure
+func (t *Throttle) delay(n int) time.Duration {
+	if n <= 0 || t.opts.Delay <= 0 {
+		return 0
+	}
+	d := t.opts.Delay
+	for i := 1; i < n && d < t.opts.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, t.opts.MaxDelay)
+}
+
+type window struct {
+	scope string
+	key   string
+	limit int
+}
+
+// windows are the sliding window limits that apply to a login
+func (t *Throttle) windows(account, addr string) []window {
+	if t.opts.Windows == nil {
+		return nil
+	}
+	var list []window
+	if t.opts.AccountLimit > 0 {
+		list = append(list, window{ScopeAccount, windowKey(ScopeAccount, accountKey(account)), t.opts.AccountLimit})
+	}
+	if t.opts.IPLimit > 0 {
+		list = append(list, window{ScopeIP, windowKey(ScopeIP, addr), t.opts.IPLimit})
+	}
+	return list
+}
+
+func windowKey(scope, id string) string {
+	return "login_failures:" + scope + ":" + id
+}
+
+func (t *Throttle) record(m map[string]*failures, key string, now time.Time) *failures {
+	f := m[key]
+	if f == nil || t.expired(f, now) {
+		f = &failures{}
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+	return f
+}
+
+// wait is how long after f's last failure the next attempt has to hold off,
+// the first free failures cost nothing
+func (t *Throttle) wait(f *failures, free int, now time.Time) time.Duration {
+	n := f.count - free
+	if n <= 0 || t.expired(f, now) {
+		return 0
+	}
+	d := t.opts.Backoff
+	for i := 1; i < n && d < t.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, t.opts.MaxBackoff)
+	return f.last.Add(d).Sub(now)
+}
+
+// expired failures are forgotten, a lock is over once its duration is
+func (t *Throttle) expired(f *failures, now time.Time) bool {
+	if !f.locked.IsZero() {
+		return !now.Before(f.locked.Add(t.opts.LockoutDuration))
+	}
+	return !now.Before(f.last.Add(t.opts.LockoutDuration))
+}
+
+// sweep drops forgotten entries, at most once a minute since a credential
+// stuffing run fills the maps quickly
+func (t *Throttle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for _, m := range []map[string]*failures{t.accounts, t.addrs} {
+		for k, f := range m {
+			if t.expired(f, now) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/tenant"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenReused means a refresh token was presented after it had been
+	// rotated, most likely it leaked. Its whole family is revoked.
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+type Options struct {
+	Secret     []byte // HMAC key for access tokens
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	ClockSkew  time.Duration // leeway when checking exp
+	// Active is asked whether a user may still sign in before their refresh
+	// token is redeemed, nil redeems any unexpired one
+	Active func(ctx context.Context, userID string) (bool, error)
+}
+
+// Pair is what login and refresh hand back, in the usual OAuth2 token
+// response shape
+type Pair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`              // seconds until AccessToken expires
+	RefreshToken string `json:"refresh_token,omitempty"` // none for an impersonation
+}
+
+// Claims are the access token claims, Subject is the user id
+type Claims struct {
+	jwt.RegisteredClaims
+	// Guest marks a guest session, see IssueGuest
+	Guest bool `json:"guest,omitempty"`
+	// Tenant the session was started in, see package tenant
+	Tenant string `json:"tenant,omitempty"`
+	// Act names who is acting as Subject when an operator impersonates a
+	// user, the actor claim of RFC 8693
+	Act *Actor `json:"act,omitempty"`
+}
+
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Issuer hands out short lived JWT access tokens and opaque refresh tokens.
+// Refresh tokens are single use: each refresh rotates to a new one in the
+// same family, and presenting a used one revokes the family.
+type Issuer struct {
+	opts  Options
+	store RefreshStore
+	now   func() time.Time
+}
+
+func NewIssuer(opts Options, store RefreshStore) *Issuer {
+	if opts.AccessTTL <= 0 {
+		opts.AccessTTL = 15 * time.Minute
+	}
+	if opts.RefreshTTL <= 0 {
+		opts.RefreshTTL = 30 * 24 * time.Hour
+	}
+	return &Issuer{opts: opts, store: store, now: time.Now}
+}
+
+// Issue starts a new session for userID
+func (i *Issuer) Issue(ctx context.Context, userID string) (*Pair, error) {
+	family, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return i.issue(ctx, userID, family, false)
+}
+
+// IssueGuest starts a session for a guest user. Its tokens carry the guest
+// claim, refreshes included, so handlers can hold guests to less.
+func (i *Issuer) IssueGuest(ctx context.Context, userID string) (*Pair, error) {
+	family, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return i.issue(ctx, userID, family, true)
+}
+
+// Impersonate hands actor an access token for userID lasting ttl, or the
+// access token lifetime when that's shorter. It carries the act claim
+// naming actor and comes without a refresh token, so an impersonation
+// can't outlive it.
+func (i *Issuer) Impersonate(ctx context.Context, userID, actor string, ttl time.Duration) (*Pair, error) {
+	if ttl <= 0 || ttl > i.opts.AccessTTL {
+		ttl = i.opts.AccessTTL
+	}
+	now := i.now()
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    i.opts.Issuer,
+		Subject:   userID,
+		ID:        jti,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}, Tenant: tenant.ID(ctx), Act: &Actor{Subject: actor}}).SignedString(i.opts.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("signing access token: %w", err)
+	}
+	return &Pair{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(ttl.Seconds())}, nil
+}
+
+// Refresh redeems refreshToken for a new pair. A user who can't sign in any
+// more, deleted, suspended or disabled since, gets ErrInvalidToken and loses
+// the rest of their refresh tokens.
+func (i *Issuer) Refresh(ctx context.Context, refreshToken string) (*Pair, error) {
+	rec, err := i.store.Consume(ctx, hashToken(refreshToken), i.now())
+	switch {
+	case errors.Is(err, ErrTokenReused):
+		metrics.Refresh(metrics.Reused)
+		return nil, err
+	case errors.Is(err, ErrInvalidToken):
+		metrics.Refresh(metrics.Failure)
+		return nil, err
+	case err != nil:
+		return nil, err
+	}
+	if rec.Tenant != tenant.ID(ctx) {
+		// a session doesn't carry over to another tenant
+		metrics.Refresh(metrics.Failure)
+		return nil, ErrInvalidToken
+	}
+	if i.opts.Active != nil {
+		active, err := i.opts.Active(ctx, rec.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			metrics.Refresh(metrics.Failure)
+			if err := i.store.RevokeUser(ctx, rec.UserID); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidToken
+		}
+	}
+	pair, err := i.issue(ctx, rec.UserID, rec.Family, rec.Guest)
+	if err == nil {
+		metrics.Refresh(metrics.Success)
+	}
+	return pair, err
+}
+
+// Revoke ends the session refreshToken belongs to. Unknown tokens are
+// ignored, logging out twice isn't an error.
+func (i *Issuer) Revoke(ctx context.Context, refreshToken string) error {
+	return i.store.RevokeFamily(ctx, hashToken(refreshToken))
+}
+
+// RevokeUser ends every session of userID, e.g. after a password reset
+func (i *Issuer) RevokeUser(ctx context.Context, userID string) error {
+	return i.store.RevokeUser(ctx, userID)
+}
+
+func (i *Issuer) issue(ctx context.Context, userID, family string, guest bool) (*Pair, error) {
+	now := i.now()
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    i.opts.Issuer,
+		Subject:   userID,
+		ID:        jti,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(i.opts.AccessTTL)),
+	}, Guest: guest, Tenant: tenant.ID(ctx)}).SignedString(i.opts.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("signing access token: %w", err)
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := i.store.Save(ctx, RefreshRecord{
+		Hash:    hashToken(refresh),
+		Family:  family,
+		UserID:  userID,
+		Guest:   guest,
+		Tenant:  tenant.ID(ctx),
+		Expires: now.Add(i.opts.RefreshTTL),
+	}); err != nil {
+		return nil, err
+	}
+	return &Pair{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(i.opts.AccessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// Verify checks an access token's signature, issuer and expiry
+func (i *Issuer) Verify(ctx context.Context, accessToken string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(accessToken, claims, func(t *jwt.Token) (any, error) {
+		return i.opts.Secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithIssuer(i.opts.Issuer),
+		jwt.WithExpirationRequired(), jwt.WithLeeway(i.opts.ClockSkew), jwt.WithTimeFunc(i.now))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// refresh tokens are only stored hashed, a leaked store can't be replayed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
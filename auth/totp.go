@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrOTPRequired means the password was right but the account has two
+// factor authentication on and no code came with it
+var ErrOTPRequired = errors.New("one time code required")
+
+// TOTP parameters, the defaults every authenticator app supports: SHA1,
+// 6 digits, 30 second steps
+const (
+	totpDigits = 6
+	totpPeriod = 30
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret makes a random 160 bit secret, base32 encoded as
+// authenticator apps expect
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// TOTPURI is the otpauth:// URI for secret, shown as a QR code for an
+// authenticator app to scan
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// CheckTOTP looks for code among the codes for the time steps around now,
+// allowing a step either way for clock drift. Steps up to lastStep were
+// already used and don't count, so a code works once. It returns the step
+// the code was for.
+func CheckTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode is the RFC 6238 code for step
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1_000_000)
+}
+
+// NewRecoveryCodes makes n single use codes for when the authenticator is
+// lost, returning them to show the user once and their hashes to store
+func NewRecoveryCodes(n int) (codes, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := hex.EncodeToString(b)
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// UseRecoveryCode returns hashes without code's, and whether it was there
+func UseRecoveryCode(hashes []string, code string) ([]string, bool) {
+	h := hashRecoveryCode(code)
+	for i, stored := range hashes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(h)) == 1 {
+			rest := append([]string{}, hashes[:i]...)
+			return append(rest, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+// recovery codes are random enough that a fast hash is fine, dashes and
+// case are ignored so they can be typed loosely
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
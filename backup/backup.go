@@ -0,0 +1,284 @@
+// Package backup takes encrypted backups of the user store to the blob
+// store and restores them. A backup is the source's dump, encrypted with
+// age to a recipient or to a key wrapped by KMS, stored next to a manifest
+// holding the dump's SHA-256. Restoring checks the hash before anything is
+// replaced, so a corrupt, truncated or swapped object never gets restored.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/storage"
+)
+
+var (
+	backupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backups_total",
+		Help: "Scheduled backups by result, ok or error.",
+	}, []string{"result"})
+	lastBackup = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_last_success_timestamp_seconds",
+		Help: "When the last backup was stored, as a unix timestamp.",
+	})
+)
+
+// ErrIntegrity is a backup whose contents don't match its manifest
+var ErrIntegrity = errors.New("backup failed its integrity check")
+
+// Source dumps the data store. The memory store writes its snapshot, a SQL
+// or Mongo backend would run its dump or export tool here.
+type Source interface {
+	Dump(ctx context.Context, w io.Writer) error
+}
+
+// Target takes a dump back
+type Target interface {
+	Restore(ctx context.Context, r io.Reader) error
+}
+
+// Manifest describes a backup, stored as JSON next to it
+type Manifest struct {
+	Key        string    `json:"key"` // the encrypted dump
+	Source     string    `json:"source"`
+	Created    time.Time `json:"created"`
+	Size       int64     `json:"size"`   // of the dump before encryption
+	SHA256     string    `json:"sha256"` // of the dump before encryption, hex
+	Encryption string    `json:"encryption"`
+	// WrappedKey is the dump's key encrypted by KMS, for kms encryption
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+type Options struct {
+	// Prefix is where backups are kept in the store, e.g. backups/users
+	Prefix string
+	// Name is the source's, recorded in manifests
+	Name       string
+	Store      storage.Storage
+	Encryption Encryption
+}
+
+type Backups struct {
+	opts   Options
+	logger *zerolog.Logger
+}
+
+func New(opts Options, logger *zerolog.Logger) *Backups {
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	return &Backups{opts: opts, logger: logger}
+}
+
+// latest is the manifest of the newest backup, a copy of its own
+func (b *Backups) latest() string {
+	return path.Join(b.opts.Prefix, "latest.json")
+}
+
+// Create dumps src, encrypts the dump as it's uploaded and stores its
+// manifest, as the backup's own and as the latest
+func (b *Backups) Create(ctx context.Context, src Source) (*Manifest, error) {
+	// a random suffix, so a backup's key can't be guessed from its time
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	m := &Manifest{
+		Key:        path.Join(b.opts.Prefix, now.Format("20060102T150405Z")+"-"+hex.EncodeToString(suffix)+".age"),
+		Source:     b.opts.Name,
+		Created:    now,
+		Encryption: b.opts.Encryption.Name(),
+	}
+	pr, pw := io.Pipe()
+	sealed := make(chan error, 1)
+	go func() {
+		enc, wrapped, err := b.opts.Encryption.Seal(ctx, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			sealed <- err
+			return
+		}
+		m.WrappedKey = wrapped
+		h := sha256.New()
+		counted := &counter{w: io.MultiWriter(enc, h)}
+		if err = src.Dump(ctx, counted); err == nil {
+			err = enc.Close()
+		}
+		m.Size, m.SHA256 = counted.n, hex.EncodeToString(h.Sum(nil))
+		pw.CloseWithError(err)
+		sealed <- err
+	}()
+	err := b.opts.Store.Put(ctx, m.Key, pr, -1, "application/octet-stream")
+	// the dump stops at a failed upload too, it writes to a closed pipe
+	pr.CloseWithError(errors.New("upload stopped"))
+	if dumpErr := <-sealed; dumpErr != nil {
+		err = dumpErr
+	}
+	if err != nil {
+		b.opts.Store.Delete(context.WithoutCancel(ctx), m.Key)
+		return nil, fmt.Errorf("storing backup: %w", err)
+	}
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{strings.TrimSuffix(m.Key, ".age") + ".json", b.latest()} {
+		if err := b.opts.Store.Put(ctx, key, bytes.NewReader(body), int64(len(body)), "application/json"); err != nil {
+			return nil, fmt.Errorf("storing manifest: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Verify downloads and decrypts a backup, the latest when key is empty,
+// and checks it against its manifest
+func (b *Backups) Verify(ctx context.Context, key string) (*Manifest, error) {
+	m, f, err := b.fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return m, nil
+}
+
+// Restore hands a backup, the latest when key is empty, to dst once it has
+// passed Verify's checks
+func (b *Backups) Restore(ctx context.Context, key string, dst Target) (*Manifest, error) {
+	m, f, err := b.fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := dst.Restore(ctx, f); err != nil {
+		return nil, fmt.Errorf("restoring %s: %w", m.Key, err)
+	}
+	return m, nil
+}
+
+// fetch decrypts a backup to a temporary file, checking it against its
+// manifest along the way. The file removes itself on Close.
+func (b *Backups) fetch(ctx context.Context, key string) (*Manifest, *tempFile, error) {
+	manifestKey := b.latest()
+	if key != "" {
+		manifestKey = strings.TrimSuffix(key, ".age") + ".json"
+	}
+	m, err := b.manifest(ctx, manifestKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := b.opts.Store.Get(ctx, m.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", m.Key, err)
+	}
+	defer obj.Close()
+	plain, err := b.opts.Encryption.Open(ctx, obj, m.WrappedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypting %s: %w", m.Key, err)
+	}
+	f, err := newTempFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), plain)
+	if err != nil {
+		f.Close()
+		// age authenticates every chunk, a tampered object fails here
+		return nil, nil, fmt.Errorf("decrypting %s: %w", m.Key, err)
+	}
+	if n != m.Size || hex.EncodeToString(h.Sum(nil)) != m.SHA256 {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", m.Key, ErrIntegrity)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return m, f, nil
+}
+
+func (b *Backups) manifest(ctx context.Context, key string) (*Manifest, error) {
+	r, err := b.opts.Store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+	defer r.Close()
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if m.Encryption != b.opts.Encryption.Name() {
+		return nil, fmt.Errorf("%s is encrypted with %s, not %s", m.Key, m.Encryption, b.opts.Encryption.Name())
+	}
+	return &m, nil
+}
+
+// Run takes a backup of src every interval until ctx is done. A failed
+// one is logged and counted, the next is tried on schedule.
+func (b *Backups) Run(ctx context.Context, src Source, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			m, err := b.Create(ctx, src)
+			if err != nil {
+				if ctx.Err() == nil {
+					backupsTotal.WithLabelValues("error").Inc()
+					b.logger.Error().Err(err).Msg("backing up")
+				}
+				continue
+			}
+			backupsTotal.WithLabelValues("ok").Inc()
+			lastBackup.Set(float64(m.Created.Unix()))
+			b.logger.Info().Str("key", m.Key).Int64("size", m.Size).Msg("backed up")
+		}
+	}
+}
+
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tempFile holds a decrypted dump while it's checked, readable only by its
+// owner since it's in the clear
+type tempFile struct {
+	*os.File
+}
+
+func newTempFile() (*tempFile, error) {
+	f, err := os.CreateTemp("", "restore-*")
+	if err != nil {
+		return nil, err
+	}
+	return &tempFile{f}, nil
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
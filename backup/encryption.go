@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// Encryption seals backups as they're uploaded and opens them to restore
+type Encryption interface {
+	Name() string
+	// Seal returns a writer encrypting to w, and the key to store in the
+	// manifest when the scheme has one
+	Seal(ctx context.Context, w io.Writer) (io.WriteCloser, []byte, error)
+	// Open decrypts r with the manifest's key
+	Open(ctx context.Context, r io.Reader, wrappedKey []byte) (io.Reader, error)
+}
+
+// Age encrypts to age recipients, so the server holding only the public
+// keys can't read its own backups. Restoring needs one of the identities.
+type Age struct {
+	Recipients []age.Recipient
+	Identities []age.Identity
+}
+
+func (a *Age) Name() string { return "age" }
+
+func (a *Age) Seal(ctx context.Context, w io.Writer) (io.WriteCloser, []byte, error) {
+	if len(a.Recipients) == 0 {
+		return nil, nil, errors.New("no age recipients to encrypt backups to")
+	}
+	enc, err := age.Encrypt(w, a.Recipients...)
+	return enc, nil, err
+}
+
+func (a *Age) Open(ctx context.Context, r io.Reader, wrappedKey []byte) (io.Reader, error) {
+	if len(a.Identities) == 0 {
+		return nil, errors.New("no age identity to decrypt backups with")
+	}
+	return age.Decrypt(r, a.Identities...)
+}
+
+// KMS encrypts each backup to a new age key of its own, and has KMS
+// encrypt that key for the manifest. Restoring needs decrypt permission on
+// the KMS key, not a key file.
+type KMS struct {
+	Client *kms.Client
+	KeyID  string
+}
+
+func (k *KMS) Name() string { return "kms" }
+
+func (k *KMS) Seal(ctx context.Context, w io.Writer) (io.WriteCloser, []byte, error) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := k.Client.Encrypt(ctx, &kms.EncryptInput{KeyId: aws.String(k.KeyID), Plaintext: []byte(id.String())})
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, err := age.Encrypt(w, id.Recipient())
+	return enc, out.CiphertextBlob, err
+}
+
+func (k *KMS) Open(ctx context.Context, r io.Reader, wrappedKey []byte) (io.Reader, error) {
+	if len(wrappedKey) == 0 {
+		return nil, errors.New("manifest has no wrapped key")
+	}
+	out, err := k.Client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: wrappedKey})
+	if err != nil {
+		return nil, err
+	}
+	id, err := age.ParseX25519Identity(string(out.Plaintext))
+	if err != nil {
+		return nil, err
+	}
+	return age.Decrypt(r, id)
+}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go-chi-microservice/users"
+)
+
+// Memory dumps the in-memory user store of a running server, and restores
+// into one
+type Memory struct {
+	Repo *users.MemoryRepository
+}
+
+func (m Memory) Dump(ctx context.Context, w io.Writer) error {
+	return m.Repo.WriteSnapshot(w)
+}
+
+// Restore replaces the store's users with the dump's
+func (m Memory) Restore(ctx context.Context, r io.Reader) error {
+	_, err := m.Repo.ReadSnapshot(r)
+	return err
+}
+
+// SnapshotFile is the memory store's snapshot file: dumping reads it and
+// restoring replaces it, for the server to load when it next starts
+type SnapshotFile struct {
+	Path string
+}
+
+func (s SnapshotFile) Dump(ctx context.Context, w io.Writer) error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore checks the snapshot loads before renaming it into place
+func (s SnapshotFile) Restore(ctx context.Context, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if _, err := users.NewMemoryRepository().LoadSnapshot(tmp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
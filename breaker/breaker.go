@@ -0,0 +1,127 @@
+// Package breaker is a small consecutive-failure circuit breaker. After
+// Threshold failures in a row it opens and fails calls fast for Cooldown,
+// then lets a single trial call through to decide whether to close again.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+type Options struct {
+	Threshold int
+	Cooldown  time.Duration
+	// OnStateChange is called, outside the lock, whenever the state moves
+	OnStateChange func(from, to State)
+}
+
+type Breaker struct {
+	opts Options
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func New(opts Options) *Breaker {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 5
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 30 * time.Second
+	}
+	return &Breaker{opts: opts}
+}
+
+// Allow reports whether a call may go ahead. Every allowed call must be
+// followed by Done with its outcome.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	var from State
+	changed := false
+	defer func() {
+		b.mu.Unlock()
+		if changed {
+			b.notify(from, HalfOpen)
+		}
+	}()
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < b.opts.Cooldown {
+			return ErrOpen
+		}
+		from, changed = b.state, true
+		b.state = HalfOpen
+		b.trial = true
+		return nil
+	case HalfOpen:
+		if b.trial {
+			// one trial at a time
+			return ErrOpen
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// Done records the outcome of an allowed call
+func (b *Breaker) Done(failed bool) {
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case !failed:
+		b.failures = 0
+		b.state = Closed
+	case b.state == HalfOpen:
+		b.state = Open
+		b.openedAt = time.Now()
+	default:
+		b.failures++
+		if b.failures >= b.opts.Threshold {
+			b.state = Open
+			b.openedAt = time.Now()
+		}
+	}
+	b.trial = false
+	to := b.state
+	b.mu.Unlock()
+	if from != to {
+		b.notify(from, to)
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *Breaker) notify(from, to State) {
+	if b.opts.OnStateChange != nil {
+		b.opts.OnStateChange(from, to)
+	}
+}
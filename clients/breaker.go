@@ -0,0 +1,54 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"go-chi-microservice/breaker"
+	"go-chi-microservice/egress"
+)
+
+var breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "client_breaker_state",
+	Help: "Downstream circuit breaker state by upstream, 0 closed, 1 open, 2 half open.",
+}, []string{"upstream"})
+
+// BreakerTransport fails requests fast with breaker.ErrOpen while the
+// upstream keeps failing, rather than piling more load on it. An error or
+// a 5xx answer counts as a failure.
+type BreakerTransport struct {
+	next     http.RoundTripper
+	upstream string
+	b        *breaker.Breaker
+}
+
+func NewBreakerTransport(next http.RoundTripper, upstream string, opts breaker.Options) *BreakerTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	opts.OnStateChange = func(from, to breaker.State) {
+		breakerState.WithLabelValues(upstream).Set(float64(to))
+	}
+	return &BreakerTransport{next: next, upstream: upstream, b: breaker.New(opts)}
+}
+
+func (t *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.b.Allow(); err != nil {
+		return nil, fmt.Errorf("%s: %w", t.upstream, err)
+	}
+	resp, err := t.next.RoundTrip(req)
+	// a caller giving up, or a request the egress policy refused, says
+	// nothing about the upstream's health
+	t.b.Done((err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, egress.ErrBlocked)) || (resp != nil && resp.StatusCode >= 500))
+	return resp, err
+}
+
+// State is the breaker's, for diagnostics
+func (t *BreakerTransport) State() breaker.State {
+	return t.b.State()
+}
@@ -0,0 +1,56 @@
+package clients
+
+import (
+	"net/http"
+	"time"
+
+	"go-chi-microservice/breaker"
+	"go-chi-microservice/egress"
+)
+
+// Options configure a client for one downstream service
+type Options struct {
+	// Upstream names the downstream service in logs, spans and metrics
+	Upstream string
+	// Timeout bounds a whole call, retries and backoff included
+	Timeout time.Duration
+	Retry   RetryOptions
+	Breaker breaker.Options
+	// Hedge sends a second copy of slow reads when set
+	Hedge *HedgeOptions
+	// Transport sends the requests, http.DefaultTransport when nil
+	Transport http.RoundTripper
+	// Egress keeps the requests to the hosts and addresses it allows, set
+	// it when URLs come from users; nil for no checks
+	Egress *egress.Policy
+}
+
+// New builds the http.Client for a downstream service. A call is traced
+// once, then tried as often as the retry options allow; each attempt is
+// logged and goes through the circuit breaker, so an open breaker ends the
+// retries, and then the hedging transport when there is one, and the
+// egress policy's. Each attempt tells the upstream how long it has left.
+func New(opts Options) *http.Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	rt := opts.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if opts.Egress != nil {
+		rt = opts.Egress.Transport(rt)
+	}
+	if opts.Hedge != nil {
+		hedge := *opts.Hedge
+		hedge.Upstream = opts.Upstream
+		rt = NewHedgingTransport(rt, hedge)
+	}
+	rt = NewBreakerTransport(rt, opts.Upstream, opts.Breaker)
+	rt = NewLoggingTransport(rt, opts.Upstream)
+	rt = NewDeadlineTransport(rt)
+	opts.Retry.Upstream = opts.Upstream
+	rt = NewRetryTransport(rt, opts.Retry)
+	rt = NewTracingTransport(rt, opts.Upstream)
+	return &http.Client{Transport: rt, Timeout: opts.Timeout}
+}
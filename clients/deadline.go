@@ -0,0 +1,42 @@
+package clients
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineHeader carries what's left of a request's deadline to the
+// upstream, in seconds, so it can give up when we do
+const DeadlineHeader = "X-Request-Timeout"
+
+// DeadlineTransport tells the upstream how long each attempt has left
+// before the request's context runs out, the handler's timeout budget or
+// the client's own, whichever is sooner. An attempt with nothing left
+// isn't sent.
+type DeadlineTransport struct {
+	next http.RoundTripper
+}
+
+func NewDeadlineTransport(next http.RoundTripper) *DeadlineTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &DeadlineTransport{next: next}
+}
+
+func (t *DeadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	// RoundTrippers mustn't change the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(DeadlineHeader, strconv.FormatFloat(left.Seconds(), 'f', 3, 64))
+	return t.next.RoundTrip(req)
+}
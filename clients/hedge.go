@@ -0,0 +1,247 @@
+// Package clients holds the pieces for calling downstream services
+package clients
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hedgesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "client_hedges_total",
+	Help: "Hedged requests by upstream and outcome: sent, won (the hedge answered first) or skipped (over budget).",
+}, []string{"upstream", "outcome"})
+
+var hedgeableTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "client_hedgeable_requests_total",
+	Help: "Requests eligible for hedging, the denominator for the hedge rate.",
+}, []string{"upstream"})
+
+type HedgeOptions struct {
+	// Upstream names the downstream service in metrics
+	Upstream string
+	// Percentile of recent latency after which the hedge is sent, 0.95 is p95
+	Percentile float64
+	// MinDelay floors the hedge delay, and is the delay used until enough
+	// latency samples have been seen
+	MinDelay time.Duration
+	// MaxRatio caps hedges to this fraction of eligible requests so a slow
+	// upstream doesn't get twice the load right when it is struggling
+	MaxRatio float64
+	// Window is how many recent latencies the percentile is taken over
+	Window int
+}
+
+func (o *HedgeOptions) withDefaults() {
+	if o.Percentile <= 0 || o.Percentile >= 1 {
+		o.Percentile = 0.95
+	}
+	if o.MinDelay <= 0 {
+		o.MinDelay = 10 * time.Millisecond
+	}
+	if o.MaxRatio <= 0 {
+		o.MaxRatio = 0.1
+	}
+	if o.Window <= 0 {
+		o.Window = 500
+	}
+}
+
+// HedgingTransport sends a second copy of slow idempotent requests and takes
+// whichever answers first, cancelling the other. Only GET and HEAD requests
+// without a body are hedged, everything else passes straight through.
+type HedgingTransport struct {
+	next   http.RoundTripper
+	opts   HedgeOptions
+	lat    *latencyWindow
+	budget *hedgeBudget
+}
+
+func NewHedgingTransport(next http.RoundTripper, opts HedgeOptions) *HedgingTransport {
+	opts.withDefaults()
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &HedgingTransport{
+		next:   next,
+		opts:   opts,
+		lat:    newLatencyWindow(opts.Window),
+		budget: &hedgeBudget{ratio: opts.MaxRatio, max: 10},
+	}
+}
+
+type attempt struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	took   time.Duration
+	cancel context.CancelFunc
+}
+
+func (t *HedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.next.RoundTrip(req)
+	}
+	hedgeableTotal.WithLabelValues(t.opts.Upstream).Inc()
+	t.budget.earn()
+
+	results := make(chan attempt, 2)
+	send := func(hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		start := time.Now()
+		resp, err := t.next.RoundTrip(req.Clone(ctx))
+		results <- attempt{resp: resp, err: err, hedge: hedge, took: time.Since(start), cancel: cancel}
+	}
+	go send(false)
+	inflight := 1
+
+	timer := time.NewTimer(t.lat.percentile(t.opts.Percentile, t.opts.MinDelay))
+	defer timer.Stop()
+	var failed attempt
+	for {
+		select {
+		case <-timer.C:
+			if !t.budget.spend() {
+				hedgesTotal.WithLabelValues(t.opts.Upstream, "skipped").Inc()
+				continue
+			}
+			hedgesTotal.WithLabelValues(t.opts.Upstream, "sent").Inc()
+			go send(true)
+			inflight++
+		case a := <-results:
+			inflight--
+			if a.err != nil && inflight > 0 {
+				// the other copy may still come good
+				failed = a
+				continue
+			}
+			if failed.cancel != nil {
+				failed.cancel()
+			}
+			if a.err != nil {
+				a.cancel()
+				return nil, a.err
+			}
+			t.lat.add(a.took)
+			if a.hedge {
+				hedgesTotal.WithLabelValues(t.opts.Upstream, "won").Inc()
+			}
+			if inflight > 0 {
+				go discard(results)
+			}
+			// the winner's context must live until its body is read
+			a.resp.Body = &cancelOnClose{ReadCloser: a.resp.Body, cancel: a.cancel}
+			return a.resp, nil
+		}
+	}
+}
+
+// discard waits out the losing attempt, cancelling it and closing its body
+func discard(results <-chan attempt) {
+	a := <-results
+	a.cancel()
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+}
+
+func hedgeable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(req.Body == nil || req.Body == http.NoBody)
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// hedgeBudget is a token bucket where each eligible request earns ratio of a
+// token and each hedge spends a whole one
+type hedgeBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func (b *hedgeBudget) earn() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *hedgeBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// latencyWindow keeps the last n latencies to take percentiles from. The
+// sorted copy is cached and refreshed every so many samples so the hot path
+// isn't sorting on every request.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+	sorted  []time.Duration
+	stale   int
+}
+
+func newLatencyWindow(n int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, n)}
+}
+
+func (l *latencyWindow) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % len(l.samples)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.stale++
+}
+
+// percentile returns the p-th latency, or floor if that is higher or there
+// are too few samples to trust yet
+func (l *latencyWindow) percentile(p float64, floor time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.samples)
+	}
+	if n < 20 {
+		return floor
+	}
+	if l.sorted == nil || l.stale >= len(l.samples)/10+1 {
+		l.sorted = append(l.sorted[:0], l.samples[:n]...)
+		sort.Slice(l.sorted, func(i, j int) bool { return l.sorted[i] < l.sorted[j] })
+		l.stale = 0
+	}
+	d := l.sorted[int(float64(len(l.sorted)-1)*p)]
+	if d < floor {
+		return floor
+	}
+	return d
+}
@@ -0,0 +1,42 @@
+package clients
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/redact"
+)
+
+// LoggingTransport logs every attempt to the request context's logger, the
+// request scoped one with its request id in a handler: at debug when it's
+// answered, at warn when it fails or gets a 5xx. Secrets in the url are
+// masked, bodies and headers aren't logged.
+type LoggingTransport struct {
+	next     http.RoundTripper
+	upstream string
+}
+
+func NewLoggingTransport(next http.RoundTripper, upstream string) *LoggingTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &LoggingTransport{next: next, upstream: upstream}
+}
+
+func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	logger := zerolog.Ctx(req.Context())
+	event := logger.Debug()
+	if err != nil || resp.StatusCode >= 500 {
+		event = logger.Warn()
+	}
+	if resp != nil {
+		event = event.Int("status", resp.StatusCode)
+	}
+	event.Err(err).Str("upstream", t.upstream).Str("method", req.Method).Str("url", redact.String(req.URL.Redacted())).
+		Dur("took", time.Since(start)).Msg("downstream request")
+	return resp, err
+}
@@ -0,0 +1,62 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrProfileNotFound is a user the profile service has no profile for
+var ErrProfileNotFound = errors.New("profile not found")
+
+// Profile is a user's public profile as the profile service has it
+type Profile struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// Profiles is an example downstream client, for a profile service answering
+// GET /profiles/{userID}. Start a real one from it: the http.Client comes
+// from New, the upstream's paths and wire format stay in here, and its
+// answers are turned into errors callers can act on.
+type Profiles struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewProfiles(baseURL string, opts Options) *Profiles {
+	if opts.Upstream == "" {
+		opts.Upstream = "profiles"
+	}
+	return &Profiles{baseURL: strings.TrimSuffix(baseURL, "/"), client: New(opts)}
+}
+
+// Get fetches userID's profile, ErrProfileNotFound when there's none
+func (p *Profiles) Get(ctx context.Context, userID string) (*Profile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/profiles/"+url.PathEscape(userID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching profile: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrProfileNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching profile: %s", resp.Status)
+	}
+	var profile Profile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("decoding profile: %w", err)
+	}
+	return &profile, nil
+}
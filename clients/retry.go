@@ -0,0 +1,152 @@
+package clients
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"go-chi-microservice/breaker"
+	"go-chi-microservice/egress"
+)
+
+var retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "client_retries_total",
+	Help: "Requests retried by upstream and reason, error or the status answered.",
+}, []string{"upstream", "reason"})
+
+type RetryOptions struct {
+	// Upstream names the downstream service in metrics
+	Upstream string
+	// MaxRetries is how many times a request is tried again after the
+	// first, 2 when 0, negative for none
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry, doubling after each,
+	// and MaxDelay caps it. The wait is a random part of it so clients that
+	// failed together don't come back together.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (o *RetryOptions) withDefaults() {
+	switch {
+	case o.MaxRetries == 0:
+		o.MaxRetries = 2
+	case o.MaxRetries < 0:
+		o.MaxRetries = 0
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = 100 * time.Millisecond
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = 2 * time.Second
+	}
+}
+
+// RetryTransport tries idempotent requests again, with jittered exponential
+// backoff, when they fail to get an answer or get 429, 502, 503 or 504.
+// Other methods are sent once, as is a request whose body can't be sent
+// again. A Retry-After from the upstream is waited out when it's within
+// MaxDelay.
+type RetryTransport struct {
+	next http.RoundTripper
+	opts RetryOptions
+}
+
+func NewRetryTransport(next http.RoundTripper, opts RetryOptions) *RetryTransport {
+	opts.withDefaults()
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RetryTransport{next: next, opts: opts}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !retryable(req) {
+		return t.next.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+		resp, err := t.next.RoundTrip(r)
+		reason := retryReason(resp, err)
+		if reason == "" || attempt == t.opts.MaxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+		delay := t.backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+		retriesTotal.WithLabelValues(t.opts.Upstream, reason).Inc()
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff is the wait before retry attempt+1, full jitter over the
+// doubling delay
+func (t *RetryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			if d := time.Duration(secs) * time.Second; d <= t.opts.MaxDelay {
+				return d
+			}
+		}
+	}
+	d := t.opts.BaseDelay << attempt
+	if d <= 0 || d > t.opts.MaxDelay {
+		d = t.opts.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryable is whether req may be sent more than once: its method is
+// idempotent, or it carries an Idempotency-Key, and its body can be sent
+// again
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		if req.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryReason is why an attempt is worth repeating, "" when it isn't
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		// an open breaker is failing fast on purpose, and the egress
+		// policy won't change its mind
+		if errors.Is(err, breaker.ErrOpen) || errors.Is(err, egress.ErrBlocked) {
+			return ""
+		}
+		return "error"
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
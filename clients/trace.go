@@ -0,0 +1,62 @@
+package clients
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-chi-microservice/redact"
+)
+
+// propagator sends the W3C traceparent and baggage headers
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// TracingTransport starts a client span for each request and passes the
+// trace on in its headers, along with the request id as X-Request-Id, so
+// the upstream's logs and spans join up with ours. Spans go to whatever
+// tracer provider is registered with otel, a no-op until one is set up.
+type TracingTransport struct {
+	next     http.RoundTripper
+	upstream string
+	tracer   trace.Tracer
+}
+
+func NewTracingTransport(next http.RoundTripper, upstream string) *TracingTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &TracingTransport{next: next, upstream: upstream, tracer: otel.Tracer("go-chi-microservice/clients")}
+}
+
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("peer.service", t.upstream),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", redact.String(req.URL.Redacted())),
+		))
+	defer span.End()
+	// RoundTrippers mustn't change the caller's request
+	req = req.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if id := middleware.GetReqID(ctx); id != "" && req.Header.Get(middleware.RequestIDHeader) == "" {
+		req.Header.Set(middleware.RequestIDHeader, id)
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.StatusCode >= 500:
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		span.SetStatus(codes.Error, resp.Status)
+	default:
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	return resp, err
+}
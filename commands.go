@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+
+	"go-chi-microservice/api"
+	"go-chi-microservice/auth"
+	"go-chi-microservice/backup"
+	"go-chi-microservice/config"
+	"go-chi-microservice/devdata"
+	"go-chi-microservice/diagnostics"
+	"go-chi-microservice/reporting"
+	"go-chi-microservice/users"
+	"go-chi-microservice/version"
+)
+
+// newRootCommand builds the CLI. Running the binary without a subcommand
+// serves, so existing deployments keep working.
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "go-chi-microservice",
+		Short:         "A simple user service built on chi",
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Version:       version.Get().String(),
+		RunE:          withConfig(serve),
+	}
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Run the server",
+			Args:  cobra.NoArgs,
+			RunE:  withConfig(serve),
+		},
+		newMigrateCommand(),
+		newSeedCommand(),
+		newRoutesCommand(),
+		newConfigCommand(),
+		newBackupCommand(),
+		newDevdataCommand(),
+	)
+	return root
+}
+
+// withConfig loads and validates the config before running fn, every
+// command that touches the service goes through here so they all see the
+// same settings
+func withConfig(fn func(cfg *config.Config) error) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("problem parsing config: %w", err)
+		}
+		return fn(cfg)
+	}
+}
+
+func newMigrateCommand() *cobra.Command {
+	var noSnapshot bool
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply storage migrations",
+		Long: `With USER_REPO_SNAPSHOT_PATH set the snapshot is first saved as a devdata state,
+pre-migrate-<time>, to restore and migrate again while working on a migration.`,
+		Args: cobra.NoArgs,
+		RunE: withConfig(func(cfg *config.Config) error {
+			if cfg.UserRepo.SnapshotPath != "" && !noSnapshot {
+				states := devdata.States{Dir: cfg.UserRepo.DevStatesDir, Snapshot: cfg.UserRepo.SnapshotPath}
+				st, err := states.Save(context.Background(), "pre-migrate-"+time.Now().UTC().Format("20060102T150405Z"))
+				switch {
+				case errors.Is(err, fs.ErrNotExist):
+					// nothing saved yet, nothing to lose
+				case err != nil:
+					return fmt.Errorf("saving the snapshot before migrating: %w", err)
+				default:
+					fmt.Printf("saved the snapshot as %s, go-chi-microservice devdata restore %s undoes the migration\n", st.Name, st.Name)
+				}
+			}
+			// users only live in memory for now, the snapshot's format is
+			// the only schema there is until a database backend lands
+			if cfg.UserRepo.SnapshotPath == "" {
+				fmt.Println("users: memory storage, nothing to migrate")
+				return nil
+			}
+			repo := users.NewMemoryRepository()
+			if _, err := repo.LoadSnapshot(cfg.UserRepo.SnapshotPath); errors.Is(err, fs.ErrNotExist) {
+				fmt.Printf("users: no snapshot yet, it's written at format %d\n", users.SnapshotVersion)
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := repo.SaveSnapshot(cfg.UserRepo.SnapshotPath); err != nil {
+				return err
+			}
+			fmt.Printf("users: snapshot at format %d\n", users.SnapshotVersion)
+			return nil
+		}),
+	}
+	cmd.Flags().BoolVar(&noSnapshot, "no-snapshot", false, "don't save the snapshot as a devdata state first")
+	return cmd
+}
+
+func newSeedCommand() *cobra.Command {
+	var file string
+	cmd := &cobra.Command{
+		Use:   "seed",
+		Short: "Load fixture users into storage",
+		Args:  cobra.NoArgs,
+		RunE: withConfig(func(cfg *config.Config) error {
+			fixtures := users.SeedUsers()
+			if file != "" {
+				b, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				fixtures = nil
+				if err := json.Unmarshal(b, &fixtures); err != nil {
+					return fmt.Errorf("%s: %w", file, err)
+				}
+			}
+			svc, err := newUserService(cfg, users.NewMemoryRepository())
+			if err != nil {
+				return err
+			}
+			// memory storage goes away with the process, so for now this only
+			// checks the fixtures load cleanly
+			fmt.Fprintf(os.Stderr, "users: memory storage, seeding only lasts for this command\n")
+			err = svc.CreateMany(context.Background(), fixtures)
+			var be *users.BatchError
+			if errors.As(err, &be) {
+				for _, f := range be.Failures {
+					fmt.Fprintln(os.Stderr, f)
+				}
+				fmt.Printf("seeded %d of %d users\n", len(fixtures)-len(be.Failures), len(fixtures))
+				return fmt.Errorf("%d fixtures failed", len(be.Failures))
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("seeded %d users\n", len(fixtures))
+			return nil
+		}),
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "JSON array of users to load instead of the built in fixtures")
+	return cmd
+}
+
+func newRoutesCommand() *cobra.Command {
+	var admin bool
+	cmd := &cobra.Command{
+		Use:   "routes",
+		Short: "Print the route tree",
+		Args:  cobra.NoArgs,
+		RunE: withConfig(func(cfg *config.Config) error {
+			svc, err := newUserService(cfg, users.NewMemoryRepository())
+			if err != nil {
+				return err
+			}
+			deps := api.Deps{Users: svc, Diagnostics: diagnostics.NewRegistry(), Reporter: reporting.Nop{}}
+			router := api.NewRouter(cfg, deps)
+			if admin {
+				router = api.NewAdminRouter(cfg, deps)
+			}
+			routes, ok := router.(chi.Routes)
+			if !ok {
+				return fmt.Errorf("router is a %T, not a chi router", router)
+			}
+			// Handle registers every method, group them per route so those
+			// show as one line
+			var order []string
+			methods := map[string][]string{}
+			err = chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+				route = strings.Replace(route, "/*/", "/", -1)
+				if len(route) > 1 {
+					route = strings.TrimSuffix(route, "/")
+				}
+				if _, ok := methods[route]; !ok {
+					order = append(order, route)
+				}
+				methods[route] = append(methods[route], method)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, route := range order {
+				m := methods[route]
+				sort.Strings(m)
+				list := strings.Join(m, ",")
+				if len(m) == len(anyMethods) {
+					list = "ANY"
+				}
+				fmt.Printf("%-10s %s\n", list, route)
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().BoolVar(&admin, "admin", false, "print the admin listener's routes instead")
+	return cmd
+}
+
+// anyMethods is every method chi routes, a route registered for all of them
+// was mounted with Handle
+var anyMethods = []string{
+	http.MethodConnect, http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodOptions,
+	http.MethodPatch, http.MethodPost, http.MethodPut, http.MethodTrace,
+}
+
+func newConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	var format string
+	docs := &cobra.Command{
+		Use:   "docs",
+		Short: "Print every setting with its env var, type, default and description",
+		Args:  cobra.NoArgs,
+		// reads the config structs, not the environment, so it works
+		// without a valid config
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return config.WriteDocs(os.Stdout, format)
+		},
+	}
+	docs.Flags().StringVar(&format, "format", "table", "output format, table or markdown")
+	cmd.AddCommand(docs)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show",
+		Short: "Print the effective value of every setting, secrets masked",
+		Args:  cobra.NoArgs,
+		RunE: withConfig(func(cfg *config.Config) error {
+			return config.WriteValues(os.Stdout, cfg)
+		}),
+	})
+	return cmd
+}
+
+func newBackupCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Take, check and restore encrypted backups of the users",
+		Long: `Backups from the command line are of the snapshot at USER_REPO_SNAPSHOT_PATH, a restore
+replaces that file for the server to load when it next starts. Stop the server first, or its
+next snapshot overwrites the restored one.`,
+	}
+	// with RunE wrapped so every subcommand gets the backups and snapshot
+	run := func(fn func(ctx context.Context, b *backup.Backups, snapshot backup.SnapshotFile, args []string) error) func(cmd *cobra.Command, args []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			return withConfig(func(cfg *config.Config) error {
+				if cfg.UserRepo.SnapshotPath == "" {
+					return errors.New("USER_REPO_SNAPSHOT_PATH isn't set, users only live in the server's memory, back them up with BACKUP_ENABLED")
+				}
+				logger := zerolog.New(os.Stderr)
+				b, err := newBackups(cmd.Context(), cfg, &logger)
+				if err != nil {
+					return err
+				}
+				return fn(cmd.Context(), b, backup.SnapshotFile{Path: cfg.UserRepo.SnapshotPath}, args)
+			})(cmd, args)
+		}
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "create",
+		Short: "Back up the users snapshot",
+		Args:  cobra.NoArgs,
+		RunE: run(func(ctx context.Context, b *backup.Backups, snapshot backup.SnapshotFile, args []string) error {
+			m, err := b.Create(ctx, snapshot)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("backed up %d bytes to %s\n", m.Size, m.Key)
+			return nil
+		}),
+	}, &cobra.Command{
+		Use:   "verify [key]",
+		Short: "Download and decrypt a backup, the latest by default, and check it against its manifest",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: run(func(ctx context.Context, b *backup.Backups, snapshot backup.SnapshotFile, args []string) error {
+			m, err := b.Verify(ctx, strings.Join(args, ""))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s from %s is intact, %d bytes, sha256 %s\n", m.Key, m.Created.Format(time.RFC3339), m.Size, m.SHA256)
+			return nil
+		}),
+	}, &cobra.Command{
+		Use:   "restore [key]",
+		Short: "Replace the users snapshot with a backup, the latest by default, once it checks out",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: run(func(ctx context.Context, b *backup.Backups, snapshot backup.SnapshotFile, args []string) error {
+			m, err := b.Restore(ctx, strings.Join(args, ""), snapshot)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("restored %s from %s to %s\n", m.Key, m.Created.Format(time.RFC3339), snapshot.Path)
+			return nil
+		}),
+	})
+	return cmd
+}
+
+func newDevdataCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "devdata",
+		Short: "Save and restore named states of the development users snapshot",
+		Long: `States are copies of the snapshot at USER_REPO_SNAPSHOT_PATH kept in USER_REPO_DEV_STATES_DIR,
+say before and after trying a migration. A restore replaces the snapshot for the server to load
+when it next starts, stop the server first, and saves what it replaced as "previous".`,
+	}
+	run := func(fn func(ctx context.Context, states devdata.States, args []string) error) func(cmd *cobra.Command, args []string) error {
+		return func(cmd *cobra.Command, args []string) error {
+			return withConfig(func(cfg *config.Config) error {
+				if cfg.UserRepo.SnapshotPath == "" {
+					return errors.New("USER_REPO_SNAPSHOT_PATH isn't set, users only live in the server's memory")
+				}
+				return fn(cmd.Context(), devdata.States{Dir: cfg.UserRepo.DevStatesDir, Snapshot: cfg.UserRepo.SnapshotPath}, args)
+			})(cmd, args)
+		}
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "save <name>",
+		Short: "Save the snapshot as a named state, replacing one of the same name",
+		Args:  cobra.ExactArgs(1),
+		RunE: run(func(ctx context.Context, states devdata.States, args []string) error {
+			st, err := states.Save(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("saved %s, %d bytes\n", st.Name, st.Size)
+			return nil
+		}),
+	}, &cobra.Command{
+		Use:   "restore <name>",
+		Short: "Replace the snapshot with a named state",
+		Args:  cobra.ExactArgs(1),
+		RunE: run(func(ctx context.Context, states devdata.States, args []string) error {
+			st, err := states.Restore(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("restored %s from %s to %s\n", st.Name, st.Saved.Format(time.RFC3339), states.Snapshot)
+			return nil
+		}),
+	}, &cobra.Command{
+		Use:   "list",
+		Short: "List the saved states, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: run(func(ctx context.Context, states devdata.States, args []string) error {
+			list, err := states.List()
+			if err != nil {
+				return err
+			}
+			for _, st := range list {
+				n, err := states.Users(st.Name)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%-32s %s %6d users\n", st.Name, st.Saved.Format(time.RFC3339), n)
+			}
+			return nil
+		}),
+	}, &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete a saved state",
+		Args:  cobra.ExactArgs(1),
+		RunE: run(func(ctx context.Context, states devdata.States, args []string) error {
+			return states.Delete(args[0])
+		}),
+	}, newSampleCommand())
+	return cmd
+}
+
+func newSampleCommand() *cobra.Command {
+	var (
+		from, fromBackup, key, password string
+		opts                            devdata.SampleOptions
+		pseudonymizeIDs                 bool
+	)
+	cmd := &cobra.Command{
+		Use:   "sample",
+		Short: "Load an anonymized sample of production users into the dev snapshot",
+		Long: `Takes users from a production snapshot file, --from, or a production backup, --from-backup
+with its key or "latest", read with the BACKUP_ and STORAGE_ settings. Emails, phones, passwords,
+second factors, avatars and suspension reasons are replaced or dropped before anything is written.
+The sample replaces the snapshot at USER_REPO_SNAPSHOT_PATH, saving the one it replaces as the
+devdata state "previous".
+
+Pseudonyms are derived from --key, the same key gives the same pseudonyms, so samples taken at
+different times line up. Without one a random key is used.`,
+		Args: cobra.NoArgs,
+		RunE: withConfig(func(cfg *config.Config) error {
+			if cfg.UserRepo.SnapshotPath == "" {
+				return errors.New("USER_REPO_SNAPSHOT_PATH isn't set, there's nowhere to load the sample")
+			}
+			if (from == "") == (fromBackup == "") {
+				return errors.New("give one of --from or --from-backup")
+			}
+			if from != "" && samePath(from, cfg.UserRepo.SnapshotPath) {
+				return errors.New("--from is USER_REPO_SNAPSHOT_PATH, the sample would replace the data it's taken from")
+			}
+			ctx := context.Background()
+			prod := users.NewMemoryRepository()
+			if from != "" {
+				if _, err := prod.LoadSnapshot(from); err != nil {
+					return err
+				}
+			} else {
+				logger := zerolog.New(os.Stderr)
+				b, err := newBackups(ctx, cfg, &logger)
+				if err != nil {
+					return err
+				}
+				if fromBackup == "latest" {
+					fromBackup = ""
+				}
+				if _, err := b.Restore(ctx, fromBackup, backup.Memory{Repo: prod}); err != nil {
+					return err
+				}
+			}
+			all, err := prod.List(ctx)
+			if err != nil {
+				return err
+			}
+			anon := devdata.Anonymizer{Key: []byte(key), PseudonymizeIDs: pseudonymizeIDs}
+			if key == "" {
+				anon.Key = make([]byte, 32)
+				if _, err := rand.Read(anon.Key); err != nil {
+					return err
+				}
+			}
+			if password != "" {
+				if anon.PasswordHash, err = auth.HashPassword(password); err != nil {
+					return err
+				}
+			}
+			sample := devdata.Sample(all, opts)
+			dev := users.NewMemoryRepository()
+			for _, u := range sample {
+				dev.Put(anon.Anonymize(u))
+			}
+			states := devdata.States{Dir: cfg.UserRepo.DevStatesDir, Snapshot: cfg.UserRepo.SnapshotPath}
+			if _, err := states.Save(ctx, "previous"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err := dev.SaveSnapshot(cfg.UserRepo.SnapshotPath); err != nil {
+				return err
+			}
+			fmt.Printf("loaded %d of %d users, anonymized, into %s\n", len(sample), len(all), cfg.UserRepo.SnapshotPath)
+			return nil
+		}),
+	}
+	cmd.Flags().StringVar(&from, "from", "", "production users snapshot file to sample")
+	cmd.Flags().StringVar(&fromBackup, "from-backup", "", `production backup to sample, its key or "latest"`)
+	cmd.Flags().IntVarP(&opts.Count, "count", "n", 100, "users to take, 0 for all")
+	cmd.Flags().Int64Var(&opts.Seed, "seed", 1, "picks the same users each time for the same data")
+	cmd.Flags().StringSliceVar(&opts.Tenants, "tenant", nil, "only take users of these tenants")
+	cmd.Flags().BoolVar(&opts.Deleted, "deleted", false, "take soft deleted users too")
+	cmd.Flags().StringVar(&key, "key", "", "secret the pseudonyms are derived from, random when empty")
+	cmd.Flags().BoolVar(&pseudonymizeIDs, "pseudonymize-ids", false, "replace user ids too")
+	cmd.Flags().StringVar(&password, "password", "", "password every sampled user signs in with, none when empty")
+	return cmd
+}
+
+func samePath(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
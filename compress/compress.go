@@ -0,0 +1,269 @@
+// Package compress compresses responses with gzip, brotli or zstd, as the
+// client's Accept-Encoding allows, and decompresses request bodies sent
+// with gzip or deflate.
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// levels are the compression levels, mapped to each encoding's own scale
+var levels = []string{"fastest", "default", "better", "best"}
+
+// Options are what responses are compressed, and how hard
+type Options struct {
+	// Encodings offered, the first the client accepts as much as any other
+	// is used: zstd, br or gzip
+	Encodings []string
+	Level     string // fastest, default, better or best
+	// MinSize is the smallest body compressed, smaller ones cost more to
+	// compress than they save. A response flushed before it's reached is
+	// compressed anyway, it's a stream.
+	MinSize int
+	// ContentTypes compressed, type/* for all of a type
+	ContentTypes []string
+}
+
+// Handler compresses responses of opts.ContentTypes in the encoding the
+// request accepts. Responses already encoded, partial content and bodies
+// under MinSize are sent as they are.
+func Handler(opts Options) func(http.Handler) http.Handler {
+	pools := map[string]*sync.Pool{}
+	for _, encoding := range opts.Encodings {
+		encoding := encoding
+		pools[encoding] = &sync.Pool{New: func() any { return newEncoder(encoding, opts.Level) }}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiate(r.Header.Get("Accept-Encoding"), opts.Encodings)
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &writer{ResponseWriter: w, opts: opts, encoding: encoding, pool: pools[encoding]}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiate picks the offer accept ranks highest, ties going to the earlier
+// offer, or "" for none. identity is always acceptable so it's never
+// chosen.
+func negotiate(accept string, offers []string) string {
+	if accept == "" {
+		return ""
+	}
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		weight := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				weight = f
+			}
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q[coding] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		weight, ok := q[offer]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > bestQ {
+			best, bestQ = offer, weight
+		}
+	}
+	return best
+}
+
+// writer holds the start of a body until it knows whether to compress it:
+// once it has MinSize bytes, or is flushed, or the handler returns
+type writer struct {
+	http.ResponseWriter
+	opts     Options
+	encoding string
+	pool     *sync.Pool // of encoders
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder // nil when sent as it is
+}
+
+// encoder is what gzip, brotli and zstd writers have in common
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+func (cw *writer) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	if status < 200 {
+		// informational, e.g. 103 Early Hints
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if !cw.eligible() {
+		cw.start(false)
+	}
+}
+
+func (cw *writer) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.opts.MinSize {
+			return len(p), nil
+		}
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// eligible is whether the response may be compressed, going by its status
+// and headers
+func (cw *writer) eligible() bool {
+	h := cw.Header()
+	switch {
+	case cw.status == http.StatusNoContent, cw.status == http.StatusNotModified, cw.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < cw.opts.MinSize {
+		return false
+	}
+	return compressible(h.Get("Content-Type"), cw.opts.ContentTypes)
+}
+
+func compressible(contentType string, types []string) bool {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if t == media || strings.HasSuffix(t, "/*") && strings.HasPrefix(media, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// start sends the header, compressed or not, and what's been held back
+func (cw *writer) start(compress bool) error {
+	cw.decided = true
+	if compress {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		cw.enc = cw.pool.Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *writer) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+		if !cw.decided {
+			cw.start(true)
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close sends a body still held back as it is, it's under MinSize, and
+// ends a compressed one
+func (cw *writer) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			// the handler wrote nothing
+			return nil
+		}
+		return cw.start(false)
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	cw.enc.Reset(io.Discard)
+	cw.pool.Put(cw.enc)
+	cw.enc = nil
+	return err
+}
+
+func (cw *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *writer) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func newEncoder(encoding, level string) encoder {
+	i := 1
+	for j, l := range levels {
+		if l == level {
+			i = j
+		}
+	}
+	switch encoding {
+	case "zstd":
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevel(i+1)), zstd.WithEncoderConcurrency(1))
+		return enc
+	case "br":
+		return brotli.NewWriterLevel(nil, []int{1, 5, 8, 11}[i])
+	}
+	gz, _ := gzip.NewWriterLevel(nil, []int{gzip.BestSpeed, gzip.DefaultCompression, 7, gzip.BestCompression}[i])
+	return gz
+}
@@ -0,0 +1,972 @@
+package config
+
+import (
+	"os"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+)
+
+// Config is the service configuration, populated from the environment. Each
+// setting's doc comment is what `config docs` prints for it, keep them to a
+// line.
+type Config struct {
+	// Port the main http listener binds on all interfaces
+	Port int `env:"PORT" envDefault:"4000" validate:"min=1,max=65535"`
+	// Listen is the main listener's addresses, host:port or unix:/path/to.sock, instead of PORT on all interfaces
+	Listen []string `env:"LISTEN" envSeparator:","`
+	// SocketMode is the permissions, in octal, of the unix socket files the listeners create
+	SocketMode string `env:"SOCKET_MODE" envDefault:"0660"`
+	// ReusePort binds the listeners with SO_REUSEPORT, so a new process can start on them while the old one drains
+	ReusePort bool `env:"REUSE_PORT" envDefault:"false"`
+	// LogDir holds server.log, "stdout" logs to stdout instead
+	LogDir string    `env:"LOGDIR,expand" envDefault:"${HOME}/tmp" validate:"required_if=Log.FileEnabled true"`
+	Log    LogConfig `envPrefix:"LOG_"`
+
+	// AgeIdentity is an age secret key for decrypting enc:age: values
+	AgeIdentity string `env:"CONFIG_AGE_IDENTITY"`
+	// AgeIdentityFile is read for age identities when AgeIdentity is unset
+	AgeIdentityFile string `env:"CONFIG_AGE_IDENTITY_FILE" validate:"file"`
+
+	// RequestTimeout is the deadline a request on the main listener runs under, unless its route has its own
+	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT" envDefault:"60s" validate:"min=1s"`
+	// RouteTimeouts overrides RequestTimeout per route, e.g. /users/export:5m,POST /users/import:2m, 0s for none
+	RouteTimeouts map[string]time.Duration `env:"ROUTE_TIMEOUTS"`
+	// TimeoutHeader is where a client sends a shorter budget for its request, in seconds or as a duration, "-" ignores it
+	TimeoutHeader string `env:"TIMEOUT_HEADER" envDefault:"X-Request-Timeout"`
+
+	// ReadHeaderTimeout is how long a client on the main listener gets to send a request's header
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT" envDefault:"10s" validate:"min=1s"`
+	// IdleTimeout closes a keep-alive connection on the main listener after this long without a request
+	IdleTimeout time.Duration `env:"IDLE_TIMEOUT" envDefault:"120s" validate:"min=1s"`
+	// ReadTimeout is how long a client on the main listener gets to send a whole request, body included, 0s for no limit
+	ReadTimeout time.Duration `env:"READ_TIMEOUT" envDefault:"0s" validate:"min=0s"`
+	// WriteTimeout is how long a response on the main listener may take to write, 0s for no limit, event streams are exempt
+	WriteTimeout time.Duration `env:"WRITE_TIMEOUT" envDefault:"0s" validate:"min=0s"`
+	// MaxHeaderBytes is the largest request header the main listener reads
+	MaxHeaderBytes int `env:"MAX_HEADER_BYTES" envDefault:"1048576" validate:"min=4096"`
+	// MaxBodyBytes is the largest request body accepted on the main listener, 0 for no limit, endpoints may take less
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES" envDefault:"16777216" validate:"min=0"`
+	// HTTP2 serves HTTP/2 on the TLS listener to clients that offer it
+	HTTP2 bool `env:"HTTP2" envDefault:"true"`
+	// H2C serves HTTP/2 without TLS when the main listener is plain, for internal clients that speak it
+	H2C bool `env:"H2C" envDefault:"false"`
+
+	// ShutdownTimeout bounds how long stopping all components may take
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s" validate:"min=1s"`
+
+	// ShutdownStreamGrace is how long event streams get to close after being
+	// told the server is going away, before they're cut off
+	ShutdownStreamGrace time.Duration `env:"SHUTDOWN_STREAM_GRACE" envDefault:"5s" validate:"min=0s"`
+
+	// ExpandMaxDepth limits how deep ?expand=a.b.c paths may nest
+	ExpandMaxDepth int `env:"EXPAND_MAX_DEPTH" envDefault:"3" validate:"min=0,max=10"`
+
+	// LoaderWait is the window the user loader collects keys over before one batch call
+	LoaderWait time.Duration `env:"LOADER_WAIT" envDefault:"2ms" validate:"max=1s"`
+	// LoaderMaxBatch dispatches a loader batch early once it has this many keys
+	LoaderMaxBatch int `env:"LOADER_MAX_BATCH" envDefault:"100" validate:"min=0"`
+
+	TLS         TLSConfig         `envPrefix:"TLS_"`
+	HTTP3       HTTP3Config       `envPrefix:"HTTP3_"`
+	Conns       ConnsConfig       `envPrefix:"CONN_"`
+	SlowClient  SlowClientConfig  `envPrefix:"SLOW_CLIENT_"`
+	Admin       AdminConfig       `envPrefix:"ADMIN_"`
+	Auth        AuthConfig        `envPrefix:"AUTH_"`
+	Sentry      SentryConfig      `envPrefix:"SENTRY_"`
+	UserRepo    RepositoryConfig  `envPrefix:"USER_REPO_"`
+	UserRules   UserRulesConfig   `envPrefix:"USER_"`
+	Stale       StaleConfig       `envPrefix:"STALE_CACHE_"`
+	Pagination  PaginationConfig  `envPrefix:"PAGINATION_"`
+	Complexity  ComplexityConfig  `envPrefix:"COMPLEXITY_"`
+	CORS        CORSConfig        `envPrefix:"CORS_"`
+	Headers     HeadersConfig     `envPrefix:"SECURITY_HEADER_"`
+	Consumer    ConsumerConfig    `envPrefix:"CONSUMER_"`
+	Notify      NotifyConfig      `envPrefix:"NOTIFY_"`
+	SCIM        SCIMConfig        `envPrefix:"SCIM_"`
+	Mail        MailConfig        `envPrefix:"MAIL_"`
+	Webhooks    WebhooksConfig    `envPrefix:"WEBHOOKS_"`
+	Storage     StorageConfig     `envPrefix:"STORAGE_"`
+	Avatar      AvatarConfig      `envPrefix:"AVATAR_"`
+	Files       FilesConfig       `envPrefix:"FILES_"`
+	Assets      AssetsConfig      `envPrefix:"ASSETS_"`
+	HTML        HTMLConfig        `envPrefix:"HTML_"`
+	CSV         CSVConfig         `envPrefix:"CSV_"`
+	Batch       BatchConfig       `envPrefix:"BATCH_"`
+	RPC         RPCConfig         `envPrefix:"RPC_"`
+	Events      EventsConfig      `envPrefix:"EVENTS_"`
+	Search      SearchConfig      `envPrefix:"SEARCH_"`
+	Docs        DocsConfig        `envPrefix:"DOCS_"`
+	Audit       AuditConfig       `envPrefix:"AUDIT_"`
+	Tenancy     TenancyConfig     `envPrefix:"TENANCY_"`
+	Flags       FlagsConfig       `envPrefix:"FLAGS_"`
+	Maintenance MaintenanceConfig `envPrefix:"MAINTENANCE_"`
+	Backup      BackupConfig      `envPrefix:"BACKUP_"`
+	PublicIDs   PublicIDsConfig   `envPrefix:"PUBLIC_IDS_"`
+	APIVersion  APIVersionConfig  `envPrefix:"API_VERSION_"`
+	Envelope    EnvelopeConfig    `envPrefix:"ENVELOPE_"`
+	Compression CompressionConfig `envPrefix:"COMPRESSION_"`
+	Egress      EgressConfig      `envPrefix:"EGRESS_"`
+}
+
+// LogConfig controls rotation of the server.log file in LogDir. With
+// FileEnabled off logs go to stdout only, the usual choice in containers.
+type LogConfig struct {
+	// Level is the starting level, changeable at runtime through PUT /admin/loglevel
+	Level string `env:"LEVEL" envDefault:"info" validate:"oneof=trace debug info warn error fatal panic disabled"`
+	// FileEnabled writes logs to LogDir/server.log, off means stdout
+	FileEnabled bool `env:"FILE_ENABLED" envDefault:"true"`
+	// MaxSizeMB rotates the log file once it reaches this size
+	MaxSizeMB int `env:"MAX_SIZE_MB" envDefault:"100" validate:"min=1"`
+	// MaxBackups is how many rotated files to keep, 0 keeps all
+	MaxBackups int `env:"MAX_BACKUPS" envDefault:"5" validate:"min=0"`
+	// MaxAgeDays deletes rotated files older than this, 0 keeps all
+	MaxAgeDays int `env:"MAX_AGE_DAYS" envDefault:"28" validate:"min=0"`
+	// Compress gzips rotated files
+	Compress bool `env:"COMPRESS" envDefault:"true"`
+}
+
+// ConnsConfig caps the connections the main listener holds open, keep-alive
+// ones idling between requests included, against connection floods
+type ConnsConfig struct {
+	// Max is how many connections may be open at once, 0 for no limit
+	Max int `env:"MAX" envDefault:"0" validate:"min=0"`
+	// PerIP is how many connections one client IP may have open at once, 0 for no limit; behind a proxy every client shares its IP
+	PerIP int `env:"PER_IP" envDefault:"0" validate:"min=0"`
+	// Mode over Max leaves new connections queued in the kernel backlog until one closes, or rejects them with a 503; over PerIP they're always rejected
+	Mode string `env:"MODE" envDefault:"queue" validate:"oneof=queue reject"`
+}
+
+// CompressionConfig compresses responses on the main listener and takes
+// compressed request bodies
+type CompressionConfig struct {
+	// Enabled compresses responses when the client accepts an encoding; mind BREACH for pages mixing secrets and input
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Encodings offered, preferred in this order when the client accepts several equally
+	Encodings []string `env:"ENCODINGS" envSeparator:"," envDefault:"zstd,br,gzip" validate:"oneof=zstd br gzip"`
+	// Level trades speed for size, mapped to each encoding's own levels
+	Level string `env:"LEVEL" envDefault:"default" validate:"oneof=fastest default better best"`
+	// MinSize is the smallest body compressed, in bytes
+	MinSize int `env:"MIN_SIZE" envDefault:"1024" validate:"min=0"`
+	// ContentTypes compressed, type/* for all of a type
+	ContentTypes []string `env:"CONTENT_TYPES" envSeparator:"," envDefault:"application/json,application/xml,application/msgpack,application/x-ndjson,application/javascript,text/html,text/plain,text/csv,text/css,image/svg+xml"`
+	// RequestBodies takes bodies sent with Content-Encoding gzip or deflate, others are a 415
+	RequestBodies bool `env:"REQUEST_BODIES" envDefault:"true"`
+}
+
+// SlowClientConfig evicts clients on the main listener that send a request
+// a few bytes at a time to hold their connection open, slowloris style
+type SlowClientConfig struct {
+	// Enabled checks the rate request headers and bodies come in at
+	Enabled bool `env:"ENABLED" envDefault:"true"`
+	// MinRate is the bytes a second a request's header and body must keep up, once Grace has passed
+	MinRate int `env:"MIN_RATE" envDefault:"500" validate:"min=1"`
+	// Grace is how long a request may take before MinRate applies, and the longest a body read may wait for bytes
+	Grace time.Duration `env:"GRACE" envDefault:"5s" validate:"min=1s"`
+}
+
+// TLSConfig serves the main listener over TLS when CertFile is set. The
+// certificate and key are read again when they change, CA and policy
+// changes need a restart.
+type TLSConfig struct {
+	// CertFile is the PEM certificate chain, serving TLS when set
+	CertFile string `env:"CERT_FILE" validate:"file,required_with=KeyFile"`
+	// KeyFile is the PEM private key for CertFile
+	KeyFile string `env:"KEY_FILE" validate:"file,required_with=CertFile"`
+	// ReloadInterval is how often the certificate and key files are checked for changes
+	ReloadInterval time.Duration `env:"RELOAD_INTERVAL" envDefault:"30s" validate:"min=1s"`
+	// MinVersion is the oldest TLS version accepted
+	MinVersion string `env:"MIN_VERSION" envDefault:"1.2" validate:"oneof=1.0 1.1 1.2 1.3"`
+	// CipherSuites limits TLS 1.2 and below to these IANA named suites, in Go's order of preference, empty for Go's defaults
+	CipherSuites []string `env:"CIPHER_SUITES" envSeparator:","`
+	// Curves are the key exchange curves offered, in order of preference, empty for Go's defaults
+	Curves []string `env:"CURVES" envSeparator:"," validate:"oneof=X25519 P256 P384 P521"`
+	// ClientAuth asks for client certificates, the verify modes check them against ClientCAFile
+	ClientAuth string `env:"CLIENT_AUTH" envDefault:"none" validate:"oneof=none request require verify_if_given require_and_verify"`
+	// ClientCAFile is the PEM CA bundle client certificates are verified against
+	ClientCAFile string `env:"CLIENT_CA_FILE" validate:"file"`
+
+	ACME ACMEConfig `envPrefix:"ACME_"`
+}
+
+// ACMEConfig obtains and renews the TLS certificate from an ACME CA when
+// Domains is set, answering DNS-01 challenges through a DNS provider, in
+// place of CertFile and KeyFile
+type ACMEConfig struct {
+	// Domains are the names on the certificate, *.example.com for a wildcard
+	Domains []string `env:"DOMAINS" envSeparator:","`
+	// Email is the ACME account contact, for expiry notices
+	Email string `env:"EMAIL" validate:"required_with=Domains"`
+	// DirectoryURL is the CA's ACME directory, Let's Encrypt's staging one while testing
+	DirectoryURL string `env:"DIRECTORY_URL" envDefault:"https://acme-v02.api.letsencrypt.org/directory" validate:"url"`
+	// CacheDir keeps the account key and the certificate across restarts
+	CacheDir string `env:"CACHE_DIR,expand" envDefault:"${HOME}/tmp/acme" validate:"required_with=Domains"`
+	// RenewBefore renews the certificate once it expires within this
+	RenewBefore time.Duration `env:"RENEW_BEFORE" envDefault:"720h" validate:"min=24h"`
+	// DNSProvider publishes the challenge TXT records
+	DNSProvider string `env:"DNS_PROVIDER" validate:"required_with=Domains,oneof=cloudflare webhook"`
+	// PropagationTimeout is how long to wait for challenge records to show up in DNS
+	PropagationTimeout time.Duration `env:"PROPAGATION_TIMEOUT" envDefault:"2m" validate:"min=0s"`
+	// CloudflareToken is an API token with Zone:Read and DNS:Edit
+	CloudflareToken string `env:"CLOUDFLARE_TOKEN" validate:"required_if=DNSProvider cloudflare"`
+	// WebhookURL gets challenge records POSTed to /present and /cleanup under it
+	WebhookURL string `env:"WEBHOOK_URL" validate:"required_if=DNSProvider webhook,url"`
+	// WebhookToken is sent to WebhookURL as a bearer token
+	WebhookToken string `env:"WEBHOOK_TOKEN"`
+}
+
+// HTTP3Config serves HTTP/3 over QUIC next to the TLS listener, advertised
+// to clients in Alt-Svc so they switch to it on their next request. It's
+// experimental, as quic-go's HTTP/3 server is.
+type HTTP3Config struct {
+	// Enabled starts the HTTP/3 listener, it needs TLS
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Addr is the UDP address it binds, the main listener's port on all interfaces when empty
+	Addr string `env:"ADDR"`
+	// AltSvcMaxAge is how long clients may remember that HTTP/3 is offered
+	AltSvcMaxAge time.Duration `env:"ALT_SVC_MAX_AGE" envDefault:"24h" validate:"min=1s"`
+}
+
+// AdminConfig enables the separate admin listener serving /admin, pprof,
+// expvar and runtime stats. It binds to localhost by default, when User is
+// set every admin request needs basic auth.
+type AdminConfig struct {
+	// Enabled starts the admin listener
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Addr the admin listener binds, host:port or unix:/path/to.sock, keep it off public interfaces
+	Addr string `env:"ADDR" envDefault:"127.0.0.1:4001" validate:"required_if=Enabled true"`
+	// User turns on basic auth for the admin listener
+	User string `env:"USER"`
+	// Password for the basic auth User
+	Password string `env:"PASSWORD" validate:"required_with=User"`
+	// OperatorUser mounts the user management operations, suspending,
+	// forcing password resets, impersonating, which take these basic auth
+	// credentials rather than User's
+	OperatorUser string `env:"OPERATOR_USER"`
+	// OperatorPassword for the basic auth OperatorUser
+	OperatorPassword string `env:"OPERATOR_PASSWORD" validate:"required_with=OperatorUser"`
+	// ImpersonationTTL is how long an impersonation token lasts, at most the
+	// access token lifetime
+	ImpersonationTTL time.Duration `env:"IMPERSONATION_TTL" envDefault:"10m" validate:"min=1m"`
+}
+
+// AuthConfig turns on password login under /auth, issuing JWT access tokens
+// and rotating refresh tokens
+type AuthConfig struct {
+	// Enabled mounts /auth/login, /auth/refresh and /auth/logout
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// JWTSecret signs access tokens, at least 32 bytes, use an enc: value
+	JWTSecret string `env:"JWT_SECRET" validate:"required_if=Enabled true,min=32"`
+	// Issuer is the iss claim of access tokens
+	Issuer string `env:"ISSUER" envDefault:"go-chi-microservice"`
+	// AccessTTL is how long an access token is good for
+	AccessTTL time.Duration `env:"ACCESS_TTL" envDefault:"15m" validate:"min=1m"`
+	// RefreshTTL is how long a refresh token is good for, each refresh starts it over
+	RefreshTTL time.Duration `env:"REFRESH_TTL" envDefault:"720h" validate:"min=1h"`
+	// Require turns away /users requests without a valid bearer token
+	Require bool `env:"REQUIRE" envDefault:"false"`
+	// ClockSkew is the leeway allowed on token expiry and issue times
+	ClockSkew time.Duration `env:"CLOCK_SKEW" envDefault:"30s" validate:"max=5m"`
+	// LockoutThreshold is the failed logins in a row that lock an account
+	LockoutThreshold int `env:"LOCKOUT_THRESHOLD" envDefault:"5" validate:"min=1"`
+	// LockoutDuration is how long a locked account stays locked, and how long failed logins are remembered
+	LockoutDuration time.Duration `env:"LOCKOUT_DURATION" envDefault:"15m" validate:"min=1m"`
+	// LoginBackoff is the wait after a failed login, doubled with each further failure
+	LoginBackoff time.Duration `env:"LOGIN_BACKOFF" envDefault:"1s" validate:"min=0"`
+	// LoginMaxBackoff caps the wait between failed logins
+	LoginMaxBackoff time.Duration `env:"LOGIN_MAX_BACKOFF" envDefault:"1m" validate:"min=1s"`
+	// IPFreeFailures is the failed logins from one address before it is slowed down too
+	IPFreeFailures int `env:"IP_FREE_FAILURES" envDefault:"20" validate:"min=0"`
+	// LoginDelay holds up the response to a failed login, doubled with each further failure
+	LoginDelay time.Duration `env:"LOGIN_DELAY" envDefault:"250ms" validate:"min=0"`
+	// LoginMaxDelay caps the response delay of a failed login
+	LoginMaxDelay time.Duration `env:"LOGIN_MAX_DELAY" envDefault:"5s" validate:"max=30s"`
+
+	OIDC    OIDCConfig    `envPrefix:"OIDC_"`
+	JWKS    JWKSConfig    `envPrefix:"JWKS_"`
+	Session SessionConfig `envPrefix:"SESSION_"`
+	TOTP    TOTPConfig    `envPrefix:"TOTP_"`
+	Account AccountConfig `envPrefix:"ACCOUNT_"`
+	Passkey PasskeyConfig `envPrefix:"PASSKEY_"`
+	Guest   GuestConfig   `envPrefix:"GUEST_"`
+	Limiter LimiterConfig `envPrefix:"LIMITER_"`
+}
+
+// LimiterConfig caps failed logins per account and per address over a
+// sliding window, counted in a store that can be shared between instances
+type LimiterConfig struct {
+	// Store counts in memory, or in redis to share counts between instances
+	Store string `env:"STORE" envDefault:"memory" validate:"oneof=memory redis"`
+	// RedisURL of the redis store, e.g. redis://localhost:6379/0
+	RedisURL string `env:"REDIS_URL" validate:"required_if=Store redis,url"`
+	// Window failed logins are counted over
+	Window time.Duration `env:"WINDOW" envDefault:"1h" validate:"min=1m"`
+	// AccountLimit is the failed logins for an account in the window before its logins are refused, 0 for no limit
+	AccountLimit int `env:"ACCOUNT_LIMIT" envDefault:"50" validate:"min=0"`
+	// IPLimit is the failed logins from an address in the window before its logins are refused, 0 for no limit
+	IPLimit int `env:"IP_LIMIT" envDefault:"200" validate:"min=0"`
+}
+
+// GuestConfig lets clients start a guest session at /auth/guest and sign up
+// later at /users/{userID}/upgrade, keeping what the guest did
+type GuestConfig struct {
+	// Enabled mounts the guest endpoints
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+}
+
+// PasskeyConfig adds passwordless login with WebAuthn passkeys at
+// /auth/passkey/login, registered by each user under
+// /users/{userID}/passkeys
+type PasskeyConfig struct {
+	// Enabled mounts the passkey endpoints
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// RPID is the domain passkeys are bound to, e.g. example.com, it can't change later
+	RPID string `env:"RP_ID" validate:"required_if=Enabled true"`
+	// RPName is the name authenticators show for this site
+	RPName string `env:"RP_NAME" envDefault:"go-chi-microservice"`
+	// Origins the frontend is served from, e.g. https://app.example.com
+	Origins []string `env:"ORIGINS" envSeparator:"," validate:"required_if=Enabled true"`
+	// Timeout is how long the user has to answer their authenticator
+	Timeout time.Duration `env:"TIMEOUT" envDefault:"5m" validate:"min=30s"`
+}
+
+// AccountConfig adds email verification and password reset by emailed
+// link, sent through the MAIL_ backend
+type AccountConfig struct {
+	// Enabled mounts /auth/forgot-password, /auth/reset-password and /auth/verify-email
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// VerifyURL is the frontend page verification links open, the token is added as ?token=
+	VerifyURL string `env:"VERIFY_URL" validate:"required_if=Enabled true,url"`
+	// ResetURL is the frontend page reset links open, the token is added as ?token=
+	ResetURL string `env:"RESET_URL" validate:"required_if=Enabled true,url"`
+	// VerifyTTL is how long a verification link works
+	VerifyTTL time.Duration `env:"VERIFY_TTL" envDefault:"24h" validate:"min=1m"`
+	// ResetTTL is how long a reset link works
+	ResetTTL time.Duration `env:"RESET_TTL" envDefault:"1h" validate:"min=1m"`
+	// Store keeps link tokens in memory, or in redis to share them between instances
+	Store string `env:"STORE" envDefault:"memory" validate:"oneof=memory redis"`
+	// RedisURL of the redis store, e.g. redis://localhost:6379/0
+	RedisURL string `env:"REDIS_URL" validate:"required_if=Store redis,url"`
+}
+
+// TOTPConfig adds authenticator app codes as a second factor for password
+// logins, set up by each user under /users/{userID}/totp
+type TOTPConfig struct {
+	// Enabled mounts the enrollment endpoints and asks enrolled users for a code at login
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+}
+
+// SessionConfig adds cookie sessions for browser clients at
+// /auth/session/login, with CSRF checks on state changing requests
+type SessionConfig struct {
+	// Enabled mounts the session endpoints and accepts the session cookie on /users
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Store keeps sessions in memory, or in redis to share them between instances
+	Store string `env:"STORE" envDefault:"memory" validate:"oneof=memory redis"`
+	// RedisURL of the redis store, e.g. redis://localhost:6379/0
+	RedisURL string `env:"REDIS_URL" validate:"required_if=Store redis,url"`
+	// TTL is how long a session lasts
+	TTL time.Duration `env:"TTL" envDefault:"12h" validate:"min=1m"`
+	// CookieName of the session cookie
+	CookieName string `env:"COOKIE_NAME" envDefault:"session" validate:"required"`
+}
+
+// JWKSConfig accepts access tokens from an external identity provider,
+// verified against the keys it publishes. It's on when URL is set.
+type JWKSConfig struct {
+	// URL of the provider's key set, e.g. https://idp.example.com/.well-known/jwks.json
+	URL string `env:"URL" validate:"url"`
+	// Issuer tokens must carry in iss
+	Issuer string `env:"ISSUER" validate:"required_with=URL"`
+	// Audience tokens must carry in aud, unchecked when unset
+	Audience string `env:"AUDIENCE"`
+	// RefreshInterval is how often keys are refetched, unknown key ids refetch sooner
+	RefreshInterval time.Duration `env:"REFRESH_INTERVAL" envDefault:"1h" validate:"min=1m"`
+}
+
+// OIDCConfig adds sign in through an OpenID Connect provider, e.g. Google or
+// Keycloak, at /auth/oidc/login. It's on when IssuerURL is set.
+type OIDCConfig struct {
+	// IssuerURL of the provider, its discovery document is fetched at startup
+	IssuerURL string `env:"ISSUER_URL" validate:"url"`
+	// ClientID registered with the provider
+	ClientID string `env:"CLIENT_ID" validate:"required_with=IssuerURL"`
+	// ClientSecret registered with the provider, use an enc: value
+	ClientSecret string `env:"CLIENT_SECRET"`
+	// RedirectURL is this service's /auth/oidc/callback as the provider reaches it
+	RedirectURL string `env:"REDIRECT_URL" validate:"required_with=IssuerURL,url"`
+	// Scopes asked for besides openid
+	Scopes []string `env:"SCOPES" envSeparator:"," envDefault:"email,profile"`
+}
+
+// SentryConfig turns on error reporting of panics and 5xx responses when a
+// DSN is set
+type SentryConfig struct {
+	// DSN of the Sentry project, reporting is off when unset
+	DSN string `env:"DSN" validate:"url"`
+	// Environment events are tagged with
+	Environment string `env:"ENVIRONMENT" envDefault:"development"`
+}
+
+// RepositoryConfig stacks decorators over the storage backend
+// UserRulesConfig is what user ids and emails must look like, checked on
+// every write
+type UserRulesConfig struct {
+	// EmailStrictness checks addresses loosely (basic), by RFC 5322 with a DNS domain (standard) or as plain ASCII with a real looking domain (strict)
+	EmailStrictness string `env:"EMAIL_STRICTNESS" envDefault:"standard" validate:"oneof=basic standard strict"`
+	// EmailPlusAddressing keeps the +tag in bob+tag@example.com, strips it so one mailbox is one account, or rejects tagged addresses
+	EmailPlusAddressing string `env:"EMAIL_PLUS_ADDRESSING" envDefault:"keep" validate:"oneof=keep strip reject"`
+	// IDPattern is a regular expression ids given by clients must match, generated ids are hex
+	IDPattern string `env:"ID_PATTERN" envDefault:"^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$"`
+	// RequireIfMatch refuses writes to /users/{id} without an If-Match header with 428, off lets them through unconditionally
+	RequireIfMatch bool `env:"REQUIRE_IF_MATCH" envDefault:"true"`
+	// PurgeDeletedAfter removes soft deleted users for good once they've been deleted this long, 0 keeps them
+	PurgeDeletedAfter time.Duration `env:"PURGE_DELETED_AFTER" envDefault:"720h" validate:"min=0s"`
+	// PurgeInterval is how often soft deleted users are checked for purging
+	PurgeInterval time.Duration `env:"PURGE_INTERVAL" envDefault:"1h" validate:"min=1s"`
+}
+
+type RepositoryConfig struct {
+	// Decorators wrapped around the backend, outermost first
+	Decorators []string `env:"DECORATORS" envSeparator:"," envDefault:"tracing,metrics,breaker,retry,timeout" validate:"oneof=cache tracing metrics breaker retry timeout"`
+	// CacheTTL is how long the cache decorator keeps a user
+	CacheTTL time.Duration `env:"CACHE_TTL" envDefault:"1m" validate:"min=1s"`
+	// RetryAttempts is the total tries the retry decorator makes
+	RetryAttempts int `env:"RETRY_ATTEMPTS" envDefault:"3" validate:"min=1,max=10"`
+	// RetryBackoff is the base delay between retries, doubled each time
+	RetryBackoff time.Duration `env:"RETRY_BACKOFF" envDefault:"50ms"`
+	// BreakerThreshold is the consecutive failures that open the breaker
+	BreakerThreshold int `env:"BREAKER_THRESHOLD" envDefault:"5" validate:"min=1"`
+	// BreakerCooldown is how long the breaker fails fast before a trial call
+	BreakerCooldown time.Duration `env:"BREAKER_COOLDOWN" envDefault:"30s"`
+	// BatchSize is the most users sent to the backend in one bulk write
+	BatchSize int `env:"BATCH_SIZE" envDefault:"500" validate:"min=1,max=10000"`
+	// StatementTimeout is the most a single call may take under the timeout decorator
+	StatementTimeout time.Duration `env:"STATEMENT_TIMEOUT" envDefault:"5s" validate:"min=1ms"`
+	// DeadlineReserve is kept back from the request deadline for writing the error
+	DeadlineReserve time.Duration `env:"DEADLINE_RESERVE" envDefault:"100ms" validate:"min=0"`
+	// SnapshotPath saves the in-memory users to this JSON file and restores them on startup, empty keeps them in memory only
+	SnapshotPath string `env:"SNAPSHOT_PATH,expand"`
+	// SnapshotInterval is how often users written since the last snapshot are saved
+	SnapshotInterval time.Duration `env:"SNAPSHOT_INTERVAL" envDefault:"30s" validate:"min=1s"`
+	// DevStatesDir is where `devdata save` keeps named copies of the snapshot, and migrate one from before it runs
+	DevStatesDir string `env:"DEV_STATES_DIR,expand" envDefault:".devdata"`
+}
+
+// StaleConfig lets read endpoints fall back to their last good response when
+// the handler fails with a 5xx, e.g. while the repository breaker is open
+type StaleConfig struct {
+	// Enabled serves stale responses for failed reads
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// MaxAge is the oldest response that will be served stale
+	MaxAge time.Duration `env:"MAX_AGE" envDefault:"1h"`
+	// MaxEntries caps how many responses are kept
+	MaxEntries int `env:"MAX_ENTRIES" envDefault:"1000" validate:"min=1"`
+	// MaxBodyBytes skips caching responses larger than this
+	MaxBodyBytes int `env:"MAX_BODY_BYTES" envDefault:"1048576"`
+}
+
+// PaginationConfig bounds how much a list endpoint returns per request
+type PaginationConfig struct {
+	// DefaultLimit is the page size when a request gives no ?limit
+	DefaultLimit int `env:"DEFAULT_LIMIT" envDefault:"50" validate:"min=1"`
+	// MaxLimit is the largest ?limit any list accepts
+	MaxLimit int `env:"MAX_LIMIT" envDefault:"500" validate:"min=1"`
+	// RouteMaxLimits overrides MaxLimit per route, e.g. /users:100
+	RouteMaxLimits map[string]int `env:"ROUTE_MAX_LIMITS"`
+	// RequireLimit rejects list requests without a ?limit
+	RequireLimit bool `env:"REQUIRE_LIMIT" envDefault:"false"`
+	// Mode is what happens to a ?limit over the max, reject with a 400 or cap it
+	Mode string `env:"MODE" envDefault:"reject" validate:"oneof=reject cap"`
+}
+
+// ComplexityConfig scores the costly parts of a read, expansions, filters,
+// sorts and search terms, against a budget, so a single request can't ask
+// for a pathological amount of work
+type ComplexityConfig struct {
+	// Enabled scores reads and enforces the budget
+	Enabled bool `env:"ENABLED" envDefault:"true"`
+	// Budget is the highest score a request may have
+	Budget int `env:"BUDGET" envDefault:"100" validate:"min=1"`
+	// Mode rejects a request over budget with a 400, or downscopes it by dropping its deepest expansions until it fits, rejecting it only if that's not enough
+	Mode string `env:"MODE" envDefault:"reject" validate:"oneof=reject downscope"`
+	// ExpandWeight is the score of an expansion, times how deep it's nested
+	ExpandWeight int `env:"EXPAND_WEIGHT" envDefault:"10" validate:"min=0"`
+	// FilterWeight is the score of each ?filter= condition
+	FilterWeight int `env:"FILTER_WEIGHT" envDefault:"2" validate:"min=0"`
+	// ContainsWeight is the score of each ~ condition, in place of FilterWeight, as it can't use an index
+	ContainsWeight int `env:"CONTAINS_WEIGHT" envDefault:"5" validate:"min=0"`
+	// SortWeight is the score of each ?sort= field
+	SortWeight int `env:"SORT_WEIGHT" envDefault:"2" validate:"min=0"`
+	// SearchTermWeight is the score of each term of a search query
+	SearchTermWeight int `env:"SEARCH_TERM_WEIGHT" envDefault:"2" validate:"min=0"`
+	// SearchPatternWeight is the score of a wildcard, fuzzy or regexp search term, in place of SearchTermWeight
+	SearchPatternWeight int `env:"SEARCH_PATTERN_WEIGHT" envDefault:"20" validate:"min=0"`
+}
+
+// CORSConfig defaults to same origin only: with no AllowedOrigins no cross
+// origin request is allowed. DevMode allows any origin and header, never turn
+// it on in production.
+type CORSConfig struct {
+	// AllowedOrigins may make cross origin requests, none by default
+	AllowedOrigins []string `env:"ALLOWED_ORIGINS" envSeparator:","`
+	// AllowedMethods for cross origin requests
+	AllowedMethods []string `env:"ALLOWED_METHODS" envSeparator:"," envDefault:"GET,HEAD,POST" validate:"oneof=GET HEAD POST PUT PATCH DELETE OPTIONS"`
+	// AllowedHeaders cross origin requests may send
+	AllowedHeaders []string `env:"ALLOWED_HEADERS" envSeparator:"," envDefault:"Accept,Content-Type"`
+	// ExposedHeaders cross origin scripts may read
+	ExposedHeaders []string `env:"EXPOSED_HEADERS" envSeparator:","`
+	// AllowCredentials lets cross origin requests carry cookies and auth
+	AllowCredentials bool `env:"ALLOW_CREDENTIALS" envDefault:"false"`
+	// MaxAge in seconds browsers may cache a preflight
+	MaxAge int `env:"MAX_AGE" envDefault:"300" validate:"min=0"`
+	// DevMode allows any origin, method and header
+	DevMode bool `env:"DEV_MODE" envDefault:"false"`
+}
+
+// HeadersConfig holds the security headers set on every response. Setting one
+// to "-" leaves that header off.
+type HeadersConfig struct {
+	// ContentTypeOptions is the X-Content-Type-Options value
+	ContentTypeOptions string `env:"CONTENT_TYPE_OPTIONS" envDefault:"nosniff"`
+	// FrameOptions is the X-Frame-Options value
+	FrameOptions string `env:"FRAME_OPTIONS" envDefault:"DENY"`
+	// ReferrerPolicy is the Referrer-Policy value
+	ReferrerPolicy string `env:"REFERRER_POLICY" envDefault:"no-referrer"`
+	// ContentSecurityPolicy is the Content-Security-Policy value
+	ContentSecurityPolicy string `env:"CONTENT_SECURITY_POLICY" envDefault:"default-src 'none'; frame-ancestors 'none'"`
+	// HSTS is the Strict-Transport-Security value, only sent over TLS
+	HSTS string `env:"HSTS" envDefault:"max-age=63072000; includeSubDomains"`
+	// TrustForwardedProto counts X-Forwarded-Proto: https from a proxy as TLS
+	TrustForwardedProto bool `env:"TRUST_FORWARDED_PROTO" envDefault:"false"`
+}
+
+// NotifyConfig turns on notifications to users about their account, sent
+// over the channel each user picks per event
+type NotifyConfig struct {
+	// Enabled sends notifications and mounts /users/{userID}/notifications for preferences
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// TemplateDir holds <event>.tmpl files replacing the built in message templates
+	TemplateDir string `env:"TEMPLATE_DIR" validate:"dir"`
+	// RetryAttempts is how many times a notification is tried in total
+	RetryAttempts int `env:"RETRY_ATTEMPTS" envDefault:"3" validate:"min=1"`
+	// RetryBackoff is the wait before the second try, doubled after
+	RetryBackoff time.Duration `env:"RETRY_BACKOFF" envDefault:"1s" validate:"min=10ms"`
+	// RetryMaxBackoff caps the wait between tries
+	RetryMaxBackoff time.Duration `env:"RETRY_MAX_BACKOFF" envDefault:"10s"`
+
+	// TwilioAccountSID turns on the sms channel
+	TwilioAccountSID string `env:"TWILIO_ACCOUNT_SID"`
+	// TwilioAuthToken of the account, use an enc: value
+	TwilioAuthToken string `env:"TWILIO_AUTH_TOKEN" validate:"required_with=TwilioAccountSID"`
+	// TwilioFrom is the number texts are sent from, e.g. +15005550006
+	TwilioFrom string `env:"TWILIO_FROM" validate:"required_with=TwilioAccountSID"`
+
+	// WebhookURL turns on the webhook channel, notifications are posted there as JSON
+	WebhookURL string `env:"WEBHOOK_URL" validate:"url"`
+	// WebhookSecret signs webhook bodies in X-Signature-256, use an enc: value
+	WebhookSecret string `env:"WEBHOOK_SECRET" validate:"required_with=WebhookURL,min=32"`
+}
+
+// SCIMConfig lets an identity provider provision users through SCIM 2.0 at
+// /scim/v2, authenticating with a shared bearer token
+type SCIMConfig struct {
+	// Enabled mounts /scim/v2
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Token the identity provider sends as its bearer token, use an enc: value
+	Token string `env:"TOKEN" validate:"required_if=Enabled true,min=32"`
+}
+
+// MailConfig selects how email is sent
+type MailConfig struct {
+	// Backend logs messages instead of sending them, or sends through an SMTP relay
+	Backend string `env:"BACKEND" envDefault:"log" validate:"oneof=log smtp"`
+	// From is the sender address
+	From string `env:"FROM" envDefault:"no-reply@localhost"`
+	// SMTPAddr is host:port of the relay
+	SMTPAddr string `env:"SMTP_ADDR" validate:"required_if=Backend smtp"`
+	// SMTPUsername for PLAIN auth, none when unset
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	// SMTPPassword for PLAIN auth, use an enc: value
+	SMTPPassword string `env:"SMTP_PASSWORD"`
+}
+
+// WebhooksConfig lets other services subscribe to user events, managed on
+// the admin listener at /admin/webhooks
+type WebhooksConfig struct {
+	// Enabled delivers events and mounts /admin/webhooks
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Workers is how many deliveries are sent at once
+	Workers int `env:"WORKERS" envDefault:"4" validate:"min=1"`
+	// MaxAttempts before a delivery is marked failed
+	MaxAttempts int `env:"MAX_ATTEMPTS" envDefault:"6" validate:"min=1"`
+	// InitialBackoff before the second attempt, doubled each time
+	InitialBackoff time.Duration `env:"INITIAL_BACKOFF" envDefault:"1s" validate:"min=10ms"`
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration `env:"MAX_BACKOFF" envDefault:"5m"`
+	// Timeout for each attempt's request
+	Timeout time.Duration `env:"TIMEOUT" envDefault:"10s" validate:"min=1s"`
+}
+
+// EgressConfig keeps requests to URLs users supply, webhook deliveries and
+// avatar downloads, off the internal network and to the hosts allowed
+type EgressConfig struct {
+	// Enabled refuses webhook and avatar URLs, deliveries and downloads to hosts not allowed or addresses that are private, link local or loopback
+	Enabled bool `env:"ENABLED" envDefault:"true"`
+	// AllowHosts may be reached, *.example.com for subdomains; empty allows any public host
+	AllowHosts []string `env:"ALLOW_HOSTS" envSeparator:","`
+	// AllowCIDRs are private ranges that may be reached anyway, e.g. 10.20.0.0/16
+	AllowCIDRs []string `env:"ALLOW_CIDRS" envSeparator:","`
+}
+
+// EventsConfig keeps the user events published so they can be replayed
+// through /admin/events
+type EventsConfig struct {
+	// Enabled records events and mounts /admin/events
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Keep is how many of the latest events the in memory store holds
+	Keep int `env:"KEEP" envDefault:"100000" validate:"min=1"`
+	// ReplayMaxRate caps how many events a second a replay sends, and is the rate of those that don't pick one
+	ReplayMaxRate float64 `env:"REPLAY_MAX_RATE" envDefault:"100" validate:"min=1"`
+}
+
+// SearchConfig serves full text search over users at /users/search, the
+// index kept up to date as users are written
+type SearchConfig struct {
+	// Enabled mounts /users/search and indexes every user at startup
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Backend indexes in process with bleve, or in an Elasticsearch or OpenSearch cluster
+	Backend string `env:"BACKEND" envDefault:"bleve" validate:"oneof=bleve elasticsearch"`
+	// BleveDir keeps the bleve index on disk, empty keeps it in memory
+	BleveDir string `env:"BLEVE_DIR,expand"`
+	// ElasticURL of the cluster, e.g. http://localhost:9200
+	ElasticURL string `env:"ELASTIC_URL" validate:"required_if=Backend elasticsearch,url"`
+	// ElasticIndex users are indexed in, created with its mapping when missing
+	ElasticIndex string `env:"ELASTIC_INDEX" envDefault:"users" validate:"required_if=Backend elasticsearch"`
+	// ElasticUsername and ElasticPassword authenticate with basic auth when set
+	ElasticUsername string `env:"ELASTIC_USERNAME"`
+	// ElasticPassword for ElasticUsername, use an enc: value
+	ElasticPassword string `env:"ELASTIC_PASSWORD"`
+}
+
+// DocsConfig serves the request and response examples recorded by the
+// handler tests, see docs/examples
+type DocsConfig struct {
+	// Enabled mounts /docs/examples
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// ExamplesDir reads examples from disk instead of the embedded ones, to see fresh ones without rebuilding
+	ExamplesDir string `env:"EXAMPLES_DIR" validate:"dir"`
+}
+
+// AuditConfig records every mutating request, who made it and what it
+// changed, to a store listed at /admin/audit and an append only file
+type AuditConfig struct {
+	// Enabled records mutating requests on both listeners and mounts /admin/audit
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Store keeps entries in memory, or in redis to share them between instances
+	Store string `env:"STORE" envDefault:"memory" validate:"oneof=memory redis"`
+	// RedisURL of the redis store, e.g. redis://localhost:6379/0
+	RedisURL string `env:"REDIS_URL" validate:"required_if=Store redis,url"`
+	// Keep is how many of the latest entries the store holds
+	Keep int `env:"KEEP" envDefault:"100000" validate:"min=1"`
+	// FileEnabled also appends entries as JSON lines to LogDir/audit.log, rotated like server.log
+	FileEnabled bool `env:"FILE_ENABLED" envDefault:"false"`
+}
+
+// TenancyConfig serves several tenants from one deployment. Each request is
+// resolved to a tenant, and users are scoped to it in the repository.
+type TenancyConfig struct {
+	// Enabled resolves a tenant for every request to /users, /auth and SCIM, and scopes users to it
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Sources are tried in order for the tenant: the subdomain of BaseDomain, the Header, or the token's tenant claim
+	Sources []string `env:"SOURCES" envSeparator:"," envDefault:"subdomain,header,claim" validate:"oneof=subdomain header claim"`
+	// BaseDomain is the domain tenants are subdomains of, e.g. example.com for acme.example.com
+	BaseDomain string `env:"BASE_DOMAIN"`
+	// Header naming the tenant
+	Header string `env:"HEADER" envDefault:"X-Tenant-ID"`
+	// Allowed are the known tenants, others are refused, empty allows any well formed id
+	Allowed []string `env:"ALLOWED" envSeparator:","`
+	// Default is the tenant of requests that don't name one, empty refuses them
+	Default string `env:"DEFAULT"`
+}
+
+// StorageConfig selects where uploaded files are kept
+type StorageConfig struct {
+	// Backend keeps files on local disk, served by this service, or in an S3 bucket
+	Backend string `env:"BACKEND" envDefault:"disk" validate:"oneof=disk s3"`
+	// DiskDir holds the disk backend's files
+	DiskDir string `env:"DISK_DIR,expand" envDefault:"${HOME}/tmp/files"`
+	// DiskURL is where disk files are served, a path or a full URL, the path is mounted on the main listener
+	DiskURL string `env:"DISK_URL" envDefault:"/files"`
+	// DiskSecret signs the disk backend's upload and download URLs, random at startup when unset, use an enc: value
+	DiskSecret string `env:"DISK_SECRET" validate:"min=32"`
+	// S3Bucket files are kept in, credentials come from the usual AWS environment
+	S3Bucket string `env:"S3_BUCKET" validate:"required_if=Backend s3"`
+	// S3Endpoint replaces the AWS endpoint, e.g. http://localhost:9000 for MinIO
+	S3Endpoint string `env:"S3_ENDPOINT" validate:"url"`
+	// S3PublicURL is where clients read objects, e.g. a CDN, the bucket's own URL when unset
+	S3PublicURL string `env:"S3_PUBLIC_URL" validate:"url"`
+}
+
+// BackupConfig takes encrypted backups of the user store to the STORAGE_
+// backend, on a schedule when Enabled and with the backup command
+type BackupConfig struct {
+	// Enabled backs the users up every Interval while serving
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Interval between scheduled backups
+	Interval time.Duration `env:"INTERVAL" envDefault:"24h" validate:"min=1m"`
+	// Prefix is the storage key backups and their manifests are kept under
+	Prefix string `env:"PREFIX" envDefault:"backups/users" validate:"required"`
+	// Encryption encrypts backups to age recipients, or to keys wrapped by a KMS key
+	Encryption string `env:"ENCRYPTION" validate:"required_if=Enabled true,oneof=age kms"`
+	// AgeRecipients are the age public keys backups are encrypted to
+	AgeRecipients []string `env:"AGE_RECIPIENTS" envSeparator:"," validate:"required_if=Encryption age"`
+	// AgeIdentityFile holds an age identity to decrypt backups with, only needed to restore
+	AgeIdentityFile string `env:"AGE_IDENTITY_FILE" validate:"file"`
+	// KMSKeyID wraps each backup's key, credentials come from the usual AWS environment
+	KMSKeyID string `env:"KMS_KEY_ID" validate:"required_if=Encryption kms"`
+}
+
+// PublicIDsConfig shows clients encrypted ids in place of the stored ones,
+// so ids don't give away how many users there are or when they were made
+type PublicIDsConfig struct {
+	// Resources whose ids are encrypted, none by default
+	Resources []string `env:"RESOURCES" envSeparator:"," validate:"oneof=users"`
+	// Secret the ids are encrypted with, changing it changes every public id; use an enc: value
+	Secret string `env:"SECRET" validate:"required_with=Resources,min=32"`
+}
+
+// APIVersionConfig is how a request picks the version of the /users
+// payloads it sends and gets back
+type APIVersionConfig struct {
+	// Header a client names the version it speaks in, answered with the version served
+	Header string `env:"HEADER" envDefault:"API-Version" validate:"required"`
+	// Default is the version for requests without Header, 1 keeps clients from before versioning working
+	Default int `env:"DEFAULT" envDefault:"1" validate:"min=1"`
+}
+
+// EnvelopeConfig wraps response bodies in an envelope of data, meta and
+// links
+type EnvelopeConfig struct {
+	// Enabled wraps the responses of both listeners, errors included, in {"data", "meta", "links"}
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+}
+
+// AvatarConfig lets users upload a picture at /users/{userID}/avatar, kept
+// in the STORAGE_ backend
+type AvatarConfig struct {
+	// Enabled mounts /users/{userID}/avatar
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// MaxBytes is the largest picture accepted
+	MaxBytes int64 `env:"MAX_BYTES" envDefault:"2097152" validate:"min=1024"`
+	// ContentTypes accepted, checked against the file's content rather than what the client says
+	ContentTypes []string `env:"CONTENT_TYPES" envSeparator:"," envDefault:"image/png,image/jpeg,image/gif,image/webp" validate:"oneof=image/png image/jpeg image/gif image/webp"`
+	// URLs lets a JSON body give the url of a picture to download instead, held to the EGRESS_ policy
+	URLs bool `env:"URLS" envDefault:"false"`
+	// FetchTimeout bounds downloading a picture from a url, redirects included
+	FetchTimeout time.Duration `env:"FETCH_TIMEOUT" envDefault:"10s"`
+	// Process decodes each picture and stores it cropped square at Sizes in Format, its metadata stripped
+	Process bool `env:"PROCESS" envDefault:"false"`
+	// Sizes are the edge lengths in pixels of the pictures stored, AvatarURL is the largest
+	Sizes []int `env:"SIZES" envSeparator:"," envDefault:"512,128" validate:"min=1"`
+	// Format the pictures are stored in, webp needs a build with cgo
+	Format string `env:"FORMAT" envDefault:"webp" validate:"oneof=webp png jpeg"`
+	// Quality of webp and jpeg pictures, 1 to 100
+	Quality int `env:"QUALITY" envDefault:"80" validate:"min=1,max=100"`
+	// MaxPixels is the width times height of the largest picture decoded
+	MaxPixels int `env:"MAX_PIXELS" envDefault:"25000000" validate:"min=1"`
+	// Workers process pictures at once, 0 for one per CPU
+	Workers int `env:"WORKERS" envDefault:"0" validate:"min=0"`
+}
+
+// FilesConfig hands clients short lived signed URLs at
+// /users/{userID}/files to upload and download files straight to and from
+// the STORAGE_ backend, so large files bypass the service
+type FilesConfig struct {
+	// Enabled mounts /users/{userID}/files
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// URLTTL is how long a signed URL works
+	URLTTL time.Duration `env:"URL_TTL" envDefault:"15m" validate:"min=1m,max=168h"`
+}
+
+// AssetsConfig serves a static frontend from the main listener, the files
+// embedded from assets/dist unless Dir is set
+type AssetsConfig struct {
+	// Enabled mounts the assets at Path
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Path the assets are served under
+	Path string `env:"PATH" envDefault:"/ui"`
+	// Dir serves files from disk instead of the embedded ones, for working on the frontend without rebuilding
+	Dir string `env:"DIR" validate:"dir"`
+	// SPA serves index.html for unknown paths without a file extension, for client side routing
+	SPA bool `env:"SPA" envDefault:"true"`
+	// MaxAge browsers cache files without a content hash in their name, 0 revalidates each time
+	MaxAge time.Duration `env:"MAX_AGE" envDefault:"0s" validate:"min=0s"`
+	// ContentSecurityPolicy replaces the API's policy on asset responses, which would block scripts and styles
+	ContentSecurityPolicy string `env:"CONTENT_SECURITY_POLICY" envDefault:"default-src 'self'; frame-ancestors 'none'"`
+}
+
+// HTMLConfig renders HTML pages from views/templates for requests whose
+// Accept prefers text/html over JSON, e.g. a browser opening /users
+type HTMLConfig struct {
+	// Enabled negotiates HTML on the endpoints with pages, JSON stays the default
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// TemplatesDir reads templates from disk instead of the embedded ones, laid out like views/templates
+	TemplatesDir string `env:"TEMPLATES_DIR" validate:"dir,required_with=Reload"`
+	// Reload parses the templates from TemplatesDir again on every page, for development
+	Reload bool `env:"RELOAD" envDefault:"false"`
+	// ContentSecurityPolicy replaces the API's policy on pages, which would block their inline styles
+	ContentSecurityPolicy string `env:"CONTENT_SECURITY_POLICY" envDefault:"default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'"`
+}
+
+// CSVConfig covers users as CSV, exported at /users.csv and imported at
+// /users/import
+type CSVConfig struct {
+	// Columns exported when the request doesn't pick them with ?columns=
+	Columns []string `env:"COLUMNS" envSeparator:"," envDefault:"Id,Email,Phone,ManagerId,Disabled,EmailVerified" validate:"oneof=Id Email Phone ManagerId Disabled EmailVerified Guest AvatarURL"`
+	// ImportEnabled mounts POST /users/import
+	ImportEnabled bool `env:"IMPORT_ENABLED" envDefault:"false"`
+	// ImportMaxBytes is the largest CSV upload accepted
+	ImportMaxBytes int64 `env:"IMPORT_MAX_BYTES" envDefault:"10485760" validate:"min=1024"`
+}
+
+// BatchConfig bounds POST /users/batch-get and POST /users/batch
+type BatchConfig struct {
+	// MaxItems is the most ids or operations one request may carry
+	MaxItems int `env:"MAX_ITEMS" envDefault:"100" validate:"min=1,max=1000"`
+}
+
+// RPCConfig serves the users service over JSON-RPC 2.0, with the same
+// authentication as /users
+type RPCConfig struct {
+	// Enabled mounts the JSON-RPC endpoint at Path
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Path the endpoint is mounted at
+	Path string `env:"PATH" envDefault:"/rpc" validate:"required_if=Enabled true"`
+}
+
+// ConsumerConfig selects and tunes the message consumer
+type ConsumerConfig struct {
+	// Backend the consumer reads from
+	Backend string `env:"BACKEND" envDefault:"none" validate:"oneof=none sqs nats mqtt redis"`
+	// Concurrency is how many messages are handled at once
+	Concurrency int `env:"CONCURRENCY" envDefault:"4" validate:"min=1"`
+	// MaxAttempts before a message is dead lettered
+	MaxAttempts int `env:"MAX_ATTEMPTS" envDefault:"5" validate:"min=1"`
+	// InitialBackoff between handler retries, doubled each time
+	InitialBackoff time.Duration `env:"INITIAL_BACKOFF" envDefault:"100ms"`
+	// MaxBackoff caps the delay between handler retries
+	MaxBackoff time.Duration `env:"MAX_BACKOFF" envDefault:"10s"`
+	// StopTimeout is how long in-flight messages get to finish on shutdown
+	StopTimeout time.Duration `env:"STOP_TIMEOUT" envDefault:"30s"`
+
+	// SQSQueueURL is the queue read by the sqs backend
+	SQSQueueURL string `env:"SQS_QUEUE_URL" validate:"required_if=Backend sqs,url"`
+	// SQSDLQURL receives dead letters, logged only when unset
+	SQSDLQURL string `env:"SQS_DLQ_URL" validate:"url"`
+
+	// NATSURL of the server for the nats backend
+	NATSURL string `env:"NATS_URL" envDefault:"nats://127.0.0.1:4222" validate:"url"`
+	// NATSSubject subscribed to, wildcards allowed
+	NATSSubject string `env:"NATS_SUBJECT" envDefault:"users.>"`
+	// NATSQueue group shared by replicas
+	NATSQueue string `env:"NATS_QUEUE" envDefault:"go-chi-microservice"`
+	// NATSDLQSubject receives dead letters, logged only when unset
+	NATSDLQSubject string `env:"NATS_DLQ_SUBJECT"`
+
+	// MQTTURL of the broker for the mqtt backend, tcp://, ssl:// or ws://
+	MQTTURL string `env:"MQTT_URL" envDefault:"tcp://127.0.0.1:1883" validate:"url"`
+	// MQTTClientID must be unique per replica, e.g. the pod name
+	MQTTClientID string `env:"MQTT_CLIENT_ID" envDefault:"go-chi-microservice" validate:"required_if=Backend mqtt"`
+	// MQTTUsername to connect as, anonymous when unset
+	MQTTUsername string `env:"MQTT_USERNAME"`
+	// MQTTPassword for MQTTUsername, use an enc: value
+	MQTTPassword string `env:"MQTT_PASSWORD"`
+	// MQTTTopic filter the command messages are read from, / becomes . in
+	// the handler topic, so users/create is handled as users.create
+	MQTTTopic string `env:"MQTT_TOPIC" envDefault:"users/+" validate:"required_if=Backend mqtt"`
+	// MQTTGroup of the shared subscription replicas split messages over,
+	// every replica gets every message when unset
+	MQTTGroup string `env:"MQTT_GROUP" envDefault:"go-chi-microservice"`
+	// MQTTQoS of the subscription and of what's published
+	MQTTQoS int `env:"MQTT_QOS" envDefault:"1" validate:"oneof=0 1 2"`
+	// MQTTEventsTopic user events are published under, as
+	// <topic>/user.created and <topic>/user.updated, none when unset
+	MQTTEventsTopic string `env:"MQTT_EVENTS_TOPIC" envDefault:"users/events"`
+	// MQTTDLQTopic receives dead letters, logged only when unset
+	MQTTDLQTopic string `env:"MQTT_DLQ_TOPIC"`
+	// MQTTMaxReconnectInterval caps the backoff between reconnects
+	MQTTMaxReconnectInterval time.Duration `env:"MQTT_MAX_RECONNECT_INTERVAL" envDefault:"1m"`
+
+	// RedisURL of the server for the redis backend, e.g. redis://localhost:6379/0
+	RedisURL string `env:"REDIS_URL" envDefault:"redis://127.0.0.1:6379/0" validate:"url"`
+	// RedisStream read through a consumer group, created when missing
+	RedisStream string `env:"REDIS_STREAM" envDefault:"users" validate:"required_if=Backend redis"`
+	// RedisGroup shared by replicas
+	RedisGroup string `env:"REDIS_GROUP" envDefault:"go-chi-microservice" validate:"required_if=Backend redis"`
+	// RedisConsumerName of this replica in the group, the hostname when unset
+	RedisConsumerName string `env:"REDIS_CONSUMER_NAME"`
+	// RedisClaimIdle is how long an entry stays pending before another replica claims it, longer than handling with retries takes
+	RedisClaimIdle time.Duration `env:"REDIS_CLAIM_IDLE" envDefault:"5m" validate:"min=1s"`
+	// RedisMaxLen trims the streams the service adds to, to about this many entries, 0 never trims
+	RedisMaxLen int64 `env:"REDIS_MAX_LEN" envDefault:"100000" validate:"min=0"`
+	// RedisEventsStream user events are added to, with topic user.created or user.updated, none when unset
+	RedisEventsStream string `env:"REDIS_EVENTS_STREAM" envDefault:"users.events"`
+	// RedisDLQStream receives dead letters, logged only when unset
+	RedisDLQStream string `env:"REDIS_DLQ_STREAM"`
+}
+
+// MaintenanceConfig is the maintenance switch's starting position, flip it
+// at runtime through PUT /admin/maintenance
+type MaintenanceConfig struct {
+	// Enabled starts the instance in maintenance, answering 503 to all but health checks
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Reason is shown to clients while in maintenance
+	Reason string `env:"REASON"`
+	// RetryAfter is sent to clients in Retry-After while in maintenance
+	RetryAfter time.Duration `env:"RETRY_AFTER" envDefault:"5m" validate:"min=1s"`
+}
+
+// FlagsConfig picks where feature flags come from: static rules, or a flag
+// service speaking OpenFeature's remote evaluation protocol (OFREP)
+type FlagsConfig struct {
+	// Provider is static, rules from File and Set, or ofrep, asking the service at OFREPURL
+	Provider string `env:"PROVIDER" envDefault:"static" validate:"oneof=static ofrep"`
+	// File is a JSON object of flag rules, {"users-me": {"enabled": false, "users": ["u1"], "tenants": ["acme"], "percent": 10}}
+	File string `env:"FILE" validate:"file"`
+	// Set turns flags on or off for everyone, over File's rules, e.g. users-me=true
+	Set []string `env:"SET" envSeparator:","`
+	// OFREPURL is the flag service, e.g. flagd's http://localhost:8016
+	OFREPURL string `env:"OFREP_URL" validate:"required_if=Provider ofrep,url"`
+	// OFREPToken is sent to the flag service as a bearer token
+	OFREPToken string `env:"OFREP_TOKEN"`
+	// OFREPTimeout bounds each evaluation, the flag is off when it runs out
+	OFREPTimeout time.Duration `env:"OFREP_TIMEOUT" envDefault:"200ms" validate:"min=1ms"`
+}
+
+// Defaults is the config with every setting at its default, ignoring the
+// environment. Tests start from this.
+func Defaults() (*Config, error) {
+	cfg := &Config{}
+	if err := env.ParseWithOptions(cfg, env.Options{Environment: map[string]string{"HOME": os.TempDir()}}); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load parses the config from the environment, decrypting any enc: values
+// first, and validates it
+func Load() (*Config, error) {
+	environ, err := decryptEnv(env.ToMap(os.Environ()))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := env.ParseWithOptions(cfg, env.Options{Environment: environ}); err != nil {
+		return nil, err
+	}
+	if err := Validate(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
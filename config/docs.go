@@ -0,0 +1,183 @@
+package config
+
+import (
+	_ "embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"go-chi-microservice/redact"
+)
+
+// the field doc comments are the descriptions, embedding the source means
+// the docs can't drift from the struct
+//
+//go:embed config.go
+var configSource string
+
+// Setting describes one env var the config reads
+type Setting struct {
+	Env         string `json:"env"`
+	Field       string `json:"field"` // dotted path in Config, e.g. Admin.Addr
+	Type        string `json:"type"`
+	Default     string `json:"default,omitempty"`
+	Rules       string `json:"rules,omitempty"` // the validate tag
+	Description string `json:"description,omitempty"`
+}
+
+// Settings lists every setting in Config, in declaration order
+func Settings() ([]Setting, error) {
+	docs, err := fieldDocs(configSource)
+	if err != nil {
+		return nil, err
+	}
+	return collectSettings(reflect.TypeOf(Config{}), "", "", docs), nil
+}
+
+func collectSettings(t reflect.Type, path, prefix string, docs map[string]string) []Setting {
+	var settings []Setting
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fieldPath := f.Name
+		if path != "" {
+			fieldPath = path + "." + f.Name
+		}
+		if p, ok := f.Tag.Lookup("envPrefix"); ok && f.Type.Kind() == reflect.Struct {
+			settings = append(settings, collectSettings(f.Type, fieldPath, prefix+p, docs)...)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		settings = append(settings, Setting{
+			Env:         prefix + name,
+			Field:       fieldPath,
+			Type:        typeName(f),
+			Default:     f.Tag.Get("envDefault"),
+			Rules:       f.Tag.Get("validate"),
+			Description: docs[t.Name()+"."+f.Name],
+		})
+	}
+	return settings
+}
+
+func typeName(f reflect.StructField) string {
+	if f.Type.Kind() == reflect.Slice {
+		sep := f.Tag.Get("envSeparator")
+		if sep == "" {
+			sep = ","
+		}
+		return fmt.Sprintf("list of %s, %q separated", f.Type.Elem(), sep)
+	}
+	return f.Type.String()
+}
+
+// fieldDocs maps "Struct.Field" to the field's doc comment, or its trailing
+// comment when there's no doc
+func fieldDocs(src string) (map[string]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "config.go", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	docs := map[string]string{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		st, ok := spec.Type.(*ast.StructType)
+		if !ok {
+			return false
+		}
+		for _, field := range st.Fields.List {
+			text := field.Doc.Text()
+			if text == "" {
+				text = field.Comment.Text()
+			}
+			text = strings.Join(strings.Fields(text), " ")
+			for _, name := range field.Names {
+				docs[spec.Name.Name+"."+name.Name] = text
+			}
+		}
+		return false
+	})
+	return docs, nil
+}
+
+// WriteDocs writes the settings table in format, "table" for aligned plain
+// text or "markdown"
+func WriteDocs(w io.Writer, format string) error {
+	settings, err := Settings()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "", "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ENV\tTYPE\tDEFAULT\tRULES\tDESCRIPTION")
+		for _, s := range settings {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.Env, s.Type, s.Default, s.Rules, s.Description)
+		}
+		return tw.Flush()
+	case "markdown":
+		fmt.Fprintln(w, "| Env | Type | Default | Rules | Description |")
+		fmt.Fprintln(w, "|-----|------|---------|-------|-------------|")
+		for _, s := range settings {
+			fmt.Fprintf(w, "| `%s` | %s | %s | %s | %s |\n", s.Env, s.Type, mdCode(s.Default), mdCode(s.Rules), mdEscape(s.Description))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown docs format %q, want table or markdown", format)
+}
+
+// WriteValues writes each setting's effective value in cfg as ENV=value
+// lines, with secrets masked by name and shape so the output can be pasted
+// into a ticket
+func WriteValues(w io.Writer, cfg *Config) error {
+	settings, err := Settings()
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		fmt.Fprintf(w, "%s=%s\n", s.Env, redact.Value(s.Env, settingValue(reflect.ValueOf(cfg).Elem(), s.Field)))
+	}
+	return nil
+}
+
+// settingValue formats the field at path as it would be set in the env
+func settingValue(sv reflect.Value, path string) string {
+	var f reflect.StructField
+	for _, name := range strings.Split(path, ".") {
+		f, _ = sv.Type().FieldByName(name)
+		sv = sv.FieldByIndex(f.Index)
+	}
+	if sv.Kind() != reflect.Slice {
+		return fmt.Sprint(sv.Interface())
+	}
+	sep := f.Tag.Get("envSeparator")
+	if sep == "" {
+		sep = ","
+	}
+	vals := make([]string, sv.Len())
+	for i := range vals {
+		vals[i] = fmt.Sprint(sv.Index(i).Interface())
+	}
+	return strings.Join(vals, sep)
+}
+
+func mdCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + mdEscape(s) + "`"
+}
+
+func mdEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
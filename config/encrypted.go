@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// EncryptedPrefix marks a config value as ciphertext. The scheme follows it,
+// then base64 of the ciphertext:
+//
+//	enc:age:<base64 of `age -r <recipient>` output>
+//	enc:kms:<base64 of a KMS Encrypt CiphertextBlob>
+const EncryptedPrefix = "enc:"
+
+// Decrypter turns ciphertext from one scheme back into the value
+type Decrypter interface {
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// decryptEnv returns environ with every enc: value decrypted. The
+// decrypters are only set up if some value needs them, and every failure
+// is collected so one run shows all bad values.
+func decryptEnv(environ map[string]string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	decrypters := map[string]Decrypter{}
+	var errs []error
+	keys := make([]string, 0, len(environ))
+	for k := range environ {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := environ[k]
+		if !strings.HasPrefix(v, EncryptedPrefix) {
+			continue
+		}
+		scheme, data, ok := strings.Cut(strings.TrimPrefix(v, EncryptedPrefix), ":")
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: encrypted value must look like enc:<scheme>:<base64>", k))
+			continue
+		}
+		d, ok := decrypters[scheme]
+		if !ok {
+			var err error
+			if d, err = newDecrypter(ctx, scheme, environ); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", k, err))
+				continue
+			}
+			decrypters[scheme] = d
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: decoding base64: %w", k, err))
+			continue
+		}
+		plain, err := d.Decrypt(ctx, ciphertext)
+		if err != nil {
+			// never include the value itself, even encrypted, in the error
+			errs = append(errs, fmt.Errorf("%s: decrypting %s value: %w", k, scheme, err))
+			continue
+		}
+		environ[k] = string(plain)
+	}
+	return environ, errors.Join(errs...)
+}
+
+func newDecrypter(ctx context.Context, scheme string, environ map[string]string) (Decrypter, error) {
+	switch scheme {
+	case "age":
+		return newAgeDecrypter(environ)
+	case "kms":
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("loading aws config for kms: %w", err)
+		}
+		return &kmsDecrypter{client: kms.NewFromConfig(awsCfg)}, nil
+	default:
+		return nil, fmt.Errorf("unknown encryption scheme %q", scheme)
+	}
+}
+
+// ageDecrypter uses the identities from CONFIG_AGE_IDENTITY, or the
+// identity file at CONFIG_AGE_IDENTITY_FILE
+type ageDecrypter struct {
+	identities []age.Identity
+}
+
+func newAgeDecrypter(environ map[string]string) (*ageDecrypter, error) {
+	var src io.Reader
+	if key := environ["CONFIG_AGE_IDENTITY"]; key != "" {
+		src = strings.NewReader(key)
+	} else if path := environ["CONFIG_AGE_IDENTITY_FILE"]; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening age identity file: %w", err)
+		}
+		defer f.Close()
+		src = f
+	} else {
+		return nil, errors.New("age encrypted value but neither CONFIG_AGE_IDENTITY nor CONFIG_AGE_IDENTITY_FILE is set")
+	}
+	ids, err := age.ParseIdentities(src)
+	if err != nil {
+		return nil, fmt.Errorf("parsing age identities: %w", err)
+	}
+	return &ageDecrypter{identities: ids}, nil
+}
+
+func (a *ageDecrypter) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), a.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// kmsDecrypter calls KMS Decrypt, the key id is embedded in the ciphertext
+// blob so it needs no config beyond AWS credentials
+type kmsDecrypter struct {
+	client *kms.Client
+}
+
+func (k *kmsDecrypter) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
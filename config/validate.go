@@ -0,0 +1,217 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chi-microservice/redact"
+)
+
+// Problem is one invalid setting
+type Problem struct {
+	Env     string
+	Message string
+}
+
+// ValidationError lists every invalid setting at once, so a bad deploy can
+// be fixed in one go instead of one restart per mistake
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d invalid config setting(s):", len(e.Problems))
+	for _, p := range e.Problems {
+		fmt.Fprintf(&b, "\n  - %s: %s", p.Env, p.Message)
+	}
+	return b.String()
+}
+
+// Validate checks cfg against the validate struct tags. Rules are comma
+// separated, arguments space separated:
+//
+//	required              must be set
+//	required_if=F v       required when sibling field F equals v
+//	required_with=F       required when sibling field F is set
+//	min=n, max=n          bounds for numbers and durations, lengths for slices and strings
+//	oneof=a b c           allowed values, checked per element for slices
+//	url                   absolute URL with scheme and host
+//	file, dir             existing file or directory
+//
+// Only required rules apply to empty values.
+func Validate(cfg *Config) error {
+	v := &validator{}
+	v.walk(reflect.ValueOf(cfg).Elem(), "")
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) walk(sv reflect.Value, prefix string) {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		fv := sv.Field(i)
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Time{}) {
+			v.walk(fv, prefix+f.Tag.Get("envPrefix"))
+			continue
+		}
+		rules := f.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := prefix + strings.Split(f.Tag.Get("env"), ",")[0]
+		for _, rule := range strings.Split(rules, ",") {
+			key, arg, _ := strings.Cut(rule, "=")
+			if msg := v.check(sv, prefix, fv, key, arg); msg != "" {
+				v.problems = append(v.problems, Problem{Env: name, Message: redactProblem(name, fv, msg)})
+			}
+		}
+	}
+}
+
+// redactProblem keeps a secret setting's value out of its problem, e.g. a
+// malformed SENTRY_DSN, and masks secret shapes in any other value
+func redactProblem(name string, fv reflect.Value, msg string) string {
+	if redact.Field(name) && fv.Kind() == reflect.String && fv.Len() > 0 {
+		msg = strings.ReplaceAll(msg, strconv.Quote(fv.String()), redact.Mask)
+		msg = strings.ReplaceAll(msg, fv.String(), redact.Mask)
+	}
+	return redact.String(msg)
+}
+
+// check applies one rule, returning what is wrong or "" when it passes
+func (v *validator) check(parent reflect.Value, prefix string, fv reflect.Value, key, arg string) string {
+	switch key {
+	case "required":
+		if fv.IsZero() {
+			return "is required"
+		}
+		return ""
+	case "required_if":
+		field, want, _ := strings.Cut(arg, " ")
+		if fv.IsZero() && fmt.Sprint(fieldByPath(parent, field).Interface()) == want {
+			return fmt.Sprintf("is required when %s is %s", envName(parent.Type(), prefix, field), want)
+		}
+		return ""
+	case "required_with":
+		if fv.IsZero() && !fieldByPath(parent, arg).IsZero() {
+			return fmt.Sprintf("is required when %s is set", envName(parent.Type(), prefix, arg))
+		}
+		return ""
+	}
+	// unset strings and slices are left to the required rules, numbers are
+	// always checked since zero is a real value for them
+	if fv.IsZero() && (fv.Kind() == reflect.String || fv.Kind() == reflect.Slice) {
+		return ""
+	}
+	switch key {
+	case "min", "max":
+		return checkBound(fv, key, arg)
+	case "oneof":
+		allowed := strings.Fields(arg)
+		vals := []string{fmt.Sprint(fv.Interface())}
+		if fv.Kind() == reflect.Slice {
+			vals = vals[:0]
+			for i := 0; i < fv.Len(); i++ {
+				vals = append(vals, fmt.Sprint(fv.Index(i).Interface()))
+			}
+		}
+		for _, val := range vals {
+			if !contains(allowed, strings.TrimSpace(val)) {
+				return fmt.Sprintf("%q is not one of %s", val, strings.Join(allowed, ", "))
+			}
+		}
+	case "url":
+		u, err := url.Parse(fv.String())
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Sprintf("%q is not an absolute url", fv.String())
+		}
+	case "file", "dir":
+		info, err := os.Stat(fv.String())
+		if err != nil {
+			return fmt.Sprintf("%s does not exist", fv.String())
+		}
+		if info.IsDir() != (key == "dir") {
+			return fmt.Sprintf("%s is not a %s", fv.String(), key)
+		}
+	default:
+		return fmt.Sprintf("unknown validate rule %q", key)
+	}
+	return ""
+}
+
+// envName is the env var of the sibling field at path
+func envName(st reflect.Type, prefix, path string) string {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		f, _ := st.FieldByName(name)
+		prefix += f.Tag.Get("envPrefix")
+		st = f.Type
+	}
+	f, _ := st.FieldByName(names[len(names)-1])
+	return prefix + strings.Split(f.Tag.Get("env"), ",")[0]
+}
+
+// fieldByPath finds a sibling field, dots reach into nested structs
+func fieldByPath(sv reflect.Value, path string) reflect.Value {
+	for _, name := range strings.Split(path, ".") {
+		sv = sv.FieldByName(name)
+	}
+	return sv
+}
+
+func checkBound(fv reflect.Value, key, arg string) string {
+	var got, bound float64
+	var shown string
+	switch {
+	case fv.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Sprintf("bad %s bound %q", key, arg)
+		}
+		got, bound, shown = float64(fv.Int()), float64(d), time.Duration(fv.Int()).String()
+	case fv.Kind() == reflect.Slice:
+		n, _ := strconv.ParseFloat(arg, 64)
+		got, bound, shown = float64(fv.Len()), n, strconv.Itoa(fv.Len())+" items"
+	case fv.Kind() == reflect.String:
+		// only the length is shown, strings with a bound tend to be secrets
+		n, _ := strconv.ParseFloat(arg, 64)
+		got, bound, shown = float64(fv.Len()), n, strconv.Itoa(fv.Len())+" characters"
+	case fv.CanInt():
+		n, _ := strconv.ParseFloat(arg, 64)
+		got, bound, shown = float64(fv.Int()), n, strconv.FormatInt(fv.Int(), 10)
+	case fv.CanFloat():
+		n, _ := strconv.ParseFloat(arg, 64)
+		got, bound, shown = fv.Float(), n, strconv.FormatFloat(fv.Float(), 'g', -1, 64)
+	default:
+		return ""
+	}
+	if key == "min" && got < bound {
+		return fmt.Sprintf("must be at least %s (got %s)", arg, shown)
+	}
+	if key == "max" && got > bound {
+		return fmt.Sprintf("must be at most %s (got %s)", arg, shown)
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+// Package connlimit caps the connections a listener holds open, in total and
+// per client IP, so a flood of connections can't exhaust file descriptors
+// and goroutines before a request is ever read. Rate limits and timeouts
+// work per request, these work on the connections underneath.
+package connlimit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/netutil"
+)
+
+var (
+	openConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_connections_open",
+		Help: "Connections open on a listener.",
+	}, []string{"listener"})
+	rejectedConns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_connections_rejected_total",
+		Help: "Connections closed on accept for being over a limit, by the limit, max or per_ip.",
+	}, []string{"listener", "limit"})
+)
+
+// Options are a listener's limits, 0 for no limit
+type Options struct {
+	Name  string // the listener, for metrics
+	Max   int    // connections open at once
+	PerIP int    // connections open at once from one client IP
+	// Queue leaves connections over Max waiting in the kernel's backlog
+	// until one closes, rather than closing them on accept. Connections
+	// over PerIP are always closed, one client shouldn't hold up the rest.
+	Queue bool
+	// TLS is for a listener whose connections are handed to TLS, a
+	// rejected one is closed without the plaintext 503 its client couldn't
+	// read
+	TLS bool
+}
+
+// rejectResponse answers a plain HTTP connection closed for being over a
+// limit, so its client sees why rather than a reset
+const rejectResponse = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nRetry-After: 1\r\nContent-Length: 0\r\n\r\n"
+
+// Wrap returns ln enforcing opts, with every connection counted in the open
+// connections gauge
+func Wrap(ln net.Listener, opts Options) net.Listener {
+	if opts.Max > 0 && opts.Queue {
+		ln = netutil.LimitListener(ln, opts.Max)
+		opts.Max = 0
+	}
+	return &listener{Listener: ln, opts: opts, perIP: map[string]int{}}
+}
+
+type listener struct {
+	net.Listener
+	opts Options
+
+	mu    sync.Mutex
+	open  int
+	perIP map[string]int
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(c)
+		if limit := l.acquire(ip); limit != "" {
+			rejectedConns.WithLabelValues(l.opts.Name, limit).Inc()
+			reject(c, l.opts.TLS)
+			continue
+		}
+		openConns.WithLabelValues(l.opts.Name).Inc()
+		return &conn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// acquire counts a connection from ip, or returns the limit it's over
+func (l *listener) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.Max > 0 && l.open >= l.opts.Max {
+		return "max"
+	}
+	if l.opts.PerIP > 0 && l.perIP[ip] >= l.opts.PerIP {
+		return "per_ip"
+	}
+	l.open++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *listener) release(ip string) {
+	l.mu.Lock()
+	l.open--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	l.mu.Unlock()
+	openConns.WithLabelValues(l.opts.Name).Dec()
+}
+
+// reject answers c with a 503 and closes it, without waiting on a client
+// that doesn't read. A TLS connection is just closed, its client is
+// expecting a handshake.
+func reject(c net.Conn, tls bool) {
+	if !tls {
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.Write([]byte(rejectResponse))
+	}
+	c.Close()
+}
+
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// conn releases its slot once, however often it's closed
+type conn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,285 @@
+// Package consumer is the subscribing side of the template. A Consumer pulls
+// messages from a Source, routes them to the Handler registered for their
+// topic, retries failures with backoff and hands messages that keep failing
+// to a DeadLetter sink.
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/redact"
+)
+
+// ErrNoHandler is passed to the dead letter sink for messages on a topic
+// nothing is registered for
+var ErrNoHandler = errors.New("no handler for topic")
+
+type Message struct {
+	ID         string
+	Topic      string
+	Body       []byte
+	Attributes map[string]string
+	// Attempt is 1 on first delivery and counts up through local retries
+	Attempt int
+}
+
+// Delivery is a received message along with the callbacks used to settle it
+// with the broker it came from
+type Delivery struct {
+	Message
+	// Ack marks the message done so the broker won't redeliver it
+	Ack func(ctx context.Context) error
+	// Nack gives the message back to the broker for redelivery
+	Nack func(ctx context.Context) error
+}
+
+// Source is a broker subscription. Receive blocks until at least one message
+// is available or ctx is done.
+type Source interface {
+	Receive(ctx context.Context) ([]*Delivery, error)
+	Close() error
+}
+
+type Handler interface {
+	Handle(ctx context.Context, msg *Message) error
+}
+
+type HandlerFunc func(ctx context.Context, msg *Message) error
+
+func (f HandlerFunc) Handle(ctx context.Context, msg *Message) error {
+	return f(ctx, msg)
+}
+
+// DeadLetter receives messages that exhausted their retries
+type DeadLetter interface {
+	DeadLetter(ctx context.Context, msg *Message, cause error) error
+}
+
+// LogDeadLetter just logs dead messages, the default when no sink is set.
+// Bodies are redacted, they can carry tokens or passwords.
+type LogDeadLetter struct{}
+
+func (LogDeadLetter) DeadLetter(ctx context.Context, msg *Message, cause error) error {
+	zerolog.Ctx(ctx).Error().Err(cause).Bytes("body", redact.JSON(msg.Body)).Msg("message dead lettered")
+	return nil
+}
+
+type Options struct {
+	// Concurrency is the number of messages handled at once
+	Concurrency int
+	// MaxAttempts is how many times a message is tried before dead lettering
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// StopTimeout bounds how long Run waits for in-flight messages on stop
+	// before cancelling their contexts
+	StopTimeout time.Duration
+	DeadLetter  DeadLetter
+}
+
+func (o *Options) withDefaults() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 10 * time.Second
+	}
+	if o.StopTimeout <= 0 {
+		o.StopTimeout = 30 * time.Second
+	}
+	if o.DeadLetter == nil {
+		o.DeadLetter = LogDeadLetter{}
+	}
+}
+
+type Consumer struct {
+	name     string
+	source   Source
+	logger   zerolog.Logger
+	opts     Options
+	handlers map[string]Handler
+}
+
+func New(name string, source Source, logger *zerolog.Logger, opts Options) *Consumer {
+	opts.withDefaults()
+	return &Consumer{
+		name:     name,
+		source:   source,
+		logger:   logger.With().Str("consumer", name).Logger(),
+		opts:     opts,
+		handlers: map[string]Handler{},
+	}
+}
+
+// Handle registers h for messages on topic. Register before calling Run.
+func (c *Consumer) Handle(topic string, h Handler) {
+	c.handlers[topic] = h
+}
+
+func (c *Consumer) HandleFunc(topic string, fn func(ctx context.Context, msg *Message) error) {
+	c.Handle(topic, HandlerFunc(fn))
+}
+
+// Run receives and handles messages until ctx is done. On stop it quits
+// receiving, waits up to StopTimeout for in-flight messages and then closes
+// the source.
+func (c *Consumer) Run(ctx context.Context) error {
+	c.logger.Info().Int("concurrency", c.opts.Concurrency).Msg("consumer starting")
+
+	// in-flight handlers outlive ctx so a stop doesn't abort them half done
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.opts.Concurrency)
+	var runErr error
+receive:
+	for {
+		deliveries, err := c.source.Receive(ctx)
+		if ctx.Err() != nil {
+			// nack anything that raced in with the stop so it isn't lost
+			for _, d := range deliveries {
+				c.settle(handlerCtx, d, d.Nack, "nack")
+			}
+			break
+		}
+		if err != nil {
+			c.logger.Error().Err(err).Msg("receive failed")
+			if !sleep(ctx, c.opts.InitialBackoff) {
+				break
+			}
+			continue
+		}
+		for i, d := range deliveries {
+			if !acquire(ctx, sem) {
+				for _, rest := range deliveries[i:] {
+					c.settle(handlerCtx, rest, rest.Nack, "nack")
+				}
+				break receive
+			}
+			wg.Add(1)
+			go func(d *Delivery) {
+				defer func() { <-sem; wg.Done() }()
+				c.process(handlerCtx, d)
+			}(d)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(c.opts.StopTimeout):
+		c.logger.Warn().Dur("timeout", c.opts.StopTimeout).Msg("in-flight messages did not finish, cancelling")
+		cancelHandlers()
+		<-done
+	}
+	if err := c.source.Close(); err != nil {
+		runErr = fmt.Errorf("closing source: %w", err)
+	}
+	c.logger.Info().Msg("consumer stopped")
+	return runErr
+}
+
+// process runs the handler for d with retries and settles the delivery
+func (c *Consumer) process(ctx context.Context, d *Delivery) {
+	msg := &d.Message
+	logger := c.logger.With().Str("msg_id", msg.ID).Str("topic", msg.Topic).Logger()
+	ctx = logger.WithContext(ctx)
+
+	h, ok := c.handlers[msg.Topic]
+	if !ok {
+		c.deadLetter(ctx, d, ErrNoHandler)
+		return
+	}
+
+	var err error
+	for attempt := 1; attempt <= c.opts.MaxAttempts; attempt++ {
+		msg.Attempt = attempt
+		mctx := logger.With().Int("attempt", attempt).Logger().WithContext(ctx)
+		if err = c.call(mctx, h, msg); err == nil {
+			c.settle(ctx, d, d.Ack, "ack")
+			return
+		}
+		zerolog.Ctx(mctx).Warn().Err(err).Msg("handler failed")
+		if attempt < c.opts.MaxAttempts && !sleep(ctx, c.backoff(attempt)) {
+			// cancelled mid retry, let the broker redeliver it later
+			c.settle(context.WithoutCancel(ctx), d, d.Nack, "nack")
+			return
+		}
+	}
+	c.deadLetter(ctx, d, err)
+}
+
+// call invokes the handler, turning a panic into an error
+func (c *Consumer) call(ctx context.Context, h Handler, msg *Message) (err error) {
+	defer func() {
+		if rvr := recover(); rvr != nil {
+			err = fmt.Errorf("handler panic: %v", rvr)
+		}
+	}()
+	return h.Handle(ctx, msg)
+}
+
+func (c *Consumer) deadLetter(ctx context.Context, d *Delivery, cause error) {
+	if err := c.opts.DeadLetter.DeadLetter(ctx, &d.Message, cause); err != nil {
+		// couldn't park it, leave it with the broker rather than drop it
+		zerolog.Ctx(ctx).Error().Err(err).Msg("dead letter failed")
+		c.settle(ctx, d, d.Nack, "nack")
+		return
+	}
+	c.settle(ctx, d, d.Ack, "ack")
+}
+
+func (c *Consumer) settle(ctx context.Context, d *Delivery, fn func(context.Context) error, what string) {
+	if fn == nil {
+		return
+	}
+	if err := fn(ctx); err != nil {
+		c.logger.Error().Err(err).Str("msg_id", d.ID).Msgf("%s failed", what)
+	}
+}
+
+// backoff is exponential with full jitter, capped at MaxBackoff
+func (c *Consumer) backoff(attempt int) time.Duration {
+	d := c.opts.InitialBackoff << (attempt - 1)
+	if d <= 0 || d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// acquire takes a concurrency slot, returning false if ctx finished first
+func acquire(ctx context.Context, sem chan struct{}) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleep waits for d, returning false if ctx finished first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,274 @@
+// Package mqtt is an example consumer.Source backed by an MQTT
+// subscription, with a Publisher for the other direction, for IoT style
+// clients that speak MQTT rather than a cloud queue
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/consumer"
+)
+
+type ConnOptions struct {
+	// URL of the broker, tcp://, ssl:// or ws://
+	URL string
+	// ClientID must be unique per replica, the broker drops the older of
+	// two connections with the same one
+	ClientID string
+	Username string
+	Password string
+	// MaxReconnectInterval caps the backoff between reconnect attempts
+	MaxReconnectInterval time.Duration
+}
+
+// Conn is a client that reconnects on its own when the connection drops.
+// The session is kept, so the broker holds QoS 1 and 2 messages while it's
+// away, and subscriptions are renewed on every reconnect in case the broker
+// lost them.
+type Conn struct {
+	client paho.Client
+	logger zerolog.Logger
+
+	mu   sync.Mutex
+	subs map[string]subscription
+}
+
+type subscription struct {
+	qos     byte
+	handler paho.MessageHandler
+}
+
+// Connect dials the broker, failing if the first attempt does
+func Connect(opts ConnOptions, logger *zerolog.Logger) (*Conn, error) {
+	c := &Conn{logger: logger.With().Str("mqtt", opts.URL).Logger(), subs: map[string]subscription{}}
+	o := paho.NewClientOptions().
+		AddBroker(opts.URL).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(opts.MaxReconnectInterval).
+		// messages are acked once handled and handled concurrently, see
+		// Source
+		SetAutoAckDisabled(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(c.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			c.logger.Warn().Err(err).Msg("mqtt connection lost, reconnecting")
+		})
+	c.client = paho.NewClient(o)
+	if t := c.client.Connect(); t.Wait() && t.Error() != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", opts.URL, t.Error())
+	}
+	return c, nil
+}
+
+func (c *Conn) onConnect(client paho.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for filter, s := range c.subs {
+		if t := client.Subscribe(filter, s.qos, s.handler); t.Wait() && t.Error() != nil {
+			c.logger.Error().Err(t.Error()).Str("filter", filter).Msg("mqtt resubscribe failed")
+		}
+	}
+	if len(c.subs) > 0 {
+		c.logger.Info().Msg("mqtt reconnected")
+	}
+}
+
+// Subscribe calls h for messages matching filter, now and after every
+// reconnect
+func (c *Conn) Subscribe(ctx context.Context, filter string, qos byte, h paho.MessageHandler) error {
+	c.mu.Lock()
+	c.subs[filter] = subscription{qos: qos, handler: h}
+	c.mu.Unlock()
+	if err := wait(ctx, c.client.Subscribe(filter, qos, h)); err != nil {
+		return fmt.Errorf("subscribing to %s: %w", filter, err)
+	}
+	return nil
+}
+
+func (c *Conn) Unsubscribe(ctx context.Context, filter string) error {
+	c.mu.Lock()
+	delete(c.subs, filter)
+	c.mu.Unlock()
+	return wait(ctx, c.client.Unsubscribe(filter))
+}
+
+// Publish sends payload to topic and waits for the broker to take it, for
+// QoS 1 and 2. While disconnected it waits for the reconnect or ctx.
+func (c *Conn) Publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	return wait(ctx, c.client.Publish(topic, qos, false, payload))
+}
+
+func wait(ctx context.Context, t paho.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type Options struct {
+	// Topic filter to subscribe to, wildcards are fine. The concrete topic
+	// of each message, with / turned into ., is used as its topic, so
+	// users/touched is handled as users.touched.
+	Topic string
+	// Group makes it a shared subscription, so replicas share the work
+	// instead of each getting every message. The broker must support them,
+	// most do for MQTT 3.1.1 as well as 5.
+	Group string
+	// QoS of the subscription, 1 or 2 for messages to be redelivered when
+	// the service stops before acking them
+	QoS byte
+}
+
+// Source is an MQTT subscription. MQTT has no negative ack, so Nack
+// republishes the message to its topic.
+type Source struct {
+	conn   *Conn
+	filter string
+	qos    byte
+	msgs   chan paho.Message
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewSource(ctx context.Context, conn *Conn, opts Options) (*Source, error) {
+	s := &Source{conn: conn, filter: opts.Topic, qos: opts.QoS, msgs: make(chan paho.Message), done: make(chan struct{})}
+	if opts.Group != "" {
+		s.filter = "$share/" + opts.Group + "/" + opts.Topic
+	}
+	err := conn.Subscribe(ctx, s.filter, s.qos, func(_ paho.Client, m paho.Message) {
+		select {
+		case s.msgs <- m:
+		case <-s.done:
+			// left unacked, the broker redelivers it to the next session
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Source) Receive(ctx context.Context) ([]*consumer.Delivery, error) {
+	var m paho.Message
+	select {
+	case m = <-s.msgs:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []*consumer.Delivery{{
+		Message: consumer.Message{
+			ID:    fmt.Sprint(m.MessageID()),
+			Topic: strings.ReplaceAll(m.Topic(), "/", "."),
+			Body:  m.Payload(),
+		},
+		Ack: func(ctx context.Context) error {
+			m.Ack()
+			return nil
+		},
+		Nack: func(ctx context.Context) error {
+			if err := s.conn.Publish(ctx, m.Topic(), s.qos, m.Payload()); err != nil {
+				return err
+			}
+			m.Ack()
+			return nil
+		},
+	}}, nil
+}
+
+func (s *Source) Close() error {
+	s.once.Do(func() { close(s.done) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.conn.Unsubscribe(ctx, s.filter)
+}
+
+// DeadLetter publishes dead messages to Topic. MQTT 3.1.1 messages have no
+// headers, so the failure and the original message are wrapped in a JSON
+// envelope.
+type DeadLetter struct {
+	conn  *Conn
+	topic string
+	qos   byte
+}
+
+func NewDeadLetter(conn *Conn, topic string, qos byte) *DeadLetter {
+	return &DeadLetter{conn: conn, topic: topic, qos: qos}
+}
+
+type deadLetter struct {
+	Topic    string `json:"topic"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	// Body is the message when it's JSON, RawBody otherwise
+	Body    json.RawMessage `json:"body,omitempty"`
+	RawBody []byte          `json:"raw_body,omitempty"`
+}
+
+func (d *DeadLetter) DeadLetter(ctx context.Context, msg *consumer.Message, cause error) error {
+	dl := deadLetter{Topic: msg.Topic, Error: cause.Error(), Attempts: msg.Attempt}
+	if json.Valid(msg.Body) {
+		dl.Body = msg.Body
+	} else {
+		dl.RawBody = msg.Body
+	}
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return d.conn.Publish(ctx, d.topic, d.qos, body)
+}
+
+// Event is what Publisher sends
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+// Publisher sends events to Topic/<event>, e.g. users/events/user.created.
+// It doesn't hold up the caller waiting for the broker, failures are
+// logged.
+type Publisher struct {
+	conn   *Conn
+	topic  string
+	qos    byte
+	logger *zerolog.Logger
+}
+
+func NewPublisher(conn *Conn, topic string, qos byte, logger *zerolog.Logger) *Publisher {
+	return &Publisher{conn: conn, topic: strings.TrimSuffix(topic, "/"), qos: qos, logger: logger}
+}
+
+func (p *Publisher) Publish(ctx context.Context, event string, data any) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if err := p.Send(ctx, event, time.Now(), data); err != nil {
+			p.logger.Error().Err(err).Str("event", event).Msg("publishing mqtt event")
+		}
+	}()
+}
+
+// Send publishes an event that happened at t and waits for the broker to
+// take it
+func (p *Publisher) Send(ctx context.Context, event string, t time.Time, data any) error {
+	body, err := json.Marshal(Event{Event: event, Time: t, Data: data})
+	if err != nil {
+		return err
+	}
+	return p.conn.Publish(ctx, p.topic+"/"+event, p.qos, body)
+}
@@ -0,0 +1,87 @@
+// Package nats is an example consumer.Source backed by a NATS subscription
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	natsgo "github.com/nats-io/nats.go"
+
+	"go-chi-microservice/consumer"
+)
+
+type Options struct {
+	// Subject to subscribe to, wildcards are fine. The concrete subject of
+	// each message is used as its topic.
+	Subject string
+	// Queue group name, so replicas share the work instead of each getting
+	// every message
+	Queue string
+}
+
+// Source is a core NATS queue subscription. Core NATS has no redelivery, so
+// Nack republishes the message to its subject.
+type Source struct {
+	conn *natsgo.Conn
+	sub  *natsgo.Subscription
+}
+
+func NewSource(conn *natsgo.Conn, opts Options) (*Source, error) {
+	sub, err := conn.QueueSubscribeSync(opts.Subject, opts.Queue)
+	if err != nil {
+		return nil, fmt.Errorf("subscribing to %s: %w", opts.Subject, err)
+	}
+	return &Source{conn: conn, sub: sub}, nil
+}
+
+func (s *Source) Receive(ctx context.Context) ([]*consumer.Delivery, error) {
+	m, err := s.sub.NextMsgWithContext(ctx)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	attrs := make(map[string]string, len(m.Header))
+	for k := range m.Header {
+		attrs[k] = m.Header.Get(k)
+	}
+	return []*consumer.Delivery{{
+		Message: consumer.Message{
+			ID:         m.Header.Get(natsgo.MsgIdHdr),
+			Topic:      m.Subject,
+			Body:       m.Data,
+			Attributes: attrs,
+		},
+		Ack: func(ctx context.Context) error { return nil },
+		Nack: func(ctx context.Context) error {
+			return s.conn.PublishMsg(&natsgo.Msg{Subject: m.Subject, Header: m.Header, Data: m.Data})
+		},
+	}}, nil
+}
+
+func (s *Source) Close() error {
+	return s.sub.Drain()
+}
+
+// DeadLetter publishes dead messages to Subject with the failure in headers
+type DeadLetter struct {
+	conn    *natsgo.Conn
+	subject string
+}
+
+func NewDeadLetter(conn *natsgo.Conn, subject string) *DeadLetter {
+	return &DeadLetter{conn: conn, subject: subject}
+}
+
+func (d *DeadLetter) DeadLetter(ctx context.Context, msg *consumer.Message, cause error) error {
+	h := natsgo.Header{}
+	for k, v := range msg.Attributes {
+		h.Set(k, v)
+	}
+	h.Set("X-Original-Subject", msg.Topic)
+	h.Set("X-Error", cause.Error())
+	h.Set("X-Attempts", fmt.Sprint(msg.Attempt))
+	return d.conn.PublishMsg(&natsgo.Msg{Subject: d.subject, Header: h, Data: msg.Body})
+}
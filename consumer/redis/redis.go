@@ -0,0 +1,238 @@
+// Package redis is an example consumer.Source backed by a Redis stream read
+// through a consumer group, with a Publisher for adding to streams, for
+// teams that run Redis but not a message broker. Needs Redis 6.2 or later.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"go-chi-microservice/consumer"
+)
+
+// entry fields, any others are passed on as attributes
+const (
+	TopicField = "topic"
+	BodyField  = "body"
+)
+
+type Options struct {
+	// Stream read, created along with the group when missing
+	Stream string
+	// Group replicas share, each entry goes to one of them
+	Group string
+	// Consumer names this replica in the group, the hostname by default.
+	// A replica restarting under the same name first goes through the
+	// entries it left pending, without waiting for ClaimIdle.
+	Consumer string
+	// Topic is used for entries without a topic field, defaults to Stream
+	Topic string
+	// Count is the most entries read at once
+	Count int64
+	// Block is how long a read waits for new entries
+	Block time.Duration
+	// ClaimIdle is how long an entry may stay pending, read but not acked,
+	// before another consumer claims it. It covers consumers that died
+	// mid-message and entries that were nacked, and must be longer than a
+	// message takes to handle, retries included.
+	ClaimIdle time.Duration
+}
+
+// Source reads a stream with XREADGROUP and acks with XACK. Streams have no
+// negative ack, a nacked entry stays pending and is claimed again once it's
+// been idle for ClaimIdle.
+type Source struct {
+	client *goredis.Client
+	opts   Options
+
+	mu        sync.Mutex
+	pending   string // where reading this consumer's own pending entries continues, empty once done
+	lastClaim time.Time
+	cursor    string // where the next XAUTOCLAIM sweep continues
+}
+
+func NewSource(ctx context.Context, client *goredis.Client, opts Options) (*Source, error) {
+	if opts.Consumer == "" {
+		opts.Consumer, _ = os.Hostname()
+	}
+	if opts.Topic == "" {
+		opts.Topic = opts.Stream
+	}
+	if opts.Count <= 0 {
+		opts.Count = 10
+	}
+	if opts.Block <= 0 {
+		opts.Block = 5 * time.Second
+	}
+	if opts.ClaimIdle <= 0 {
+		opts.ClaimIdle = time.Minute
+	}
+	// $ leaves what the stream already holds to groups that existed before
+	err := client.XGroupCreateMkStream(ctx, opts.Stream, opts.Group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("creating group %s on %s: %w", opts.Group, opts.Stream, err)
+	}
+	return &Source{client: client, opts: opts, pending: "0", cursor: "0-0"}, nil
+}
+
+// Receive starts with the entries this consumer left pending last time,
+// then reads new ones, claiming stale pending entries in between at most
+// every half ClaimIdle
+func (s *Source) Receive(ctx context.Context) ([]*consumer.Delivery, error) {
+	if claimed, err := s.claim(ctx); err != nil || len(claimed) > 0 {
+		return s.deliveries(claimed), err
+	}
+	s.mu.Lock()
+	pending := s.pending
+	s.mu.Unlock()
+	args := &goredis.XReadGroupArgs{
+		Group:    s.opts.Group,
+		Consumer: s.opts.Consumer,
+		Streams:  []string{s.opts.Stream, ">"},
+		Count:    s.opts.Count,
+		Block:    s.opts.Block,
+	}
+	if pending != "" {
+		// an id reads the consumer's pending entries after it rather than
+		// new ones
+		args.Streams[1], args.Block = pending, -1
+	}
+	streams, err := s.client.XReadGroup(ctx, args).Result()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	var msgs []goredis.XMessage
+	for _, st := range streams {
+		msgs = append(msgs, st.Messages...)
+	}
+	if pending != "" {
+		s.mu.Lock()
+		s.pending = ""
+		if len(msgs) > 0 {
+			s.pending = msgs[len(msgs)-1].ID
+		}
+		s.mu.Unlock()
+	}
+	return s.deliveries(msgs), nil
+}
+
+func (s *Source) claim(ctx context.Context) ([]goredis.XMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cursor == "0-0" && time.Since(s.lastClaim) < s.opts.ClaimIdle/2 {
+		return nil, nil
+	}
+	msgs, next, err := s.client.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+		Stream:   s.opts.Stream,
+		Group:    s.opts.Group,
+		Consumer: s.opts.Consumer,
+		MinIdle:  s.opts.ClaimIdle,
+		Start:    s.cursor,
+		Count:    s.opts.Count,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("claiming pending entries: %w", err)
+	}
+	if s.cursor == "0-0" {
+		s.lastClaim = time.Now()
+	}
+	// a sweep continues on the next Receive until it wraps around
+	s.cursor = next
+	return msgs, nil
+}
+
+func (s *Source) deliveries(msgs []goredis.XMessage) []*consumer.Delivery {
+	deliveries := make([]*consumer.Delivery, 0, len(msgs))
+	for _, m := range msgs {
+		id := m.ID
+		d := &consumer.Delivery{
+			Message: consumer.Message{ID: id, Topic: s.opts.Topic, Attributes: map[string]string{}},
+			Ack: func(ctx context.Context) error {
+				return s.client.XAck(ctx, s.opts.Stream, s.opts.Group, id).Err()
+			},
+			Nack: func(ctx context.Context) error { return nil },
+		}
+		for k, v := range m.Values {
+			switch k {
+			case TopicField:
+				d.Topic = fmt.Sprint(v)
+			case BodyField:
+				d.Body = []byte(fmt.Sprint(v))
+			default:
+				d.Attributes[k] = fmt.Sprint(v)
+			}
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+// Close leaves the client open, it's the caller's and may be shared with a
+// Publisher
+func (s *Source) Close() error {
+	return nil
+}
+
+// Publisher adds entries to streams, trimming each to about MaxLen entries
+// as it goes so streams nobody reads don't grow without bound
+type Publisher struct {
+	client *goredis.Client
+	maxLen int64
+}
+
+// NewPublisher trims to maxLen, 0 leaves streams untrimmed
+func NewPublisher(client *goredis.Client, maxLen int64) *Publisher {
+	return &Publisher{client: client, maxLen: maxLen}
+}
+
+// Publish adds an entry with topic, body and attrs to stream, returning its
+// id
+func (p *Publisher) Publish(ctx context.Context, stream, topic string, body []byte, attrs map[string]string) (string, error) {
+	values := make([]any, 0, 4+2*len(attrs))
+	values = append(values, TopicField, topic, BodyField, body)
+	for k, v := range attrs {
+		values = append(values, k, v)
+	}
+	return p.client.XAdd(ctx, &goredis.XAddArgs{
+		Stream: stream,
+		MaxLen: p.maxLen,
+		// ~ lets Redis trim whole nodes, much cheaper than an exact length
+		Approx: true,
+		Values: values,
+	}).Result()
+}
+
+// DeadLetter adds dead messages to Stream with the failure in extra fields
+type DeadLetter struct {
+	pub    *Publisher
+	stream string
+}
+
+func NewDeadLetter(pub *Publisher, stream string) *DeadLetter {
+	return &DeadLetter{pub: pub, stream: stream}
+}
+
+func (d *DeadLetter) DeadLetter(ctx context.Context, msg *consumer.Message, cause error) error {
+	attrs := make(map[string]string, len(msg.Attributes)+3)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs["original_id"] = msg.ID
+	attrs["error"] = cause.Error()
+	attrs["attempts"] = fmt.Sprint(msg.Attempt)
+	_, err := d.pub.Publish(ctx, d.stream, msg.Topic, msg.Body, attrs)
+	return err
+}
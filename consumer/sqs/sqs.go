@@ -0,0 +1,133 @@
+// Package sqs is an example consumer.Source backed by an AWS SQS queue
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"go-chi-microservice/consumer"
+)
+
+// TopicAttribute is the message attribute used to route a message. Messages
+// without it are routed to the Source's default topic.
+const TopicAttribute = "topic"
+
+type Options struct {
+	QueueURL string
+	// Topic is used for messages that don't carry a topic attribute,
+	// defaults to the queue name
+	Topic string
+	// MaxMessages per receive call, 1-10
+	MaxMessages int32
+	// WaitTime in seconds for long polling, 0-20
+	WaitTime int32
+}
+
+type Source struct {
+	client *awssqs.Client
+	opts   Options
+}
+
+func NewSource(client *awssqs.Client, opts Options) *Source {
+	if opts.Topic == "" {
+		opts.Topic = opts.QueueURL[strings.LastIndex(opts.QueueURL, "/")+1:]
+	}
+	if opts.MaxMessages <= 0 || opts.MaxMessages > 10 {
+		opts.MaxMessages = 10
+	}
+	if opts.WaitTime <= 0 || opts.WaitTime > 20 {
+		opts.WaitTime = 20
+	}
+	return &Source{client: client, opts: opts}
+}
+
+func (s *Source) Receive(ctx context.Context) ([]*consumer.Delivery, error) {
+	out, err := s.client.ReceiveMessage(ctx, &awssqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(s.opts.QueueURL),
+		MaxNumberOfMessages:   s.opts.MaxMessages,
+		WaitTimeSeconds:       s.opts.WaitTime,
+		MessageAttributeNames: []string{"All"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*consumer.Delivery, 0, len(out.Messages))
+	for _, m := range out.Messages {
+		deliveries = append(deliveries, s.delivery(m))
+	}
+	return deliveries, nil
+}
+
+func (s *Source) delivery(m types.Message) *consumer.Delivery {
+	attrs := make(map[string]string, len(m.MessageAttributes))
+	for k, v := range m.MessageAttributes {
+		attrs[k] = aws.ToString(v.StringValue)
+	}
+	topic := attrs[TopicAttribute]
+	if topic == "" {
+		topic = s.opts.Topic
+	}
+	receipt := m.ReceiptHandle
+	return &consumer.Delivery{
+		Message: consumer.Message{
+			ID:         aws.ToString(m.MessageId),
+			Topic:      topic,
+			Body:       []byte(aws.ToString(m.Body)),
+			Attributes: attrs,
+		},
+		Ack: func(ctx context.Context) error {
+			_, err := s.client.DeleteMessage(ctx, &awssqs.DeleteMessageInput{
+				QueueUrl:      aws.String(s.opts.QueueURL),
+				ReceiptHandle: receipt,
+			})
+			return err
+		},
+		Nack: func(ctx context.Context) error {
+			// zero visibility makes the message available again right away
+			_, err := s.client.ChangeMessageVisibility(ctx, &awssqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(s.opts.QueueURL),
+				ReceiptHandle:     receipt,
+				VisibilityTimeout: 0,
+			})
+			return err
+		},
+	}
+}
+
+func (s *Source) Close() error {
+	return nil
+}
+
+// DeadLetter forwards dead messages to another queue, recording the failure
+type DeadLetter struct {
+	client   *awssqs.Client
+	queueURL string
+}
+
+func NewDeadLetter(client *awssqs.Client, queueURL string) *DeadLetter {
+	return &DeadLetter{client: client, queueURL: queueURL}
+}
+
+func (d *DeadLetter) DeadLetter(ctx context.Context, msg *consumer.Message, cause error) error {
+	attrs := map[string]types.MessageAttributeValue{
+		TopicAttribute: stringAttr(msg.Topic),
+		"error":        stringAttr(cause.Error()),
+		"attempts":     {DataType: aws.String("Number"), StringValue: aws.String(fmt.Sprint(msg.Attempt))},
+		"original_id":  stringAttr(msg.ID),
+	}
+	_, err := d.client.SendMessage(ctx, &awssqs.SendMessageInput{
+		QueueUrl:          aws.String(d.queueURL),
+		MessageBody:       aws.String(string(msg.Body)),
+		MessageAttributes: attrs,
+	})
+	return err
+}
+
+func stringAttr(v string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+}
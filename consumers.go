@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	natsgo "github.com/nats-io/nats.go"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/config"
+	"go-chi-microservice/consumer"
+	"go-chi-microservice/consumer/mqtt"
+	"go-chi-microservice/consumer/nats"
+	"go-chi-microservice/consumer/redis"
+	"go-chi-microservice/consumer/sqs"
+	"go-chi-microservice/events"
+	"go-chi-microservice/users"
+	"go-chi-microservice/webhooks"
+)
+
+// setupConsumer builds the configured consumer, nil when the backend is none,
+// and adds its event publisher, if any, to replayer as a sink
+func setupConsumer(ctx context.Context, cfg config.ConsumerConfig, logger *zerolog.Logger, userSvc *users.Service, replayer *events.Replayer) (*consumer.Consumer, error) {
+	opts := consumer.Options{
+		Concurrency:    cfg.Concurrency,
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+		StopTimeout:    cfg.StopTimeout,
+	}
+	var source consumer.Source
+	switch cfg.Backend {
+	case "", "none":
+		return nil, nil
+	case "sqs":
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("loading aws config: %w", err)
+		}
+		client := awssqs.NewFromConfig(awsCfg)
+		source = sqs.NewSource(client, sqs.Options{QueueURL: cfg.SQSQueueURL, Topic: "users.touched"})
+		if cfg.SQSDLQURL != "" {
+			opts.DeadLetter = sqs.NewDeadLetter(client, cfg.SQSDLQURL)
+		}
+	case "nats":
+		conn, err := natsgo.Connect(cfg.NATSURL)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to nats: %w", err)
+		}
+		if source, err = nats.NewSource(conn, nats.Options{Subject: cfg.NATSSubject, Queue: cfg.NATSQueue}); err != nil {
+			return nil, err
+		}
+		if cfg.NATSDLQSubject != "" {
+			opts.DeadLetter = nats.NewDeadLetter(conn, cfg.NATSDLQSubject)
+		}
+	case "mqtt":
+		conn, err := mqtt.Connect(mqtt.ConnOptions{
+			URL:                  cfg.MQTTURL,
+			ClientID:             cfg.MQTTClientID,
+			Username:             cfg.MQTTUsername,
+			Password:             cfg.MQTTPassword,
+			MaxReconnectInterval: cfg.MQTTMaxReconnectInterval,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		qos := byte(cfg.MQTTQoS)
+		if source, err = mqtt.NewSource(ctx, conn, mqtt.Options{Topic: cfg.MQTTTopic, Group: cfg.MQTTGroup, QoS: qos}); err != nil {
+			return nil, err
+		}
+		if cfg.MQTTDLQTopic != "" {
+			opts.DeadLetter = mqtt.NewDeadLetter(conn, cfg.MQTTDLQTopic, qos)
+		}
+		if cfg.MQTTEventsTopic != "" {
+			p := mqtt.NewPublisher(conn, cfg.MQTTEventsTopic, qos, logger)
+			publishUserEvents(userSvc, func(ctx context.Context, event string, u *users.User) { p.Publish(ctx, event, u) })
+			if replayer != nil {
+				replayer.AddSink("mqtt", events.SinkFunc(func(ctx context.Context, e events.Event) error {
+					return p.Send(ctx, e.Type, e.Time, e.Data)
+				}))
+			}
+		}
+	case "redis":
+		redisOpts, err := goredis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("redis url: %w", err)
+		}
+		client := goredis.NewClient(redisOpts)
+		source, err = redis.NewSource(ctx, client, redis.Options{
+			Stream:    cfg.RedisStream,
+			Group:     cfg.RedisGroup,
+			Consumer:  cfg.RedisConsumerName,
+			Topic:     "users.touched",
+			ClaimIdle: cfg.RedisClaimIdle,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p := redis.NewPublisher(client, cfg.RedisMaxLen)
+		if cfg.RedisDLQStream != "" {
+			opts.DeadLetter = redis.NewDeadLetter(p, cfg.RedisDLQStream)
+		}
+		if cfg.RedisEventsStream != "" {
+			publishUserEvents(userSvc, func(ctx context.Context, event string, u *users.User) {
+				body, err := json.Marshal(u)
+				if err == nil {
+					_, err = p.Publish(ctx, cfg.RedisEventsStream, event, body, nil)
+				}
+				if err != nil {
+					logger.Error().Err(err).Str("event", event).Str("user_id", u.Id).Msg("publishing user event")
+				}
+			})
+			if replayer != nil {
+				replayer.AddSink("redis", events.SinkFunc(func(ctx context.Context, e events.Event) error {
+					_, err := p.Publish(ctx, cfg.RedisEventsStream, e.Type, e.Data, map[string]string{"replayed_seq": fmt.Sprint(e.Seq)})
+					return err
+				}))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown consumer backend: %s", cfg.Backend)
+	}
+
+	c := consumer.New(cfg.Backend, source, logger, opts)
+	c.HandleFunc("users.touched", userTouchedHandler(userSvc))
+	c.HandleFunc("users.create", createUserCommand(userSvc))
+	c.HandleFunc("users.update", updateUserCommand(userSvc))
+	c.HandleFunc("users.disable", disableUserCommand(userSvc))
+	return c, nil
+}
+
+// publishUserEvents hands user writes to publish as the events webhooks
+// send
+func publishUserEvents(userSvc *users.Service, publish func(ctx context.Context, event string, u *users.User)) {
+	userSvc.OnCreate(func(ctx context.Context, u *users.User) { publish(ctx, webhooks.EventUserCreated, u) })
+	userSvc.OnUpdate(func(ctx context.Context, u *users.User) { publish(ctx, webhooks.EventUserUpdated, u) })
+}
+
+// userTouchedHandler is an example handler for messages like {"id": "fece"}.
+// It just confirms the user exists, a real one would do something useful.
+func userTouchedHandler(userSvc *users.Service) consumer.HandlerFunc {
+	return func(ctx context.Context, msg *consumer.Message) error {
+		var evt struct {
+			Id string `json:"id"`
+		}
+		if err := json.Unmarshal(msg.Body, &evt); err != nil {
+			return fmt.Errorf("decoding message: %w", err)
+		}
+		user, err := userSvc.Get(ctx, evt.Id)
+		if err != nil {
+			return err
+		}
+		zerolog.Ctx(ctx).Info().Str("user", user.Id).Msg("user touched")
+		return nil
+	}
+}
+
+// userCommand is the body of the create and update commands, the fields
+// they may set
+type userCommand struct {
+	Id        string
+	Email     string
+	Phone     string
+	ManagerId string
+	Disabled  bool
+}
+
+func decodeCommand(msg *consumer.Message, v any) error {
+	if err := json.Unmarshal(msg.Body, v); err != nil {
+		return fmt.Errorf("decoding message: %w", err)
+	}
+	return nil
+}
+
+// createUserCommand creates the user in messages like {"Id": "fece",
+// "Email": "fece@example.com"}, for devices that can publish but not call
+// the API
+func createUserCommand(userSvc *users.Service) consumer.HandlerFunc {
+	return func(ctx context.Context, msg *consumer.Message) error {
+		var cmd userCommand
+		if err := decodeCommand(msg, &cmd); err != nil {
+			return err
+		}
+		u := &users.User{Id: cmd.Id, Email: cmd.Email, Phone: cmd.Phone, ManagerId: cmd.ManagerId, Disabled: cmd.Disabled}
+		if err := userSvc.Create(ctx, u, "consumer"); err != nil {
+			return err
+		}
+		zerolog.Ctx(ctx).Info().Str("audit", "user_created").Str("user_id", u.Id).Msg("user created by command")
+		return nil
+	}
+}
+
+// updateUserCommand sets the fields of the user in messages like
+// createUserCommand's, an empty Email keeps the stored one
+func updateUserCommand(userSvc *users.Service) consumer.HandlerFunc {
+	return func(ctx context.Context, msg *consumer.Message) error {
+		var cmd userCommand
+		if err := decodeCommand(msg, &cmd); err != nil {
+			return err
+		}
+		return updateUser(ctx, userSvc, cmd.Id, func(u *users.User) {
+			if cmd.Email != "" {
+				u.Email = cmd.Email
+			}
+			u.Phone, u.ManagerId, u.Disabled = cmd.Phone, cmd.ManagerId, cmd.Disabled
+		})
+	}
+}
+
+// disableUserCommand deprovisions the user in messages like {"id": "fece"}
+func disableUserCommand(userSvc *users.Service) consumer.HandlerFunc {
+	return func(ctx context.Context, msg *consumer.Message) error {
+		var cmd struct {
+			Id string `json:"id"`
+		}
+		if err := decodeCommand(msg, &cmd); err != nil {
+			return err
+		}
+		return updateUser(ctx, userSvc, cmd.Id, func(u *users.User) { u.Disabled = true })
+	}
+}
+
+// updateUser applies change to a copy of the stored user and writes it
+func updateUser(ctx context.Context, userSvc *users.Service, id string, change func(*users.User)) error {
+	stored, err := userSvc.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	u := *stored
+	change(&u)
+	if err := userSvc.Update(ctx, &u); err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Info().Str("audit", "user_updated").Str("user_id", u.Id).Msg("user updated by command")
+	return nil
+}
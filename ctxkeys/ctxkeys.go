@@ -0,0 +1,55 @@
+// Package ctxkeys holds the keys values shared through a request's context
+// are stored under, every one of them, so they are declared once and can't
+// collide. The keys are of their own type so no other package's can clash
+// with them, and Value checks the value's type rather than panic on a bad
+// assertion.
+//
+// The package imports nothing of the service's, so that any package, down
+// to tenant, can keep its value here; the typed helpers, like tenant.ID or
+// the api package's ClaimsFrom, stay next to the types they return.
+package ctxkeys
+
+import "context"
+
+// Key is what a value is stored under, its comment says the value's type
+type Key int
+
+const (
+	_              Key = iota
+	User               // *users.User the request is about, loaded by the middleware in front of its handler
+	Claims             // *auth.Claims of the caller's token
+	Session            // *auth.Session the caller signed in with
+	Page               // api.Page, the limit and offset of a list
+	Start              // time.Time the request came in
+	PayloadVersion     // int, the payload version the client asked for
+	PublicIDs          // publicid.Codec for the ids in the request's responses
+	Tenant             // string id of the tenant the request acts for
+	Flags              // *flags.evaluation, the request's flags
+	Report             // *api.reportState, the error reported for the request
+	Envelope           // *api.envelopeState, what the response envelope adds
+	AuditRecord        // *audit.Record of the change being made
+	Loader             // the request's *dataloader.Loader of users
+	IncludeDeleted     // bool, whether soft deleted users are read
+)
+
+var names = [...]string{"", "user", "claims", "session", "page", "start", "payload_version", "public_ids",
+	"tenant", "flags", "report", "envelope", "audit_record", "loader", "include_deleted"}
+
+func (k Key) String() string {
+	if k > 0 && int(k) < len(names) {
+		return "ctxkeys." + names[k]
+	}
+	return "ctxkeys.unknown"
+}
+
+// With is ctx carrying v under k
+func With[T any](ctx context.Context, k Key, v T) context.Context {
+	return context.WithValue(ctx, k, v)
+}
+
+// Value is what With put under k in ctx, ok is false when there's nothing
+// or a value of another type
+func Value[T any](ctx context.Context, k Key) (v T, ok bool) {
+	v, ok = ctx.Value(k).(T)
+	return v, ok
+}
@@ -0,0 +1,184 @@
+// Package dataloader batches and caches key lookups. Loads issued within a
+// short window are collected into a single call to the batch function, which
+// turns the N+1 lookups of expansions and list enrichment into one query.
+// Loaders are meant to be request scoped, the cache is never invalidated.
+package dataloader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Load when the batch function had no value for
+// the key
+var ErrNotFound = errors.New("dataloader: key not found")
+
+// BatchFunc fetches values for keys in one go. Keys it has no value for are
+// left out of the returned map.
+type BatchFunc[K comparable, V any] func(ctx context.Context, keys []K) (map[K]V, error)
+
+type Options struct {
+	// Wait is how long a batch collects keys before it is dispatched
+	Wait time.Duration
+	// MaxBatch dispatches early once a batch has this many keys, 0 is no cap
+	MaxBatch int
+}
+
+type Loader[K comparable, V any] struct {
+	fetch BatchFunc[K, V]
+	opts  Options
+
+	mu    sync.Mutex
+	cache map[K]*result[V]
+	batch *batch[K, V]
+}
+
+type result[V any] struct {
+	done  chan struct{}
+	val   V
+	found bool
+	err   error
+}
+
+type batch[K comparable, V any] struct {
+	ctx     context.Context
+	keys    []K
+	results map[K]*result[V]
+	timer   *time.Timer
+}
+
+func New[K comparable, V any](fetch BatchFunc[K, V], opts Options) *Loader[K, V] {
+	if opts.Wait <= 0 {
+		opts.Wait = 2 * time.Millisecond
+	}
+	return &Loader[K, V]{fetch: fetch, opts: opts, cache: map[K]*result[V]{}}
+}
+
+// Load returns the value for key, waiting for the batch it lands in
+func (l *Loader[K, V]) Load(ctx context.Context, key K) (V, error) {
+	l.mu.Lock()
+	r := l.enqueue(ctx, key)
+	l.mu.Unlock()
+	return l.wait(ctx, r)
+}
+
+// LoadMany returns the values found for keys. Since the caller already has
+// every key the batch is dispatched right away rather than waiting out the
+// window.
+func (l *Loader[K, V]) LoadMany(ctx context.Context, keys []K) (map[K]V, error) {
+	l.mu.Lock()
+	results := make(map[K]*result[V], len(keys))
+	for _, key := range keys {
+		results[key] = l.enqueue(ctx, key)
+	}
+	if b := l.batch; b != nil {
+		l.dispatchLocked(b)
+	}
+	l.mu.Unlock()
+
+	found := make(map[K]V, len(results))
+	for key, r := range results {
+		v, err := l.wait(ctx, r)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found[key] = v
+	}
+	return found, nil
+}
+
+// Prime seeds the cache, e.g. with records a list query already returned
+func (l *Loader[K, V]) Prime(key K, val V) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.cache[key]; ok {
+		return
+	}
+	r := &result[V]{done: make(chan struct{}), val: val, found: true}
+	close(r.done)
+	l.cache[key] = r
+}
+
+// Clear drops key from the cache, so the next Load fetches it again
+func (l *Loader[K, V]) Clear(key K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.cache, key)
+}
+
+// enqueue returns the cached result for key or adds key to the pending
+// batch. l.mu must be held.
+func (l *Loader[K, V]) enqueue(ctx context.Context, key K) *result[V] {
+	if r, ok := l.cache[key]; ok {
+		return r
+	}
+	r := &result[V]{done: make(chan struct{})}
+	l.cache[key] = r
+	b := l.batch
+	if b == nil {
+		b = &batch[K, V]{ctx: ctx, results: map[K]*result[V]{}}
+		b.timer = time.AfterFunc(l.opts.Wait, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.dispatchLocked(b)
+		})
+		l.batch = b
+	}
+	b.keys = append(b.keys, key)
+	b.results[key] = r
+	if l.opts.MaxBatch > 0 && len(b.keys) >= l.opts.MaxBatch {
+		l.dispatchLocked(b)
+	}
+	return r
+}
+
+// dispatchLocked sends b off to the batch function. l.mu must be held.
+func (l *Loader[K, V]) dispatchLocked(b *batch[K, V]) {
+	if l.batch != b {
+		// already dispatched by the other of timer or MaxBatch
+		return
+	}
+	l.batch = nil
+	b.timer.Stop()
+	go l.run(b)
+}
+
+func (l *Loader[K, V]) run(b *batch[K, V]) {
+	vals, err := l.fetch(b.ctx, b.keys)
+	if err != nil {
+		// don't cache failures, a later load should get to retry
+		l.mu.Lock()
+		for key := range b.results {
+			delete(l.cache, key)
+		}
+		l.mu.Unlock()
+	}
+	for key, r := range b.results {
+		r.err = err
+		r.val, r.found = vals[key]
+		close(r.done)
+	}
+}
+
+func (l *Loader[K, V]) wait(ctx context.Context, r *result[V]) (V, error) {
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+	if r.err != nil {
+		var zero V
+		return zero, r.err
+	}
+	if !r.found {
+		var zero V
+		return zero, ErrNotFound
+	}
+	return r.val, nil
+}
@@ -0,0 +1,159 @@
+// Package devdata keeps named copies of the development users snapshot, to
+// go back to a known state while trying out changes to the users' schema:
+// save one before a migration, restore it to run the migration again.
+// There's no database yet, the memory store's snapshot file is the data.
+package devdata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go-chi-microservice/backup"
+	"go-chi-microservice/users"
+)
+
+// ErrNotFound is for a state that was never saved
+var ErrNotFound = errors.New("no such state")
+
+// names are kept to what's safe as a file name on every platform
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// State is a saved copy of the snapshot
+type State struct {
+	Name  string    `json:"name"`
+	Saved time.Time `json:"saved"`
+	Size  int64     `json:"size"`
+}
+
+// States are saved to Dir, one file each, from and to the snapshot at
+// Snapshot. Restoring replaces the snapshot for the server to load when it
+// next starts, stop it first or its next snapshot overwrites the restored
+// one.
+type States struct {
+	Dir      string
+	Snapshot string
+}
+
+// Save copies the snapshot to the state name, replacing one saved before
+func (s States) Save(ctx context.Context, name string) (State, error) {
+	if err := checkName(name); err != nil {
+		return State{}, err
+	}
+	f, err := os.Open(s.Snapshot)
+	if err != nil {
+		return State{}, err
+	}
+	defer f.Close()
+	// through the snapshot file's restore, so only a snapshot that loads
+	// is saved
+	if err := (backup.SnapshotFile{Path: s.path(name)}).Restore(ctx, f); err != nil {
+		return State{}, fmt.Errorf("saving %s: %w", name, err)
+	}
+	return s.stat(name)
+}
+
+// Restore replaces the snapshot with the state name, saving what it
+// replaces as "previous" to undo with
+func (s States) Restore(ctx context.Context, name string) (State, error) {
+	st, err := s.stat(name)
+	if err != nil {
+		return State{}, err
+	}
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return State{}, err
+	}
+	defer f.Close()
+	if name != "previous" {
+		if _, err := s.Save(ctx, "previous"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return State{}, err
+		}
+	}
+	if err := (backup.SnapshotFile{Path: s.Snapshot}).Restore(ctx, f); err != nil {
+		return State{}, fmt.Errorf("restoring %s: %w", name, err)
+	}
+	return st, nil
+}
+
+// List is the saved states, oldest first
+func (s States) List() ([]State, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var states []State
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() || !validName.MatchString(name) {
+			continue
+		}
+		st, err := s.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Saved.Before(states[j].Saved) })
+	return states, nil
+}
+
+// Delete removes the state name
+func (s States) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return err
+}
+
+// Users counts the users in the state name
+func (s States) Users(name string) (int, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	repo := users.NewMemoryRepository()
+	if _, err := repo.LoadSnapshot(s.path(name)); err != nil {
+		return 0, err
+	}
+	all, err := repo.List(context.Background())
+	return len(all), err
+}
+
+func (s States) stat(name string) (State, error) {
+	if err := checkName(name); err != nil {
+		return State{}, err
+	}
+	fi, err := os.Stat(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return State{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return State{}, err
+	}
+	return State{Name: name, Saved: fi.ModTime(), Size: fi.Size()}, nil
+}
+
+func (s States) path(name string) string {
+	return filepath.Join(s.Dir, name+".json")
+}
+
+func checkName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("state name %q must be letters, digits, '.', '_' or '-', up to 64", name)
+	}
+	return nil
+}
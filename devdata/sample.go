@@ -0,0 +1,143 @@
+package devdata
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+
+	"go-chi-microservice/redact"
+	"go-chi-microservice/users"
+)
+
+// SampleOptions pick the users to take from production data
+type SampleOptions struct {
+	// Count is how many users to take, all of them when 0
+	Count int
+	// Seed picks the same users every time for the same data
+	Seed int64
+	// Tenants only takes users of these tenants when set
+	Tenants []string
+	// Deleted takes soft deleted users too
+	Deleted bool
+}
+
+// Sample picks users at random, as opts say. Managers left out of the
+// sample are cleared from the users that point at them, so the sample
+// stands on its own.
+func Sample(all []*users.User, opts SampleOptions) []*users.User {
+	var picked []*users.User
+	for _, u := range all {
+		if u.DeletedAt != nil && !opts.Deleted {
+			continue
+		}
+		if len(opts.Tenants) > 0 && !slices.Contains(opts.Tenants, u.TenantID) {
+			continue
+		}
+		picked = append(picked, u)
+	}
+	// sorted first, so the seed picks the same users whatever order they
+	// came in
+	slices.SortFunc(picked, func(a, b *users.User) int {
+		switch {
+		case a.Id < b.Id:
+			return -1
+		case a.Id > b.Id:
+			return 1
+		}
+		return 0
+	})
+	if opts.Count > 0 && opts.Count < len(picked) {
+		rng := rand.New(rand.NewSource(opts.Seed))
+		rng.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+		picked = picked[:opts.Count]
+	}
+	ids := map[string]bool{}
+	for _, u := range picked {
+		ids[u.Id] = true
+	}
+	for _, u := range picked {
+		if u.ManagerId != "" && !ids[u.ManagerId] {
+			u.ManagerId = ""
+		}
+	}
+	return picked
+}
+
+// Anonymizer replaces what identifies a person or signs them in with
+// stand ins derived from Key, the same ones for the same Key, so two
+// samples line up. What's replaced is up to the redact registry, every
+// field it calls secret or personal data:
+//
+//   - emails become user-<hash>@example.com, phones fictional
+//     +1 202-555-01xx numbers
+//   - passwords are PasswordHash, none when it's empty
+//   - other fields, TOTP enrollments, passkeys, avatars and suspension
+//     reasons among them, are cleared
+//   - ids become u<hash> with PseudonymizeIDs, managers following
+//
+// Tenants, flags, versions and timestamps are kept, they're what makes the
+// data realistic.
+type Anonymizer struct {
+	Key             []byte
+	PseudonymizeIDs bool
+	// PasswordHash every user signs in with, from auth.HashPassword, say
+	// of a shared dev password
+	PasswordHash string
+	// Registry says which fields to replace, redact.Default when nil
+	Registry *redact.Registry
+}
+
+// Anonymize returns an anonymized copy of u
+func (a Anonymizer) Anonymize(u *users.User) *users.User {
+	reg := a.Registry
+	if reg == nil {
+		reg = redact.Default
+	}
+	anon := *u
+	v := reflect.ValueOf(&anon).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, f := v.Type().Field(i).Name, v.Field(i)
+		if !reg.Field(name) && !reg.PersonalField(name) || f.IsZero() {
+			continue
+		}
+		switch name {
+		case "Email":
+			f.SetString("user-" + a.hash("email", u.Email)[:16] + "@example.com")
+		case "Phone":
+			sum := a.sum("phone", u.Phone)
+			f.SetString(fmt.Sprintf("+120255501%02d", binary.BigEndian.Uint16(sum)%100))
+		default:
+			f.SetZero()
+		}
+	}
+	if a.PseudonymizeIDs {
+		anon.Id = a.ID(u.Id)
+		if u.ManagerId != "" {
+			anon.ManagerId = a.ID(u.ManagerId)
+		}
+	}
+	// the password is the dev one, there's none of the user's to reset
+	anon.PasswordHash = a.PasswordHash
+	anon.PasswordResetRequired = false
+	return &anon
+}
+
+// ID is the pseudonym of a user id
+func (a Anonymizer) ID(id string) string {
+	return "u" + a.hash("id", id)[:20]
+}
+
+func (a Anonymizer) hash(field, value string) string {
+	return hex.EncodeToString(a.sum(field, value))
+}
+
+func (a Anonymizer) sum(field, value string) []byte {
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(field + "\x00" + value))
+	return mac.Sum(nil)
+}
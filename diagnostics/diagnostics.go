@@ -0,0 +1,177 @@
+// Package diagnostics collects a self-description of the running service,
+// what is enabled, how it is wired and what it was built from, so an operator
+// can see the effective setup of an instance without reading its config.
+package diagnostics
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"go-chi-microservice/redact"
+)
+
+type Registry struct {
+	mu         sync.Mutex
+	started    time.Time
+	modules    map[string]Module
+	storage    map[string]string
+	middleware []string
+	listeners  []Listener
+	workers    map[string]int
+	schemas    map[string]Schema
+	apis       []API
+}
+
+// Module is an optional part of the service and its effective settings
+type Module struct {
+	Enabled  bool           `json:"enabled"`
+	Settings map[string]any `json:"settings,omitempty"`
+}
+
+type Listener struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// Schema is the version of a resource's stored data an instance reads and
+// writes, and the migrations that brought it there, oldest first
+type Schema struct {
+	Store      string      `json:"store"`
+	Version    int         `json:"version"`
+	Migrations []Migration `json:"migrations,omitempty"`
+}
+
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+}
+
+// API is a versioned API the instance serves and where
+type API struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+}
+
+type Dependency struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+type Report struct {
+	Started      time.Time         `json:"started"`
+	Uptime       string            `json:"uptime"`
+	GoVersion    string            `json:"go_version"`
+	Module       string            `json:"module"`
+	Modules      map[string]Module `json:"modules"`
+	Storage      map[string]string `json:"storage"`
+	Middleware   []string          `json:"middleware"`
+	Listeners    []Listener        `json:"listeners"`
+	Workers      map[string]int    `json:"workers"`
+	Schemas      map[string]Schema `json:"schemas"`
+	APIs         []API             `json:"apis"`
+	Dependencies []Dependency      `json:"dependencies"`
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		started: time.Now(),
+		modules: map[string]Module{},
+		storage: map[string]string{},
+		workers: map[string]int{},
+		schemas: map[string]Schema{},
+	}
+}
+
+func (r *Registry) AddModule(name string, enabled bool, settings map[string]any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modules[name] = Module{Enabled: enabled, Settings: settings}
+}
+
+// SetStorage records the backend serving a resource, e.g. "users" -> "memory"
+func (r *Registry) SetStorage(resource, backend string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.storage[resource] = backend
+}
+
+// AddMiddleware appends to the recorded middleware stack, call it in the
+// order the middleware is installed
+func (r *Registry) AddMiddleware(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, name)
+}
+
+func (r *Registry) AddListener(name, network, address string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, Listener{Name: name, Network: network, Address: address})
+}
+
+func (r *Registry) SetWorkers(pool string, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.workers[pool] = count
+}
+
+// SetSchema records the schema of a resource's stored data, e.g. "users"
+func (r *Registry) SetSchema(resource string, schema Schema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[resource] = schema
+}
+
+// AddAPI records an API mounted at path, call it where the API is mounted
+func (r *Registry) AddAPI(name, version, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apis = append(r.apis, API{Name: name, Version: version, Path: path})
+}
+
+// Report is the current description. Module settings go through redact, so
+// a secret passed to AddModule by mistake is masked rather than served.
+func (r *Registry) Report() Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := Report{
+		Started:    r.started,
+		Uptime:     time.Since(r.started).Round(time.Second).String(),
+		GoVersion:  runtime.Version(),
+		Modules:    make(map[string]Module, len(r.modules)),
+		Storage:    make(map[string]string, len(r.storage)),
+		Middleware: append([]string{}, r.middleware...),
+		Listeners:  append([]Listener{}, r.listeners...),
+		Workers:    make(map[string]int, len(r.workers)),
+		Schemas:    make(map[string]Schema, len(r.schemas)),
+		APIs:       append([]API{}, r.apis...),
+	}
+	for k, v := range r.modules {
+		rep.Modules[k] = Module{Enabled: v.Enabled, Settings: redact.Map(v.Settings)}
+	}
+	for k, v := range r.storage {
+		rep.Storage[k] = v
+	}
+	for k, v := range r.workers {
+		rep.Workers[k] = v
+	}
+	for k, v := range r.schemas {
+		rep.Schemas[k] = v
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		rep.Module = info.Main.Path
+		for _, dep := range info.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			rep.Dependencies = append(rep.Dependencies, Dependency{Path: dep.Path, Version: dep.Version})
+		}
+		sort.Slice(rep.Dependencies, func(i, j int) bool { return rep.Dependencies[i].Path < rep.Dependencies[j].Path })
+	}
+	return rep
+}
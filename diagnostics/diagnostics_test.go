@@ -0,0 +1,37 @@
+package diagnostics
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go-chi-microservice/redact"
+)
+
+func TestReportMasksModuleSecrets(t *testing.T) {
+	r := NewRegistry()
+	r.AddModule("audit", true, map[string]any{
+		"store":     "redis",
+		"redis_url": "redis://:hunter2pass@cache:6379/0",
+		"token":     "s3cr3t-t0ken",
+		"auth":      true,
+		"upstream":  map[string]any{"authorization": "Bearer abcdefgh12345678"},
+	})
+	data, err := json.Marshal(r.Report())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, secret := range []string{"hunter2pass", "s3cr3t-t0ken", "abcdefgh12345678"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("secret %q in the report: %s", secret, out)
+		}
+	}
+	if leaks := redact.Leaks(out); len(leaks) > 0 {
+		t.Fatalf("leaks %q in the report: %s", leaks, out)
+	}
+	settings := r.Report().Modules["audit"].Settings
+	if settings["store"] != "redis" || settings["auth"] != true {
+		t.Fatalf("settings that aren't secret were changed: %v", settings)
+	}
+}
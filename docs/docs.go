@@ -0,0 +1,118 @@
+// Package docs holds the API examples served at /docs/examples. Each is a
+// request and its response recorded by a handler test along with its golden
+// file, so the examples are exactly what the service does.
+package docs
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed examples
+var embedded embed.FS
+
+// Embedded returns the examples in docs/examples
+func Embedded() fs.FS {
+	sub, err := fs.Sub(embedded, "examples")
+	if err != nil {
+		panic(err) // examples is always embedded
+	}
+	return sub
+}
+
+// Example is a request and the response it got. Bodies are JSON, or a JSON
+// string for anything else, with volatile values such as times scrubbed.
+type Example struct {
+	Name string `json:"name"`
+	// Route is the pattern that served the request, e.g. /users/{userID}
+	Route        string          `json:"route"`
+	Method       string          `json:"method"`
+	Path         string          `json:"path"`
+	RequestBody  json.RawMessage `json:"request_body,omitempty"`
+	Status       int             `json:"status"`
+	ContentType  string          `json:"content_type,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+}
+
+// Body turns a request or response body into an Example body
+func Body(b []byte) json.RawMessage {
+	if len(b) == 0 {
+		return nil
+	}
+	if json.Valid(b) {
+		return b
+	}
+	s, _ := json.Marshal(string(b))
+	return s
+}
+
+// Load reads every *.json example in fsys
+func Load(fsys fs.FS) ([]Example, error) {
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Example, 0, len(names))
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		var ex Example
+		if err := json.Unmarshal(data, &ex); err != nil {
+			return nil, fmt.Errorf("example %s: %w", name, err)
+		}
+		if ex.Name == "" {
+			ex.Name = strings.TrimSuffix(path.Base(name), ".json")
+		}
+		list = append(list, ex)
+	}
+	return list, nil
+}
+
+// Route is the examples of one method and route pattern, by status
+type Route struct {
+	Method   string   `json:"method"`
+	Route    string   `json:"route"`
+	Statuses []Status `json:"statuses"`
+}
+
+type Status struct {
+	Status   int       `json:"status"`
+	Examples []Example `json:"examples"`
+}
+
+// Group sorts examples into routes, ordered by route then method, and
+// statuses, lowest first
+func Group(examples []Example) []Route {
+	byRoute := map[[2]string]map[int][]Example{}
+	for _, ex := range examples {
+		key := [2]string{ex.Route, ex.Method}
+		if byRoute[key] == nil {
+			byRoute[key] = map[int][]Example{}
+		}
+		byRoute[key][ex.Status] = append(byRoute[key][ex.Status], ex)
+	}
+	routes := make([]Route, 0, len(byRoute))
+	for key, byStatus := range byRoute {
+		rt := Route{Route: key[0], Method: key[1]}
+		for status, list := range byStatus {
+			sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+			rt.Statuses = append(rt.Statuses, Status{Status: status, Examples: list})
+		}
+		sort.Slice(rt.Statuses, func(i, j int) bool { return rt.Statuses[i].Status < rt.Statuses[j].Status })
+		routes = append(routes, rt)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
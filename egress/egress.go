@@ -0,0 +1,164 @@
+// Package egress keeps outbound requests to hosts they're allowed to reach,
+// so a URL a client supplies, a webhook's say, can't point the service at
+// itself, the internal network or the cloud's metadata endpoint (SSRF).
+// Hosts are checked against an allowlist before the request is sent, and
+// the addresses they resolve to are checked again as the connection is
+// dialed, so a name that resolves to a private address is caught too,
+// whenever it's looked up.
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrBlocked is wrapped by the errors for requests the policy refuses
+var ErrBlocked = errors.New("egress blocked")
+
+var blocked = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "egress_blocked_total",
+	Help: "Outbound requests refused by the egress policy, by whether the host wasn't allowed or its address was private.",
+}, []string{"reason"})
+
+// blockedRanges are refused besides what netip calls loopback, private,
+// link local, multicast or unspecified
+var blockedRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier grade NAT, some clouds' internal ranges
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("fd00:ec2::254/128"), // AWS metadata over IPv6, in fc00::/7 anyway
+	netip.MustParsePrefix("64:ff9b::/96"),      // NAT64, would reach any IPv4 address
+}
+
+// Policy is where outbound requests may go
+type Policy struct {
+	// Hosts may be reached, example.com for the name itself and
+	// *.example.com for its subdomains; empty allows any host
+	Hosts []string
+	// Allowed are ranges let through though they're private, e.g. the
+	// network a downstream service is on
+	Allowed []netip.Prefix
+}
+
+// NewPolicy parses the allowed ranges, CIDRs or single addresses
+func NewPolicy(hosts, allowed []string) (*Policy, error) {
+	p := &Policy{}
+	for _, h := range hosts {
+		p.Hosts = append(p.Hosts, strings.ToLower(strings.TrimSuffix(h, ".")))
+	}
+	for _, a := range allowed {
+		prefix, err := netip.ParsePrefix(a)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(a)
+			if aerr != nil {
+				return nil, fmt.Errorf("egress: %q is not a CIDR or address", a)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.Allowed = append(p.Allowed, prefix)
+	}
+	return p, nil
+}
+
+// CheckURL refuses a URL that isn't http or https, or whose host isn't
+// allowed or is a private address. Check user supplied URLs with it when
+// they're saved, the transport checks them again as they're used.
+func (p *Policy) CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrBlocked, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if !p.hostAllowed(host) {
+		blocked.WithLabelValues("host").Inc()
+		return fmt.Errorf("%w: host %s is not allowed", ErrBlocked, host)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(addr)
+	}
+	return nil
+}
+
+func (p *Policy) hostAllowed(host string) bool {
+	if len(p.Hosts) == 0 {
+		return true
+	}
+	for _, h := range p.Hosts {
+		if h == host || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range p.Allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	private := addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+	for _, prefix := range blockedRanges {
+		private = private || prefix.Contains(addr)
+	}
+	if private {
+		blocked.WithLabelValues("address").Inc()
+		return fmt.Errorf("%w: %s is a private address", ErrBlocked, addr)
+	}
+	return nil
+}
+
+// Transport checks each request's URL, redirects included, before next
+// sends it. When next is an *http.Transport, http.DefaultTransport when
+// nil, a copy of it sends them instead, dialing only addresses the policy
+// allows. Behind a proxy it's the proxy that's dialed, the proxy must keep
+// to the policy itself.
+func (p *Policy) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if t, ok := next.(*http.Transport); ok {
+		t = t.Clone()
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: p.control}
+		t.DialContext = dialer.DialContext
+		next = t
+	}
+	return roundTripper{policy: p, next: next}
+}
+
+// control runs before each connection is made, with the address resolved
+func (p *Policy) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	return p.checkAddr(ap.Addr())
+}
+
+type roundTripper struct {
+	policy *Policy
+	next   http.RoundTripper
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := rt.policy.CheckURL(req.URL); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return rt.next.RoundTrip(req)
+}
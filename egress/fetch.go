@@ -0,0 +1,168 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidURL is wrapped by the errors for URLs ParseURL refuses
+	ErrInvalidURL = errors.New("invalid url")
+	// ErrTooLarge is a fetched body over the Fetcher's MaxBytes
+	ErrTooLarge = errors.New("response is too large")
+	// ErrContentType is a fetched body of a type the Fetcher doesn't accept
+	ErrContentType = errors.New("response has an unaccepted content type")
+)
+
+// maxURLLength is the longest URL ParseURL takes
+const maxURLLength = 2048
+
+// ParseURL parses a URL a user supplies, refusing one that isn't an
+// absolute http or https URL with a host, carries credentials or is overly
+// long. Where it may go is the Policy's to check.
+func ParseURL(raw string) (*url.URL, error) {
+	if len(raw) > maxURLLength {
+		return nil, fmt.Errorf("%w: longer than %d characters", ErrInvalidURL, maxURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: must be an absolute http or https url", ErrInvalidURL)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("%w: must not carry credentials", ErrInvalidURL)
+	}
+	return u, nil
+}
+
+// FetchOptions caps what a Fetcher downloads
+type FetchOptions struct {
+	// MaxBytes is the largest body accepted
+	MaxBytes int64
+	// Timeout bounds the whole fetch, redirects and body included
+	Timeout time.Duration
+	// ContentTypes are the media types accepted, any when empty. A response
+	// that doesn't say has its type sniffed from the body.
+	ContentTypes []string
+	// MaxRedirects are followed, each to a URL checked like the first
+	MaxRedirects int
+}
+
+// Fetcher GETs URLs users supply, for features that download from them:
+// the URL is checked with ParseURL and the policy before the request and
+// each redirect, and the addresses dialed are checked as they're
+// resolved, so a name that resolves to a public address when checked and
+// a private one when dialed (DNS rebinding) is still refused. Proxies
+// from the environment aren't used, the policy couldn't see past them.
+type Fetcher struct {
+	policy *Policy
+	opts   FetchOptions
+	client *http.Client
+}
+
+// Fetched is a downloaded body
+type Fetched struct {
+	Body        []byte
+	ContentType string   // the media type, without parameters
+	URL         *url.URL // where it came from, after redirects
+}
+
+// NewFetcher fetches within policy, nil for no checks on where
+func NewFetcher(policy *Policy, opts FetchOptions) *Fetcher {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	var rt http.RoundTripper = t
+	if policy != nil {
+		rt = policy.Transport(t)
+	}
+	f := &Fetcher{policy: policy, opts: opts}
+	f.client = &http.Client{Transport: rt, Timeout: opts.Timeout, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > opts.MaxRedirects {
+			return fmt.Errorf("%w: more than %d redirects", ErrBlocked, opts.MaxRedirects)
+		}
+		_, err := f.check(req.URL.String())
+		return err
+	}}
+	return f
+}
+
+// Fetch GETs rawURL, failing with an error wrapping ErrInvalidURL or
+// ErrBlocked when it may not be fetched, ErrTooLarge or ErrContentType
+// when its body isn't accepted, and any other for a failed request or a
+// status other than 200.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Fetched, error) {
+	u, err := f.check(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.opts.ContentTypes) > 0 {
+		req.Header.Set("Accept", strings.Join(f.opts.ContentTypes, ", "))
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u.Redacted(), resp.Status)
+	}
+	if resp.ContentLength > f.opts.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, over %d", ErrTooLarge, resp.ContentLength, f.opts.MaxBytes)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" {
+		if err := f.checkType(contentType); err != nil {
+			return nil, err
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.opts.MaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", u.Redacted(), err)
+	}
+	if int64(len(body)) > f.opts.MaxBytes {
+		return nil, fmt.Errorf("%w: over %d bytes", ErrTooLarge, f.opts.MaxBytes)
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+		if err := f.checkType(contentType); err != nil {
+			return nil, err
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return &Fetched{Body: body, ContentType: mediaType, URL: resp.Request.URL}, nil
+}
+
+func (f *Fetcher) check(rawURL string) (*url.URL, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if f.policy != nil {
+		if err := f.policy.CheckURL(u); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (f *Fetcher) checkType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrContentType, contentType)
+	}
+	if len(f.opts.ContentTypes) > 0 && !slices.Contains(f.opts.ContentTypes, mediaType) {
+		return fmt.Errorf("%w: %s", ErrContentType, mediaType)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Package events keeps the user events the service publishes, numbered in
+// the order they happened, so a range of them can be replayed to a sink
+// later: to rebuild a cache, or backfill a consumer that subscribed late.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is an unknown replay or sink
+var ErrNotFound = errors.New("not found")
+
+type Event struct {
+	// Seq numbers events from 1 in the order they were appended
+	Seq  int64           `json:"seq"`
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Range picks events by sequence number, time or both, the zero value of a
+// bound leaves that end open. Both ends are inclusive.
+type Range struct {
+	FromSeq int64     `json:"from_seq,omitempty"`
+	ToSeq   int64     `json:"to_seq,omitempty"`
+	Since   time.Time `json:"since,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+}
+
+func (q Range) Contains(e Event) bool {
+	return (q.FromSeq == 0 || e.Seq >= q.FromSeq) &&
+		(q.ToSeq == 0 || e.Seq <= q.ToSeq) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || !e.Time.After(q.Until))
+}
+
+// Store is the event log, a table in a database backed implementation
+type Store interface {
+	// Append records an event with data as JSON and returns it numbered
+	Append(ctx context.Context, typ string, data any) (Event, error)
+	// Each calls fn with the events in q in order, stopping at the first
+	// error fn returns, which Each returns
+	Each(ctx context.Context, q Range, fn func(Event) error) error
+}
+
+// MemoryStore is a Store for a single instance that keeps the latest
+// events, older ones are dropped and can't be replayed
+type MemoryStore struct {
+	keep int
+
+	mu     sync.RWMutex
+	events []Event
+	seq    int64
+}
+
+func NewMemoryStore(keep int) *MemoryStore {
+	if keep <= 0 {
+		keep = 10000
+	}
+	return &MemoryStore{keep: keep}
+}
+
+func (m *MemoryStore) Append(ctx context.Context, typ string, data any) (Event, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	e := Event{Seq: m.seq, Type: typ, Time: time.Now(), Data: body}
+	m.events = append(m.events, e)
+	if over := len(m.events) - m.keep; over > 0 {
+		m.events = append(m.events[:0:0], m.events[over:]...)
+	}
+	return e, nil
+}
+
+// Each walks a snapshot, so slow callers don't hold up appends
+func (m *MemoryStore) Each(ctx context.Context, q Range, fn func(Event) error) error {
+	m.mu.RLock()
+	snapshot := m.events
+	m.mu.RUnlock()
+	for _, e := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !q.Contains(e) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
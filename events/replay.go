@@ -0,0 +1,242 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sink is where a replay sends events
+type Sink interface {
+	Send(ctx context.Context, e Event) error
+}
+
+type SinkFunc func(ctx context.Context, e Event) error
+
+func (f SinkFunc) Send(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+// replay statuses
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed" // the sink failed, Error says how
+	StatusCancelled = "cancelled"
+)
+
+// Replay is a replay of a range of events to a sink, as it stands
+type Replay struct {
+	ID    string `json:"id"`
+	Sink  string `json:"sink"`
+	Range Range  `json:"range"`
+	// Rate is the most events sent a second
+	Rate float64 `json:"rate"`
+	// Sent counts the events the sink took, LastSeq is the last of them so
+	// a failed replay can be resumed from LastSeq+1
+	Sent     int       `json:"sent"`
+	LastSeq  int64     `json:"last_seq,omitempty"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// Replayer runs replays in the background, one goroutine each, and keeps
+// the latest of them to look up
+type Replayer struct {
+	store   Store
+	maxRate float64
+	keep    int
+
+	mu      sync.Mutex
+	sinks   map[string]Sink
+	replays map[string]*Replay
+	order   []string // replay ids, oldest first
+	cancels map[string]context.CancelFunc
+	ctx     context.Context
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewReplayer replays from store at up to maxRate events a second
+func NewReplayer(store Store, maxRate float64) *Replayer {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Replayer{
+		store:   store,
+		maxRate: maxRate,
+		keep:    100,
+		sinks:   map[string]Sink{},
+		replays: map[string]*Replay{},
+		cancels: map[string]context.CancelFunc{},
+		ctx:     ctx,
+		stop:    stop,
+	}
+}
+
+// AddSink makes s available to replays as name. Add sinks before serving.
+func (rp *Replayer) AddSink(name string, s Sink) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.sinks[name] = s
+}
+
+// Sinks are the names replays can pick
+func (rp *Replayer) Sinks() []string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	names := make([]string, 0, len(rp.sinks))
+	for name := range rp.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Store is where the replayed events come from
+func (rp *Replayer) Store() Store {
+	return rp.store
+}
+
+// Start replays the events in q to the named sink at rate events a second,
+// the maximum when rate is 0
+func (rp *Replayer) Start(sink string, q Range, rate float64) (Replay, error) {
+	if rate == 0 {
+		rate = rp.maxRate
+	}
+	if rate < 0 || rate > rp.maxRate {
+		return Replay{}, fmt.Errorf("rate must be over 0 and at most %g events a second", rp.maxRate)
+	}
+	id, err := newID()
+	if err != nil {
+		return Replay{}, err
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	s, ok := rp.sinks[sink]
+	if !ok {
+		return Replay{}, fmt.Errorf("sink %q: %w", sink, ErrNotFound)
+	}
+	if rp.ctx.Err() != nil {
+		return Replay{}, errors.New("replays are stopped")
+	}
+	r := &Replay{ID: id, Sink: sink, Range: q, Rate: rate, Status: StatusRunning, Started: time.Now()}
+	rp.replays[id] = r
+	rp.order = append(rp.order, id)
+	rp.forget()
+	ctx, cancel := context.WithCancel(rp.ctx)
+	rp.cancels[id] = cancel
+	rp.wg.Add(1)
+	go func() {
+		defer rp.wg.Done()
+		defer cancel()
+		rp.run(ctx, r, s)
+	}()
+	return *r, nil
+}
+
+// forget drops the oldest finished replays over keep
+func (rp *Replayer) forget() {
+	for len(rp.order) > rp.keep {
+		i := 0
+		for i < len(rp.order) && rp.replays[rp.order[i]].Status == StatusRunning {
+			i++
+		}
+		if i == len(rp.order) {
+			return
+		}
+		delete(rp.replays, rp.order[i])
+		rp.order = append(rp.order[:i], rp.order[i+1:]...)
+	}
+}
+
+func (rp *Replayer) run(ctx context.Context, r *Replay, s Sink) {
+	tick := time.NewTicker(time.Duration(float64(time.Second) / r.Rate))
+	defer tick.Stop()
+	err := rp.store.Each(ctx, r.Range, func(e Event) error {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := s.Send(ctx, e); err != nil {
+			return fmt.Errorf("event %d: %w", e.Seq, err)
+		}
+		rp.mu.Lock()
+		r.Sent++
+		r.LastSeq = e.Seq
+		rp.mu.Unlock()
+		return nil
+	})
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	delete(rp.cancels, r.ID)
+	r.Finished = time.Now()
+	switch {
+	case err == nil:
+		r.Status = StatusSucceeded
+	case ctx.Err() != nil:
+		r.Status = StatusCancelled
+	default:
+		r.Status, r.Error = StatusFailed, err.Error()
+	}
+}
+
+func (rp *Replayer) Get(id string) (Replay, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	r, ok := rp.replays[id]
+	if !ok {
+		return Replay{}, fmt.Errorf("replay %s: %w", id, ErrNotFound)
+	}
+	return *r, nil
+}
+
+// List returns the replays kept, newest first
+func (rp *Replayer) List() []Replay {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	list := make([]Replay, 0, len(rp.order))
+	for i := len(rp.order) - 1; i >= 0; i-- {
+		list = append(list, *rp.replays[rp.order[i]])
+	}
+	return list
+}
+
+// Cancel stops a running replay, what was sent stays sent
+func (rp *Replayer) Cancel(id string) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if _, ok := rp.replays[id]; !ok {
+		return fmt.Errorf("replay %s: %w", id, ErrNotFound)
+	}
+	if cancel, ok := rp.cancels[id]; ok {
+		cancel()
+	}
+	return nil
+}
+
+// Run waits for ctx to be done, then cancels running replays and waits for
+// them to stop
+func (rp *Replayer) Run(ctx context.Context) error {
+	<-ctx.Done()
+	rp.mu.Lock()
+	rp.stop()
+	rp.mu.Unlock()
+	rp.wg.Wait()
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
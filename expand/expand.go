@@ -0,0 +1,160 @@
+// Package expand implements the ?expand= query parameter, letting clients
+// embed related resources in a response, e.g. ?expand=manager.manager,team
+package expand
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrTooDeep = errors.New("expansion exceeds max depth")
+	ErrUnknown = errors.New("unknown expansion")
+)
+
+var nameRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Tree is a parsed set of expansion paths. Each key is a relation to expand
+// and its value holds the expansions requested on the related resource.
+type Tree map[string]Tree
+
+// Parse turns a comma separated list of dotted paths into a Tree. Paths
+// nested deeper than maxDepth are rejected, a maxDepth <= 0 means no limit.
+func Parse(raw string, maxDepth int) (Tree, error) {
+	tree := Tree{}
+	for _, path := range strings.Split(raw, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		parts := strings.Split(path, ".")
+		if maxDepth > 0 && len(parts) > maxDepth {
+			return nil, fmt.Errorf("%w: %q has depth %d, max is %d", ErrTooDeep, path, len(parts), maxDepth)
+		}
+		node := tree
+		for _, name := range parts {
+			if !nameRe.MatchString(name) {
+				return nil, fmt.Errorf("invalid expansion name %q in %q", name, path)
+			}
+			next, ok := node[name]
+			if !ok {
+				next = Tree{}
+				node[name] = next
+			}
+			node = next
+		}
+	}
+	return tree, nil
+}
+
+func (t Tree) Has(name string) bool {
+	_, ok := t[name]
+	return ok
+}
+
+// Sub returns the expansions requested beneath name
+func (t Tree) Sub(name string) Tree {
+	return t[name]
+}
+
+func (t Tree) Empty() bool {
+	return len(t) == 0
+}
+
+// Depth is how deep the longest path nests, 0 for an empty tree
+func (t Tree) Depth() int {
+	depth := 0
+	for _, sub := range t {
+		depth = max(depth, 1+sub.Depth())
+	}
+	return depth
+}
+
+// Prune returns a copy of t without the expansions nested deeper than depth
+func (t Tree) Prune(depth int) Tree {
+	pruned := Tree{}
+	if depth <= 0 {
+		return pruned
+	}
+	for name, sub := range t {
+		pruned[name] = sub.Prune(depth - 1)
+	}
+	return pruned
+}
+
+// Paths returns the dotted paths of t's leaves, sorted, e.g. the paths
+// Parse was given without duplicates or prefixes of longer ones
+func (t Tree) Paths() []string {
+	var paths []string
+	for name, sub := range t {
+		if sub.Empty() {
+			paths = append(paths, name)
+			continue
+		}
+		for _, p := range sub.Paths() {
+			paths = append(paths, name+"."+p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Func expands one relation for a whole batch of resources at once, so
+// implementations can collect foreign keys and make a single batch load
+// instead of one per item. next holds the expansions wanted on the related
+// resources.
+type Func[T any] func(ctx context.Context, items []T, next Tree) error
+
+// Registry holds the expanders for one resource type
+type Registry[T any] struct {
+	expanders map[string]Func[T]
+}
+
+func NewRegistry[T any]() *Registry[T] {
+	return &Registry[T]{expanders: map[string]Func[T]{}}
+}
+
+func (r *Registry[T]) Register(name string, fn Func[T]) {
+	r.expanders[name] = fn
+}
+
+// Names lists the registered expansions, sorted
+func (r *Registry[T]) Names() []string {
+	names := make([]string, 0, len(r.expanders))
+	for name := range r.expanders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks every name in the tree is registered at this level. Deeper
+// levels are validated by the registry of the related resource as it expands.
+func (r *Registry[T]) Validate(tree Tree) error {
+	for name := range tree {
+		if _, ok := r.expanders[name]; !ok {
+			return fmt.Errorf("%w: %q, available: %s", ErrUnknown, name, strings.Join(r.Names(), ", "))
+		}
+	}
+	return nil
+}
+
+// Expand runs the requested expanders over items
+func (r *Registry[T]) Expand(ctx context.Context, items []T, tree Tree) error {
+	if tree.Empty() || len(items) == 0 {
+		return nil
+	}
+	if err := r.Validate(tree); err != nil {
+		return err
+	}
+	for name, next := range tree {
+		if err := r.expanders[name](ctx, items, next); err != nil {
+			return fmt.Errorf("expanding %s: %w", name, err)
+		}
+	}
+	return nil
+}
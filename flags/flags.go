@@ -0,0 +1,73 @@
+// Package flags turns features on and off per user and tenant without a
+// deploy. A Provider decides a flag's value for an evaluation context: the
+// Static one from the environment and a file, OFREP from a flag service
+// speaking OpenFeature's remote evaluation protocol. Handlers ask through
+// the request context with Enabled, each flag evaluated once per request.
+package flags
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/ctxkeys"
+)
+
+var evaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "flag_evaluations_total",
+	Help: "Flag evaluations by flag and result, true, false or default when the provider failed.",
+}, []string{"flag", "result"})
+
+// EvalContext is who a flag is evaluated for, empty fields when unknown
+type EvalContext struct {
+	UserID     string
+	Tenant     string
+	Attributes map[string]string // e.g. "guest": "true"
+}
+
+// Provider decides flag values. Bool returns def for a flag it doesn't
+// know, and an error when it can't tell, def is used then too.
+type Provider interface {
+	Bool(ctx context.Context, key string, ec EvalContext, def bool) (bool, error)
+}
+
+// evaluation is one request's flags, each asked of the provider once
+type evaluation struct {
+	provider Provider
+	ec       EvalContext
+
+	mu     sync.Mutex
+	values map[string]bool
+}
+
+// With returns a context whose flags are evaluated by provider for ec
+func With(ctx context.Context, provider Provider, ec EvalContext) context.Context {
+	return ctxkeys.With(ctx, ctxkeys.Flags, &evaluation{provider: provider, ec: ec, values: map[string]bool{}})
+}
+
+// Enabled reports whether the flag key is on for ctx's evaluation context,
+// false when ctx has none or the provider fails
+func Enabled(ctx context.Context, key string) bool {
+	ev, _ := ctxkeys.Value[*evaluation](ctx, ctxkeys.Flags)
+	if ev == nil {
+		return false
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if v, ok := ev.values[key]; ok {
+		return v
+	}
+	v, err := ev.provider.Bool(ctx, key, ev.ec, false)
+	result := strconv.FormatBool(v)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("flag", key).Msg("evaluating flag, using its default")
+		v, result = false, "default"
+	}
+	evaluations.WithLabelValues(key, result).Inc()
+	ev.values[key] = v
+	return v
+}
@@ -0,0 +1,94 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule is when a static flag is on: for everyone when Enabled, else for
+// the listed users and tenants, and for Percent of the other users, the
+// same ones every time
+type Rule struct {
+	Enabled bool     `json:"enabled"`
+	Users   []string `json:"users,omitempty"`
+	Tenants []string `json:"tenants,omitempty"`
+	Percent int      `json:"percent,omitempty"`
+}
+
+// Static is a Provider with fixed rules, read at startup
+type Static map[string]Rule
+
+// NewStatic reads rules from file, a JSON object of Rules by flag, when
+// it's set, then applies set, flag=true or flag=false entries turning a
+// flag on or off for everyone
+func NewStatic(file string, set []string) (Static, error) {
+	s := Static{}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	for _, entry := range set {
+		key, value, _ := strings.Cut(entry, "=")
+		on, err := strconv.ParseBool(value)
+		if key == "" || err != nil {
+			return nil, fmt.Errorf("flag %q must be name=true or name=false", entry)
+		}
+		rule := s[key]
+		rule.Enabled = on
+		s[key] = rule
+	}
+	for key, rule := range s {
+		if rule.Percent < 0 || rule.Percent > 100 {
+			return nil, fmt.Errorf("flag %s: percent must be 0 to 100", key)
+		}
+	}
+	return s, nil
+}
+
+func (s Static) Bool(ctx context.Context, key string, ec EvalContext, def bool) (bool, error) {
+	rule, ok := s[key]
+	if !ok {
+		return def, nil
+	}
+	switch {
+	case rule.Enabled:
+		return true, nil
+	case ec.UserID != "" && slices.Contains(rule.Users, ec.UserID):
+		return true, nil
+	case ec.Tenant != "" && slices.Contains(rule.Tenants, ec.Tenant):
+		return true, nil
+	case ec.UserID != "" && rule.Percent > 0:
+		return bucket(key, ec.UserID) < rule.Percent, nil
+	}
+	return false, nil
+}
+
+// Keys lists the flags, for diagnostics
+func (s Static) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bucket puts a user in 0 to 99 for a flag, independently per flag so the
+// same users aren't first in line for every rollout
+func bucket(key, userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key + "/" + userID))
+	return int(h.Sum32() % 100)
+}
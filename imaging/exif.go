@@ -0,0 +1,110 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// exifOrientation is the orientation tag in a jpeg's EXIF, 1 to 8 as the
+// TIFF spec numbers them, 1 (upright) when there's none or it can't be
+// read
+func exifOrientation(src []byte) int {
+	if len(src) < 4 || src[0] != 0xff || src[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(src); {
+		if src[i] != 0xff {
+			return 1
+		}
+		marker := src[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// the image data starts, the metadata is all before it
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(src[i+2:]))
+		if length < 2 || i+2+length > len(src) {
+			return 1
+		}
+		segment := src[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads tag 0x0112 from the first IFD of the TIFF
+// structure EXIF is
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		at := ifd + 2 + e*12
+		if at+12 > len(tiff) {
+			return 1
+		}
+		// a SHORT, held in the first two bytes of the value
+		if order.Uint16(tiff[at:]) == 0x0112 && order.Uint16(tiff[at+2:]) == 3 {
+			if o := int(order.Uint16(tiff[at+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient turns img as EXIF orientation o says it must be to be upright
+func orient(img *image.RGBA, o int) *image.RGBA {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		// the ones that turn it a quarter
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // mirrored along the top left to bottom right diagonal
+				dx, dy = y, x
+			case 6: // needs a quarter turn clockwise
+				dx, dy = h-1-y, x
+			case 7: // mirrored along the other diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs a quarter turn anticlockwise
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, img.RGBAAt(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,272 @@
+// Package imaging turns uploaded pictures into the ones served: it checks
+// they decode as an image of an accepted format and size, crops them
+// square, scales them to each of the standard sizes and encodes them
+// afresh, to WebP by default. Only pixels are carried over, so EXIF,
+// with the camera and location it may hold, and any other metadata are
+// left behind; the EXIF orientation is applied first so the picture
+// stays the right way up. Decoding is memory and CPU heavy, so it runs
+// on a fixed number of workers.
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // decoder, for the first frame of an animation
+	"image/jpeg"
+	"image/png"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // decoder
+)
+
+var (
+	// ErrInvalid is a picture that doesn't decode as a png, jpeg, gif or
+	// webp image
+	ErrInvalid = errors.New("not a valid image")
+	// ErrTooManyPixels is a picture over MaxPixels, refused before it's
+	// decoded
+	ErrTooManyPixels = errors.New("image has too many pixels")
+	// ErrBusy is a picture turned away because the queue is full
+	ErrBusy = errors.New("image processing queue is full")
+)
+
+var (
+	processed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "images_processed_total",
+		Help: "Pictures processed, by result: ok, invalid, busy or error.",
+	}, []string{"result"})
+	processSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "image_processing_seconds",
+		Help:    "Time taken to process a picture into all of its sizes, once a worker had it.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// Formats are the ones pictures can be encoded to
+var Formats = []string{"webp", "png", "jpeg"}
+
+// decodable are the formats of the pictures accepted, as image names them
+var decodable = []string{"png", "jpeg", "gif", "webp"}
+
+type Options struct {
+	Sizes     []int  // edge lengths of the square variants, in pixels
+	Format    string // one of Formats, webp by default
+	Quality   int    // for webp and jpeg, 1 to 100, 80 by default
+	MaxPixels int    // width times height of the largest picture decoded, 25 million by default
+	Workers   int    // pictures processed at once, the CPUs by default
+	QueueSize int    // pictures waiting for a worker, 16 by default
+}
+
+// Variant is a picture processed to one of the sizes. Smaller pictures
+// aren't scaled up, Size is the one asked for and Width what it is.
+type Variant struct {
+	Size        int
+	Width       int
+	Data        []byte
+	ContentType string
+	Ext         string // with the dot
+}
+
+// Processor processes pictures on Run's workers
+type Processor struct {
+	opts  Options
+	queue chan job
+}
+
+type job struct {
+	src  []byte
+	done chan result // buffered, the caller may have stopped waiting
+}
+
+type result struct {
+	variants []Variant
+	err      error
+}
+
+// NewProcessor fails for a format that can't be encoded, webp in a build
+// without cgo
+func NewProcessor(opts Options) (*Processor, error) {
+	if opts.Format == "" {
+		opts.Format = "webp"
+	}
+	if !slices.Contains(Formats, opts.Format) {
+		return nil, fmt.Errorf("imaging: unknown format %q", opts.Format)
+	}
+	if opts.Format == "webp" && !webpSupported {
+		return nil, errors.New("imaging: webp needs a build with cgo, pick png or jpeg")
+	}
+	if len(opts.Sizes) == 0 {
+		return nil, errors.New("imaging: no sizes")
+	}
+	for _, size := range opts.Sizes {
+		if size < 1 || size > 4096 {
+			return nil, fmt.Errorf("imaging: size %d isn't 1 to 4096", size)
+		}
+	}
+	if opts.Quality <= 0 {
+		opts.Quality = 80
+	}
+	if opts.MaxPixels <= 0 {
+		opts.MaxPixels = 25_000_000
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 16
+	}
+	// largest first, the one a single URL points at
+	opts.Sizes = slices.Clone(opts.Sizes)
+	slices.Sort(opts.Sizes)
+	slices.Reverse(opts.Sizes)
+	return &Processor{opts: opts, queue: make(chan job, opts.QueueSize)}, nil
+}
+
+// Workers is how many pictures are processed at once
+func (p *Processor) Workers() int {
+	return p.opts.Workers
+}
+
+// Sizes are the variants' sizes, largest first
+func (p *Processor) Sizes() []int {
+	return p.opts.Sizes
+}
+
+// Ext is the extension of the variants, with the dot
+func (p *Processor) Ext() string {
+	if p.opts.Format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + p.opts.Format
+}
+
+// Run processes the queued pictures until ctx is done
+func (p *Processor) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	for i := 0; i < p.opts.Workers; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case j := <-p.queue:
+					start := time.Now()
+					variants, err := p.process(j.src)
+					processSeconds.Observe(time.Since(start).Seconds())
+					j.done <- result{variants, err}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < p.opts.Workers; i++ {
+		<-done
+	}
+	return nil
+}
+
+// Process queues src and waits for its variants, largest first. It fails
+// with ErrBusy at once when the queue is full, and with ErrInvalid or
+// ErrTooManyPixels for a picture that isn't accepted.
+func (p *Processor) Process(ctx context.Context, src []byte) ([]Variant, error) {
+	j := job{src: src, done: make(chan result, 1)}
+	select {
+	case p.queue <- j:
+	default:
+		processed.WithLabelValues("busy").Inc()
+		return nil, ErrBusy
+	}
+	select {
+	case res := <-j.done:
+		return res.variants, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Processor) process(src []byte) ([]Variant, error) {
+	variants, err := p.variants(src)
+	switch {
+	case errors.Is(err, ErrInvalid) || errors.Is(err, ErrTooManyPixels):
+		processed.WithLabelValues("invalid").Inc()
+	case err != nil:
+		processed.WithLabelValues("error").Inc()
+	default:
+		processed.WithLabelValues("ok").Inc()
+	}
+	return variants, err
+}
+
+func (p *Processor) variants(src []byte) ([]Variant, error) {
+	// the header alone, so a small file claiming huge dimensions isn't
+	// decoded into gigabytes
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil || !slices.Contains(decodable, format) {
+		return nil, ErrInvalid
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrInvalid
+	}
+	if cfg.Width*cfg.Height > p.opts.MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrTooManyPixels, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(src)
+	}
+	square := centerSquare(img.Bounds())
+	variants := make([]Variant, 0, len(p.opts.Sizes))
+	for _, size := range p.opts.Sizes {
+		// cropping square about the center and then turning the picture
+		// upright is the same as the other way round, and cheaper
+		scaled := orient(p.scale(img, square, min(size, square.Dx())), orientation)
+		var buf bytes.Buffer
+		if err := p.encode(&buf, scaled); err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{Size: size, Width: scaled.Bounds().Dx(), Data: buf.Bytes(),
+			ContentType: "image/" + p.opts.Format, Ext: p.Ext()})
+	}
+	return variants, nil
+}
+
+// centerSquare is the largest square in the middle of r
+func centerSquare(r image.Rectangle) image.Rectangle {
+	side := min(r.Dx(), r.Dy())
+	x, y := r.Min.X+(r.Dx()-side)/2, r.Min.Y+(r.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+func (p *Processor) scale(img image.Image, from image.Rectangle, side int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	if p.opts.Format == "jpeg" {
+		// jpeg has no transparency, what's see-through would turn black
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, from, draw.Over, nil)
+	return dst
+}
+
+func (p *Processor) encode(buf *bytes.Buffer, img image.Image) error {
+	switch p.opts.Format {
+	case "png":
+		return png.Encode(buf, img)
+	case "jpeg":
+		return jpeg.Encode(buf, img, &jpeg.Options{Quality: p.opts.Quality})
+	default:
+		return encodeWebP(buf, img, p.opts.Quality)
+	}
+}
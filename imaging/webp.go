@@ -0,0 +1,18 @@
+//go:build cgo
+
+package imaging
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// webpSupported is whether pictures can be encoded to webp, the encoder
+// is libwebp's and needs cgo
+const webpSupported = true
+
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+}
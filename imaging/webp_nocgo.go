@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package imaging
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+const webpSupported = false
+
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return errors.New("imaging: webp needs a build with cgo")
+}
@@ -0,0 +1,363 @@
+// Package jsonpatch applies partial updates to JSON documents, either as a
+// JSON Merge Patch (RFC 7386) or a JSON Patch (RFC 6902). Documents are
+// handled as decoded JSON, so it works for any resource; callers decode the
+// result into their own type to validate it.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is wrapped by errors for patches that are malformed or can't
+// be applied to the document
+var ErrInvalid = errors.New("invalid patch")
+
+// ErrTestFailed is returned when a JSON Patch test operation doesn't match,
+// the document is left as it was
+var ErrTestFailed = errors.New("patch test failed")
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrInvalid}, args...)...)
+}
+
+// Merge applies a JSON Merge Patch to doc: members of the patch replace
+// those of the document, objects are merged recursively and null removes
+// a member
+func Merge(doc, patch []byte) ([]byte, error) {
+	var d, p any
+	if err := decode(doc, &d); err != nil {
+		return nil, err
+	}
+	if err := decode(patch, &p); err != nil {
+		return nil, invalidf("%v", err)
+	}
+	return json.Marshal(merge(d, p))
+}
+
+func merge(doc, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]any)
+	if !ok {
+		d = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = merge(d[k], v)
+	}
+	return d
+}
+
+// Operation is one step of a JSON Patch
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies a JSON Patch, an array of operations, to doc. Operations
+// run in order and the patch applies whole or not at all.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var d any
+	if err := decode(doc, &d); err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(patch, &raw); err != nil {
+		return nil, invalidf("a JSON Patch is an array of operations: %v", err)
+	}
+	ops := make([]Operation, len(raw))
+	for i, r := range raw {
+		if err := unique(r); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		if err := json.Unmarshal(r, &ops[i]); err != nil {
+			return nil, invalidf("operation %d: %v", i, err)
+		}
+	}
+	for i, op := range ops {
+		var err error
+		if d, err = apply(d, op); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return json.Marshal(d)
+}
+
+func apply(doc any, op Operation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	value := func() (any, error) {
+		if op.Value == nil {
+			return nil, invalidf("%s needs a value", op.Op)
+		}
+		var v any
+		if err := decode(op.Value, &v); err != nil {
+			return nil, invalidf("%v", err)
+		}
+		return v, nil
+	}
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if doc, _, err = remove(doc, path); err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && isPrefix(from, path) && len(from) < len(path) {
+			return nil, invalidf("can't move %s into itself", op.From)
+		}
+		var v any
+		if op.Op == "move" {
+			doc, v, err = remove(doc, from)
+		} else {
+			v, err = get(doc, from)
+			v = clone(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(got, v) {
+			return nil, fmt.Errorf("%w: %s", ErrTestFailed, op.Path)
+		}
+		return doc, nil
+	}
+	return nil, invalidf("unknown op %q", op.Op)
+}
+
+// unique refuses an operation naming a member twice, which encoding/json
+// would settle by taking the last one
+func unique(op json.RawMessage) error {
+	dec := json.NewDecoder(bytes.NewReader(op))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return invalidf("an operation is an object")
+	}
+	seen := map[string]bool{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return invalidf("%v", err)
+		}
+		name := t.(string)
+		if seen[name] {
+			return invalidf("%q given twice", name)
+		}
+		seen[name] = true
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return invalidf("%v", err)
+		}
+	}
+	return nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped tokens
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, invalidf("path %q must start with /", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, t := range path {
+		switch c := doc.(type) {
+		case map[string]any:
+			v, ok := c[t]
+			if !ok {
+				return nil, invalidf("no member %q", t)
+			}
+			doc = v
+		case []any:
+			i, err := index(t, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, invalidf("%q is inside a value that isn't an object or array", t)
+		}
+	}
+	return doc, nil
+}
+
+// add sets the value at path, inserting into arrays, and returns the
+// document, which is v itself when path is the root
+func add(doc any, path []string, v any) (any, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch c := parent.(type) {
+	case map[string]any:
+		c[last] = v
+		return doc, nil
+	case []any:
+		i := len(c)
+		if last != "-" {
+			if i, err = index(last, len(c)); err != nil {
+				return nil, err
+			}
+		}
+		c = append(c[:i:i], append([]any{v}, c[i:]...)...)
+		return set(doc, path[:len(path)-1], c)
+	}
+	return nil, invalidf("can't add %q to a value that isn't an object or array", last)
+}
+
+// remove deletes the value at path, returning the document and the value
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch c := parent.(type) {
+	case map[string]any:
+		v, ok := c[last]
+		if !ok {
+			return nil, nil, invalidf("no member %q", last)
+		}
+		delete(c, last)
+		return doc, v, nil
+	case []any:
+		i, err := index(last, len(c)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := c[i]
+		c = append(c[:i:i], c[i+1:]...)
+		doc, err = set(doc, path[:len(path)-1], c)
+		return doc, v, err
+	}
+	return nil, nil, invalidf("can't remove %q from a value that isn't an object or array", last)
+}
+
+// set replaces the value at path, which exists, for arrays that grew or
+// shrank
+func set(doc any, path []string, v any) (any, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch c := parent.(type) {
+	case map[string]any:
+		c[last] = v
+	case []any:
+		i, err := index(last, len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+	}
+	return doc, nil
+}
+
+// index parses an array index token, at most max. RFC 6901 allows only
+// digits without a leading zero, so no sign either.
+func index(t string, max int) (int, error) {
+	i, err := strconv.Atoi(t)
+	if err != nil || strings.TrimLeft(t, "0123456789") != "" || (len(t) > 1 && t[0] == '0') {
+		return 0, invalidf("%q is not an array index", t)
+	}
+	if i > max {
+		return 0, invalidf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+func clone(v any) any {
+	switch c := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(c))
+		for k, e := range c {
+			m[k] = clone(e)
+		}
+		return m
+	case []any:
+		s := make([]any, len(c))
+		for i, e := range c {
+			s[i] = clone(e)
+		}
+		return s
+	}
+	return v
+}
+
+// decode keeps numbers exact, so ids and large values survive a round trip
+func decode(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
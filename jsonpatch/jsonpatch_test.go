@@ -0,0 +1,199 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// canonical re-encodes a document so equal ones compare equal as strings
+func canonical(t *testing.T, doc string) string {
+	t.Helper()
+	var v any
+	if err := decode([]byte(doc), &v); err != nil {
+		t.Fatalf("%s: %v", doc, err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string // the patched document, when err is nil
+		wantErr error
+	}{
+		// RFC 6902 appendix A
+		{name: "A.1 adding an object member", doc: `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux"}]`, want: `{"baz":"qux","foo":"bar"}`},
+		{name: "A.2 adding an array element", doc: `{"foo":["bar","baz"]}`,
+			patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, want: `{"foo":["bar","qux","baz"]}`},
+		{name: "A.3 removing an object member", doc: `{"baz":"qux","foo":"bar"}`,
+			patch: `[{"op":"remove","path":"/baz"}]`, want: `{"foo":"bar"}`},
+		{name: "A.4 removing an array element", doc: `{"foo":["bar","qux","baz"]}`,
+			patch: `[{"op":"remove","path":"/foo/1"}]`, want: `{"foo":["bar","baz"]}`},
+		{name: "A.5 replacing a value", doc: `{"baz":"qux","foo":"bar"}`,
+			patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, want: `{"baz":"boo","foo":"bar"}`},
+		{name: "A.6 moving a value", doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			want:  `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{name: "A.7 moving an array element", doc: `{"foo":["all","grass","cows","eat"]}`,
+			patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, want: `{"foo":["all","cows","eat","grass"]}`},
+		{name: "A.8 testing a value, success", doc: `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			want:  `{"baz":"qux","foo":["a",2,"c"]}`},
+		{name: "A.9 testing a value, error", doc: `{"baz":"qux"}`,
+			patch: `[{"op":"test","path":"/baz","value":"bar"}]`, wantErr: ErrTestFailed},
+		{name: "A.10 adding a nested member object", doc: `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, want: `{"foo":"bar","child":{"grandchild":{}}}`},
+		{name: "A.11 ignoring unrecognized elements", doc: `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, want: `{"foo":"bar","baz":"qux"}`},
+		{name: "A.12 adding to a nonexistent target", doc: `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, wantErr: ErrInvalid},
+		{name: "A.13 invalid JSON Patch document", doc: `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux","op":"remove"}]`, wantErr: ErrInvalid},
+		{name: "member given twice", doc: `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux","value":"quux"}]`, wantErr: ErrInvalid},
+		{name: "operation not an object", doc: `{"foo":"bar"}`, patch: `["add"]`, wantErr: ErrInvalid},
+		{name: "A.14 ~ escape ordering", doc: `{"/":9,"~1":10}`,
+			patch: `[{"op":"test","path":"/~01","value":10}]`, want: `{"/":9,"~1":10}`},
+		{name: "A.15 comparing strings and numbers", doc: `{"/":9,"~1":10}`,
+			patch: `[{"op":"test","path":"/~01","value":"10"}]`, wantErr: ErrTestFailed},
+		{name: "A.16 adding an array value", doc: `{"foo":["bar"]}`,
+			patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, want: `{"foo":["bar",["abc","def"]]}`},
+
+		// array indexes
+		{name: "append with -", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"add","path":"/foo/-","value":3}]`, want: `{"foo":[1,2,3]}`},
+		{name: "add at the end index", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"add","path":"/foo/2","value":3}]`, want: `{"foo":[1,2,3]}`},
+		{name: "add past the end", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"add","path":"/foo/3","value":3}]`, wantErr: ErrInvalid},
+		{name: "remove past the end", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"remove","path":"/foo/2"}]`, wantErr: ErrInvalid},
+		{name: "remove with -", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"remove","path":"/foo/-"}]`, wantErr: ErrInvalid},
+		{name: "negative index", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"replace","path":"/foo/-1","value":3}]`, wantErr: ErrInvalid},
+		{name: "leading zero", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"replace","path":"/foo/01","value":3}]`, wantErr: ErrInvalid},
+		{name: "leading plus", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"replace","path":"/foo/+1","value":3}]`, wantErr: ErrInvalid},
+		{name: "index 0", doc: `{"foo":[1,2]}`,
+			patch: `[{"op":"replace","path":"/foo/0","value":3}]`, want: `{"foo":[3,2]}`},
+
+		// move and copy
+		{name: "move into itself", doc: `{"foo":{"bar":1}}`,
+			patch: `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, wantErr: ErrInvalid},
+		{name: "move onto itself", doc: `{"foo":{"bar":1}}`,
+			patch: `[{"op":"move","from":"/foo","path":"/foo"}]`, want: `{"foo":{"bar":1}}`},
+		{name: "copy doesn't share", doc: `{"foo":{"bar":1}}`,
+			patch: `[{"op":"copy","from":"/foo","path":"/qux"},{"op":"replace","path":"/qux/bar","value":2}]`,
+			want:  `{"foo":{"bar":1},"qux":{"bar":2}}`},
+
+		// whole patches
+		{name: "replace the root", doc: `{"foo":1}`,
+			patch: `[{"op":"replace","path":"","value":[1]}]`, want: `[1]`},
+		{name: "replace a missing member", doc: `{"foo":1}`,
+			patch: `[{"op":"replace","path":"/bar","value":1}]`, wantErr: ErrInvalid},
+		{name: "add without a value", doc: `{"foo":1}`,
+			patch: `[{"op":"add","path":"/bar"}]`, wantErr: ErrInvalid},
+		{name: "add a null", doc: `{"foo":1}`,
+			patch: `[{"op":"add","path":"/bar","value":null}]`, want: `{"foo":1,"bar":null}`},
+		{name: "path without a slash", doc: `{"foo":1}`,
+			patch: `[{"op":"remove","path":"foo"}]`, wantErr: ErrInvalid},
+		{name: "unknown op", doc: `{"foo":1}`,
+			patch: `[{"op":"frob","path":"/foo"}]`, wantErr: ErrInvalid},
+		{name: "not an array", doc: `{"foo":1}`,
+			patch: `{"op":"remove","path":"/foo"}`, wantErr: ErrInvalid},
+		{name: "large numbers kept exact", doc: `{"id":12345678901234567890}`,
+			patch: `[{"op":"add","path":"/n","value":0.1}]`, want: `{"id":12345678901234567890,"n":0.1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := canonical(t, tt.want); string(got) != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestApplyFailedTestLeavesDocument checks a patch applies whole or not at
+// all, the operations before a failed test don't reach the document
+func TestApplyFailedTestLeavesDocument(t *testing.T) {
+	doc := []byte(`{"foo":["a","b"],"bar":{"baz":1}}`)
+	before := string(doc)
+	patch := `[
+		{"op":"add","path":"/foo/-","value":"c"},
+		{"op":"remove","path":"/bar/baz"},
+		{"op":"test","path":"/foo/0","value":"z"}
+	]`
+	got, err := Apply(doc, []byte(patch))
+	if !errors.Is(err, ErrTestFailed) {
+		t.Fatalf("err = %v, want %v", err, ErrTestFailed)
+	}
+	if got != nil {
+		t.Fatalf("got %s with a failed test", got)
+	}
+	if string(doc) != before {
+		t.Fatalf("document changed to %s", doc)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr error
+	}{
+		{name: "replace a member", doc: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "add a member", doc: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{name: "null deletes", doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{name: "null deletes a missing member", doc: `{"a":"b"}`, patch: `{"c":null}`, want: `{"a":"b"}`},
+		{name: "nested null deletes", doc: `{"a":{"b":"c","d":"e"}}`, patch: `{"a":{"d":null}}`, want: `{"a":{"b":"c"}}`},
+		{name: "null deletes nested objects", doc: `{"a":{"b":{"c":1}}}`, patch: `{"a":null}`, want: `{}`},
+		{name: "null inside an added object is dropped", doc: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+		{name: "arrays replace", doc: `{"a":["b"]}`, patch: `{"a":["c","d"]}`, want: `{"a":["c","d"]}`},
+		{name: "object replaces a scalar", doc: `{"a":"c"}`, patch: `{"a":{"b":"c"}}`, want: `{"a":{"b":"c"}}`},
+		{name: "scalar replaces the document", doc: `{"a":"foo"}`, patch: `"bar"`, want: `"bar"`},
+		{name: "array replaces the document", doc: `{"a":"foo"}`, patch: `["c"]`, want: `["c"]`},
+		{name: "null patch", doc: `{"a":"foo"}`, patch: `null`, want: `null`},
+		{name: "empty patch", doc: `{"a":"b"}`, patch: `{}`, want: `{"a":"b"}`},
+		{name: "merge into a non object", doc: `["a"]`, patch: `{"a":"b"}`, want: `{"a":"b"}`},
+		{name: "malformed patch", doc: `{"a":"b"}`, patch: `{"a":`, wantErr: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Merge([]byte(tt.doc), []byte(tt.patch))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := canonical(t, tt.want); string(got) != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
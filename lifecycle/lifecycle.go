@@ -0,0 +1,121 @@
+// Package lifecycle starts and stops the service's components in a fixed
+// order. Components append hooks as they are constructed, so dependencies
+// (which are constructed first) start first and stop last.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Hook is a component's start and stop. OnStart must not block, long running
+// work belongs in a goroutine that reports failure through Lifecycle.Fail.
+type Hook struct {
+	Name    string
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+}
+
+type Lifecycle struct {
+	logger *zerolog.Logger
+
+	mu      sync.Mutex
+	hooks   []Hook
+	started int
+	failed  chan error
+}
+
+func New(logger *zerolog.Logger) *Lifecycle {
+	return &Lifecycle{logger: logger, failed: make(chan error, 1)}
+}
+
+// Append adds a hook, run after every hook appended before it
+func (l *Lifecycle) Append(h Hook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, h)
+}
+
+// Fail reports that a running component died, which stops the service. Only
+// the first failure is kept.
+func (l *Lifecycle) Fail(name string, err error) {
+	select {
+	case l.failed <- fmt.Errorf("%s: %w", name, err):
+	default:
+	}
+}
+
+// Start runs the OnStart hooks in order. If one fails the hooks already
+// started are stopped again, in reverse, before the error is returned.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	hooks := append([]Hook{}, l.hooks...)
+	l.mu.Unlock()
+	for i, h := range hooks {
+		if h.OnStart != nil {
+			start := time.Now()
+			if err := h.OnStart(ctx); err != nil {
+				err = fmt.Errorf("starting %s: %w", h.Name, err)
+				if stopErr := l.stop(ctx, hooks[:i]); stopErr != nil {
+					err = errors.Join(err, stopErr)
+				}
+				return err
+			}
+			l.logger.Debug().Str("component", h.Name).Dur("took", time.Since(start)).Msg("started")
+		}
+		l.mu.Lock()
+		l.started = i + 1
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// Stop runs the OnStop hooks of everything started, in reverse order. Every
+// hook gets to run, the errors are joined.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	hooks := append([]Hook{}, l.hooks[:l.started]...)
+	l.started = 0
+	l.mu.Unlock()
+	return l.stop(ctx, hooks)
+}
+
+func (l *Lifecycle) stop(ctx context.Context, hooks []Hook) error {
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if h.OnStop == nil {
+			continue
+		}
+		if err := h.OnStop(ctx); err != nil {
+			l.logger.Error().Err(err).Str("component", h.Name).Msg("stop failed")
+			errs = append(errs, fmt.Errorf("stopping %s: %w", h.Name, err))
+			continue
+		}
+		l.logger.Debug().Str("component", h.Name).Msg("stopped")
+	}
+	return errors.Join(errs...)
+}
+
+// Run starts everything, waits for ctx to be done or a component to Fail,
+// then stops everything within stopTimeout
+func (l *Lifecycle) Run(ctx context.Context, stopTimeout time.Duration) error {
+	if err := l.Start(ctx); err != nil {
+		return err
+	}
+	var runErr error
+	select {
+	case <-ctx.Done():
+		l.logger.Info().Msg("shutting down")
+	case runErr = <-l.failed:
+		l.logger.Error().Err(runErr).Msg("component failed, shutting down")
+	}
+	stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), stopTimeout)
+	defer cancel()
+	return errors.Join(runErr, l.Stop(stopCtx))
+}
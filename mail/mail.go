@@ -0,0 +1,123 @@
+// Package mail sends email. Mailer is the seam: SMTP for real delivery,
+// Log for development where the message, links and all, goes to the log.
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Log writes messages to the logger instead of sending them
+type Log struct {
+	Logger *zerolog.Logger
+}
+
+func (l Log) Send(ctx context.Context, m Message) error {
+	l.Logger.Info().Str("to", m.To).Str("subject", m.Subject).Str("text", m.Text).Msg("email not sent, MAIL_BACKEND is log")
+	return nil
+}
+
+type SMTPOptions struct {
+	Addr     string // host:port of the relay
+	From     string
+	Username string // PLAIN auth when set, the relay must offer STARTTLS
+	Password string
+	Timeout  time.Duration
+}
+
+// SMTP sends through a relay, one connection per message
+type SMTP struct {
+	opts SMTPOptions
+}
+
+func NewSMTP(opts SMTPOptions) *SMTP {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &SMTP{opts: opts}
+}
+
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	// net/smtp has no context support, so the deadline goes on the
+	// connection instead
+	deadline := time.Now().Add(s.opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	d := net.Dialer{Deadline: deadline}
+	conn, err := d.DialContext(ctx, "tcp", s.opts.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp dial: %w", err)
+	}
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(s.opts.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp: %w", err)
+	}
+	defer c.Close()
+	if s.opts.Username != "" {
+		// PlainAuth refuses to send credentials unencrypted, except to
+		// localhost
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return fmt.Errorf("smtp starttls: %w", err)
+			}
+		}
+		if err := c.Auth(smtp.PlainAuth("", s.opts.Username, s.opts.Password, host)); err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+	if err := c.Mail(s.opts.From); err != nil {
+		return fmt.Errorf("smtp from: %w", err)
+	}
+	if err := c.Rcpt(m.To); err != nil {
+		return fmt.Errorf("smtp rcpt: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	if _, err := w.Write(s.format(m)); err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp data: %w", err)
+	}
+	return c.Quit()
+}
+
+func (s *SMTP) format(m Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue(s.opts.From))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue(m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Text, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// headerValue drops line breaks so a value can't add headers of its own
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
+}
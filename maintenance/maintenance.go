@@ -0,0 +1,49 @@
+// Package maintenance is the switch operators flip to take the API down for
+// maintenance. While it's on the API answers 503 with Retry-After, and
+// health checks keep passing so the orchestrator leaves the instance be.
+// It's per instance, flip it on each one.
+package maintenance
+
+import (
+	"sync"
+	"time"
+)
+
+// State is whether maintenance is on, and who last flipped the switch
+// when, and why
+type State struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"` // shown to clients
+	By      string     `json:"by,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	// RetryAfterSeconds is when clients are told to come back
+	RetryAfterSeconds int `json:"retry_after_seconds"`
+}
+
+type Switch struct {
+	mu    sync.RWMutex
+	state State
+}
+
+func NewSwitch(initial State) *Switch {
+	return &Switch{state: initial}
+}
+
+// State is the switch as it is now
+func (s *Switch) State() State {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// Set flips the switch to st, stamped with when, and returns the state
+// it replaced
+func (s *Switch) Set(st State) State {
+	now := time.Now()
+	st.Since = &now
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.state
+	s.state = st
+	return prev
+}
@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/metrics"
+)
+
+// Notification is one event to tell a user about
+type Notification struct {
+	UserID string
+	Email  string
+	Phone  string // for SMS, empty when the user has none
+	Event  Event
+	Time   time.Time
+	Data   map[string]string // event specific details, e.g. the client address
+}
+
+// Sender delivers notifications over one channel, see EmailSender,
+// TwilioSender and WebhookSender. Errors wrapped with Permanent aren't
+// retried by WithRetry.
+type Sender interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// Dispatcher routes notifications to the sender for the channel the user
+// picked for the event. Nothing is sent for ChannelNone or for a channel
+// without a sender.
+type Dispatcher struct {
+	prefs   PreferenceStore
+	senders map[Channel]Sender
+	logger  *zerolog.Logger
+	timeout time.Duration
+}
+
+func NewDispatcher(prefs PreferenceStore, logger *zerolog.Logger) *Dispatcher {
+	return &Dispatcher{prefs: prefs, senders: map[Channel]Sender{}, logger: logger, timeout: 30 * time.Second}
+}
+
+// Register makes s the sender for channel
+func (d *Dispatcher) Register(channel Channel, s Sender) {
+	d.senders[channel] = s
+}
+
+// Preferences returns the user's effective preferences, defaults filled in
+// for events they haven't set
+func (d *Dispatcher) Preferences(ctx context.Context, userID string) (Preferences, error) {
+	set, err := d.prefs.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	p := DefaultPreferences()
+	for e, c := range set {
+		p[e] = c
+	}
+	return p, nil
+}
+
+// SetPreferences validates prefs and stores them for the user, events left
+// out keep their current channel
+func (d *Dispatcher) SetPreferences(ctx context.Context, userID string, prefs Preferences) error {
+	if err := prefs.Validate(); err != nil {
+		return err
+	}
+	return d.prefs.Put(ctx, userID, prefs)
+}
+
+// Dispatch sends n in the background so the request that caused it isn't
+// held up, or failed, by a slow mail server. It outlives ctx's cancellation
+// but keeps its values.
+func (d *Dispatcher) Dispatch(ctx context.Context, n Notification) {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.timeout)
+	go func() {
+		defer cancel()
+		d.send(ctx, n)
+	}()
+}
+
+func (d *Dispatcher) send(ctx context.Context, n Notification) {
+	log := d.logger.With().Str("user_id", n.UserID).Str("event", string(n.Event)).Logger()
+	set, err := d.prefs.Get(ctx, n.UserID)
+	if err != nil {
+		log.Error().Err(err).Msg("notification preferences")
+		return
+	}
+	channel := set.Channel(n.Event)
+	if channel == ChannelNone {
+		return
+	}
+	s, ok := d.senders[channel]
+	if !ok {
+		log.Debug().Str("channel", string(channel)).Msg("no sender for channel, notification dropped")
+		metrics.Notification(string(n.Event), string(channel), metrics.Dropped)
+		return
+	}
+	if err := s.Send(ctx, n); err != nil {
+		log.Error().Err(err).Str("channel", string(channel)).Msg("sending notification")
+		metrics.Notification(string(n.Event), string(channel), metrics.Failure)
+		return
+	}
+	metrics.Notification(string(n.Event), string(channel), metrics.Success)
+}
@@ -0,0 +1,30 @@
+package notify
+
+import (
+	"context"
+	"errors"
+
+	"go-chi-microservice/mail"
+)
+
+// EmailSender sends notifications through a mail.Mailer, SMTP in
+// production
+type EmailSender struct {
+	mailer    mail.Mailer
+	templates *Templates
+}
+
+func NewEmailSender(mailer mail.Mailer, templates *Templates) *EmailSender {
+	return &EmailSender{mailer: mailer, templates: templates}
+}
+
+func (s *EmailSender) Send(ctx context.Context, n Notification) error {
+	if n.Email == "" {
+		return Permanent(errors.New("user has no email"))
+	}
+	subject, body, err := s.templates.Render(n)
+	if err != nil {
+		return Permanent(err)
+	}
+	return s.mailer.Send(ctx, mail.Message{To: n.Email, Subject: subject, Text: body})
+}
@@ -0,0 +1,127 @@
+// Package notify tells users about things that happened to their account,
+// over the channel they picked for each kind of event
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Channel is how a user wants to hear about an event
+type Channel string
+
+const (
+	ChannelEmail   Channel = "email"
+	ChannelSMS     Channel = "sms"
+	ChannelWebhook Channel = "webhook"
+	ChannelNone    Channel = "none"
+)
+
+// Event is a kind of notification users can set a channel for
+type Event string
+
+const (
+	EventLogin         Event = "login"          // a successful sign in
+	EventAccountLocked Event = "account_locked" // too many failed logins
+	EventWelcome       Event = "welcome"        // the account was just created
+)
+
+// Events are every event preferences can be set for, each needs a template
+// in notify/templates
+var Events = []Event{EventLogin, EventAccountLocked, EventWelcome}
+
+// Preferences maps each event to the channel it's sent over
+type Preferences map[Event]Channel
+
+// DefaultPreferences are what users get until they change them: security
+// events by email, routine ones not at all
+func DefaultPreferences() Preferences {
+	return Preferences{
+		EventLogin:         ChannelNone,
+		EventAccountLocked: ChannelEmail,
+		EventWelcome:       ChannelEmail,
+	}
+}
+
+// Channel is the channel for event, falling back to the default
+func (p Preferences) Channel(event Event) Channel {
+	if c, ok := p[event]; ok {
+		return c
+	}
+	return DefaultPreferences()[event]
+}
+
+// Validate rejects unknown events and channels
+func (p Preferences) Validate() error {
+	for e, c := range p {
+		if !knownEvent(e) {
+			return fmt.Errorf("unknown event %q", e)
+		}
+		switch c {
+		case ChannelEmail, ChannelSMS, ChannelWebhook, ChannelNone:
+		default:
+			return fmt.Errorf("unknown channel %q for %s", c, e)
+		}
+	}
+	return nil
+}
+
+func knownEvent(event Event) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// PreferenceStore keeps each user's preferences. Get returns only what the
+// user has set, an empty map for a user who never has.
+type PreferenceStore interface {
+	Get(ctx context.Context, userID string) (Preferences, error)
+	// Put merges prefs into the user's stored preferences
+	Put(ctx context.Context, userID string, prefs Preferences) error
+}
+
+// MemoryPreferenceStore is a PreferenceStore for a single instance,
+// preferences don't survive a restart
+type MemoryPreferenceStore struct {
+	mu    sync.RWMutex
+	prefs map[string]Preferences
+}
+
+func NewMemoryPreferenceStore() *MemoryPreferenceStore {
+	return &MemoryPreferenceStore{prefs: map[string]Preferences{}}
+}
+
+func (s *MemoryPreferenceStore) Get(ctx context.Context, userID string) (Preferences, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// a copy, so callers can't change the stored map
+	p := make(Preferences, len(s.prefs[userID]))
+	for e, c := range s.prefs[userID] {
+		p[e] = c
+	}
+	return p, nil
+}
+
+func (s *MemoryPreferenceStore) Put(ctx context.Context, userID string, prefs Preferences) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.prefs[userID]
+	if stored == nil {
+		stored = Preferences{}
+		s.prefs[userID] = stored
+	}
+	for e, c := range prefs {
+		stored[e] = c
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// permanentError marks a failure that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string { return p.err.Error() }
+func (p *permanentError) Unwrap() error { return p.err }
+
+// Permanent wraps err so WithRetry gives up at once, for senders to use on
+// e.g. a rejected phone number
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was wrapped with Permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+type RetryOptions struct {
+	Attempts   int           // in total, 3 by default
+	Backoff    time.Duration // before the second attempt, doubled after, 1s by default
+	MaxBackoff time.Duration // 30s by default
+}
+
+type retrySender struct {
+	next Sender
+	opts RetryOptions
+}
+
+// WithRetry retries s with jittered exponential backoff until it succeeds,
+// fails with a Permanent error or ctx is done
+func WithRetry(s Sender, opts RetryOptions) Sender {
+	if opts.Attempts <= 0 {
+		opts.Attempts = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	return &retrySender{next: s, opts: opts}
+}
+
+func (r *retrySender) Send(ctx context.Context, n Notification) (err error) {
+	for attempt := 0; attempt < r.opts.Attempts; attempt++ {
+		if attempt > 0 {
+			d := min(r.opts.Backoff<<(attempt-1), r.opts.MaxBackoff)
+			d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			}
+		}
+		if err = r.next.Send(ctx, n); err == nil || IsPermanent(err) {
+			return err
+		}
+	}
+	return err
+}
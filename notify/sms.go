@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type TwilioOptions struct {
+	AccountSID string
+	AuthToken  string
+	From       string // a Twilio number in E.164 format, e.g. +15005550006
+	BaseURL    string // https://api.twilio.com by default
+	Client     *http.Client
+}
+
+// TwilioSender texts the subject of each notification through the Twilio
+// Messages API
+type TwilioSender struct {
+	opts      TwilioOptions
+	templates *Templates
+}
+
+func NewTwilioSender(opts TwilioOptions, templates *Templates) *TwilioSender {
+	if opts.BaseURL == "" {
+		opts.BaseURL = "https://api.twilio.com"
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &TwilioSender{opts: opts, templates: templates}
+}
+
+func (s *TwilioSender) Send(ctx context.Context, n Notification) error {
+	if n.Phone == "" {
+		return Permanent(errors.New("user has no phone number"))
+	}
+	subject, _, err := s.templates.Render(n)
+	if err != nil {
+		return Permanent(err)
+	}
+	form := url.Values{"To": {n.Phone}, "From": {s.opts.From}, "Body": {subject}}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", s.opts.BaseURL, url.PathEscape(s.opts.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.opts.AccountSID, s.opts.AuthToken)
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("twilio: %w", err)
+	}
+	defer resp.Body.Close()
+	return statusError("twilio", resp)
+}
+
+// statusError turns a non 2xx response into an error, Permanent for client
+// errors other than 408 and 429 since sending again won't change them
+func statusError(name string, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s: %s: %s", name, resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+// Templates render the message for each event. An event's template defines
+// a "subject" block, a one line summary also used as the SMS text, and a
+// "body" block. Both are executed with the Notification.
+type Templates struct {
+	byEvent map[Event]*template.Template
+}
+
+// LoadTemplates parses the built in templates in notify/templates, then
+// any <event>.tmpl in dir over them. dir may be empty for the built in ones
+// only.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{byEvent: map[Event]*template.Template{}}
+	for _, e := range Events {
+		name := string(e) + ".tmpl"
+		src, err := defaultTemplates.ReadFile("templates/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("template for %s: %w", e, err)
+		}
+		if dir != "" {
+			if b, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+				src = b
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(string(src))
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range []string{"subject", "body"} {
+			if tmpl.Lookup(block) == nil {
+				return nil, fmt.Errorf("%s: no %q block", name, block)
+			}
+		}
+		t.byEvent[e] = tmpl
+	}
+	return t, nil
+}
+
+// Render returns n's subject and body
+func (t *Templates) Render(n Notification) (subject, body string, err error) {
+	tmpl, ok := t.byEvent[n.Event]
+	if !ok {
+		return "", "", fmt.Errorf("no template for %s", n.Event)
+	}
+	var b strings.Builder
+	if err := tmpl.ExecuteTemplate(&b, "subject", n); err != nil {
+		return "", "", err
+	}
+	subject = strings.TrimSpace(b.String())
+	b.Reset()
+	if err := tmpl.ExecuteTemplate(&b, "body", n); err != nil {
+		return "", "", err
+	}
+	return subject, strings.TrimSpace(b.String()) + "\n", nil
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of a webhook body, keyed with
+// the shared secret, as sha256=<hex>
+const SignatureHeader = "X-Signature-256"
+
+type WebhookOptions struct {
+	URL    string
+	Secret string // signs each body, see SignatureHeader
+	Client *http.Client
+}
+
+// WebhookSender posts notifications as JSON to one endpoint, e.g. a chat
+// integration that relays them to the user
+type WebhookSender struct {
+	opts      WebhookOptions
+	templates *Templates
+}
+
+func NewWebhookSender(opts WebhookOptions, templates *Templates) *WebhookSender {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &WebhookSender{opts: opts, templates: templates}
+}
+
+// webhookPayload is the body posted for each notification
+type webhookPayload struct {
+	Event   Event             `json:"event"`
+	UserID  string            `json:"user_id"`
+	Time    time.Time         `json:"time"`
+	Subject string            `json:"subject"`
+	Text    string            `json:"text"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+func (s *WebhookSender) Send(ctx context.Context, n Notification) error {
+	subject, text, err := s.templates.Render(n)
+	if err != nil {
+		return Permanent(err)
+	}
+	body, err := json.Marshal(webhookPayload{Event: n.Event, UserID: n.UserID, Time: n.Time, Subject: subject, Text: text, Data: n.Data})
+	if err != nil {
+		return Permanent(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(s.opts.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	return statusError("webhook", resp)
+}
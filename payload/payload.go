@@ -0,0 +1,136 @@
+// Package payload keeps older versions of an API's request and response
+// bodies working as the DTOs behind them change. Each change registers a
+// Step between the version before it and the one it introduces: Up takes a
+// body an older client sent to the newer shape, Down takes a response back
+// to the shape the client knows. The steps work on the JSON form of a DTO,
+// so a field renamed or dropped in the Go type needn't stay on it, and get
+// the request's context, for what an older shape takes from the request
+// rather than the DTO.
+package payload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupported is for a version older than the oldest still served, or
+// newer than the current one
+var ErrUnsupported = errors.New("unsupported payload version")
+
+// Doc is a DTO as a JSON object, numbers as json.Number
+type Doc = map[string]any
+
+// Step is a change to one payload between two versions, nil for a direction
+// where the shape is the same
+type Step struct {
+	Up   func(ctx context.Context, doc Doc) error
+	Down func(ctx context.Context, doc Doc) error
+}
+
+// Versions are an API's payload versions, numbered from 1, and the steps
+// between them by payload, e.g. "user"
+type Versions struct {
+	oldest, current int
+	steps           map[string]map[int]Step // by payload, then the version a step goes up from
+}
+
+// New serves versions oldest to current, current being what the DTOs are
+func New(oldest, current int) *Versions {
+	return &Versions{oldest: oldest, current: current, steps: map[string]map[int]Step{}}
+}
+
+// Register adds the step payload takes from version from to from+1.
+// Register every step at startup, before serving.
+func (v *Versions) Register(payload string, from int, step Step) {
+	if from < 1 || from >= v.current {
+		panic(fmt.Sprintf("payload %s: no version after %d to step to", payload, from))
+	}
+	if v.steps[payload] == nil {
+		v.steps[payload] = map[int]Step{}
+	}
+	v.steps[payload][from] = step
+}
+
+func (v *Versions) Oldest() int  { return v.oldest }
+func (v *Versions) Current() int { return v.current }
+
+// Check is ErrUnsupported unless version is served
+func (v *Versions) Check(version int) error {
+	if version < v.oldest || version > v.current {
+		return fmt.Errorf("%w: %d, versions %d to %d are served", ErrUnsupported, version, v.oldest, v.current)
+	}
+	return nil
+}
+
+// Marshal is dto as JSON in version's shape
+func (v *Versions) Marshal(ctx context.Context, payload string, dto any, version int) ([]byte, error) {
+	data, err := json.Marshal(dto)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Check(version); err != nil {
+		return nil, err
+	}
+	if !v.changed(payload, version, func(s Step) bool { return s.Down != nil }) {
+		return data, nil
+	}
+	doc, err := decode(data)
+	if err != nil || doc == nil {
+		return data, err
+	}
+	for from := v.current - 1; from >= version; from-- {
+		if down := v.steps[payload][from].Down; down != nil {
+			if err := down(ctx, doc); err != nil {
+				return nil, fmt.Errorf("payload %s down to version %d: %w", payload, from, err)
+			}
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// Upgrade takes data, sent in version's shape, to the current one for
+// decoding into the DTO
+func (v *Versions) Upgrade(ctx context.Context, payload string, data []byte, version int) ([]byte, error) {
+	if err := v.Check(version); err != nil {
+		return nil, err
+	}
+	if !v.changed(payload, version, func(s Step) bool { return s.Up != nil }) {
+		return data, nil
+	}
+	doc, err := decode(data)
+	if err != nil || doc == nil {
+		return data, err
+	}
+	for from := version; from < v.current; from++ {
+		if up := v.steps[payload][from].Up; up != nil {
+			if err := up(ctx, doc); err != nil {
+				return nil, fmt.Errorf("payload %s up from version %d: %w", payload, from, err)
+			}
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// changed is whether payload has a step with has from version on, the
+// JSON is left as it is when not
+func (v *Versions) changed(payload string, version int, has func(Step) bool) bool {
+	for from := version; from < v.current; from++ {
+		if step, ok := v.steps[payload][from]; ok && has(step) {
+			return true
+		}
+	}
+	return false
+}
+
+func decode(data []byte) (Doc, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc Doc
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/lifecycle"
+)
+
+// newHTTP3 builds the HTTP/3 server for srv, serving its handler with its
+// TLS config on the UDP address addr. 0-RTT stays off, a replayed early
+// request could repeat a write.
+func newHTTP3(srv *http.Server, addr string) *http3.Server {
+	return &http3.Server{
+		Addr:           addr,
+		Handler:        srv.Handler,
+		TLSConfig:      srv.TLSConfig,
+		MaxHeaderBytes: srv.MaxHeaderBytes,
+		QuicConfig:     &quic.Config{MaxIdleTimeout: srv.IdleTimeout},
+	}
+}
+
+// http3Hook binds srv's UDP address at start, so a port clash fails
+// startup, and serves in the background until stop. Requests in flight are
+// cut off on stop, quic-go doesn't drain them yet.
+func http3Hook(lc *lifecycle.Lifecycle, logger *zerolog.Logger, srv *http3.Server) lifecycle.Hook {
+	return lifecycle.Hook{
+		Name: "http3_server",
+		OnStart: func(ctx context.Context) error {
+			conn, err := net.ListenPacket("udp", srv.Addr)
+			if err != nil {
+				return fmt.Errorf("listening on udp %s: %w", srv.Addr, err)
+			}
+			logger.Info().Str("addr", conn.LocalAddr().String()).Msg("http3_server listening")
+			go func() {
+				if err := srv.Serve(conn); err != nil && err != http.ErrServerClosed && err != quic.ErrServerClosed {
+					lc.Fail("http3_server", err)
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return srv.Close()
+		},
+	}
+}
+
+// altSvc advertises HTTP/3 on port in responses over TLS, clients that
+// speak it try it for their next requests and keep using it for maxAge
+func altSvc(port int, maxAge time.Duration) func(http.Handler) http.Handler {
+	value := `h3=":` + strconv.Itoa(port) + `"; ma=` + strconv.Itoa(int(maxAge.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && r.ProtoMajor < 3 {
+				w.Header().Set("Alt-Svc", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Package publicid turns the ids a store keeps into the ones clients see
+// and back, so ids that give something away, a sequence counting the
+// users, a timestamp, an id from another system, stay internal.
+package publicid
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrInvalid is for a public id that no internal id encodes to, answered
+// like an id that doesn't exist
+var ErrInvalid = errors.New("not a valid id")
+
+// Codec encodes internal ids for clients and decodes theirs. Encode must
+// give the same public id every time for an id, so clients can compare and
+// cache them.
+type Codec interface {
+	Encode(id string) string
+	Decode(public string) (string, error)
+}
+
+// Encrypted encodes ids by encrypting them with AES-GCM, under a nonce
+// derived from the id so it's deterministic, as base64url. Public ids are
+// 38 characters longer than the id, and nobody without the secret learns
+// anything from one but its length.
+type Encrypted struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// NewEncrypted derives the encryption and nonce keys from secret, which
+// must be at least 32 bytes. Changing it changes every public id.
+func NewEncrypted(secret string) (*Encrypted, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the public id secret must be at least 32 bytes")
+	}
+	block, err := aes.NewCipher(derive(secret, "encrypt"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypted{aead: aead, macKey: derive(secret, "nonce")}, nil
+}
+
+func derive(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("publicid/" + purpose))
+	return mac.Sum(nil)
+}
+
+func (e *Encrypted) nonce(id string) []byte {
+	mac := hmac.New(sha256.New, e.macKey)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)[:e.aead.NonceSize()]
+}
+
+func (e *Encrypted) Encode(id string) string {
+	nonce := e.nonce(id)
+	return base64.RawURLEncoding.EncodeToString(e.aead.Seal(nonce, nonce, []byte(id), nil))
+}
+
+func (e *Encrypted) Decode(public string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(public)
+	if err != nil || len(b) < e.aead.NonceSize()+e.aead.Overhead() {
+		return "", ErrInvalid
+	}
+	nonce := b[:e.aead.NonceSize()]
+	id, err := e.aead.Open(nil, nonce, b[e.aead.NonceSize():], nil)
+	// the nonce check refuses a valid ciphertext under a nonce of the
+	// client's choosing, so each id has exactly one public id
+	if err != nil || !hmac.Equal(nonce, e.nonce(string(id))) {
+		return "", ErrInvalid
+	}
+	return string(id), nil
+}
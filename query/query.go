@@ -0,0 +1,266 @@
+// Package query implements the ?filter= and ?sort= parameters of list
+// endpoints, e.g. ?filter=email~"deadbug",disabled=false&sort=-created_at.
+// Only fields a resource allows can be used, values are checked against the
+// field's kind and never end up in a query string, and the size of a query
+// is bounded.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is wrapped by every parse error
+var ErrInvalid = errors.New("invalid query")
+
+// limits keeping a query cheap to check
+const (
+	MaxConditions = 10
+	MaxOrders     = 3
+	MaxValueLen   = 256
+)
+
+// Kind is the type of a field's values, which decides the operators it
+// takes
+type Kind int
+
+const (
+	String Kind = iota // =, != and ~, a case insensitive contains
+	Bool               // = and !=, true or false
+	Time               // =, !=, <, <=, > and >=, in RFC 3339
+)
+
+var operators = map[Kind][]string{
+	String: {"=", "!=", "~"},
+	Bool:   {"=", "!="},
+	Time:   {"=", "!=", "<", "<=", ">", ">="},
+}
+
+// Condition is one field op value comparison. Value is parsed for its kind:
+// a string, a bool or a time.Time.
+type Condition struct {
+	Field string
+	Op    string
+	Value any
+}
+
+// Order sorts by Field, descending when Desc
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// Query is a parsed filter, every condition must match, and sort order
+type Query struct {
+	Filter []Condition
+	Sort   []Order
+}
+
+// IsZero is true for no filter and no sort
+func (q Query) IsZero() bool {
+	return len(q.Filter) == 0 && len(q.Sort) == 0
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrInvalid}, args...)...)
+}
+
+var fieldRe = regexp.MustCompile(`^[a-z][a-z0-9_]*`)
+
+// Parse reads a filter, comma separated conditions such as email~"deadbug"
+// with strings optionally quoted, and a sort, comma separated fields with a
+// leading - for descending, allowing only the fields in fields
+func Parse(filter, sort string, fields map[string]Kind) (Query, error) {
+	var q Query
+	for rest := strings.TrimSpace(filter); rest != ""; {
+		if len(q.Filter) == MaxConditions {
+			return Query{}, invalidf("at most %d conditions are allowed", MaxConditions)
+		}
+		c, tail, err := parseCondition(rest, fields)
+		if err != nil {
+			return Query{}, err
+		}
+		q.Filter = append(q.Filter, c)
+		rest = strings.TrimSpace(tail)
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return Query{}, invalidf("expected , after the condition on %s", c.Field)
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	for _, s := range strings.Split(sort, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if len(q.Sort) == MaxOrders {
+			return Query{}, invalidf("at most %d sort fields are allowed", MaxOrders)
+		}
+		o := Order{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+		if _, ok := fields[o.Field]; !ok {
+			return Query{}, invalidf("can't sort on %q, fields are %s", o.Field, fieldNames(fields))
+		}
+		q.Sort = append(q.Sort, o)
+	}
+	return q, nil
+}
+
+func parseCondition(s string, fields map[string]Kind) (Condition, string, error) {
+	field := fieldRe.FindString(s)
+	kind, ok := fields[field]
+	if !ok {
+		return Condition{}, "", invalidf("can't filter on %q, fields are %s", field, fieldNames(fields))
+	}
+	s = s[len(field):]
+	var op string
+	for _, candidate := range []string{"!=", "<=", ">=", "=", "~", "<", ">"} {
+		if strings.HasPrefix(s, candidate) {
+			op = candidate
+			break
+		}
+	}
+	allowed := operators[kind]
+	if !contains(allowed, op) {
+		return Condition{}, "", invalidf("%s takes the operators %s", field, strings.Join(allowed, " "))
+	}
+	raw, tail, err := parseValue(s[len(op):])
+	if err != nil {
+		return Condition{}, "", fmt.Errorf("%s: %w", field, err)
+	}
+	c := Condition{Field: field, Op: op}
+	switch kind {
+	case String:
+		c.Value = raw
+	case Bool:
+		if c.Value, err = strconv.ParseBool(raw); err != nil {
+			return Condition{}, "", invalidf("%s takes true or false", field)
+		}
+	case Time:
+		if c.Value, err = time.Parse(time.RFC3339, raw); err != nil {
+			return Condition{}, "", invalidf("%s takes an RFC 3339 time", field)
+		}
+	}
+	return c, tail, nil
+}
+
+// parseValue reads a quoted string, with \" and \\ escapes, or a bare one
+// up to the next comma
+func parseValue(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		v, tail := s, ""
+		if i := strings.IndexByte(s, ','); i >= 0 {
+			v, tail = s[:i], s[i:]
+		}
+		v = strings.TrimSpace(v)
+		if len(v) > MaxValueLen {
+			return "", "", fmt.Errorf("values are at most %d bytes", MaxValueLen)
+		}
+		return v, tail, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 == len(s) {
+				return "", "", errors.New("unterminated string")
+			}
+			i++
+			b.WriteByte(s[i])
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(c)
+		}
+		if b.Len() > MaxValueLen {
+			return "", "", fmt.Errorf("values are at most %d bytes", MaxValueLen)
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
+
+// Matches compares v, the field's value of the kind the condition was
+// parsed for, with the condition's value
+func (c Condition) Matches(v any) bool {
+	switch want := c.Value.(type) {
+	case string:
+		got, _ := v.(string)
+		switch c.Op {
+		case "=":
+			return got == want
+		case "!=":
+			return got != want
+		case "~":
+			return strings.Contains(strings.ToLower(got), strings.ToLower(want))
+		}
+	case bool:
+		got, _ := v.(bool)
+		return (got == want) == (c.Op == "=")
+	case time.Time:
+		got, _ := v.(time.Time)
+		return compare(Compare(got, want), c.Op)
+	}
+	return false
+}
+
+func compare(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// Compare orders two values of a field's kind, -1, 0 or 1, false before
+// true and strings ignoring case
+func Compare(a, b any) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b.(string)))
+	case bool:
+		switch b := b.(bool); {
+		case a == b:
+			return 0
+		case b:
+			return -1
+		}
+		return 1
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return 0
+}
+
+func fieldNames(fields map[string]Kind) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,334 @@
+// Package redact keeps secrets out of what the service writes: request logs,
+// error reports, the diagnostics report and config dumps. A Registry knows a
+// secret two ways, by the name of the field holding it and by its shape, so
+// a token is still caught when it turns up under an innocent name or inside
+// an error message.
+package redact
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every redacted value
+const Mask = "[REDACTED]"
+
+// Fields are the built-in secret field names. A name matches when, lower
+// cased and without separators, it ends with one of these, so JWT_SECRET,
+// clientSecret and X-Amz-Signature all do.
+var Fields = []string{
+	"password", "passwd", "secret", "token", "apikey", "authorization", "cookie",
+	"signature", "credential", "privatekey", "dsn", "identity", "session", "code", "otp",
+	"passwordhash", "passkeys",
+}
+
+// Personal are the built-in names of fields holding personal data, matched
+// like Fields. They aren't masked in output, a user's own email is in
+// their response, but they are what's anonymized in data copied out of
+// production, see devdata.Anonymizer.
+var Personal = []string{"email", "phone", "avatarurl", "avatarkey", "reason"}
+
+// Patterns are the built-in secret shapes. When a pattern has a group named
+// secret only that part is masked, otherwise the whole match is.
+var Patterns = []*regexp.Regexp{
+	// JWTs, access and action tokens
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	// credentials in an Authorization header value
+	regexp.MustCompile(`(?i)\b(?:bearer|basic)\s+(?P<secret>[A-Za-z0-9._~+/=-]{8,})`),
+	// the password in a URL's userinfo, e.g. redis://:pass@host
+	regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*:(?P<secret>[^/\s@]+)@`),
+	// webhook signing secrets
+	regexp.MustCompile(`\bwhsec_[A-Za-z0-9]+`),
+	// AWS access key ids
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`),
+	// age identities
+	regexp.MustCompile(`AGE-SECRET-KEY-1[0-9A-Z]+`),
+	// PEM private keys
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+}
+
+// queryParam finds name=value pairs in URLs and form bodies inside free text
+var queryParam = regexp.MustCompile(`([?&;]|^)([A-Za-z0-9_.-]+)=([^&;\s"'#]+)`)
+
+// jsonMember finds "name":"value" members of JSON inside free text, such as
+// a log line
+var jsonMember = regexp.MustCompile(`"([A-Za-z0-9_.-]+)"(\s*:\s*)"((?:[^"\\]|\\.)*)"`)
+
+// Registry is a set of secret field names and shapes
+type Registry struct {
+	mu       sync.RWMutex
+	fields   []string
+	personal []string
+	patterns []*regexp.Regexp
+}
+
+// New returns an empty Registry
+func New() *Registry {
+	return &Registry{}
+}
+
+// NewDefault returns a Registry with the built-in Fields, Personal and
+// Patterns
+func NewDefault() *Registry {
+	r := New()
+	r.AddFields(Fields...)
+	r.AddPersonal(Personal...)
+	r.AddPatterns(Patterns...)
+	return r
+}
+
+// Default is the Registry the package functions use. Register
+// service-specific names and shapes on it at startup.
+var Default = NewDefault()
+
+// AddFields registers field names, matched by suffix as in Fields
+func (r *Registry) AddFields(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		r.fields = append(r.fields, normalize(name))
+	}
+}
+
+// AddPersonal registers personal data field names, matched by suffix as in
+// Fields
+func (r *Registry) AddPersonal(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		r.personal = append(r.personal, normalize(name))
+	}
+}
+
+// AddPatterns registers secret shapes
+func (r *Registry) AddPatterns(patterns ...*regexp.Regexp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.patterns = append(r.patterns, patterns...)
+}
+
+func normalize(name string) string {
+	return strings.NewReplacer("_", "", "-", "", ".", "", " ", "").Replace(strings.ToLower(name))
+}
+
+// Field reports whether values of the named field are secret
+func (r *Registry) Field(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.field(name)
+}
+
+// field is Field for callers holding the lock
+func (r *Registry) field(name string) bool {
+	return matches(r.fields, name)
+}
+
+// PersonalField reports whether values of the named field are personal data
+func (r *Registry) PersonalField(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return matches(r.personal, name)
+}
+
+func matches(suffixes []string, name string) bool {
+	name = normalize(name)
+	for _, f := range suffixes {
+		if name != "" && strings.HasSuffix(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// String masks secret shapes in s, and the values of query parameters and
+// JSON members with secret names, e.g. the signature of a signed URL in a
+// request log line
+func (r *Registry) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, re := range r.patterns {
+		s = replace(re, s)
+	}
+	s = queryParam.ReplaceAllStringFunc(s, func(m string) string {
+		sub := queryParam.FindStringSubmatch(m)
+		if sub[3] == Mask || !r.field(sub[2]) {
+			return m
+		}
+		return sub[1] + sub[2] + "=" + Mask
+	})
+	return jsonMember.ReplaceAllStringFunc(s, func(m string) string {
+		sub := jsonMember.FindStringSubmatch(m)
+		if sub[3] == "" || sub[3] == Mask || !r.field(sub[1]) {
+			return m
+		}
+		return `"` + sub[1] + `"` + sub[2] + `"` + Mask + `"`
+	})
+}
+
+func replace(re *regexp.Regexp, s string) string {
+	group := re.SubexpIndex("secret")
+	if group < 0 {
+		return re.ReplaceAllString(s, Mask)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(Mask)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Value redacts v as the value of the named field: masked outright when the
+// name is secret, otherwise strings are scanned and maps and slices walked
+func (r *Registry) Value(name string, v any) any {
+	if r.Field(name) && !keep(v) {
+		return Mask
+	}
+	switch v := v.(type) {
+	case string:
+		return r.String(v)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = r.String(s)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = r.Value(name, e)
+		}
+		return out
+	case map[string]any:
+		return r.Map(v)
+	}
+	return v
+}
+
+// keep reports whether a value under a secret name can be shown as it is:
+// unset ones, so a dump still shows what is missing, and flags such as
+// "auth": true that say whether a secret is set rather than what it is
+func keep(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return true
+	}
+	return false
+}
+
+// Map returns a redacted copy of m
+func (r *Registry) Map(m map[string]any) map[string]any {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[k] = r.Value(k, v)
+	}
+	return out
+}
+
+// Header returns a redacted copy of h
+func (r *Registry) Header(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		if r.Field(k) {
+			out[k] = []string{Mask}
+			continue
+		}
+		out[k] = r.Value(k, vs).([]string)
+	}
+	return out
+}
+
+// JSON redacts a JSON document by field name and shape, anything that isn't
+// JSON is redacted as a string
+func (r *Registry) JSON(data []byte) []byte {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return []byte(r.String(string(data)))
+	}
+	out, err := json.Marshal(r.Value("", v))
+	if err != nil {
+		return []byte(r.String(string(data)))
+	}
+	return out
+}
+
+// Leaks returns the secret shapes found in s, for checking output that
+// should have been redacted
+func (r *Registry) Leaks(s string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var found []string
+	for _, re := range r.patterns {
+		group := re.SubexpIndex("secret")
+		for _, m := range re.FindAllStringSubmatch(s, -1) {
+			leak := m[0]
+			if group >= 0 {
+				leak = m[group]
+			}
+			if leak != Mask {
+				found = append(found, leak)
+			}
+		}
+	}
+	for _, m := range queryParam.FindAllStringSubmatch(s, -1) {
+		if m[3] != Mask && r.field(m[2]) {
+			found = append(found, m[0])
+		}
+	}
+	for _, m := range jsonMember.FindAllStringSubmatch(s, -1) {
+		if m[3] != "" && m[3] != Mask && r.field(m[1]) {
+			found = append(found, m[0])
+		}
+	}
+	return found
+}
+
+// Writer redacts each write with String before passing it on, for wrapping
+// a logger's output. It relies on the logger writing whole lines at once,
+// as zerolog does.
+type Writer struct {
+	w io.Writer
+	r *Registry
+}
+
+// NewWriter redacts writes to w with the Default registry
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, r: Default}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func Field(name string) bool                 { return Default.Field(name) }
+func String(s string) string                 { return Default.String(s) }
+func Value(name string, v any) any           { return Default.Value(name, v) }
+func Map(m map[string]any) map[string]any    { return Default.Map(m) }
+func Header(h http.Header) http.Header       { return Default.Header(h) }
+func JSON(data []byte) []byte                { return Default.JSON(data) }
+func Leaks(s string) []string                { return Default.Leaks(s) }
+func PersonalField(name string) bool         { return Default.PersonalField(name) }
+func AddFields(names ...string)              { Default.AddFields(names...) }
+func AddPersonal(names ...string)            { Default.AddPersonal(names...) }
+func AddPatterns(patterns ...*regexp.Regexp) { Default.AddPatterns(patterns...) }
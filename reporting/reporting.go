@@ -0,0 +1,37 @@
+// Package reporting sends errors worth a human's attention, panics and 5xx
+// responses, to an error tracker along with the request they happened in
+package reporting
+
+import (
+	"context"
+	"time"
+)
+
+type Event struct {
+	Err error
+	// Panic is the recovered value when the event is a panic
+	Panic any
+	Stack []byte
+
+	Status    int
+	Method    string
+	Route     string
+	Path      string
+	RequestID string
+	// UserID is the authenticated caller, when there is one
+	UserID string
+	Time   time.Time
+}
+
+type Reporter interface {
+	Report(ctx context.Context, evt *Event)
+	// Flush waits up to timeout for queued events to be sent
+	Flush(timeout time.Duration)
+}
+
+// Nop discards events, used when no error tracker is configured
+type Nop struct{}
+
+func (Nop) Report(ctx context.Context, evt *Event) {}
+
+func (Nop) Flush(timeout time.Duration) {}
@@ -0,0 +1,93 @@
+package reporting
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+
+	"go-chi-microservice/redact"
+)
+
+type SentryOptions struct {
+	DSN         string
+	Environment string
+	Release     string
+}
+
+// Sentry reports events to Sentry
+type Sentry struct {
+	hub *sentry.Hub
+}
+
+func NewSentry(opts SentryOptions) (*Sentry, error) {
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:         opts.DSN,
+		Environment: opts.Environment,
+		Release:     opts.Release,
+		BeforeSend:  redactEvent,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating sentry client: %w", err)
+	}
+	return &Sentry{hub: sentry.NewHub(client, sentry.NewScope())}, nil
+}
+
+func (s *Sentry) Report(ctx context.Context, evt *Event) {
+	hub := s.hub.Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("route", evt.Route)
+		scope.SetTag("status", http.StatusText(evt.Status))
+		scope.SetTag("request_id", evt.RequestID)
+		scope.SetContext("request", map[string]any{
+			"method": evt.Method,
+			"path":   evt.Path,
+			"status": evt.Status,
+		})
+		if evt.UserID != "" {
+			scope.SetUser(sentry.User{ID: evt.UserID})
+		}
+		switch {
+		case evt.Panic != nil:
+			scope.SetExtra("stack", string(evt.Stack))
+			hub.RecoverWithContext(ctx, evt.Panic)
+		case evt.Err != nil:
+			hub.CaptureException(evt.Err)
+		default:
+			hub.CaptureMessage(fmt.Sprintf("%d %s %s", evt.Status, evt.Method, evt.Route))
+		}
+	})
+}
+
+// redactEvent masks secrets before an event leaves, error messages can quote
+// urls with credentials in them or the token that failed to parse
+func redactEvent(evt *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	evt.Message = redact.String(evt.Message)
+	for i := range evt.Exception {
+		evt.Exception[i].Value = redact.String(evt.Exception[i].Value)
+	}
+	evt.Extra = redact.Map(evt.Extra)
+	for k, c := range evt.Contexts {
+		evt.Contexts[k] = redact.Map(c)
+	}
+	if req := evt.Request; req != nil {
+		req.URL = redact.String(req.URL)
+		req.QueryString = redact.String("?" + req.QueryString)[1:]
+		req.Data = string(redact.JSON([]byte(req.Data)))
+		req.Cookies = ""
+		for k, v := range req.Headers {
+			if redact.Field(k) {
+				req.Headers[k] = redact.Mask
+			} else {
+				req.Headers[k] = redact.String(v)
+			}
+		}
+	}
+	return evt
+}
+
+func (s *Sentry) Flush(timeout time.Duration) {
+	s.hub.Flush(timeout)
+}
@@ -0,0 +1,172 @@
+package scim
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-chi-microservice/users"
+)
+
+// Filter is a parsed ?filter=, comparisons that all have to match. It's the
+// subset identity providers actually send, e.g. userName eq "bob@example.com";
+// or, not and grouping aren't supported.
+type Filter []Comparison
+
+// Comparison is one attribute test, Value is unused for pr
+type Comparison struct {
+	Attr  string // lower cased
+	Op    string // eq ne co sw ew pr, lower cased
+	Value any    // string, bool or nil
+}
+
+var filterAttrs = map[string]bool{"id": true, "username": true, "emails": true, "emails.value": true, "active": true}
+
+// ParseFilter parses raw, an empty filter matches everything
+func ParseFilter(raw string) (Filter, error) {
+	tokens, err := tokenize(raw)
+	if err != nil {
+		return nil, err
+	}
+	var f Filter
+	for len(tokens) > 0 {
+		if len(f) > 0 {
+			if !strings.EqualFold(tokens[0], "and") {
+				return nil, invalidFilter("expected and, got %q", tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 2 {
+			return nil, invalidFilter("incomplete comparison")
+		}
+		c := Comparison{Attr: strings.ToLower(tokens[0]), Op: strings.ToLower(tokens[1])}
+		if !filterAttrs[c.Attr] {
+			return nil, invalidFilter("can't filter on %s", tokens[0])
+		}
+		tokens = tokens[2:]
+		switch c.Op {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew":
+			if len(tokens) == 0 {
+				return nil, invalidFilter("%s %s needs a value", c.Attr, c.Op)
+			}
+			if c.Value, err = parseValue(tokens[0]); err != nil {
+				return nil, err
+			}
+			tokens = tokens[1:]
+		default:
+			return nil, invalidFilter("unsupported operator %q", c.Op)
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+// Match reports whether u passes every comparison
+func (f Filter) Match(u *users.User) bool {
+	for _, c := range f {
+		if !c.match(u) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Comparison) match(u *users.User) bool {
+	var have any
+	switch c.Attr {
+	case "id":
+		have = u.Id
+	case "username", "emails", "emails.value":
+		have = u.Email
+	case "active":
+		have = !u.Disabled
+	}
+	if c.Op == "pr" {
+		s, ok := have.(string)
+		return !ok || s != ""
+	}
+	if b, ok := have.(bool); ok {
+		want, ok := c.Value.(bool)
+		return ok && (c.Op == "eq") == (b == want)
+	}
+	want, ok := c.Value.(string)
+	if !ok {
+		return c.Op == "ne"
+	}
+	// userName and emails are case insensitive, ids are not
+	s := have.(string)
+	if c.Attr != "id" {
+		s, want = strings.ToLower(s), strings.ToLower(want)
+	}
+	switch c.Op {
+	case "eq":
+		return s == want
+	case "ne":
+		return s != want
+	case "co":
+		return strings.Contains(s, want)
+	case "sw":
+		return strings.HasPrefix(s, want)
+	case "ew":
+		return strings.HasSuffix(s, want)
+	}
+	return false
+}
+
+func parseValue(tok string) (any, error) {
+	switch strings.ToLower(tok) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if !strings.HasPrefix(tok, `"`) {
+		return nil, invalidFilter("value %s must be quoted", tok)
+	}
+	s, err := strconv.Unquote(tok)
+	if err != nil {
+		return nil, invalidFilter("bad string %s", tok)
+	}
+	return s, nil
+}
+
+// tokenize splits on spaces outside of double quoted strings
+func tokenize(raw string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	quoted, escaped := false, false
+	for _, r := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && r == ' ':
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+			continue
+		case !quoted && (r == '(' || r == ')' || r == '['):
+			return nil, invalidFilter("grouping isn't supported")
+		}
+		cur.WriteRune(r)
+	}
+	if quoted {
+		return nil, invalidFilter("unterminated string")
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, nil
+}
+
+func invalidFilter(format string, args ...any) error {
+	return &Error{Status: http.StatusBadRequest, Type: "invalidFilter", Detail: fmt.Sprintf(format, args...)}
+}
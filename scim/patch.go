@@ -0,0 +1,112 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go-chi-microservice/users"
+)
+
+// PatchOp is a PATCH request body
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation changes one attribute, or with no Path the attributes in Value
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply makes p's changes to u. Either every operation applies or u is left
+// as it was.
+func (p *PatchOp) Apply(u *users.User) error {
+	if len(p.Operations) == 0 {
+		return invalidValue("no Operations")
+	}
+	next := *u
+	for _, op := range p.Operations {
+		if err := op.apply(&next); err != nil {
+			return err
+		}
+	}
+	*u = next
+	return nil
+}
+
+func (op Operation) apply(u *users.User) error {
+	kind := strings.ToLower(op.Op)
+	switch kind {
+	case "add", "replace":
+	case "remove":
+		// every supported attribute is required, active aside
+		if strings.EqualFold(op.Path, "active") {
+			u.Disabled = false
+			return nil
+		}
+		return &Error{Status: http.StatusBadRequest, Type: "mutability", Detail: fmt.Sprintf("%s can't be removed", op.Path)}
+	default:
+		return invalidValue("unknown op %q", op.Op)
+	}
+	if op.Path == "" {
+		// Okta and Entra send {"op": "replace", "value": {"active": false}}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return invalidValue("value must be an object when there's no path")
+		}
+		for name, v := range attrs {
+			if err := set(u, name, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return set(u, op.Path, op.Value)
+}
+
+// set changes the attribute at path, emails filters such as
+// emails[type eq "work"].value all mean the one email
+func set(u *users.User, path string, v json.RawMessage) error {
+	attr := strings.ToLower(path)
+	if strings.HasPrefix(attr, "emails[") {
+		attr = "emails.value"
+	}
+	switch attr {
+	case "active":
+		var active bool
+		if err := json.Unmarshal(v, &active); err != nil {
+			// some providers send "False" as a string
+			var s string
+			if json.Unmarshal(v, &s) != nil || (!strings.EqualFold(s, "true") && !strings.EqualFold(s, "false")) {
+				return invalidValue("active must be a boolean")
+			}
+			active = strings.EqualFold(s, "true")
+		}
+		u.Disabled = !active
+	case "username", "emails.value":
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil || s == "" {
+			return invalidValue("%s must be a non empty string", path)
+		}
+		u.Email = s
+	case "emails":
+		var emails []Email
+		if err := json.Unmarshal(v, &emails); err != nil || primaryEmail(emails) == "" {
+			return invalidValue("emails must be a list with a value")
+		}
+		u.Email = primaryEmail(emails)
+	case "externalid", "name", "displayname", "name.givenname", "name.familyname":
+		// not stored, accepted so providers that always send them work
+	default:
+		return &Error{Status: http.StatusBadRequest, Type: "invalidPath", Detail: fmt.Sprintf("unsupported path %q", path)}
+	}
+	return nil
+}
+
+func invalidValue(format string, args ...any) error {
+	return &Error{Status: http.StatusBadRequest, Type: "invalidValue", Detail: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,140 @@
+// Package scim maps users to and from SCIM 2.0 (RFC 7643, RFC 7644)
+// resources, so identity providers such as Okta or Entra ID can provision
+// them. Only the core User schema's userName, emails and active are
+// supported.
+package scim
+
+import (
+	"fmt"
+	"net/http"
+
+	"go-chi-microservice/users"
+)
+
+const (
+	UserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	ConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// ContentType is what SCIM responses are sent as
+const ContentType = "application/scim+json"
+
+// User is the SCIM representation of a users.User. userName is the email.
+type User struct {
+	Schemas    []string `json:"schemas"`
+	ID         string   `json:"id,omitempty"`
+	ExternalID string   `json:"externalId,omitempty"`
+	UserName   string   `json:"userName"`
+	Emails     []Email  `json:"emails,omitempty"`
+	Active     *bool    `json:"active,omitempty"` // absent on create means active
+	Meta       *Meta    `json:"meta,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+// FromUser is u as a SCIM resource found at baseURL/Users/{id}
+func FromUser(u *users.User, baseURL string) *User {
+	active := !u.Disabled
+	return &User{
+		Schemas:  []string{UserSchema},
+		ID:       u.Id,
+		UserName: u.Email,
+		Emails:   []Email{{Value: u.Email, Type: "work", Primary: true}},
+		Active:   &active,
+		Meta:     &Meta{ResourceType: "User", Location: baseURL + "/Users/" + u.Id},
+	}
+}
+
+// ToUser is the users.User for a created or replaced resource. The email is
+// the primary email when there is one, else userName.
+func (su *User) ToUser() (*users.User, error) {
+	if su.UserName == "" {
+		return nil, &Error{Status: http.StatusBadRequest, Type: "invalidValue", Detail: "userName is required"}
+	}
+	u := &users.User{Id: su.ID, Email: su.UserName}
+	if e := primaryEmail(su.Emails); e != "" {
+		u.Email = e
+	}
+	if su.Active != nil {
+		u.Disabled = !*su.Active
+	}
+	return u, nil
+}
+
+func primaryEmail(emails []Email) string {
+	for _, e := range emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// ListResponse is a page of query results, StartIndex counts from 1
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []*User  `json:"Resources"`
+}
+
+// Error is a SCIM error response, Type is the scimType detail code such as
+// invalidFilter or uniqueness
+type Error struct {
+	Status int
+	Type   string
+	Detail string
+}
+
+func (e *Error) Error() string {
+	if e.Type == "" {
+		return e.Detail
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Detail)
+}
+
+// ErrorResponse is e as sent over the wire
+type ErrorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func (e *Error) Response() *ErrorResponse {
+	return &ErrorResponse{Schemas: []string{ErrorSchema}, Status: fmt.Sprint(e.Status), ScimType: e.Type, Detail: e.Detail}
+}
+
+// ServiceProviderConfig tells identity providers what this implementation
+// supports
+func ServiceProviderConfig(maxResults int) map[string]any {
+	unsupported := map[string]bool{"supported": false}
+	return map[string]any{
+		"schemas":        []string{ConfigSchema},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": maxResults},
+		"changePassword": unsupported,
+		"sort":           unsupported,
+		"etag":           unsupported,
+		"authenticationSchemes": []map[string]any{{
+			"type": "oauthbearertoken", "name": "Bearer token", "description": "The configured SCIM token",
+		}},
+	}
+}
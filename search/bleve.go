@@ -0,0 +1,119 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/analysis/tokenizer/regexp"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+
+	"go-chi-microservice/tenant"
+)
+
+// Bleve is an index inside the service, in memory or in a directory on
+// disk. Each replica has its own, fine for a single instance or a demo.
+type Bleve struct {
+	index bleve.Index
+}
+
+// NewBleve opens the index in dir, creating it when missing, or keeps it in
+// memory when dir is empty
+func NewBleve(dir string) (*Bleve, error) {
+	m, err := newMapping()
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		index, err := bleve.NewMemOnly(m)
+		if err != nil {
+			return nil, err
+		}
+		return &Bleve{index: index}, nil
+	}
+	index, err := bleve.Open(dir)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		index, err = bleve.New(dir, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening search index %s: %w", dir, err)
+	}
+	if im, ok := index.Mapping().(*mapping.IndexMappingImpl); ok && im.DefaultMapping.Properties["tenant"] == nil {
+		index.Close()
+		return nil, fmt.Errorf("search index %s has no tenant field, delete it and it's rebuilt from the users at startup", dir)
+	}
+	return &Bleve{index: index}, nil
+}
+
+// newMapping indexes email and phone split into their letters and digits,
+// so bill@deadbug.com matches bill, deadbug and com on their own, and
+// manager_id and tenant as exact keywords
+func newMapping() (mapping.IndexMapping, error) {
+	m := bleve.NewIndexMapping()
+	err := m.AddCustomTokenizer("words", map[string]any{"type": regexp.Name, "regexp": `[\p{L}\p{N}]+`})
+	if err != nil {
+		return nil, err
+	}
+	err = m.AddCustomAnalyzer("words", map[string]any{"type": custom.Name, "tokenizer": "words", "token_filters": []string{lowercase.Name}})
+	if err != nil {
+		return nil, err
+	}
+	m.DefaultAnalyzer = "words"
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = "words"
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("email", text)
+	doc.AddFieldMappingsAt("phone", text)
+	doc.AddFieldMappingsAt("manager_id", bleve.NewKeywordFieldMapping())
+	doc.AddFieldMappingsAt("tenant", bleve.NewKeywordFieldMapping())
+	m.DefaultMapping = doc
+	return m, nil
+}
+
+func (b *Bleve) Index(ctx context.Context, docs ...Document) error {
+	batch := b.index.NewBatch()
+	for _, d := range docs {
+		if err := batch.Index(d.ID, d); err != nil {
+			return err
+		}
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *Bleve) Delete(ctx context.Context, ids ...string) error {
+	batch := b.index.NewBatch()
+	for _, id := range ids {
+		batch.Delete(id)
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *Bleve) Query(ctx context.Context, q string, limit, offset int) (Result, error) {
+	qs := bleve.NewQueryStringQuery(q)
+	if _, err := qs.Parse(); err != nil {
+		return Result{}, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	var scoped query.Query = qs
+	if id := tenant.ID(ctx); id != "" {
+		in := bleve.NewTermQuery(id)
+		in.SetField("tenant")
+		scoped = bleve.NewConjunctionQuery(qs, in)
+	}
+	res, err := b.index.SearchInContext(ctx, bleve.NewSearchRequestOptions(scoped, limit, offset, false))
+	if err != nil {
+		return Result{}, err
+	}
+	r := Result{Total: int(res.Total), Hits: make([]Hit, 0, len(res.Hits))}
+	for _, h := range res.Hits {
+		r.Hits = append(r.Hits, Hit{ID: h.ID, Score: h.Score})
+	}
+	return r, nil
+}
+
+func (b *Bleve) Close() error {
+	return b.index.Close()
+}
@@ -0,0 +1,238 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-chi-microservice/tenant"
+)
+
+type ElasticOptions struct {
+	// URL of the cluster, e.g. http://localhost:9200
+	URL      string
+	Index    string
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// Elastic is an index in an Elasticsearch or OpenSearch cluster, shared by
+// every replica. It talks to the REST API both have in common, so there's
+// no client library to match to the server version.
+type Elastic struct {
+	opts ElasticOptions
+}
+
+func NewElastic(opts ElasticOptions) *Elastic {
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Elastic{opts: opts}
+}
+
+// indexMapping matches the bleve one, email and phone split into their
+// letters and digits and an exact manager_id and tenant
+const indexMapping = `{
+	"settings":{"analysis":{
+		"tokenizer":{"words":{"type":"pattern","pattern":"[^\\p{L}\\p{N}]+"}},
+		"analyzer":{"words":{"type":"custom","tokenizer":"words","filter":["lowercase"]}}
+	}},
+	"mappings":{"properties":{
+		"id":{"type":"keyword"},
+		"email":{"type":"text","analyzer":"words"},
+		"phone":{"type":"text","analyzer":"words"},
+		"manager_id":{"type":"keyword"},
+		"tenant":{"type":"keyword"}
+	}}
+}`
+
+// tenantMapping adds the tenant field to an index created before it
+const tenantMapping = `{"properties":{"tenant":{"type":"keyword"}}}`
+
+// EnsureIndex creates the index with its mapping unless it exists, then
+// adds the tenant field to one created without it
+func (e *Elastic) EnsureIndex(ctx context.Context) error {
+	resp, err := e.do(ctx, http.MethodPut, "/"+url.PathEscape(e.opts.Index), "application/json", strings.NewReader(indexMapping))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		var body struct {
+			Error struct {
+				Type string `json:"type"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.Error.Type == "resource_already_exists_exception" {
+			return e.ensureTenant(ctx)
+		}
+		return fmt.Errorf("elasticsearch: creating index %s: %s", e.opts.Index, body.Error.Type)
+	}
+	return statusError(resp)
+}
+
+func (e *Elastic) ensureTenant(ctx context.Context) error {
+	resp, err := e.do(ctx, http.MethodPut, "/"+url.PathEscape(e.opts.Index)+"/_mapping", "application/json", strings.NewReader(tenantMapping))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return statusError(resp)
+}
+
+func (e *Elastic) Index(ctx context.Context, docs ...Document) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, d := range docs {
+		enc.Encode(map[string]any{"index": map[string]string{"_index": e.opts.Index, "_id": d.ID}})
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return e.bulk(ctx, &body)
+}
+
+func (e *Elastic) Delete(ctx context.Context, ids ...string) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, id := range ids {
+		enc.Encode(map[string]any{"delete": map[string]string{"_index": e.opts.Index, "_id": id}})
+	}
+	return e.bulk(ctx, &body)
+}
+
+// bulk sends NDJSON actions to _bulk, failing with the first item that
+// failed. Deleting a missing document isn't a failure.
+func (e *Elastic) bulk(ctx context.Context, body *bytes.Buffer) error {
+	if body.Len() == 0 {
+		return nil
+	}
+	resp, err := e.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return err
+	}
+	var res struct {
+		Errors bool                         `json:"errors"`
+		Items  []map[string]json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("elasticsearch: decoding bulk response: %w", err)
+	}
+	if !res.Errors {
+		return nil
+	}
+	for _, item := range res.Items {
+		for action, raw := range item {
+			var r struct {
+				ID     string          `json:"_id"`
+				Status int             `json:"status"`
+				Error  json.RawMessage `json:"error"`
+			}
+			json.Unmarshal(raw, &r)
+			if r.Error != nil && !(action == "delete" && r.Status == http.StatusNotFound) {
+				return fmt.Errorf("elasticsearch: %s %s: %s", action, r.ID, r.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// Query runs a query_string query over the indexed fields, filtered to the
+// tenant of ctx. A query the cluster can't parse comes back as a 400, which
+// is ErrInvalidQuery.
+func (e *Elastic) Query(ctx context.Context, q string, limit, offset int) (Result, error) {
+	var query any = map[string]any{"query_string": map[string]any{
+		"query":  q,
+		"fields": []string{"email", "phone", "manager_id"},
+	}}
+	if id := tenant.ID(ctx); id != "" {
+		query = map[string]any{"bool": map[string]any{
+			"must":   query,
+			"filter": map[string]any{"term": map[string]any{"tenant": id}},
+		}}
+	}
+	body, err := json.Marshal(map[string]any{
+		"from":             offset,
+		"size":             limit,
+		"query":            query,
+		"track_total_hits": true,
+		"_source":          false,
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	resp, err := e.do(ctx, http.MethodPost, "/"+url.PathEscape(e.opts.Index)+"/_search", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return Result{}, fmt.Errorf("%w: %v", ErrInvalidQuery, statusError(resp))
+	}
+	if err := statusError(resp); err != nil {
+		return Result{}, err
+	}
+	var res struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				ID    string  `json:"_id"`
+				Score float64 `json:"_score"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return Result{}, fmt.Errorf("elasticsearch: decoding search response: %w", err)
+	}
+	r := Result{Total: res.Hits.Total.Value, Hits: make([]Hit, 0, len(res.Hits.Hits))}
+	for _, h := range res.Hits.Hits {
+		r.Hits = append(r.Hits, Hit{ID: h.ID, Score: h.Score})
+	}
+	return r, nil
+}
+
+// Close has nothing to release, the cluster keeps the index
+func (e *Elastic) Close() error {
+	return nil
+}
+
+func (e *Elastic) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, e.opts.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.opts.Username != "" {
+		req.SetBasicAuth(e.opts.Username, e.opts.Password)
+	}
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch: %w", err)
+	}
+	return resp, nil
+}
+
+// statusError turns a non 2xx response into an error with the start of its
+// body
+func statusError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("elasticsearch: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
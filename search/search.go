@@ -0,0 +1,47 @@
+// Package search is full text search over users, in process with bleve or
+// in an Elasticsearch or OpenSearch cluster, behind one interface. The index
+// only holds what's searchable, results are ids to load from the users
+// repository.
+package search
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInvalidQuery is a query the backend can't parse
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// Document is what's indexed of a user. Tenant scopes it, queries made for
+// a tenant only find its documents.
+type Document struct {
+	ID        string `json:"id"`
+	Tenant    string `json:"tenant,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+	ManagerID string `json:"manager_id,omitempty"`
+}
+
+type Hit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// Result is a page of hits, best first, and how many matched in all
+type Result struct {
+	Total int
+	Hits  []Hit
+}
+
+type Search interface {
+	// Index adds documents or replaces those with the same id
+	Index(ctx context.Context, docs ...Document) error
+	Delete(ctx context.Context, ids ...string) error
+	// Query finds documents matching q, skipping offset and returning at
+	// most limit. q takes words, which match anywhere, "quoted phrases",
+	// +required and -excluded terms, and field:term for a single field.
+	// With a tenant in ctx only its documents are found and counted,
+	// without one, the operator's, every document is.
+	Query(ctx context.Context, q string, limit, offset int) (Result, error)
+	Close() error
+}
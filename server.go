@@ -2,144 +2,1022 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"filippo.io/age"
 	"fmt"
-	"github.com/caarlos0/env/v10"
-	"github.com/go-chi/render"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
+	"go-chi-microservice/acmedns"
+	"go-chi-microservice/api"
+	"go-chi-microservice/audit"
+	"go-chi-microservice/auth"
+	"go-chi-microservice/backup"
+	"go-chi-microservice/config"
+	"go-chi-microservice/connlimit"
+	"go-chi-microservice/dataloader"
+	"go-chi-microservice/diagnostics"
+	"go-chi-microservice/egress"
+	"go-chi-microservice/events"
+	"go-chi-microservice/flags"
+	"go-chi-microservice/imaging"
+	"go-chi-microservice/lifecycle"
+	"go-chi-microservice/mail"
+	"go-chi-microservice/maintenance"
+	"go-chi-microservice/notify"
+	"go-chi-microservice/publicid"
+	"go-chi-microservice/redact"
+	"go-chi-microservice/reporting"
+	"go-chi-microservice/search"
+	"go-chi-microservice/slowconn"
+	"go-chi-microservice/sockets"
+	"go-chi-microservice/storage"
+	"go-chi-microservice/streams"
+	"go-chi-microservice/tenant"
+	"go-chi-microservice/tlsconf"
+	"go-chi-microservice/users"
+	"go-chi-microservice/version"
+	"go-chi-microservice/views"
+	"go-chi-microservice/webhooks"
 )
 
-type config struct {
-	Port   int    `env:"PORT" envDefault:"4000"`
-	LogDir string `env:"LOGDIR,expand" envDefault:"${HOME}/tmp"`
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-type User struct {
-	Id    string
-	Email string
-}
+// serve runs the server until it's interrupted or a component fails
+func serve(cfg *config.Config) error {
+	level, err := zerolog.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return fmt.Errorf("problem parsing LOG_LEVEL: %w", err)
+	}
+	zerolog.SetGlobalLevel(level)
+	logger, logCloser := setupLogger(context.Background(), cfg)
+	defer logCloser.Close()
+	v := version.Get()
+	logger.Info().Str("version", v.Version).Str("commit", v.Commit).Str("built", v.Date).
+		Str("go", v.GoVersion).Msg("starting")
 
-var allUsers = map[string]*User{
-	"fece": {Id: "fece", Email: "bill@deadbug.com"},
-	"d00f": {Id: "d00f", Email: "hhill@stricklandpropance.com"},
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-type UserResponse struct {
-	*User
-	Elapsed int64 `json:"elapsed"`
+	// components are built in dependency order and append their hooks as
+	// they go, so they start in that order and stop in reverse
+	lc := lifecycle.New(logger)
+	if err := setup(ctx, cfg, logger, lc); err != nil {
+		logger.Error().Err(err).Msg("problem setting up")
+		return err
+	}
+	if err := lc.Run(ctx, cfg.ShutdownTimeout); err != nil {
+		logger.Error().Err(err).Msg("server stopped with error")
+		return err
+	}
+	return nil
 }
 
-func (rd *UserResponse) Render(w http.ResponseWriter, r *http.Request) error {
-	// Pre-processing before a response is marshalled and sent across the wire
-	rd.Elapsed = 10
+// setup builds every component and registers its lifecycle hooks
+func setup(ctx context.Context, cfg *config.Config, logger *zerolog.Logger, lc *lifecycle.Lifecycle) error {
+	diag := diagnostics.NewRegistry()
+	diag.SetStorage("users", "memory")
+	schema := diagnostics.Schema{Store: "memory", Version: users.SnapshotVersion}
+	for _, m := range users.SnapshotMigrations {
+		schema.Migrations = append(schema.Migrations, diagnostics.Migration{Version: m.Version, Name: m.Name})
+	}
+	diag.SetSchema("users", schema)
+
+	var reporter reporting.Reporter = reporting.Nop{}
+	if cfg.Sentry.DSN != "" {
+		var err error
+		if reporter, err = reporting.NewSentry(reporting.SentryOptions{
+			DSN:         cfg.Sentry.DSN,
+			Environment: cfg.Sentry.Environment,
+		}); err != nil {
+			return fmt.Errorf("error reporting: %w", err)
+		}
+	}
+	diag.AddModule("error_reporting", cfg.Sentry.DSN != "", map[string]any{"environment": cfg.Sentry.Environment})
+	lc.Append(lifecycle.Hook{
+		Name: "error_reporting",
+		OnStop: func(ctx context.Context) error {
+			reporter.Flush(5 * time.Second)
+			return nil
+		},
+	})
+
+	memRepo := users.NewMemoryRepository()
+	if cfg.UserRepo.SnapshotPath != "" {
+		if err := restoreUsers(memRepo, cfg.UserRepo.SnapshotPath, logger); err != nil {
+			return fmt.Errorf("user snapshot: %w", err)
+		}
+		lc.Append(runHook(lc, "user_snapshots", func(ctx context.Context) error {
+			return snapshotUsers(ctx, memRepo, cfg.UserRepo.SnapshotPath, cfg.UserRepo.SnapshotInterval, logger)
+		}))
+	} else {
+		memRepo.Put(users.SeedUsers()...)
+	}
+	userSvc, err := newUserService(cfg, memRepo)
+	if err != nil {
+		return err
+	}
+	diag.AddModule("backup", cfg.Backup.Enabled, map[string]any{"interval": cfg.Backup.Interval.String(), "encryption": cfg.Backup.Encryption})
+	if cfg.Backup.Enabled {
+		b, err := newBackups(ctx, cfg, logger)
+		if err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+		lc.Append(runHook(lc, "backup", func(ctx context.Context) error {
+			return b.Run(ctx, backup.Memory{Repo: memRepo}, cfg.Backup.Interval)
+		}))
+	}
+	diag.AddModule("user_repository", true, map[string]any{"decorators": cfg.UserRepo.Decorators, "snapshot": cfg.UserRepo.SnapshotPath})
+	if cfg.UserRules.PurgeDeletedAfter > 0 {
+		lc.Append(runHook(lc, "user_purge", func(ctx context.Context) error {
+			return purgeDeletedUsers(ctx, userSvc, cfg.UserRules.PurgeDeletedAfter, cfg.UserRules.PurgeInterval, logger)
+		}))
+	}
+	diag.AddModule("user_purge", cfg.UserRules.PurgeDeletedAfter > 0, map[string]any{"after": cfg.UserRules.PurgeDeletedAfter.String()})
+
+	var replayer *events.Replayer
+	if cfg.Events.Enabled {
+		replayer = newReplayer(cfg.Events, logger, userSvc)
+		lc.Append(runHook(lc, "events", replayer.Run))
+	}
+
+	c, err := setupConsumer(ctx, cfg.Consumer, logger, userSvc, replayer)
+	if err != nil {
+		return fmt.Errorf("consumer: %w", err)
+	}
+	diag.AddModule("consumer", c != nil, map[string]any{"backend": cfg.Consumer.Backend})
+	if c != nil {
+		diag.SetWorkers("consumer", cfg.Consumer.Concurrency)
+		lc.Append(runHook(lc, "consumer", c.Run))
+	}
+
+	deps := api.Deps{Logger: logger, Users: userSvc, Diagnostics: diag, Reporter: reporter, Mailer: newMailer(cfg.Mail, logger), Events: replayer, Streams: streams.NewRegistry()}
+	deps.Maintenance = maintenance.NewSwitch(maintenance.State{Enabled: cfg.Maintenance.Enabled, Reason: cfg.Maintenance.Reason,
+		By: "config", RetryAfterSeconds: int(cfg.Maintenance.RetryAfter.Seconds())})
+	if cfg.Maintenance.Enabled {
+		logger.Warn().Str("reason", cfg.Maintenance.Reason).Msg("starting in maintenance mode")
+	}
+	diag.AddModule("maintenance", cfg.Admin.Enabled, map[string]any{"started_enabled": cfg.Maintenance.Enabled})
+	diag.AddModule("mail", true, map[string]any{"backend": cfg.Mail.Backend})
+	if deps.Flags, err = newFlags(cfg.Flags); err != nil {
+		return fmt.Errorf("flags: %w", err)
+	}
+	flagsInfo := map[string]any{"provider": cfg.Flags.Provider}
+	if static, ok := deps.Flags.(flags.Static); ok {
+		flagsInfo["flags"] = static.Keys()
+	}
+	diag.AddModule("flags", true, flagsInfo)
+	if cfg.Notify.Enabled {
+		if deps.Notifier, err = newNotifier(cfg.Notify, deps.Mailer, logger); err != nil {
+			return fmt.Errorf("notify: %w", err)
+		}
+		// an example hook, welcoming users created through SCIM or a first
+		// OIDC sign in
+		userSvc.OnCreate(func(ctx context.Context, u *users.User) {
+			deps.Notifier.Dispatch(ctx, notify.Notification{UserID: u.Id, Email: u.Email, Phone: u.Phone, Event: notify.EventWelcome})
+		})
+	}
+	diag.AddModule("notify", cfg.Notify.Enabled, map[string]any{
+		"sms": cfg.Notify.TwilioAccountSID != "", "webhook": cfg.Notify.WebhookURL != "",
+	})
+	var policy *egress.Policy
+	if cfg.Egress.Enabled {
+		if policy, err = egress.NewPolicy(cfg.Egress.AllowHosts, cfg.Egress.AllowCIDRs); err != nil {
+			return err
+		}
+	}
+	deps.Egress = policy
+	diag.AddModule("egress", cfg.Egress.Enabled, map[string]any{"allow_hosts": cfg.Egress.AllowHosts, "allow_cidrs": cfg.Egress.AllowCIDRs})
+	if cfg.Webhooks.Enabled {
+		deps.Webhooks = newWebhooks(cfg.Webhooks, policy, logger, userSvc)
+		diag.SetWorkers("webhooks", cfg.Webhooks.Workers)
+		lc.Append(runHook(lc, "webhooks", deps.Webhooks.Run))
+		if replayer != nil {
+			replayer.AddSink("webhooks", events.SinkFunc(func(ctx context.Context, e events.Event) error {
+				return deps.Webhooks.Publish(ctx, e.Type, e.Data)
+			}))
+		}
+	}
+	diag.AddModule("webhooks", cfg.Webhooks.Enabled, nil)
+	if replayer != nil {
+		diag.AddModule("events", true, map[string]any{"sinks": replayer.Sinks()})
+	} else {
+		diag.AddModule("events", false, nil)
+	}
+	if cfg.Search.Enabled {
+		if deps.Search, err = newSearch(ctx, cfg.Search, logger, userSvc); err != nil {
+			return fmt.Errorf("search: %w", err)
+		}
+		lc.Append(lifecycle.Hook{Name: "search", OnStop: func(ctx context.Context) error { return deps.Search.Close() }})
+	}
+	diag.AddModule("search", cfg.Search.Enabled, map[string]any{"backend": cfg.Search.Backend})
+	if len(cfg.PublicIDs.Resources) > 0 {
+		if deps.PublicIDs, err = publicid.NewEncrypted(cfg.PublicIDs.Secret); err != nil {
+			return fmt.Errorf("public ids: %w", err)
+		}
+	}
+	if err := api.CheckAPIVersion(cfg.APIVersion.Default); err != nil {
+		return fmt.Errorf("API_VERSION_DEFAULT: %w", err)
+	}
+	diag.AddModule("api_versions", true, map[string]any{"header": cfg.APIVersion.Header, "default": cfg.APIVersion.Default, "current": api.UsersAPIVersion})
+	diag.AddModule("public_ids", len(cfg.PublicIDs.Resources) > 0, map[string]any{"resources": cfg.PublicIDs.Resources})
+	if cfg.Audit.Enabled {
+		if deps.AuditStore, deps.Audit, err = newAudit(lc, cfg); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		userSvc.OnChange(func(ctx context.Context, before, after *users.User) {
+			if err := audit.RecordChange(ctx, "user", after.Id, before, after); err != nil {
+				logger.Error().Err(err).Str("user_id", after.Id).Msg("recording user change")
+			}
+		})
+	}
+	diag.AddModule("audit", cfg.Audit.Enabled, map[string]any{"store": cfg.Audit.Store, "file": cfg.Audit.FileEnabled})
+	if cfg.Avatar.Enabled || cfg.Files.Enabled {
+		if deps.Storage, err = newStorage(ctx, cfg.Storage); err != nil {
+			return fmt.Errorf("storage: %w", err)
+		}
+		diag.SetStorage("files", cfg.Storage.Backend)
+	}
+	if cfg.Avatar.Enabled && cfg.Avatar.Process {
+		if deps.Images, err = newImageProcessor(cfg.Avatar); err != nil {
+			return err
+		}
+		diag.SetWorkers("avatar_images", deps.Images.Workers())
+		lc.Append(runHook(lc, "avatar_images", deps.Images.Run))
+	}
+	if cfg.HTML.Enabled {
+		if deps.Views, err = views.New(views.Options{Dir: cfg.HTML.TemplatesDir, Reload: cfg.HTML.Reload}); err != nil {
+			return fmt.Errorf("templates: %w", err)
+		}
+	}
+	diag.AddModule("html", cfg.HTML.Enabled, map[string]any{"embedded": cfg.HTML.TemplatesDir == "", "reload": cfg.HTML.Reload})
+	if cfg.Auth.Enabled {
+		deps.Auth = auth.NewIssuer(auth.Options{
+			Secret:     []byte(cfg.Auth.JWTSecret),
+			Issuer:     cfg.Auth.Issuer,
+			AccessTTL:  cfg.Auth.AccessTTL,
+			RefreshTTL: cfg.Auth.RefreshTTL,
+			ClockSkew:  cfg.Auth.ClockSkew,
+			Active:     userSvc.Active,
+		}, auth.NewMemoryRefreshStore())
+		if cfg.Auth.Session.Enabled {
+			if deps.Sessions, err = sessionStore(lc, cfg.Auth.Session); err != nil {
+				return err
+			}
+		}
+		if deps.Limiter, err = limiterStore(lc, cfg.Auth.Limiter); err != nil {
+			return err
+		}
+		diag.SetStorage("login_limiter", cfg.Auth.Limiter.Store)
+		if cfg.Auth.Account.Enabled {
+			if deps.ActionTokens, err = actionTokenStore(lc, cfg.Auth.Account); err != nil {
+				return err
+			}
+		}
+		if cfg.Auth.Passkey.Enabled {
+			if deps.Passkeys, err = auth.NewPasskeys(auth.PasskeyOptions{
+				RPID:    cfg.Auth.Passkey.RPID,
+				RPName:  cfg.Auth.Passkey.RPName,
+				Origins: cfg.Auth.Passkey.Origins,
+				Timeout: cfg.Auth.Passkey.Timeout,
+			}); err != nil {
+				return fmt.Errorf("passkeys: %w", err)
+			}
+		}
+		if cfg.Auth.OIDC.IssuerURL != "" {
+			if deps.OIDC, err = auth.NewOIDC(ctx, auth.OIDCOptions{
+				IssuerURL:    cfg.Auth.OIDC.IssuerURL,
+				ClientID:     cfg.Auth.OIDC.ClientID,
+				ClientSecret: cfg.Auth.OIDC.ClientSecret,
+				RedirectURL:  cfg.Auth.OIDC.RedirectURL,
+				Scopes:       cfg.Auth.OIDC.Scopes,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	var verifiers auth.Verifiers
+	if deps.Auth != nil {
+		verifiers = append(verifiers, deps.Auth)
+	}
+	if cfg.Auth.JWKS.URL != "" {
+		jwks := auth.NewJWKS(auth.JWKSOptions{
+			URL:       cfg.Auth.JWKS.URL,
+			Issuer:    cfg.Auth.JWKS.Issuer,
+			Audience:  cfg.Auth.JWKS.Audience,
+			Refresh:   cfg.Auth.JWKS.RefreshInterval,
+			ClockSkew: cfg.Auth.ClockSkew,
+		}, logger)
+		verifiers = append(verifiers, jwks)
+		lc.Append(jwksHook(jwks))
+	}
+	if len(verifiers) > 0 {
+		deps.Verifier = verifiers
+	} else if cfg.Auth.Require {
+		return errors.New("AUTH_REQUIRE needs AUTH_ENABLED or AUTH_JWKS_URL to verify tokens with")
+	}
+	diag.AddModule("jwks", cfg.Auth.JWKS.URL != "", map[string]any{"url": cfg.Auth.JWKS.URL})
+
+	diag.AddModule("admin", cfg.Admin.Enabled, map[string]any{"addr": cfg.Admin.Addr, "auth": cfg.Admin.User != "", "operations": cfg.Admin.OperatorUser != ""})
+	mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("SOCKET_MODE %q isn't an octal file mode", cfg.SocketMode)
+	}
+	socketMode := fs.FileMode(mode)
+	if cfg.Admin.Enabled {
+		adminSrv := &http.Server{Addr: cfg.Admin.Addr, Handler: api.NewAdminRouter(cfg, deps)}
+		addListeners(diag, "admin", adminSrv.Addr)
+		lc.Append(serverHook(lc, logger, "admin_server", adminSrv, []string{adminSrv.Addr}, sockets.Options{Name: "admin", ReusePort: cfg.ReusePort, SocketMode: socketMode},
+			connLimits(connlimit.Options{Name: "admin"})))
+	}
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: api.NewRouter(cfg, deps),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout, ReadTimeout: cfg.ReadTimeout, WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout: cfg.IdleTimeout, MaxHeaderBytes: cfg.MaxHeaderBytes}
+	addrs := cfg.Listen
+	if len(addrs) == 0 {
+		addrs = []string{srv.Addr}
+	}
+	addListeners(diag, "http", addrs...)
+	diag.AddModule("socket_activation", len(sockets.Names()) > 0, map[string]any{"sockets": sockets.Names(), "reuse_port": cfg.ReusePort})
+	certFile, keyFile := cfg.TLS.CertFile, cfg.TLS.KeyFile
+	diag.AddModule("acme", len(cfg.TLS.ACME.Domains) > 0, map[string]any{"domains": cfg.TLS.ACME.Domains, "dns_provider": cfg.TLS.ACME.DNSProvider})
+	if len(cfg.TLS.ACME.Domains) > 0 {
+		if certFile != "" {
+			return errors.New("TLS_CERT_FILE and TLS_ACME_DOMAINS can't both be set")
+		}
+		mgr := acmedns.NewManager(acmedns.Options{
+			DirectoryURL:       cfg.TLS.ACME.DirectoryURL,
+			Email:              cfg.TLS.ACME.Email,
+			Domains:            cfg.TLS.ACME.Domains,
+			Dir:                cfg.TLS.ACME.CacheDir,
+			RenewBefore:        cfg.TLS.ACME.RenewBefore,
+			PropagationTimeout: cfg.TLS.ACME.PropagationTimeout,
+			Provider:           dnsProvider(cfg.TLS.ACME),
+		}, logger)
+		// the listener can't start without one, renewals run in the background
+		if err := mgr.Ensure(ctx); err != nil {
+			return fmt.Errorf("acme: %w", err)
+		}
+		certFile, keyFile = mgr.CertFile(), mgr.KeyFile()
+		lc.Append(runHook(lc, "acme", mgr.Run))
+	}
+	diag.AddModule("tls", certFile != "", map[string]any{"min_version": cfg.TLS.MinVersion, "client_auth": cfg.TLS.ClientAuth})
+	if certFile != "" {
+		cert, err := tlsconf.LoadCertificate(certFile, keyFile, logger)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		if srv.TLSConfig, err = tlsconf.Config(tlsconf.Options{
+			MinVersion:   cfg.TLS.MinVersion,
+			CipherSuites: cfg.TLS.CipherSuites,
+			Curves:       cfg.TLS.Curves,
+			ClientAuth:   cfg.TLS.ClientAuth,
+			ClientCAFile: cfg.TLS.ClientCAFile,
+		}, cert); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		lc.Append(runHook(lc, "tls_reload", func(ctx context.Context) error {
+			return cert.Watch(ctx, cfg.TLS.ReloadInterval)
+		}))
+	}
+	switch {
+	case srv.TLSConfig != nil && !cfg.HTTP2:
+		// set, so ServeTLS doesn't add h2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case srv.TLSConfig == nil && cfg.H2C:
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	diag.AddModule("http2", cfg.HTTP2 && srv.TLSConfig != nil || cfg.H2C && srv.TLSConfig == nil, map[string]any{"h2c": cfg.H2C && srv.TLSConfig == nil})
+	diag.AddModule("http3", cfg.HTTP3.Enabled, map[string]any{"addr": cfg.HTTP3.Addr, "alt_svc_max_age": cfg.HTTP3.AltSvcMaxAge.String()})
+	if cfg.HTTP3.Enabled {
+		if srv.TLSConfig == nil {
+			return errors.New("HTTP3_ENABLED needs TLS, set TLS_CERT_FILE or TLS_ACME_DOMAINS")
+		}
+		addr := cfg.HTTP3.Addr
+		if addr == "" {
+			addr = fmt.Sprintf(":%d", cfg.Port)
+		}
+		_, port, err := net.SplitHostPort(addr)
+		n, perr := strconv.Atoi(port)
+		if err != nil || perr != nil {
+			return fmt.Errorf("HTTP3_ADDR %q needs a numeric port", addr)
+		}
+		h3 := newHTTP3(srv, addr)
+		srv.Handler = altSvc(n, cfg.HTTP3.AltSvcMaxAge)(srv.Handler)
+		diag.AddListener("http3", "udp", addr)
+		lc.Append(http3Hook(lc, logger, h3))
+	}
+	wraps := []func(net.Listener) net.Listener{connLimits(connlimit.Options{Name: "http", Max: cfg.Conns.Max, PerIP: cfg.Conns.PerIP,
+		Queue: cfg.Conns.Mode == "queue", TLS: srv.TLSConfig != nil})}
+	diag.AddModule("conn_limits", cfg.Conns.Max > 0 || cfg.Conns.PerIP > 0, map[string]any{"max": cfg.Conns.Max, "per_ip": cfg.Conns.PerIP, "mode": cfg.Conns.Mode})
+	diag.AddModule("slow_clients", cfg.SlowClient.Enabled, map[string]any{"min_rate": cfg.SlowClient.MinRate, "grace": cfg.SlowClient.Grace.String()})
+	if cfg.SlowClient.Enabled {
+		guard := slowconn.NewGuard(slowconn.Options{MinRate: cfg.SlowClient.MinRate, Grace: cfg.SlowClient.Grace})
+		// outermost, the server's ConnState must see the guard's connections
+		srv.ConnState = guard.ConnState
+		wraps = append(wraps, guard.Listener)
+		lc.Append(runHook(lc, "slow_clients", guard.Run))
+	}
+	lc.Append(serverHook(lc, logger, "http_server", srv, addrs, sockets.Options{Name: "http", ReusePort: cfg.ReusePort, SocketMode: socketMode}, wraps...))
+
+	// appended after the servers so it stops first: a server's Shutdown
+	// waits for every active request, and a stream never stops being one
+	diag.AddModule("streams", true, map[string]any{"grace": cfg.ShutdownStreamGrace.String()})
+	lc.Append(streamsHook(logger, deps.Streams, cfg.ShutdownStreamGrace))
+
+	// what clients and stored data can expect of this instance, also on
+	// the admin diagnostics
+	rep := diag.Report()
+	logger.Info().Interface("schemas", rep.Schemas).Interface("apis", rep.APIs).Msg("schema and api versions")
 	return nil
 }
 
-func main() {
-	cfg := config{}
-	if err := env.Parse(&cfg); err != nil {
-		log.Fatalf("problem parsing config: %+v", err)
-	}
-	logger := setupLogger(context.Background(), filepath.Join(cfg.LogDir, "server.log"))
-
-	r := chi.NewRouter()
-	r.Use(middleware.RequestID)                 // add an id to context
-	r.Use(middleware.RealIP)                    // do the True-Client-IP, X-Real-IP or the X-Forwarded-For dance
-	r.Use(middleware.Logger)                    // log requests
-	r.Use(middleware.Recoverer)                 // panic recovery with http 500
-	r.Use(middleware.Timeout(60 * time.Second)) // request timeout
-	r.Use(middleware.URLFormat)
-	r.Use(render.SetContentType(render.ContentTypeJSON))
-
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Golang Chi microservice template"))
+// newStorage builds the configured file storage
+func newStorage(ctx context.Context, cfg config.StorageConfig) (storage.Storage, error) {
+	if cfg.Backend != "s3" {
+		return storage.NewDisk(storage.DiskOptions{Dir: cfg.DiskDir, BaseURL: cfg.DiskURL, Secret: []byte(cfg.DiskSecret)})
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+	client := awss3.NewFromConfig(awsCfg, func(o *awss3.Options) {
+		if cfg.S3Endpoint != "" {
+			// MinIO and the like serve buckets by path rather than subdomain
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+			o.UsePathStyle = true
+		}
 	})
+	return storage.NewS3(client, storage.S3Options{Bucket: cfg.S3Bucket, PublicURL: cfg.S3PublicURL}), nil
+}
+
+// newBackups sets up backups to the configured storage with the configured
+// encryption
+func newBackups(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (*backup.Backups, error) {
+	store, err := newStorage(ctx, cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	var enc backup.Encryption
+	switch cfg.Backup.Encryption {
+	case "age":
+		a := &backup.Age{}
+		if a.Recipients, err = age.ParseRecipients(strings.NewReader(strings.Join(cfg.Backup.AgeRecipients, "\n"))); err != nil {
+			return nil, fmt.Errorf("parsing age recipients: %w", err)
+		}
+		if cfg.Backup.AgeIdentityFile != "" {
+			f, err := os.Open(cfg.Backup.AgeIdentityFile)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			if a.Identities, err = age.ParseIdentities(f); err != nil {
+				return nil, fmt.Errorf("parsing age identities: %w", err)
+			}
+		}
+		enc = a
+	case "kms":
+		awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("loading aws config: %w", err)
+		}
+		enc = &backup.KMS{Client: kms.NewFromConfig(awsCfg), KeyID: cfg.Backup.KMSKeyID}
+	default:
+		return nil, errors.New("BACKUP_ENCRYPTION must be set, backups are never stored in the clear")
+	}
+	return backup.New(backup.Options{Prefix: cfg.Backup.Prefix, Name: "users:memory", Store: store, Encryption: enc}, logger), nil
+}
+
+// newImageProcessor builds the avatar processor, its workers run as a
+// lifecycle hook
+func newImageProcessor(cfg config.AvatarConfig) (*imaging.Processor, error) {
+	return imaging.NewProcessor(imaging.Options{Sizes: cfg.Sizes, Format: cfg.Format, Quality: cfg.Quality,
+		MaxPixels: cfg.MaxPixels, Workers: cfg.Workers})
+}
 
-	r.Route("/users", func(r chi.Router) {
-		r.With(paginate).Get("/", ListUsers)
+// newWebhooks builds the deliverer and publishes user events to it
+func newWebhooks(cfg config.WebhooksConfig, policy *egress.Policy, logger *zerolog.Logger, userSvc *users.Service) *webhooks.Deliverer {
+	d := webhooks.NewDeliverer(webhooks.NewMemoryStore(100), webhooks.Options{
+		Workers:        cfg.Workers,
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+		Timeout:        cfg.Timeout,
+		Egress:         policy,
+	}, logger)
+	publish := func(event string) func(ctx context.Context, u *users.User) {
+		return func(ctx context.Context, u *users.User) {
+			if err := d.Publish(ctx, event, u); err != nil {
+				logger.Error().Err(err).Str("event", event).Str("user_id", u.Id).Msg("publishing webhook event")
+			}
+		}
+	}
+	userSvc.OnCreate(publish(webhooks.EventUserCreated))
+	userSvc.OnUpdate(publish(webhooks.EventUserUpdated))
+	return d
+}
+
+// newReplayer records user events in an event store and replays them, to
+// the log until other sinks are added
+func newReplayer(cfg config.EventsConfig, logger *zerolog.Logger, userSvc *users.Service) *events.Replayer {
+	store := events.NewMemoryStore(cfg.Keep)
+	publishUserEvents(userSvc, func(ctx context.Context, event string, u *users.User) {
+		if _, err := store.Append(ctx, event, u); err != nil {
+			logger.Error().Err(err).Str("event", event).Str("user_id", u.Id).Msg("recording event")
+		}
+	})
+	rp := events.NewReplayer(store, cfg.ReplayMaxRate)
+	rp.AddSink("log", events.SinkFunc(func(ctx context.Context, e events.Event) error {
+		logger.Info().Int64("seq", e.Seq).Str("event", e.Type).RawJSON("data", e.Data).Msg("replayed event")
+		return nil
+	}))
+	return rp
+}
 
-		// Subrouters:
-		r.Route("/{userID}", func(r chi.Router) {
-			r.Use(UserCtx)
-			r.Get("/", GetUser)
+// newSearch opens the search index, indexes every user in it and keeps it
+// up to date as users are written. Writes index synchronously, so a user
+// shows up in searches once the write returns.
+func newSearch(ctx context.Context, cfg config.SearchConfig, logger *zerolog.Logger, userSvc *users.Service) (search.Search, error) {
+	var index search.Search
+	if cfg.Backend == "elasticsearch" {
+		es := search.NewElastic(search.ElasticOptions{
+			URL:      cfg.ElasticURL,
+			Index:    cfg.ElasticIndex,
+			Username: cfg.ElasticUsername,
+			Password: cfg.ElasticPassword,
 		})
+		if err := es.EnsureIndex(ctx); err != nil {
+			return nil, err
+		}
+		index = es
+	} else {
+		bl, err := search.NewBleve(cfg.BleveDir)
+		if err != nil {
+			return nil, err
+		}
+		index = bl
+	}
+	batch := make([]search.Document, 0, 500)
+	flush := func() error {
+		err := index.Index(ctx, batch...)
+		batch = batch[:0]
+		return err
+	}
+	err := userSvc.Each(ctx, func(u *users.User) error {
+		if batch = append(batch, userDocument(u)); len(batch) == cap(batch) {
+			return flush()
+		}
+		return nil
 	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		index.Close()
+		return nil, fmt.Errorf("indexing users: %w", err)
+	}
+	publishUserEvents(userSvc, func(ctx context.Context, event string, u *users.User) {
+		var err error
+		if u.DeletedAt != nil {
+			err = index.Delete(context.WithoutCancel(ctx), u.Id)
+		} else {
+			err = index.Index(context.WithoutCancel(ctx), userDocument(u))
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("user_id", u.Id).Msg("indexing user")
+		}
+	})
+	return index, nil
+}
 
-	addrStr := fmt.Sprintf(":%d", cfg.Port)
-	logger.Fatal().Err(http.ListenAndServe(addrStr, r))
+func userDocument(u *users.User) search.Document {
+	return search.Document{ID: u.Id, Tenant: u.TenantID, Email: u.Email, Phone: u.Phone, ManagerID: u.ManagerId}
 }
 
-func ListUsers(w http.ResponseWriter, r *http.Request) {
-	if err := render.RenderList(w, r, NewUserListResponse(allUsers)); err != nil {
-		render.Render(w, r, ErrRender(err))
-		return
+// purgeDeletedUsers removes users soft deleted more than after ago, every
+// interval until ctx is done. A failed purge is logged and tried again on
+// the next tick.
+func purgeDeletedUsers(ctx context.Context, userSvc *users.Service, after, interval time.Duration, logger *zerolog.Logger) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return nil
+		}
+		n, err := userSvc.PurgeDeleted(ctx, time.Now().Add(-after))
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error().Err(err).Msg("purging deleted users")
+			}
+			continue
+		}
+		if n > 0 {
+			logger.Info().Str("audit", "users_purged").Int("count", n).Msg("deleted users purged")
+		}
 	}
 }
 
-func GetUser(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value("user").(*User)
-	if err := render.Render(w, r, NewUserResponse(user)); err != nil {
-		render.Render(w, r, ErrRender(err))
-		return
+// restoreUsers loads the last snapshot at path into repo, or the seed users
+// when there is none yet
+func restoreUsers(repo *users.MemoryRepository, path string, logger *zerolog.Logger) error {
+	taken, err := repo.LoadSnapshot(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Info().Str("path", path).Msg("no user snapshot yet, starting from seed users")
+		repo.Put(users.SeedUsers()...)
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	logger.Info().Str("path", path).Time("taken", taken).Msg("users restored from snapshot")
+	return nil
 }
 
-// UserCtx convenience middleware for user specific endpoints
-func UserCtx(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID := chi.URLParam(r, "userID")
-		user, err := retrieveUser(userID)
-		if err != nil {
-			http.Error(w, http.StatusText(404), 404)
+// snapshotUsers saves repo to path every interval it was written in, and a
+// last time once ctx is done. A failed save is logged and tried again on the
+// next tick.
+func snapshotUsers(ctx context.Context, repo *users.MemoryRepository, path string, interval time.Duration, logger *zerolog.Logger) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	saved := repo.Writes()
+	save := func() {
+		writes := repo.Writes()
+		if writes == saved {
 			return
 		}
-		ctx := context.WithValue(r.Context(), "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+		if err := repo.SaveSnapshot(path); err != nil {
+			logger.Error().Err(err).Str("path", path).Msg("saving user snapshot")
+			return
+		}
+		saved = writes
+	}
+	for {
+		select {
+		case <-tick.C:
+			save()
+		case <-ctx.Done():
+			save()
+			return nil
+		}
+	}
+}
+
+// newFlags builds the configured feature flag provider
+func newFlags(cfg config.FlagsConfig) (flags.Provider, error) {
+	if cfg.Provider == "ofrep" {
+		return flags.NewOFREP(flags.OFREPOptions{URL: cfg.OFREPURL, Token: cfg.OFREPToken, Client: &http.Client{Timeout: cfg.OFREPTimeout}}), nil
+	}
+	return flags.NewStatic(cfg.File, cfg.Set)
+}
+
+// newUserService decorates backend as configured and builds the service
+// over it
+func newUserService(cfg *config.Config, backend users.Repository) (*users.Service, error) {
+	userRepo, err := users.Decorate(backend, cfg.UserRepo.Decorators,
+		users.DecoratorOptions{
+			CacheTTL:         cfg.UserRepo.CacheTTL,
+			RetryAttempts:    cfg.UserRepo.RetryAttempts,
+			RetryBackoff:     cfg.UserRepo.RetryBackoff,
+			BreakerThreshold: cfg.UserRepo.BreakerThreshold,
+			BreakerCooldown:  cfg.UserRepo.BreakerCooldown,
+			StatementTimeout: cfg.UserRepo.StatementTimeout,
+			DeadlineReserve:  cfg.UserRepo.DeadlineReserve,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("user repository: %w", err)
+	}
+	if cfg.Tenancy.Enabled {
+		for _, id := range append([]string{cfg.Tenancy.Default}, cfg.Tenancy.Allowed...) {
+			if id != "" && !tenant.Valid(id) {
+				return nil, fmt.Errorf("tenant %q: ids are lowercase letters, digits and dashes", id)
+			}
+		}
+		// outermost, so nothing underneath, the cache included, is reached
+		// unscoped
+		userRepo = users.WithTenants()(userRepo)
+	}
+	idPattern, err := regexp.Compile(cfg.UserRules.IDPattern)
+	if err != nil {
+		return nil, fmt.Errorf("USER_ID_PATTERN: %w", err)
+	}
+	return users.NewService(userRepo, users.ServiceOptions{
+		Loader:    dataloader.Options{Wait: cfg.LoaderWait, MaxBatch: cfg.LoaderMaxBatch},
+		BatchSize: cfg.UserRepo.BatchSize,
+		Validation: users.ValidationOptions{
+			EmailStrictness: cfg.UserRules.EmailStrictness,
+			PlusAddressing:  cfg.UserRules.EmailPlusAddressing,
+			IDPattern:       idPattern,
+		},
+	}), nil
 }
 
-// retrieveUser mock user record retrieval
-func retrieveUser(userId string) (*User, error) {
-	if u, ok := allUsers[userId]; ok {
-		return u, nil
+// serverHook binds addrs at start, or takes the socket systemd passed for
+// them, so a port clash fails startup,
+// serves in the background through the listener wraps, innermost first,
+// and gracefully shuts down on stop
+func serverHook(lc *lifecycle.Lifecycle, logger *zerolog.Logger, name string, srv *http.Server, addrs []string, sock sockets.Options, wraps ...func(net.Listener) net.Listener) lifecycle.Hook {
+	return lifecycle.Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			lns, inherited, err := sockets.Listen(ctx, addrs, sock)
+			if err != nil {
+				return err
+			}
+			serve := srv.Serve
+			if srv.TLSConfig != nil {
+				// the certificate comes from TLSConfig.GetCertificate
+				serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+			}
+			for _, ln := range lns {
+				logger.Info().Str("addr", ln.Addr().String()).Bool("inherited", inherited).Msgf("%s listening", name)
+				for _, wrap := range wraps {
+					ln = wrap(ln)
+				}
+				go func(ln net.Listener) {
+					if err := serve(ln); err != nil && err != http.ErrServerClosed {
+						lc.Fail(name, err)
+					}
+				}(ln)
+			}
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return srv.Shutdown(ctx)
+		},
 	}
-	return nil, fmt.Errorf("no user with id: %s", userId)
 }
 
-func NewUserListResponse(users map[string]*User) []render.Renderer {
-	list := []render.Renderer{}
-	for _, user := range users {
-		list = append(list, NewUserResponse(user))
+// streamsHook tells the open event streams the server is going away on
+// stop, and cuts off those still open after grace
+func streamsHook(logger *zerolog.Logger, reg *streams.Registry, grace time.Duration) lifecycle.Hook {
+	return lifecycle.Hook{
+		Name: "streams",
+		OnStop: func(ctx context.Context) error {
+			open := reg.Len()
+			forced, err := reg.Shutdown(ctx, grace)
+			if len(open) > 0 {
+				logger.Info().Interface("open", open).Int("forced", forced).Msg("event streams closed")
+			}
+			return err
+		},
 	}
-	return list
 }
-func NewUserResponse(user *User) *UserResponse {
-	resp := &UserResponse{User: user}
-	if resp.User == nil {
-		if user, _ := retrieveUser(resp.Id); user != nil {
-			resp.User = user
+
+// dnsProvider builds the configured ACME DNS-01 provider
+func dnsProvider(cfg config.ACMEConfig) acmedns.Provider {
+	if cfg.DNSProvider == "webhook" {
+		return acmedns.NewWebhook(acmedns.WebhookOptions{URL: cfg.WebhookURL, Token: cfg.WebhookToken})
+	}
+	return acmedns.NewCloudflare(acmedns.CloudflareOptions{Token: cfg.CloudflareToken})
+}
+
+// addListeners records a listener's addresses, unix:/path ones as unix
+// sockets
+func addListeners(diag *diagnostics.Registry, name string, addrs ...string) {
+	for _, addr := range addrs {
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			diag.AddListener(name, "unix", path)
+			continue
 		}
+		diag.AddListener(name, "tcp", addr)
 	}
-	return resp
 }
 
-func setupLogger(ctx context.Context, logFilePath string) *zerolog.Logger {
-	var outWriter = os.Stdout
-	if logFilePath != "" && logFilePath != "stdout" {
-		file, err := os.OpenFile(logFilePath,
-			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+// connLimits wraps a listener in the connection limits of opts
+func connLimits(opts connlimit.Options) func(net.Listener) net.Listener {
+	return func(ln net.Listener) net.Listener {
+		return connlimit.Wrap(ln, opts)
+	}
+}
+
+// newAudit builds the audit store, closing a redis one on stop, and the
+// logger writing to it and to the audit log file when that's enabled
+func newAudit(lc *lifecycle.Lifecycle, cfg *config.Config) (audit.Store, audit.Logger, error) {
+	var store audit.Store = audit.NewMemoryStore(cfg.Audit.Keep)
+	if cfg.Audit.Store == "redis" {
+		rs, err := audit.NewRedisStore(cfg.Audit.RedisURL, cfg.Audit.Keep)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, nil, err
+		}
+		lc.Append(lifecycle.Hook{
+			Name:    "audit_store",
+			OnStart: rs.Ping,
+			OnStop: func(ctx context.Context) error {
+				return rs.Close()
+			},
+		})
+		store = rs
+	}
+	if !cfg.Audit.FileEnabled {
+		return store, store, nil
+	}
+	file := &lumberjack.Logger{
+		Filename:   filepath.Join(cfg.LogDir, "audit.log"),
+		MaxSize:    cfg.Log.MaxSizeMB,
+		MaxBackups: cfg.Log.MaxBackups,
+		MaxAge:     cfg.Log.MaxAgeDays,
+		Compress:   cfg.Log.Compress,
+	}
+	lc.Append(lifecycle.Hook{
+		Name: "audit_file",
+		OnStop: func(ctx context.Context) error {
+			return file.Close()
+		},
+	})
+	return store, audit.Multi{store, audit.NewFileLogger(file)}, nil
+}
+
+// sessionStore builds the configured session store, closing a redis one on
+// stop
+func sessionStore(lc *lifecycle.Lifecycle, cfg config.SessionConfig) (auth.SessionStore, error) {
+	if cfg.Store != "redis" {
+		return auth.NewMemorySessionStore(), nil
+	}
+	store, err := auth.NewRedisSessionStore(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(lifecycle.Hook{
+		Name:    "session_store",
+		OnStart: store.Ping,
+		OnStop: func(ctx context.Context) error {
+			return store.Close()
+		},
+	})
+	return store, nil
+}
+
+// limiterStore builds the configured store for failed login counts,
+// closing a redis one on stop
+func limiterStore(lc *lifecycle.Lifecycle, cfg config.LimiterConfig) (auth.LimiterStore, error) {
+	if cfg.Store != "redis" {
+		return auth.NewMemoryLimiterStore(), nil
+	}
+	store, err := auth.NewRedisLimiterStore(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(lifecycle.Hook{
+		Name:    "limiter_store",
+		OnStart: store.Ping,
+		OnStop: func(ctx context.Context) error {
+			return store.Close()
+		},
+	})
+	return store, nil
+}
+
+// actionTokenStore builds the configured store for emailed link tokens,
+// closing a redis one on stop
+func actionTokenStore(lc *lifecycle.Lifecycle, cfg config.AccountConfig) (auth.ActionTokenStore, error) {
+	if cfg.Store != "redis" {
+		return auth.NewMemoryActionTokenStore(), nil
+	}
+	store, err := auth.NewRedisActionTokenStore(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(lifecycle.Hook{
+		Name:    "action_token_store",
+		OnStart: store.Ping,
+		OnStop: func(ctx context.Context) error {
+			return store.Close()
+		},
+	})
+	return store, nil
+}
+
+// newMailer builds the configured mail backend
+func newMailer(cfg config.MailConfig, logger *zerolog.Logger) mail.Mailer {
+	if cfg.Backend == "smtp" {
+		return mail.NewSMTP(mail.SMTPOptions{
+			Addr:     cfg.SMTPAddr,
+			From:     cfg.From,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		})
+	}
+	return mail.Log{Logger: logger}
+}
+
+// newNotifier builds the dispatcher with a sender for every configured
+// channel, email always, each retried as configured
+func newNotifier(cfg config.NotifyConfig, mailer mail.Mailer, logger *zerolog.Logger) (*notify.Dispatcher, error) {
+	templates, err := notify.LoadTemplates(cfg.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	retry := notify.RetryOptions{Attempts: cfg.RetryAttempts, Backoff: cfg.RetryBackoff, MaxBackoff: cfg.RetryMaxBackoff}
+	d := notify.NewDispatcher(notify.NewMemoryPreferenceStore(), logger)
+	d.Register(notify.ChannelEmail, notify.WithRetry(notify.NewEmailSender(mailer, templates), retry))
+	if cfg.TwilioAccountSID != "" {
+		d.Register(notify.ChannelSMS, notify.WithRetry(notify.NewTwilioSender(notify.TwilioOptions{
+			AccountSID: cfg.TwilioAccountSID,
+			AuthToken:  cfg.TwilioAuthToken,
+			From:       cfg.TwilioFrom,
+		}, templates), retry))
+	}
+	if cfg.WebhookURL != "" {
+		d.Register(notify.ChannelWebhook, notify.WithRetry(notify.NewWebhookSender(notify.WebhookOptions{
+			URL:    cfg.WebhookURL,
+			Secret: cfg.WebhookSecret,
+		}, templates), retry))
+	}
+	return d, nil
+}
+
+// jwksHook loads the provider's keys before serving, so startup fails on a
+// bad URL, then keeps them fresh until stop
+func jwksHook(jwks *auth.JWKS) lifecycle.Hook {
+	runCtx, cancel := context.WithCancel(context.Background())
+	return lifecycle.Hook{
+		Name: "jwks",
+		OnStart: func(ctx context.Context) error {
+			if err := jwks.Fetch(ctx); err != nil {
+				return err
+			}
+			go jwks.Run(runCtx)
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	}
+}
+
+// runHook calls run in the background until stop, then waits for it to
+// drain, e.g. the consumer or the webhook deliverer
+func runHook(lc *lifecycle.Lifecycle, name string, run func(ctx context.Context) error) lifecycle.Hook {
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	return lifecycle.Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			go func() {
+				defer close(done)
+				if err := run(runCtx); err != nil {
+					lc.Fail(name, err)
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+// setupLogger builds the app logger, writing to stdout or a rotated log
+// file, and the closer to call on shutdown
+func setupLogger(ctx context.Context, cfg *config.Config) (*zerolog.Logger, io.Closer) {
+	var outWriter io.Writer = os.Stdout
+	// stdout is the process's, only a log file of our own is closed
+	var closer io.Closer = nopCloser{}
+	if cfg.Log.FileEnabled && cfg.LogDir != "" && cfg.LogDir != "stdout" {
+		// lumberjack creates the file and rotates it by size, pruning old
+		// backups by count and age
+		file := &lumberjack.Logger{
+			Filename:   filepath.Join(cfg.LogDir, "server.log"),
+			MaxSize:    cfg.Log.MaxSizeMB,
+			MaxBackups: cfg.Log.MaxBackups,
+			MaxAge:     cfg.Log.MaxAgeDays,
+			Compress:   cfg.Log.Compress,
 		}
-		outWriter = file
+		outWriter, closer = file, file
 	}
 	cout := zerolog.ConsoleWriter{Out: outWriter, TimeFormat: time.RFC822}
 	cout.FormatLevel = func(i interface{}) string {
@@ -149,37 +1027,13 @@ func setupLogger(ctx context.Context, logFilePath string) *zerolog.Logger {
 	//out.FormatTimestamp = func(i interface{}) string {
 	//	return ""
 	//}
-	baseLogger := zerolog.New(cout).With().Timestamp().Logger()
+	// secrets are masked in the json before the console writer formats it
+	baseLogger := zerolog.New(redact.NewWriter(cout)).With().Timestamp().Logger()
 	logCtx := baseLogger.WithContext(ctx)
 	l := zerolog.Ctx(logCtx)
-	return l
-}
-
-func paginate(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// just a stub.. some ideas are to look at URL query params for something like
-		// the page number, or the limit, and send a query cursor down the chain
-		next.ServeHTTP(w, r)
-	})
+	return l, closer
 }
 
-type ErrResponse struct {
-	Err            error  `json:"-"`               // low-level runtime error
-	HTTPStatusCode int    `json:"-"`               // http response status code
-	StatusText     string `json:"status"`          // user-level status message
-	ErrorText      string `json:"error,omitempty"` // application-level error message, for debugging
-}
-
-func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
-	render.Status(r, e.HTTPStatusCode)
-	return nil
-}
+type nopCloser struct{}
 
-func ErrRender(err error) render.Renderer {
-	return &ErrResponse{
-		Err:            err,
-		HTTPStatusCode: 422,
-		StatusText:     "Error rendering response.",
-		ErrorText:      err.Error(),
-	}
-}
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,77 @@
+package slowconn
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ErrTooSlow is what reading a request body sent below the minimum rate
+// returns
+var ErrTooSlow = errors.New("request body sent too slowly")
+
+// MinBodyRate holds request bodies to the minimum rate: no single read may
+// wait longer than Grace for bytes, and once Grace has passed since the
+// first read the body must have come at MinRate or faster. A body that
+// falls behind fails with ErrTooSlow and its connection is closed after
+// the response.
+func MinBodyRate(opts Options) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &rateReader{ReadCloser: r.Body, w: w, rc: http.NewResponseController(w), opts: opts}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type rateReader struct {
+	io.ReadCloser
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	opts Options
+
+	start time.Time
+	read  int64
+	slow  bool
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	if rr.slow {
+		return 0, ErrTooSlow
+	}
+	now := time.Now()
+	if rr.start.IsZero() {
+		rr.start = now
+	}
+	// a deadline the server couldn't set, e.g. under a test recorder, is
+	// left to the rate check
+	deadline := rr.rc.SetReadDeadline(now.Add(rr.opts.Grace)) == nil
+	n, err := rr.ReadCloser.Read(p)
+	rr.read += int64(n)
+	if err != nil && deadline {
+		// the server's background read mustn't inherit it
+		rr.rc.SetReadDeadline(time.Time{})
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, rr.evict()
+	}
+	if err != nil {
+		return n, err
+	}
+	if elapsed := time.Since(rr.start); elapsed >= rr.opts.Grace && float64(rr.read)/elapsed.Seconds() < float64(rr.opts.MinRate) {
+		rr.rc.SetReadDeadline(time.Time{})
+		return n, rr.evict()
+	}
+	return n, nil
+}
+
+func (rr *rateReader) evict() error {
+	rr.slow = true
+	evicted.WithLabelValues("body").Inc()
+	rr.w.Header().Set("Connection", "close")
+	return ErrTooSlow
+}
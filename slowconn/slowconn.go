@@ -0,0 +1,155 @@
+// Package slowconn evicts clients that trickle a request in, a few bytes at
+// a time, to hold a connection and its goroutine for as long as the server
+// lets them: slowloris, and its slow POST cousin. The server's
+// ReadHeaderTimeout bounds the whole header, this also turns away a client
+// well before it runs out when it sends below a minimum rate, freeing the
+// connection for others during a flood.
+package slowconn
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var evicted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_slow_clients_evicted_total",
+	Help: "Connections closed for sending a request below the minimum rate, by whether it was the header or the body.",
+}, []string{"phase"})
+
+// Options is the throughput a request must keep up once Grace has passed
+// since its first byte
+type Options struct {
+	MinRate int // bytes a second
+	Grace   time.Duration
+}
+
+// Guard watches the header phase of a server's connections: from the first
+// byte of a request until its header has been read. Connections waiting
+// for a request without sending anything are left to the server's
+// IdleTimeout.
+type Guard struct {
+	opts Options
+
+	mu    sync.Mutex
+	conns map[net.Conn]*phase
+}
+
+// phase is where a connection is between requests
+type phase struct {
+	waiting bool      // for a request header, not handling one
+	mark    int64     // bytes read when the wait started
+	first   time.Time // when the header's first bytes were seen, zero until then
+}
+
+func NewGuard(opts Options) *Guard {
+	return &Guard{opts: opts, conns: map[net.Conn]*phase{}}
+}
+
+// Listener counts the bytes read from ln's connections, serve through it
+// and set the server's ConnState to the guard's
+func (g *Guard) Listener(ln net.Listener) net.Listener {
+	return &listener{Listener: ln}
+}
+
+// ConnState follows a connection through its requests, install it as the
+// server's ConnState
+func (g *Guard) ConnState(c net.Conn, state http.ConnState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		g.conns[c] = &phase{waiting: true}
+	case http.StateIdle:
+		if p, ok := g.conns[c]; ok {
+			*p = phase{waiting: true, mark: bytesRead(c)}
+		}
+	case http.StateActive:
+		if p, ok := g.conns[c]; ok {
+			p.waiting = false
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(g.conns, c)
+	}
+}
+
+// Run checks the connections every second until ctx is done, closing those
+// sending a header below the minimum rate
+func (g *Guard) Run(ctx context.Context) error {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-t.C:
+			g.check(now)
+		}
+	}
+}
+
+func (g *Guard) check(now time.Time) {
+	var slow []net.Conn
+	g.mu.Lock()
+	for c, p := range g.conns {
+		got := bytesRead(c) - p.mark
+		if !p.waiting || got == 0 {
+			continue
+		}
+		if p.first.IsZero() {
+			// seen to a second, the grace covers that
+			p.first = now
+			continue
+		}
+		if elapsed := now.Sub(p.first); elapsed >= g.opts.Grace && float64(got)/elapsed.Seconds() < float64(g.opts.MinRate) {
+			slow = append(slow, c)
+			delete(g.conns, c)
+		}
+	}
+	g.mu.Unlock()
+	for _, c := range slow {
+		evicted.WithLabelValues("header").Inc()
+		c.Close()
+	}
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c}, nil
+}
+
+// conn counts the bytes read from it
+type conn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func bytesRead(c net.Conn) int64 {
+	// a TLS server sees the connection under its tls.Conn
+	if tc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = tc.NetConn()
+	}
+	if cc, ok := c.(*conn); ok {
+		return cc.read.Load()
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first descriptor systemd passes, after stdin,
+// stdout and stderr
+const listenFDsStart = 3
+
+var (
+	activation     sync.Once
+	activated      map[string]*os.File
+	activationErr  error
+	activatedNames []string
+)
+
+// Inherited is the socket systemd passed under name, nil when there's
+// none. Sockets are named with FileDescriptorName= in the .socket unit, a
+// single unnamed socket is the main listener's, "http". Each is handed
+// out once.
+func Inherited(name string) (net.Listener, error) {
+	activation.Do(func() { activated, activationErr = listenFDs() })
+	if activationErr != nil {
+		return nil, activationErr
+	}
+	f, ok := activated[name]
+	if !ok {
+		return nil, nil
+	}
+	delete(activated, name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket %s: %w", name, err)
+	}
+	return ln, nil
+}
+
+// Names lists the sockets systemd passed, for diagnostics
+func Names() []string {
+	activation.Do(func() { activated, activationErr = listenFDs() })
+	return activatedNames
+}
+
+// listenFDs reads the sockets passed by the sd_listen_fds protocol. The
+// variables are cleared so processes we start don't take them for theirs.
+func listenFDs() (map[string]*os.File, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// meant for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.New("LISTEN_FDS isn't a count of sockets")
+	}
+	var named []string
+	if names != "" {
+		named = strings.Split(names, ":")
+	}
+	if len(named) != 0 && len(named) != n {
+		return nil, fmt.Errorf("LISTEN_FDNAMES names %d sockets, LISTEN_FDS passes %d", len(named), n)
+	}
+	files := map[string]*os.File{}
+	for i := 0; i < n; i++ {
+		name := "http"
+		if len(named) > 0 {
+			name = named[i]
+		} else if n > 1 {
+			return nil, errors.New("several sockets were passed without names, set FileDescriptorName= in the .socket unit")
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("two sockets were passed named %s", name)
+		}
+		files[name] = os.NewFile(uintptr(listenFDsStart+i), name)
+		activatedNames = append(activatedNames, name)
+	}
+	return files, nil
+}
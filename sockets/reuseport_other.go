@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package sockets
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT isn't supported on this platform")
+}
@@ -0,0 +1,87 @@
+// Package sockets binds the server's listeners: on TCP addresses or unix
+// sockets, several at once, and so a new process can take over from an
+// old one on the same host without refusing connections. The listener
+// comes from systemd socket activation when the process was started with
+// one, so systemd holds the socket across restarts, else it's bound with
+// SO_REUSEPORT when asked, so the new process binds the port while the old
+// one still holds it and drains.
+package sockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// Options say which listener to look for among those systemd passed, and
+// how to bind it when it isn't one of them
+type Options struct {
+	// Name is the listener's, http or admin
+	Name string
+	// ReusePort binds TCP addresses with SO_REUSEPORT, letting several
+	// processes listen on the same address, each started the same way
+	ReusePort bool
+	// SocketMode is the permissions of unix socket files, 0660 when 0
+	SocketMode fs.FileMode
+}
+
+// Listen returns the listeners systemd passed under opts.Name, or binds
+// each of addrs: host:port, or unix:/path for a unix socket
+func Listen(ctx context.Context, addrs []string, opts Options) (lns []net.Listener, inherited bool, err error) {
+	ln, err := Inherited(opts.Name)
+	if err != nil || ln != nil {
+		return []net.Listener{ln}, ln != nil, err
+	}
+	for _, addr := range addrs {
+		ln, err := listen(ctx, addr, opts)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, false, fmt.Errorf("listening on %s: %w", addr, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, false, nil
+}
+
+func listen(ctx context.Context, addr string, opts Options) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		lc := net.ListenConfig{}
+		if opts.ReusePort {
+			lc.Control = reusePort
+		}
+		return lc.Listen(ctx, "tcp", addr)
+	}
+	// a socket left by a process that didn't close it, a file that's not
+	// a socket is left for the bind to fail on
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// left in place on close, a process taking over may already have bound
+	// the path again; the next start clears it
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	mode := opts.SocketMode
+	if mode == 0 {
+		mode = 0o660
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DiskOptions struct {
+	Dir string
+	// BaseURL is where ServeHTTP is mounted, e.g. /files or
+	// https://api.example.com/files
+	BaseURL string
+	// Secret signs URLs from SignedURL, random by default so they stop
+	// working on restart and on other instances
+	Secret []byte
+}
+
+// Disk keeps objects as files under a directory, for development and single
+// instance deployments. It serves them itself, see ServeHTTP.
+type Disk struct {
+	root    string
+	baseURL string
+	secret  []byte
+}
+
+// NewDisk stores under opts.Dir, creating it if needed
+func NewDisk(opts DiskOptions) (*Disk, error) {
+	if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	if len(opts.Secret) == 0 {
+		opts.Secret = make([]byte, 32)
+		if _, err := rand.Read(opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Disk{root: opts.Dir, baseURL: strings.TrimSuffix(opts.BaseURL, "/"), secret: opts.Secret}, nil
+}
+
+// Put writes to a temporary file and renames it into place, so readers never
+// see half an object
+func (d *Disk) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	name := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, contextReader{ctx, r}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (d *Disk) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+	f, err := os.Open(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d *Disk) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *Disk) URL(key string) string {
+	return d.baseURL + "/" + key
+}
+
+// SignedURL adds an expiry and a signature over the method, key, content
+// type and expiry to key's URL, checked by ServeHTTP. Objects can be read
+// without one, a signed GET is for callers that don't know that.
+func (d *Disk) SignedURL(ctx context.Context, method, key, contentType string, ttl time.Duration) (string, error) {
+	if err := checkSigned(method, key); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	q := url.Values{"expires": {expires}, "signature": {d.sign(method, key, contentType, expires)}}
+	return d.URL(key) + "?" + q.Encode(), nil
+}
+
+func (d *Disk) sign(method, key, contentType, expires string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(method + "\n" + key + "\n" + contentType + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks r's signature and expiry for key
+func (d *Disk) verify(r *http.Request, key string) bool {
+	expires := r.URL.Query().Get("expires")
+	at, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > at {
+		return false
+	}
+	want := d.sign(r.Method, key, r.Header.Get("Content-Type"), expires)
+	return hmac.Equal([]byte(want), []byte(r.URL.Query().Get("signature")))
+}
+
+// ServeHTTP serves the object at the request path, with the mount prefix
+// stripped, and stores a PUT body there when the URL is signed for it.
+// Directories aren't listed.
+func (d *Disk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if !validKey(key) || strings.HasPrefix(path.Base(key), ".") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		if !d.verify(r, key) {
+			http.Error(w, "invalid or expired signature", http.StatusForbidden)
+			return
+		}
+		if err := d.Put(r.Context(), key, r.Body, r.ContentLength, r.Header.Get("Content-Type")); err != nil {
+			http.Error(w, "storing object failed", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (d *Disk) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+// contextReader stops a copy once ctx is done, e.g. the client went away
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type S3Options struct {
+	Bucket string
+	// PublicURL is where the bucket's objects are read from, e.g. a CDN in
+	// front of it. By default https://<bucket>.s3.<region>.amazonaws.com.
+	PublicURL string
+}
+
+// S3 keeps objects in an S3 bucket, or anything speaking its API such as
+// MinIO. URL reads straight from the bucket, or a CDN in front of it, so
+// it's for objects publicly readable there; SignedURL reaches private ones.
+type S3 struct {
+	client   *awss3.Client
+	uploader *manager.Uploader
+	presign  *awss3.PresignClient
+	opts     S3Options
+}
+
+func NewS3(client *awss3.Client, opts S3Options) *S3 {
+	if opts.PublicURL == "" {
+		opts.PublicURL = "https://" + opts.Bucket + ".s3." + client.Options().Region + ".amazonaws.com"
+	}
+	opts.PublicURL = strings.TrimSuffix(opts.PublicURL, "/")
+	return &S3{client: client, uploader: manager.NewUploader(client), presign: awss3.NewPresignClient(client), opts: opts}
+}
+
+// Put streams r in parts, so objects of unknown size aren't held in memory
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	_, err := s.uploader.Upload(ctx, &awss3.PutObjectInput{
+		Bucket:      aws.String(s.opts.Bucket),
+		Key:         aws.String(key),
+		Body:        r,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+	out, err := s.client.GetObject(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if errors.As(err, new(*types.NoSuchKey)) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	_, err := s.client.DeleteObject(ctx, &awss3.DeleteObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3) URL(key string) string {
+	return s.opts.PublicURL + "/" + key
+}
+
+// SignedURL presigns a GetObject or PutObject request, reaching the bucket
+// itself rather than PublicURL. Presigned URLs can't outlive the
+// credentials that signed them, at most 7 days.
+func (s *S3) SignedURL(ctx context.Context, method, key, contentType string, ttl time.Duration) (string, error) {
+	if err := checkSigned(method, key); err != nil {
+		return "", err
+	}
+	expires := awss3.WithPresignExpires(ttl)
+	if method == http.MethodGet {
+		req, err := s.presign.PresignGetObject(ctx, &awss3.GetObjectInput{
+			Bucket: aws.String(s.opts.Bucket),
+			Key:    aws.String(key),
+		}, expires)
+		if err != nil {
+			return "", err
+		}
+		return req.URL, nil
+	}
+	in := &awss3.PutObjectInput{Bucket: aws.String(s.opts.Bucket), Key: aws.String(key)}
+	if contentType != "" {
+		in.ContentType = aws.String(contentType)
+	}
+	req, err := s.presign.PresignPutObject(ctx, in, expires)
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
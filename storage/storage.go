@@ -0,0 +1,62 @@
+// Package storage keeps uploaded files, on local disk or in S3, behind one
+// interface so handlers stream to whichever backend is configured.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrInvalidKey is a key that's empty or could climb out of the store
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// ErrNotFound is a Get for a key with nothing stored
+var ErrNotFound = errors.New("storage object not found")
+
+// ErrMethod is a signed URL asked for a method other than GET or PUT
+var ErrMethod = errors.New("signed urls are for GET or PUT")
+
+// Storage is an object store. Keys are slash separated paths, e.g.
+// avatars/<user id>/<name>.png.
+type Storage interface {
+	// Put streams r to key, replacing what's there. size is -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get reads key back, ErrNotFound when there's nothing there
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes key, it's not an error when there's nothing there
+	Delete(ctx context.Context, key string) error
+	// URL is where clients fetch key from. It doesn't change for a key, so
+	// it can be stored.
+	URL(key string) string
+	// SignedURL lets whoever holds it GET or PUT key directly for ttl,
+	// without going through the service. A PUT should send contentType as
+	// its Content-Type, the disk backend turns it away otherwise.
+	SignedURL(ctx context.Context, method, key, contentType string, ttl time.Duration) (string, error)
+}
+
+func checkSigned(method, key string) error {
+	if method != http.MethodGet && method != http.MethodPut {
+		return ErrMethod
+	}
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	return nil
+}
+
+// validKey rejects keys that could climb out of the store's root
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+// Package streams keeps track of long lived responses, server-sent event
+// streams, websockets and long polls, so a shutting down server can deal
+// with them instead of waiting for them to end on their own. http.Server's
+// Shutdown only waits for active requests, which a stream never stops
+// being, and doesn't see hijacked websocket connections at all.
+//
+// On Shutdown every stream is told it's going away, so it can send its
+// client a last event or close frame and return, and after a grace period
+// the context of those still open is cancelled to force them closed.
+package streams
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Registry holds the open streams of one server
+type Registry struct {
+	mu        sync.Mutex
+	conns     map[*Conn]struct{}
+	goingAway chan struct{} // closed once Shutdown starts
+	closed    chan struct{} // signalled as each stream closes
+}
+
+func NewRegistry() *Registry {
+	return &Registry{conns: map[*Conn]struct{}{}, goingAway: make(chan struct{}), closed: make(chan struct{}, 1)}
+}
+
+// Conn is one open stream
+type Conn struct {
+	reg    *Registry
+	kind   string
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// Open registers a stream of kind, e.g. "sse" or "websocket", for the
+// request with ctx. The stream must run under the returned context, which
+// is cancelled when shutdown forces it closed, and call Close when it
+// ends.
+func (reg *Registry) Open(ctx context.Context, kind string) (*Conn, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Conn{reg: reg, kind: kind, cancel: cancel}
+	reg.mu.Lock()
+	reg.conns[c] = struct{}{}
+	reg.mu.Unlock()
+	return c, ctx
+}
+
+// GoingAway is closed when the server starts shutting down: the stream
+// should tell its client, a shutdown event or a close frame, and end. It's
+// closed already for a stream opened during shutdown.
+func (c *Conn) GoingAway() <-chan struct{} {
+	return c.reg.goingAway
+}
+
+// Close ends the stream's registration, it's safe to call more than once
+func (c *Conn) Close() {
+	c.once.Do(func() {
+		c.cancel()
+		c.reg.mu.Lock()
+		delete(c.reg.conns, c)
+		c.reg.mu.Unlock()
+		select {
+		case c.reg.closed <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// Len is how many streams are open, by kind
+func (reg *Registry) Len() map[string]int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	n := map[string]int{}
+	for c := range reg.conns {
+		n[c.kind]++
+	}
+	return n
+}
+
+func (reg *Registry) open() int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return len(reg.conns)
+}
+
+// Shutdown tells every stream it's going away, waits up to grace for them
+// to close, then cancels those still open and waits for them until ctx is
+// done. It returns how many had to be forced.
+func (reg *Registry) Shutdown(ctx context.Context, grace time.Duration) (int, error) {
+	reg.mu.Lock()
+	select {
+	case <-reg.goingAway:
+	default:
+		close(reg.goingAway)
+	}
+	reg.mu.Unlock()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	for reg.open() > 0 {
+		select {
+		case <-reg.closed:
+			continue
+		case <-timer.C:
+		case <-ctx.Done():
+			return reg.open(), ctx.Err()
+		}
+		break
+	}
+	reg.mu.Lock()
+	forced := len(reg.conns)
+	for c := range reg.conns {
+		c.cancel()
+	}
+	reg.mu.Unlock()
+	for reg.open() > 0 {
+		select {
+		case <-reg.closed:
+		case <-ctx.Done():
+			return forced, ctx.Err()
+		}
+	}
+	return forced, nil
+}
@@ -0,0 +1,32 @@
+// Package tenant carries the tenant a request acts for through its context,
+// so the repository can scope every query to it and logs and metrics can be
+// tagged with it. A context without a tenant is the operator's, acting
+// across tenants: background jobs, consumers and the admin listener.
+package tenant
+
+import (
+	"context"
+	"regexp"
+
+	"go-chi-microservice/ctxkeys"
+)
+
+// idRe keeps tenant ids fit for a subdomain, a log field and a metric label
+var idRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Valid reports whether id is a well formed tenant id, lowercase letters,
+// digits and dashes
+func Valid(id string) bool {
+	return idRe.MatchString(id)
+}
+
+// With returns a context acting for the tenant id
+func With(ctx context.Context, id string) context.Context {
+	return ctxkeys.With(ctx, ctxkeys.Tenant, id)
+}
+
+// ID is the tenant ctx acts for, empty for the operator
+func ID(ctx context.Context) string {
+	id, _ := ctxkeys.Value[string](ctx, ctxkeys.Tenant)
+	return id
+}
@@ -0,0 +1,612 @@
+// Package testsupport boots the full router against in-memory fakes so
+// handler tests exercise the real middleware stack and routing:
+//
+//	srv := testsupport.NewServer(t)
+//	srv.SeedUsers(&users.User{Id: "a1", Email: "a@example.com"})
+//	srv.Get("/users/a1").AssertStatus(200).AssertGolden("get_user")
+package testsupport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/api"
+	"go-chi-microservice/audit"
+	"go-chi-microservice/auth"
+	"go-chi-microservice/config"
+	"go-chi-microservice/diagnostics"
+	"go-chi-microservice/docs"
+	"go-chi-microservice/egress"
+	"go-chi-microservice/flags"
+	"go-chi-microservice/mail"
+	"go-chi-microservice/maintenance"
+	"go-chi-microservice/publicid"
+	"go-chi-microservice/query"
+	"go-chi-microservice/redact"
+	"go-chi-microservice/search"
+	"go-chi-microservice/users"
+	"go-chi-microservice/views"
+)
+
+// Update rewrites golden files with the actual responses, run the tests
+// with -update after an intended response change and review the diff
+var Update = flag.Bool("update", false, "update golden files")
+
+type Server struct {
+	t       testing.TB
+	Config  *config.Config
+	Users   *FakeUsers
+	Mail    *FakeMailer
+	Handler http.Handler
+	Admin   http.Handler
+
+	logs   logBuffer
+	search search.Search // nil unless search is enabled
+}
+
+// logBuffer collects what the app logger writes, requests can log from
+// several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Option adjusts the server before the router is built
+type Option func(*Server)
+
+// WithConfig lets a test change settings from their defaults
+func WithConfig(fn func(cfg *config.Config)) Option {
+	return func(s *Server) { fn(s.Config) }
+}
+
+// NewServer builds the router with default config and an empty user store
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	cfg, err := config.Defaults()
+	if err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	s := &Server{t: t, Config: cfg, Users: NewFakeUsers(), Mail: &FakeMailer{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	var repo users.Repository = s.Users
+	if slices.Contains(cfg.UserRepo.Decorators, "timeout") {
+		// as in the service, so calls stop at the same deadlines
+		repo = users.WithTimeout(cfg.UserRepo.StatementTimeout, cfg.UserRepo.DeadlineReserve)(repo)
+	}
+	if cfg.Tenancy.Enabled {
+		repo = users.WithTenants()(repo)
+	}
+	// redacted as in the service, so tests see what would be logged
+	logger := zerolog.New(redact.NewWriter(&s.logs))
+	deps := api.Deps{
+		Logger: &logger,
+		Users: users.NewService(repo, users.ServiceOptions{Validation: users.ValidationOptions{
+			EmailStrictness: cfg.UserRules.EmailStrictness,
+			PlusAddressing:  cfg.UserRules.EmailPlusAddressing,
+			IDPattern:       regexp.MustCompile(cfg.UserRules.IDPattern),
+		}}),
+		Diagnostics: diagnostics.NewRegistry(),
+		Maintenance: maintenance.NewSwitch(maintenance.State{Enabled: cfg.Maintenance.Enabled, Reason: cfg.Maintenance.Reason,
+			RetryAfterSeconds: int(cfg.Maintenance.RetryAfter.Seconds())}),
+	}
+	if cfg.Audit.Enabled {
+		// kept in memory whatever the store, read them back at /admin/audit
+		store := audit.NewMemoryStore(cfg.Audit.Keep)
+		deps.Audit, deps.AuditStore = store, store
+		deps.Users.OnChange(func(ctx context.Context, before, after *users.User) {
+			audit.RecordChange(ctx, "user", after.Id, before, after)
+		})
+	}
+	if cfg.Auth.Enabled {
+		// tokens and cookie sessions in memory whatever the stores
+		deps.Auth = auth.NewIssuer(auth.Options{
+			Secret:     []byte(cfg.Auth.JWTSecret),
+			Issuer:     cfg.Auth.Issuer,
+			AccessTTL:  cfg.Auth.AccessTTL,
+			RefreshTTL: cfg.Auth.RefreshTTL,
+			ClockSkew:  cfg.Auth.ClockSkew,
+			Active:     deps.Users.Active,
+		}, auth.NewMemoryRefreshStore())
+		deps.Verifier = deps.Auth
+		if cfg.Auth.Session.Enabled {
+			deps.Sessions = auth.NewMemorySessionStore()
+		}
+		if cfg.Auth.Account.Enabled {
+			deps.ActionTokens, deps.Mailer = auth.NewMemoryActionTokenStore(), s.Mail
+		}
+	}
+	// static flags whatever the provider, turn one on with cfg.Flags.Set
+	if deps.Flags, err = flags.NewStatic(cfg.Flags.File, cfg.Flags.Set); err != nil {
+		t.Fatalf("flags: %v", err)
+	}
+	if cfg.HTML.Enabled {
+		if deps.Views, err = views.New(views.Options{Dir: cfg.HTML.TemplatesDir, Reload: cfg.HTML.Reload}); err != nil {
+			t.Fatalf("templates: %v", err)
+		}
+	}
+	if len(cfg.PublicIDs.Resources) > 0 {
+		if deps.PublicIDs, err = publicid.NewEncrypted(cfg.PublicIDs.Secret); err != nil {
+			t.Fatalf("public ids: %v", err)
+		}
+	}
+	if cfg.Search.Enabled {
+		// in memory whatever the backend, kept up to date as in the service
+		if s.search, err = search.NewBleve(""); err != nil {
+			t.Fatalf("search: %v", err)
+		}
+		t.Cleanup(func() { s.search.Close() })
+		deps.Search = s.search
+		deps.Users.OnCreate(s.index)
+		deps.Users.OnUpdate(s.index)
+	}
+	if cfg.Egress.Enabled {
+		if deps.Egress, err = egress.NewPolicy(cfg.Egress.AllowHosts, cfg.Egress.AllowCIDRs); err != nil {
+			t.Fatalf("egress: %v", err)
+		}
+	}
+	s.Handler = api.NewRouter(cfg, deps)
+	s.Admin = api.NewAdminRouter(cfg, deps)
+	return s
+}
+
+// Logs returns what the app logger has written, as JSON lines
+func (s *Server) Logs() string {
+	return s.logs.String()
+}
+
+// AssertNoSecretsLogged fails when the logs contain a secret shape known to
+// the redact registry or any of values, e.g. the secrets the test configured
+func (s *Server) AssertNoSecretsLogged(values ...string) {
+	s.t.Helper()
+	if found := leaks(s.Logs(), values); len(found) > 0 {
+		s.t.Fatalf("secrets logged: %q\nlogs:\n%s", found, s.Logs())
+	}
+}
+
+// SeedUsers loads users into the fake store
+func (s *Server) SeedUsers(list ...*users.User) {
+	s.Users.Put(list...)
+	for _, u := range list {
+		s.index(context.Background(), u)
+	}
+}
+
+// index adds u to the search index when there is one, or takes it out once
+// it's deleted
+func (s *Server) index(ctx context.Context, u *users.User) {
+	if s.search == nil {
+		return
+	}
+	var err error
+	if u.DeletedAt != nil {
+		err = s.search.Delete(ctx, u.Id)
+	} else {
+		err = s.search.Index(ctx, search.Document{ID: u.Id, Tenant: u.TenantID, Email: u.Email, Phone: u.Phone, ManagerID: u.ManagerId})
+	}
+	if err != nil {
+		s.t.Fatalf("indexing %s: %v", u.Id, err)
+	}
+}
+
+// Do sends a request through the router. A non-nil body is sent as JSON
+// unless it is already a string or []byte.
+func (s *Server) Do(method, path string, body any, header http.Header) *Response {
+	s.t.Helper()
+	return do(s.t, s.Handler, method, path, body, header)
+}
+
+func (s *Server) Get(path string) *Response {
+	s.t.Helper()
+	return s.Do(http.MethodGet, path, nil, nil)
+}
+
+func (s *Server) Post(path string, body any) *Response {
+	s.t.Helper()
+	return s.Do(http.MethodPost, path, body, nil)
+}
+
+// DoAdmin sends a request through the admin router
+func (s *Server) DoAdmin(method, path string, body any, header http.Header) *Response {
+	s.t.Helper()
+	return do(s.t, s.Admin, method, path, body, header)
+}
+
+func do(t testing.TB, h http.Handler, method, path string, body any, header http.Header) *Response {
+	t.Helper()
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+	case string:
+		data = []byte(b)
+	case []byte:
+		data = b
+	default:
+		var err error
+		if data, err = json.Marshal(b); err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+	}
+	var rdr io.Reader
+	if body != nil {
+		rdr = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, rdr)
+	if rdr != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// a route context of our own, so the pattern that served the request
+	// can be read afterwards for its example
+	rctx := chi.NewRouteContext()
+	rctx.Routes, _ = h.(chi.Routes)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return &Response{t: t, ResponseRecorder: rec, method: method, path: path, reqBody: data, route: rctx.RoutePattern()}
+}
+
+type Response struct {
+	t testing.TB
+	*httptest.ResponseRecorder
+
+	// the request, for its example
+	method, path, route string
+	reqBody             []byte
+}
+
+func (r *Response) AssertStatus(code int) *Response {
+	r.t.Helper()
+	if r.Code != code {
+		r.t.Fatalf("status = %d, want %d\nbody: %s", r.Code, code, r.Body.String())
+	}
+	return r
+}
+
+func (r *Response) AssertHeader(key, want string) *Response {
+	r.t.Helper()
+	if got := r.Header().Get(key); got != want {
+		r.t.Fatalf("header %s = %q, want %q", key, got, want)
+	}
+	return r
+}
+
+// AssertNoSecrets fails when the body or headers contain a secret shape
+// known to the redact registry or any of values. Set-Cookie is skipped, a
+// session cookie is a secret handed out on purpose.
+func (r *Response) AssertNoSecrets(values ...string) *Response {
+	r.t.Helper()
+	var text strings.Builder
+	for k, vs := range r.Header() {
+		if k != "Set-Cookie" {
+			text.WriteString(k + ": " + strings.Join(vs, ", ") + "\n")
+		}
+	}
+	text.Write(r.Body.Bytes())
+	if found := leaks(text.String(), values); len(found) > 0 {
+		r.t.Fatalf("secrets in response: %q\n%s", found, text.String())
+	}
+	return r
+}
+
+func leaks(text string, values []string) []string {
+	found := redact.Leaks(text)
+	for _, v := range values {
+		if v != "" && strings.Contains(text, v) {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+// DecodeJSON unmarshals the body into v
+func (r *Response) DecodeJSON(v any) *Response {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body.Bytes(), v); err != nil {
+		r.t.Fatalf("decoding response: %v\nbody: %s", err, r.Body.String())
+	}
+	return r
+}
+
+// AssertGolden compares the body, indented if it is JSON, with
+// testdata/<name>.golden next to the calling test. Volatile parts are
+// scrubbed first, by DefaultScrubs and then scrubs, both when comparing and
+// when updating.
+func (r *Response) AssertGolden(name string, scrubs ...Scrub) *Response {
+	r.t.Helper()
+	got := r.Body.Bytes()
+	var indented bytes.Buffer
+	if json.Indent(&indented, got, "", "  ") == nil {
+		got = append(indented.Bytes(), '\n')
+	}
+	for _, scrub := range append(DefaultScrubs[:len(DefaultScrubs):len(DefaultScrubs)], scrubs...) {
+		got = scrub(got)
+	}
+	path := filepath.Join("testdata", name+".golden")
+	if *Update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			r.t.Fatal(err)
+		}
+		r.writeExample(name, got, scrubs)
+		return r
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		r.t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		r.t.Fatalf("response does not match %s (run with -update if intended)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+	return r
+}
+
+// writeExample records the request and its golden response in
+// docs/examples, where /docs/examples serves them from
+func (r *Response) writeExample(name string, body []byte, scrubs []Scrub) {
+	r.t.Helper()
+	reqBody := r.reqBody
+	for _, scrub := range append(DefaultScrubs[:len(DefaultScrubs):len(DefaultScrubs)], scrubs...) {
+		reqBody = scrub(reqBody)
+	}
+	ex := docs.Example{
+		Name:         name,
+		Route:        r.route,
+		Method:       r.method,
+		Path:         r.path,
+		RequestBody:  docs.Body(reqBody),
+		Status:       r.Code,
+		ContentType:  r.Header().Get("Content-Type"),
+		ResponseBody: docs.Body(bytes.TrimSpace(body)),
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false) // keep placeholders like <time> readable
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ex); err != nil {
+		r.t.Fatalf("encoding example: %v", err)
+	}
+	dir, err := moduleRoot()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "examples", strings.ReplaceAll(name, "/", "_")+".json"), data.Bytes(), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// moduleRoot finds the directory with go.mod above the test's
+func moduleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("no go.mod above the test directory")
+		}
+		dir = parent
+	}
+}
+
+// Scrub replaces what changes from run to run in a golden response, such as
+// timestamps and generated ids, with a fixed placeholder
+type Scrub func(body []byte) []byte
+
+// DefaultScrubs apply to every golden response: RFC 3339 times become
+// "<time>", request ids "<request_id>" and the version 1 elapsed "<elapsed>"
+var DefaultScrubs = []Scrub{
+	ScrubPattern(regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`), "<time>"),
+	ScrubFields("request_id", "elapsed"),
+}
+
+// ScrubPattern replaces every match of re with placeholder
+func ScrubPattern(re *regexp.Regexp, placeholder string) Scrub {
+	return func(body []byte) []byte {
+		return re.ReplaceAllLiteral(body, []byte(placeholder))
+	}
+}
+
+// ScrubFields replaces the string or number values of the named JSON fields,
+// at any depth, with "<name>", e.g. ScrubFields("Id") for users created
+// without one
+func ScrubFields(names ...string) Scrub {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	re := regexp.MustCompile(`"(` + strings.Join(quoted, "|") + `)": ("(?:[^"\\]|\\.)*"|-?[0-9][0-9.eE+-]*)`)
+	return func(body []byte) []byte {
+		return re.ReplaceAll(body, []byte(`"$1": "<$1>"`))
+	}
+}
+
+// FakeMailer keeps the emails sent, for tests to follow their links
+type FakeMailer struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (f *FakeMailer) Send(ctx context.Context, m mail.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+// Wait returns the first email sent to addr, waiting up to a second for
+// ones sent in the background
+func (f *FakeMailer) Wait(addr string) (mail.Message, bool) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		for _, m := range f.sent {
+			if m.To == addr {
+				f.mu.Unlock()
+				return m, true
+			}
+		}
+		f.mu.Unlock()
+		if time.Now().After(deadline) {
+			return mail.Message{}, false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// FakeUsers is an in-memory user repository that can be told to fail or
+// hang, for testing error paths
+type FakeUsers struct {
+	*users.MemoryRepository
+
+	mu       sync.Mutex
+	err      error
+	hang     bool
+	inFlight int
+}
+
+func NewFakeUsers() *FakeUsers {
+	return &FakeUsers{MemoryRepository: users.NewMemoryRepository()}
+}
+
+// FailWith makes every call return err until cleared with FailWith(nil)
+func (f *FakeUsers) FailWith(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// ErrInjected is a generic backend failure for FailWith
+var ErrInjected = errors.New("injected failure")
+
+// Hang makes every call wait for its context to be done, like a query stuck
+// on the backend, and fail with the context's error, until cleared with
+// Hang(false)
+func (f *FakeUsers) Hang(hang bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hang = hang
+}
+
+// InFlight is how many calls are hanging, still waiting on their context
+func (f *FakeUsers) InFlight() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inFlight
+}
+
+func (f *FakeUsers) failure(ctx context.Context) error {
+	f.mu.Lock()
+	if !f.hang {
+		defer f.mu.Unlock()
+		return f.err
+	}
+	f.inFlight++
+	f.mu.Unlock()
+	<-ctx.Done()
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+	return ctx.Err()
+}
+
+func (f *FakeUsers) Get(ctx context.Context, id string) (*users.User, error) {
+	if err := f.failure(ctx); err != nil {
+		return nil, err
+	}
+	return f.MemoryRepository.Get(ctx, id)
+}
+
+func (f *FakeUsers) GetMany(ctx context.Context, ids []string) (map[string]*users.User, error) {
+	if err := f.failure(ctx); err != nil {
+		return nil, err
+	}
+	return f.MemoryRepository.GetMany(ctx, ids)
+}
+
+func (f *FakeUsers) List(ctx context.Context) ([]*users.User, error) {
+	if err := f.failure(ctx); err != nil {
+		return nil, err
+	}
+	return f.MemoryRepository.List(ctx)
+}
+
+func (f *FakeUsers) Find(ctx context.Context, q query.Query) ([]*users.User, error) {
+	if err := f.failure(ctx); err != nil {
+		return nil, err
+	}
+	return f.MemoryRepository.Find(ctx, q)
+}
+
+func (f *FakeUsers) Each(ctx context.Context, fn func(*users.User) error) error {
+	if err := f.failure(ctx); err != nil {
+		return err
+	}
+	return f.MemoryRepository.Each(ctx, fn)
+}
+
+func (f *FakeUsers) GetByEmail(ctx context.Context, email string) (*users.User, error) {
+	if err := f.failure(ctx); err != nil {
+		return nil, err
+	}
+	return f.MemoryRepository.GetByEmail(ctx, email)
+}
+
+func (f *FakeUsers) CreateMany(ctx context.Context, list []*users.User) error {
+	if err := f.failure(ctx); err != nil {
+		return err
+	}
+	return f.MemoryRepository.CreateMany(ctx, list)
+}
+
+func (f *FakeUsers) UpdateMany(ctx context.Context, list []*users.User) error {
+	if err := f.failure(ctx); err != nil {
+		return err
+	}
+	return f.MemoryRepository.UpdateMany(ctx, list)
+}
+
+func (f *FakeUsers) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	if err := f.failure(ctx); err != nil {
+		return 0, err
+	}
+	return f.MemoryRepository.PurgeDeleted(ctx, before)
+}
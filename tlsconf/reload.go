@@ -0,0 +1,116 @@
+package tlsconf
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+var (
+	reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tls_certificate_reloads_total",
+		Help: "Certificate reloads after its files changed, by result, ok or error.",
+	}, []string{"result"})
+	notAfter = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tls_certificate_expiry_timestamp_seconds",
+		Help: "When the served certificate expires, as a unix timestamp.",
+	})
+)
+
+// Certificate is a key pair read from files and read again when they
+// change. A reload that fails, say a half written renewal, keeps serving
+// the previous pair and is tried again on the next check.
+type Certificate struct {
+	certFile, keyFile string
+	logger            *zerolog.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte // as last loaded, to tell a change from a touch
+	keyPEM  []byte
+}
+
+// LoadCertificate reads the key pair in certFile and keyFile, PEM encoded
+func LoadCertificate(certFile, keyFile string, logger *zerolog.Logger) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile, logger: logger}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate serves the current pair, set it as the tls.Config's
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// NotAfter is when the current certificate expires
+func (c *Certificate) NotAfter() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert.Leaf.NotAfter
+}
+
+// Watch checks the files every interval until ctx is done, loading the pair
+// again when either changed. Polling rather than file notifications sees
+// a kubernetes secret or cert-manager swapping a symlink just the same.
+func (c *Certificate) Watch(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			changed, err := c.reload()
+			switch {
+			case err != nil:
+				reloads.WithLabelValues("error").Inc()
+				c.logger.Error().Err(err).Str("cert_file", c.certFile).Msg("reloading TLS certificate, still serving the previous one")
+			case changed:
+				reloads.WithLabelValues("ok").Inc()
+				c.logger.Info().Str("cert_file", c.certFile).Time("not_after", c.NotAfter()).Msg("reloaded TLS certificate")
+			}
+		}
+	}
+}
+
+// reload reads the files and swaps the pair in when they've changed
+func (c *Certificate) reload() (bool, error) {
+	certPEM, err := os.ReadFile(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	same := bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM)
+	c.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cert, c.certPEM, c.keyPEM = &cert, certPEM, keyPEM
+	c.mu.Unlock()
+	notAfter.Set(float64(cert.Leaf.NotAfter.Unix()))
+	return true, nil
+}
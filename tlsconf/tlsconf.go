@@ -0,0 +1,108 @@
+// Package tlsconf builds the main listener's TLS config from named settings,
+// the protocol versions, cipher suites, curves and client certificate policy
+// an operator would write down, and serves a certificate that's reloaded
+// when its files change so a renewal doesn't need a restart.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Options is a TLS policy by name, empty fields take Go's defaults
+type Options struct {
+	MinVersion   string   // 1.0, 1.1, 1.2 or 1.3
+	CipherSuites []string // IANA names, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS 1.2 and below only
+	Curves       []string // X25519, P256, P384 or P521, in order of preference
+	// ClientAuth is none, request, require, verify_if_given or
+	// require_and_verify, the verifying ones against ClientCAFile
+	ClientAuth   string
+	ClientCAFile string
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var clientAuths = map[string]tls.ClientAuthType{
+	"":                   tls.NoClientCert,
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// Config is the server TLS config for opts, serving cert's certificate
+func Config(opts Options, cert *Certificate) (*tls.Config, error) {
+	cfg := &tls.Config{GetCertificate: cert.GetCertificate}
+	if opts.MinVersion != "" {
+		v, ok := versions[opts.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", opts.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	for _, name := range opts.CipherSuites {
+		id, err := cipherSuite(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range opts.Curves {
+		id, ok := curves[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+	auth, ok := clientAuths[opts.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth %q", opts.ClientAuth)
+	}
+	cfg.ClientAuth = auth
+	if opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", opts.ClientCAFile)
+		}
+	} else if auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert {
+		return nil, errors.New("verifying client certificates needs a client CA file")
+	}
+	return cfg, nil
+}
+
+// cipherSuite looks a suite up by name. Insecure suites are refused, Go
+// only offers them when asked and they shouldn't be asked for by accident.
+func cipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, nil
+		}
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
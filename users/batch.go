@@ -0,0 +1,112 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go-chi-microservice/metrics"
+)
+
+var ErrExists = errors.New("user already exists")
+
+// ItemError is one user of a batch write that wasn't written
+type ItemError struct {
+	Index int    `json:"index"` // position in the batch
+	Id    string `json:"id"`
+	Err   error  `json:"-"`
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("user %d (%s): %v", e.Index, e.Id, e.Err)
+}
+
+// BatchError reports the users of a batch write that failed, the others
+// were written
+type BatchError struct {
+	Failures []ItemError
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Failures) == 1 {
+		return e.Failures[0].Error()
+	}
+	return fmt.Sprintf("%d users failed, first %v", len(e.Failures), e.Failures[0])
+}
+
+// batchErr is the error for failures, nil when there were none
+func batchErr(failures []ItemError) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	return &BatchError{Failures: failures}
+}
+
+// CreateMany inserts list in chunks of the configured batch size. Invalid
+// users and those the repository rejects are reported in a *BatchError with
+// their index in list, everything else is written.
+func (s *Service) CreateMany(ctx context.Context, list []*User) error {
+	written, err := s.writeMany(ctx, list, s.repo.CreateMany)
+	metrics.UsersCreated("batch", written)
+	return err
+}
+
+// UpdateMany replaces the stored users with list, in chunks like CreateMany
+func (s *Service) UpdateMany(ctx context.Context, list []*User) error {
+	written, err := s.writeMany(ctx, list, s.repo.UpdateMany)
+	metrics.UsersUpdated(written)
+	return err
+}
+
+// writeMany returns how many users of list were written along with what
+// went wrong for the rest
+func (s *Service) writeMany(ctx context.Context, list []*User, write func(context.Context, []*User) error) (int, error) {
+	var failures []ItemError
+	valid := make([]*User, 0, len(list))
+	index := make([]int, 0, len(list)) // valid[i] is list[index[i]]
+	for i, u := range list {
+		if u == nil || u.Id == "" || u.Email == "" {
+			failures = append(failures, ItemError{Index: i, Id: idOf(u), Err: errors.New("id and email are required")})
+			continue
+		}
+		if err := s.validator.Check(u); err != nil {
+			failures = append(failures, ItemError{Index: i, Id: u.Id, Err: err})
+			continue
+		}
+		valid = append(valid, u)
+		index = append(index, i)
+	}
+	for start, end := 0, 0; start < len(valid); start = end {
+		end = min(start+s.batchSize, len(valid))
+		err := write(ctx, valid[start:end])
+		var be *BatchError
+		switch {
+		case err == nil:
+		case errors.As(err, &be):
+			for _, f := range be.Failures {
+				f.Index = index[start+f.Index]
+				failures = append(failures, f)
+			}
+		default:
+			// the whole chunk failed, and every chunk after it will too
+			// once the caller has gone
+			if ctx.Err() != nil {
+				end = len(valid)
+			}
+			for i := start; i < end; i++ {
+				failures = append(failures, ItemError{Index: index[i], Id: valid[i].Id, Err: err})
+			}
+		}
+	}
+	// invalid users were collected first, report in list order
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+	return len(list) - len(failures), batchErr(failures)
+}
+
+func idOf(u *User) string {
+	if u == nil {
+		return ""
+	}
+	return u.Id
+}
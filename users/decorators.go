@@ -0,0 +1,852 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"go-chi-microservice/breaker"
+	"go-chi-microservice/query"
+	"go-chi-microservice/tenant"
+)
+
+// Decorator wraps a Repository with a cross-cutting concern, so caching,
+// tracing etc. work the same whatever backend is underneath
+type Decorator func(Repository) Repository
+
+type DecoratorOptions struct {
+	CacheTTL         time.Duration
+	RetryAttempts    int
+	RetryBackoff     time.Duration
+	RetryIsTransient func(error) bool
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	StatementTimeout time.Duration
+	DeadlineReserve  time.Duration
+}
+
+// Decorate wraps repo with the named decorators, any of cache, tracing,
+// metrics, retry, breaker and timeout. names are outermost first,
+// so "metrics,cache" measures cache hits too while "cache,metrics" only
+// measures what reaches the backend.
+func Decorate(repo Repository, names []string, opts DecoratorOptions) (Repository, error) {
+	for i := len(names) - 1; i >= 0; i-- {
+		var d Decorator
+		switch name := strings.TrimSpace(names[i]); name {
+		case "":
+			continue
+		case "cache":
+			d = WithCache(opts.CacheTTL)
+		case "tracing":
+			d = WithTracing()
+		case "metrics":
+			d = WithMetrics()
+		case "retry":
+			d = WithRetry(opts.RetryAttempts, opts.RetryBackoff, opts.RetryIsTransient)
+		case "breaker":
+			d = WithBreaker(breaker.Options{Threshold: opts.BreakerThreshold, Cooldown: opts.BreakerCooldown})
+		case "timeout":
+			d = WithTimeout(opts.StatementTimeout, opts.DeadlineReserve)
+		default:
+			return nil, fmt.Errorf("unknown repository decorator: %s", name)
+		}
+		repo = d(repo)
+	}
+	return repo, nil
+}
+
+// cachingRepository is a read-through TTL cache in front of Get and GetMany.
+// List always goes to the backend so new records show up.
+type cachingRepository struct {
+	next Repository
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+func WithCache(ttl time.Duration) Decorator {
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return func(next Repository) Repository {
+		return &cachingRepository{next: next, ttl: ttl, entries: map[string]cacheEntry{}}
+	}
+}
+
+func (c *cachingRepository) lookup(id string, now time.Time) (*User, bool) {
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	return e.user, true
+}
+
+func (c *cachingRepository) Get(ctx context.Context, id string) (*User, error) {
+	c.mu.Lock()
+	u, ok := c.lookup(id, time.Now())
+	c.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+	u, err := c.next.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[id] = cacheEntry{user: u, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return u, nil
+}
+
+func (c *cachingRepository) GetMany(ctx context.Context, ids []string) (map[string]*User, error) {
+	found := make(map[string]*User, len(ids))
+	var missing []string
+	now := time.Now()
+	c.mu.Lock()
+	for _, id := range ids {
+		if u, ok := c.lookup(id, now); ok {
+			found[id] = u
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return found, nil
+	}
+	fetched, err := c.next.GetMany(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(c.ttl)
+	c.mu.Lock()
+	for id, u := range fetched {
+		c.entries[id] = cacheEntry{user: u, expires: expires}
+		found[id] = u
+	}
+	c.mu.Unlock()
+	return found, nil
+}
+
+func (c *cachingRepository) List(ctx context.Context) ([]*User, error) {
+	return c.next.List(ctx)
+}
+
+func (c *cachingRepository) Find(ctx context.Context, q query.Query) ([]*User, error) {
+	return c.next.Find(ctx, q)
+}
+
+func (c *cachingRepository) Each(ctx context.Context, fn func(*User) error) error {
+	return c.next.Each(ctx, fn)
+}
+
+// GetByEmail isn't cached, it's used for logins which want the current
+// credentials
+func (c *cachingRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return c.next.GetByEmail(ctx, email)
+}
+
+// writes drop the cached copies rather than caching what was sent, a
+// failed item must not show up as if it had been written
+func (c *cachingRepository) CreateMany(ctx context.Context, users []*User) error {
+	defer c.forget(users)
+	return c.next.CreateMany(ctx, users)
+}
+
+func (c *cachingRepository) UpdateMany(ctx context.Context, users []*User) error {
+	defer c.forget(users)
+	return c.next.UpdateMany(ctx, users)
+}
+
+// PurgeDeleted drops the whole cache, it doesn't know which users went
+func (c *cachingRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	n, err := c.next.PurgeDeleted(ctx, before)
+	if n > 0 {
+		c.mu.Lock()
+		c.entries = map[string]cacheEntry{}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *cachingRepository) forget(users []*User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		delete(c.entries, u.Id)
+	}
+}
+
+// tracingRepository starts a span per call. Spans go to whatever tracer
+// provider is registered with otel, a no-op until one is set up.
+type tracingRepository struct {
+	next   Repository
+	tracer trace.Tracer
+}
+
+func WithTracing() Decorator {
+	return func(next Repository) Repository {
+		return &tracingRepository{next: next, tracer: otel.Tracer("go-chi-microservice/users")}
+	}
+}
+
+func (t *tracingRepository) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, "UserRepository."+op, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if errors.Is(err, context.Canceled) {
+		span.SetAttributes(attribute.Bool("canceled", true))
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *tracingRepository) Get(ctx context.Context, id string) (u *User, err error) {
+	ctx, span := t.start(ctx, "Get", attribute.String("user.id", id))
+	defer func() { endSpan(span, err) }()
+	return t.next.Get(ctx, id)
+}
+
+func (t *tracingRepository) GetMany(ctx context.Context, ids []string) (m map[string]*User, err error) {
+	ctx, span := t.start(ctx, "GetMany", attribute.Int("user.count", len(ids)))
+	defer func() { endSpan(span, err) }()
+	return t.next.GetMany(ctx, ids)
+}
+
+func (t *tracingRepository) List(ctx context.Context) (l []*User, err error) {
+	ctx, span := t.start(ctx, "List")
+	defer func() { endSpan(span, err) }()
+	return t.next.List(ctx)
+}
+
+func (t *tracingRepository) Find(ctx context.Context, q query.Query) (l []*User, err error) {
+	ctx, span := t.start(ctx, "Find", attribute.Int("query.conditions", len(q.Filter)))
+	defer func() { endSpan(span, err) }()
+	return t.next.Find(ctx, q)
+}
+
+func (t *tracingRepository) Each(ctx context.Context, fn func(*User) error) (err error) {
+	ctx, span := t.start(ctx, "Each")
+	defer func() { endSpan(span, err) }()
+	return t.next.Each(ctx, fn)
+}
+
+// the email stays out of the span, it's personal data
+func (t *tracingRepository) GetByEmail(ctx context.Context, email string) (u *User, err error) {
+	ctx, span := t.start(ctx, "GetByEmail")
+	defer func() { endSpan(span, err) }()
+	return t.next.GetByEmail(ctx, email)
+}
+
+func (t *tracingRepository) CreateMany(ctx context.Context, users []*User) (err error) {
+	ctx, span := t.start(ctx, "CreateMany", attribute.Int("user.count", len(users)))
+	defer func() { endSpan(span, err) }()
+	return t.next.CreateMany(ctx, users)
+}
+
+func (t *tracingRepository) UpdateMany(ctx context.Context, users []*User) (err error) {
+	ctx, span := t.start(ctx, "UpdateMany", attribute.Int("user.count", len(users)))
+	defer func() { endSpan(span, err) }()
+	return t.next.UpdateMany(ctx, users)
+}
+
+func (t *tracingRepository) PurgeDeleted(ctx context.Context, before time.Time) (n int, err error) {
+	ctx, span := t.start(ctx, "PurgeDeleted")
+	defer func() { endSpan(span, err) }()
+	return t.next.PurgeDeleted(ctx, before)
+}
+
+var repoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "user_repository_duration_seconds",
+	Help:    "Duration of user repository calls.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"op", "outcome"})
+
+// metricsRepository records call durations by operation and outcome
+type metricsRepository struct {
+	next Repository
+}
+
+func WithMetrics() Decorator {
+	return func(next Repository) Repository {
+		return &metricsRepository{next: next}
+	}
+}
+
+func observe(op string, start time.Time, err error) {
+	outcome := "ok"
+	switch {
+	case errors.Is(err, ErrNotFound):
+		outcome = "not_found"
+	case errors.As(err, new(*BatchError)):
+		outcome = "partial"
+	case errors.Is(err, context.Canceled):
+		// the caller gave up, most likely the http client went away
+		outcome = "client_closed"
+	case err != nil:
+		outcome = "error"
+	}
+	repoDuration.WithLabelValues(op, outcome).Observe(time.Since(start).Seconds())
+}
+
+func (m *metricsRepository) Get(ctx context.Context, id string) (u *User, err error) {
+	defer func(start time.Time) { observe("get", start, err) }(time.Now())
+	return m.next.Get(ctx, id)
+}
+
+func (m *metricsRepository) GetMany(ctx context.Context, ids []string) (found map[string]*User, err error) {
+	defer func(start time.Time) { observe("get_many", start, err) }(time.Now())
+	return m.next.GetMany(ctx, ids)
+}
+
+func (m *metricsRepository) List(ctx context.Context) (l []*User, err error) {
+	defer func(start time.Time) { observe("list", start, err) }(time.Now())
+	return m.next.List(ctx)
+}
+
+func (m *metricsRepository) Find(ctx context.Context, q query.Query) (l []*User, err error) {
+	defer func(start time.Time) { observe("find", start, err) }(time.Now())
+	return m.next.Find(ctx, q)
+}
+
+// Each's duration includes the time fn takes, for an export that's how
+// fast the client reads
+func (m *metricsRepository) Each(ctx context.Context, fn func(*User) error) (err error) {
+	defer func(start time.Time) { observe("each", start, err) }(time.Now())
+	return m.next.Each(ctx, fn)
+}
+
+func (m *metricsRepository) GetByEmail(ctx context.Context, email string) (u *User, err error) {
+	defer func(start time.Time) { observe("get_by_email", start, err) }(time.Now())
+	return m.next.GetByEmail(ctx, email)
+}
+
+func (m *metricsRepository) CreateMany(ctx context.Context, users []*User) (err error) {
+	defer func(start time.Time) { observe("create_many", start, err) }(time.Now())
+	return m.next.CreateMany(ctx, users)
+}
+
+func (m *metricsRepository) UpdateMany(ctx context.Context, users []*User) (err error) {
+	defer func(start time.Time) { observe("update_many", start, err) }(time.Now())
+	return m.next.UpdateMany(ctx, users)
+}
+
+func (m *metricsRepository) PurgeDeleted(ctx context.Context, before time.Time) (n int, err error) {
+	defer func(start time.Time) { observe("purge_deleted", start, err) }(time.Now())
+	return m.next.PurgeDeleted(ctx, before)
+}
+
+// retryRepository retries calls that fail with a transient error. Reads are
+// safe to repeat, which is all the interface has for now.
+type retryRepository struct {
+	next        Repository
+	attempts    int
+	backoff     time.Duration
+	isTransient func(error) bool
+}
+
+var (
+	repoRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_repository_retries_total",
+		Help: "User repository call attempts after the first.",
+	}, []string{"op"})
+	repoRetried = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_repository_retried_operations_total",
+		Help: "User repository calls that needed a retry, by how they ended.",
+	}, []string{"op", "outcome"})
+)
+
+// WithRetry retries up to attempts times in total with jittered exponential
+// backoff. isTransient decides which errors are worth retrying, IsTransient
+// by default.
+func WithRetry(attempts int, backoff time.Duration, isTransient func(error) bool) Decorator {
+	if attempts <= 0 {
+		attempts = 3
+	}
+	if backoff <= 0 {
+		backoff = 50 * time.Millisecond
+	}
+	if isTransient == nil {
+		isTransient = IsTransient
+	}
+	return func(next Repository) Repository {
+		return &retryRepository{next: next, attempts: attempts, backoff: backoff, isTransient: isTransient}
+	}
+}
+
+func (r *retryRepository) do(ctx context.Context, op string, fn func() error) (err error) {
+	attempt := 0
+	defer func() {
+		if attempt == 0 {
+			return
+		}
+		outcome := "succeeded"
+		if err != nil {
+			outcome = "failed"
+		}
+		repoRetried.WithLabelValues(op, outcome).Inc()
+	}()
+	for ; attempt < r.attempts; attempt++ {
+		if attempt > 0 {
+			d := r.backoff << (attempt - 1)
+			d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return err
+			}
+			repoRetries.WithLabelValues(op).Inc()
+		}
+		if err = fn(); err == nil || !r.isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *retryRepository) Get(ctx context.Context, id string) (u *User, err error) {
+	err = r.do(ctx, "get", func() error {
+		u, err = r.next.Get(ctx, id)
+		return err
+	})
+	return u, err
+}
+
+func (r *retryRepository) GetMany(ctx context.Context, ids []string) (found map[string]*User, err error) {
+	err = r.do(ctx, "get_many", func() error {
+		found, err = r.next.GetMany(ctx, ids)
+		return err
+	})
+	return found, err
+}
+
+func (r *retryRepository) List(ctx context.Context) (l []*User, err error) {
+	err = r.do(ctx, "list", func() error {
+		l, err = r.next.List(ctx)
+		return err
+	})
+	return l, err
+}
+
+func (r *retryRepository) Find(ctx context.Context, q query.Query) (l []*User, err error) {
+	err = r.do(ctx, "find", func() error {
+		l, err = r.next.Find(ctx, q)
+		return err
+	})
+	return l, err
+}
+
+// Each is only retried until the first user reaches fn, after that a retry
+// would hand the caller the same users twice
+func (r *retryRepository) Each(ctx context.Context, fn func(*User) error) error {
+	started := false
+	var err error
+	r.do(ctx, "each", func() error {
+		err = r.next.Each(ctx, func(u *User) error {
+			started = true
+			return fn(u)
+		})
+		if started {
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+func (r *retryRepository) GetByEmail(ctx context.Context, email string) (u *User, err error) {
+	err = r.do(ctx, "get_by_email", func() error {
+		u, err = r.next.GetByEmail(ctx, email)
+		return err
+	})
+	return u, err
+}
+
+// writes aren't retried, a failure after the backend applied part of the
+// batch would turn into spurious ErrExists on the second go
+func (r *retryRepository) CreateMany(ctx context.Context, users []*User) error {
+	return r.next.CreateMany(ctx, users)
+}
+
+func (r *retryRepository) UpdateMany(ctx context.Context, users []*User) error {
+	return r.next.UpdateMany(ctx, users)
+}
+
+// PurgeDeleted is safe to repeat, a second go finds nothing left to purge
+func (r *retryRepository) PurgeDeleted(ctx context.Context, before time.Time) (n int, err error) {
+	err = r.do(ctx, "purge_deleted", func() error {
+		n, err = r.next.PurgeDeleted(ctx, before)
+		return err
+	})
+	return n, err
+}
+
+var breakerState = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "user_repository_breaker_state",
+	Help: "User repository circuit breaker state, 0 closed, 1 open, 2 half open.",
+})
+
+// breakerRepository fails fast with breaker.ErrOpen while the backend keeps
+// erroring, rather than piling more load on it
+type breakerRepository struct {
+	next Repository
+	b    *breaker.Breaker
+}
+
+func WithBreaker(opts breaker.Options) Decorator {
+	opts.OnStateChange = func(from, to breaker.State) {
+		breakerState.Set(float64(to))
+	}
+	return func(next Repository) Repository {
+		return &breakerRepository{next: next, b: breaker.New(opts)}
+	}
+}
+
+func (r *breakerRepository) do(fn func() error) error {
+	if err := r.b.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	// not found, rejected batch items and a caller giving up say nothing
+	// about backend health
+	r.b.Done(err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, context.Canceled) &&
+		!errors.As(err, new(*BatchError)))
+	return err
+}
+
+func (r *breakerRepository) Get(ctx context.Context, id string) (u *User, err error) {
+	err = r.do(func() error {
+		u, err = r.next.Get(ctx, id)
+		return err
+	})
+	return u, err
+}
+
+func (r *breakerRepository) GetMany(ctx context.Context, ids []string) (found map[string]*User, err error) {
+	err = r.do(func() error {
+		found, err = r.next.GetMany(ctx, ids)
+		return err
+	})
+	return found, err
+}
+
+func (r *breakerRepository) List(ctx context.Context) (l []*User, err error) {
+	err = r.do(func() error {
+		l, err = r.next.List(ctx)
+		return err
+	})
+	return l, err
+}
+
+func (r *breakerRepository) Find(ctx context.Context, q query.Query) (l []*User, err error) {
+	err = r.do(func() error {
+		l, err = r.next.Find(ctx, q)
+		return err
+	})
+	return l, err
+}
+
+// an error from fn is the caller's, the backend was fine
+func (r *breakerRepository) Each(ctx context.Context, fn func(*User) error) error {
+	var fnErr error
+	err := r.do(func() error {
+		err := r.next.Each(ctx, func(u *User) error {
+			fnErr = fn(u)
+			return fnErr
+		})
+		if fnErr != nil && errors.Is(err, fnErr) {
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		err = fnErr
+	}
+	return err
+}
+
+func (r *breakerRepository) GetByEmail(ctx context.Context, email string) (u *User, err error) {
+	err = r.do(func() error {
+		u, err = r.next.GetByEmail(ctx, email)
+		return err
+	})
+	return u, err
+}
+
+func (r *breakerRepository) CreateMany(ctx context.Context, users []*User) error {
+	return r.do(func() error { return r.next.CreateMany(ctx, users) })
+}
+
+func (r *breakerRepository) UpdateMany(ctx context.Context, users []*User) error {
+	return r.do(func() error { return r.next.UpdateMany(ctx, users) })
+}
+
+func (r *breakerRepository) PurgeDeleted(ctx context.Context, before time.Time) (n int, err error) {
+	err = r.do(func() error {
+		n, err = r.next.PurgeDeleted(ctx, before)
+		return err
+	})
+	return n, err
+}
+
+// timeoutRepository bounds each call, so a slow query gives up on its own
+// rather than running on after the request it serves has timed out
+type timeoutRepository struct {
+	next    Repository
+	max     time.Duration
+	reserve time.Duration
+}
+
+// WithTimeout gives each call at most max, and never longer than the
+// caller's deadline less reserve, which leaves the handler time to write an
+// error before the request deadline passes. Put it inside retry so every
+// attempt gets its own budget.
+func WithTimeout(max, reserve time.Duration) Decorator {
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	return func(next Repository) Repository {
+		return &timeoutRepository{next: next, max: max, reserve: reserve}
+	}
+}
+
+func (t *timeoutRepository) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(t.max)
+	if d, ok := ctx.Deadline(); ok && d.Add(-t.reserve).Before(deadline) {
+		deadline = d.Add(-t.reserve)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+func (t *timeoutRepository) Get(ctx context.Context, id string) (*User, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.Get(ctx, id)
+}
+
+func (t *timeoutRepository) GetMany(ctx context.Context, ids []string) (map[string]*User, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.GetMany(ctx, ids)
+}
+
+func (t *timeoutRepository) List(ctx context.Context) ([]*User, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.List(ctx)
+}
+
+func (t *timeoutRepository) Find(ctx context.Context, q query.Query) ([]*User, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.Find(ctx, q)
+}
+
+// Each takes as long as the caller keeps reading, so only the caller's
+// deadline applies, a whole export can't fit in one call's budget
+func (t *timeoutRepository) Each(ctx context.Context, fn func(*User) error) error {
+	return t.next.Each(ctx, fn)
+}
+
+func (t *timeoutRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.GetByEmail(ctx, email)
+}
+
+func (t *timeoutRepository) CreateMany(ctx context.Context, users []*User) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.CreateMany(ctx, users)
+}
+
+func (t *timeoutRepository) UpdateMany(ctx context.Context, users []*User) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.UpdateMany(ctx, users)
+}
+
+func (t *timeoutRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+	return t.next.PurgeDeleted(ctx, before)
+}
+
+// tenantRepository scopes every call to the tenant its context acts for,
+// see package tenant, so a request can't read or write another tenant's
+// users whatever the layers above it do. Users another tenant has are
+// reported missing. A context without a tenant is the operator's and
+// passes straight through. Wrap it outermost, outside the cache.
+type tenantRepository struct {
+	next Repository
+}
+
+func WithTenants() Decorator {
+	return func(next Repository) Repository {
+		return &tenantRepository{next: next}
+	}
+}
+
+// scoped adds a condition on the tenant to q's filter
+func scoped(id string, q query.Query) query.Query {
+	q.Filter = append([]query.Condition{{Field: "tenant_id", Op: "=", Value: id}}, q.Filter...)
+	return q
+}
+
+func (t *tenantRepository) Get(ctx context.Context, id string) (*User, error) {
+	u, err := t.next.Get(ctx, id)
+	if err == nil && !inTenant(ctx, u) {
+		return nil, ErrNotFound
+	}
+	return u, err
+}
+
+func inTenant(ctx context.Context, u *User) bool {
+	id := tenant.ID(ctx)
+	return id == "" || u.TenantID == id
+}
+
+func (t *tenantRepository) GetMany(ctx context.Context, ids []string) (map[string]*User, error) {
+	found, err := t.next.GetMany(ctx, ids)
+	for id, u := range found {
+		if !inTenant(ctx, u) {
+			delete(found, id)
+		}
+	}
+	return found, err
+}
+
+// List is Find with only the tenant condition, which sorts by id as List
+// does
+func (t *tenantRepository) List(ctx context.Context) ([]*User, error) {
+	id := tenant.ID(ctx)
+	if id == "" {
+		return t.next.List(ctx)
+	}
+	return t.next.Find(ctx, scoped(id, query.Query{}))
+}
+
+func (t *tenantRepository) Find(ctx context.Context, q query.Query) ([]*User, error) {
+	id := tenant.ID(ctx)
+	if id == "" {
+		return t.next.Find(ctx, q)
+	}
+	return t.next.Find(ctx, scoped(id, q))
+}
+
+func (t *tenantRepository) Each(ctx context.Context, fn func(*User) error) error {
+	return t.next.Each(ctx, func(u *User) error {
+		if !inTenant(ctx, u) {
+			return nil
+		}
+		return fn(u)
+	})
+}
+
+// GetByEmail looks among the tenant's users only, emails are unique within
+// a tenant and the same one can be in use in several
+func (t *tenantRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	id := tenant.ID(ctx)
+	if id == "" {
+		return t.next.GetByEmail(ctx, email)
+	}
+	list, err := t.next.Find(ctx, scoped(id, query.Query{}))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		if u.DeletedAt == nil && strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CreateMany puts new users in the tenant, whatever they say
+func (t *tenantRepository) CreateMany(ctx context.Context, users []*User) error {
+	if id := tenant.ID(ctx); id != "" {
+		for _, u := range users {
+			u.TenantID = id
+		}
+	}
+	return t.next.CreateMany(ctx, users)
+}
+
+// UpdateMany fails users stored in another tenant with ErrNotFound, and
+// keeps the others in the tenant
+func (t *tenantRepository) UpdateMany(ctx context.Context, users []*User) error {
+	id := tenant.ID(ctx)
+	if id == "" {
+		return t.next.UpdateMany(ctx, users)
+	}
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.Id
+	}
+	stored, err := t.next.GetMany(ctx, ids)
+	if err != nil {
+		return err
+	}
+	var failures []ItemError
+	var kept []*User
+	var index []int // position in users of each kept user
+	for i, u := range users {
+		if s, ok := stored[u.Id]; ok && s.TenantID != id {
+			failures = append(failures, ItemError{Index: i, Id: u.Id, Err: ErrNotFound})
+			continue
+		}
+		u.TenantID = id
+		kept = append(kept, u)
+		index = append(index, i)
+	}
+	if len(kept) > 0 {
+		err := t.next.UpdateMany(ctx, kept)
+		var be *BatchError
+		switch {
+		case errors.As(err, &be):
+			for _, f := range be.Failures {
+				f.Index = index[f.Index]
+				failures = append(failures, f)
+			}
+			sort.Slice(failures, func(i, j int) bool { return failures[i].Index < failures[j].Index })
+		case err != nil:
+			return err
+		}
+	}
+	return batchErr(failures)
+}
+
+// PurgeDeleted is an operator's job, a tenant can't purge
+func (t *tenantRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	if tenant.ID(ctx) != "" {
+		return 0, errors.New("purging deleted users needs the operator, not a tenant")
+	}
+	return t.next.PurgeDeleted(ctx, before)
+}
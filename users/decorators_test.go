@@ -0,0 +1,98 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// hungRepository is a backend whose Get hangs until its context is done,
+// noting the deadline it was given and when it gave up
+type hungRepository struct {
+	*MemoryRepository
+	deadline time.Time
+	stopped  time.Time
+}
+
+func (h *hungRepository) Get(ctx context.Context, id string) (*User, error) {
+	h.deadline, _ = ctx.Deadline()
+	<-ctx.Done()
+	h.stopped = time.Now()
+	return nil, ctx.Err()
+}
+
+func TestWithTimeoutDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		request time.Duration // the caller's deadline, 0 for none
+		max     time.Duration
+		reserve time.Duration
+		want    time.Duration
+	}{
+		{name: "no request deadline", max: 30 * time.Millisecond, want: 30 * time.Millisecond},
+		{name: "request deadline further off", request: time.Second, max: 30 * time.Millisecond, reserve: 10 * time.Millisecond, want: 30 * time.Millisecond},
+		{name: "request deadline sooner", request: 50 * time.Millisecond, max: time.Second, reserve: 20 * time.Millisecond, want: 30 * time.Millisecond},
+		{name: "request deadline without a reserve", request: 40 * time.Millisecond, max: time.Second, want: 40 * time.Millisecond},
+		{name: "reserve already spent", request: 10 * time.Millisecond, max: time.Second, reserve: 20 * time.Millisecond, want: -10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.request > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.request)
+				defer cancel()
+			}
+			hung := &hungRepository{MemoryRepository: NewMemoryRepository()}
+			repo := WithTimeout(tt.max, tt.reserve)(hung)
+			start := time.Now()
+			_, err := repo.Get(ctx, "a1")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("err = %v, want the deadline exceeded", err)
+			}
+			if got := hung.deadline.Sub(start); got < tt.want-5*time.Millisecond || got > tt.want+5*time.Millisecond {
+				t.Fatalf("the call's deadline is %v away, want %v", got, tt.want)
+			}
+			if hung.stopped.IsZero() {
+				t.Fatal("the call returned before the backend stopped")
+			}
+		})
+	}
+}
+
+// TestWithTimeoutLeavesTimeToAnswer checks a hung call gives up before the
+// request's deadline, while there's still time to answer it with a 504,
+// rather than running on after it
+func TestWithTimeoutLeavesTimeToAnswer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Millisecond)
+	defer cancel()
+	hung := &hungRepository{MemoryRepository: NewMemoryRepository()}
+	repo := WithTimeout(5*time.Second, 20*time.Millisecond)(hung)
+	_, err := repo.Get(ctx, "a1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the deadline exceeded", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the call ran on to the request's deadline")
+	}
+	requestDeadline, _ := ctx.Deadline()
+	if left := requestDeadline.Sub(hung.stopped); left < 10*time.Millisecond {
+		t.Fatalf("the backend stopped %v before the request deadline, want the reserve kept", left)
+	}
+}
+
+func TestWithTimeoutStopsWhenTheCallerGoes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hung := &hungRepository{MemoryRepository: NewMemoryRepository()}
+	repo := WithTimeout(5*time.Second, 0)(hung)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := repo.Get(ctx, "a1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want canceled", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("the call took %v after its caller went", took)
+	}
+}
@@ -0,0 +1,201 @@
+package users
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-chi-microservice/query"
+)
+
+// MemoryRepository is a map backed Repository, handy for demos and tests
+type MemoryRepository struct {
+	mu     sync.RWMutex
+	users  map[string]*User
+	writes uint64 // see Writes
+}
+
+func NewMemoryRepository(seed ...*User) *MemoryRepository {
+	m := &MemoryRepository{users: make(map[string]*User, len(seed))}
+	m.Put(seed...)
+	return m
+}
+
+// Put adds or replaces users as they are, those without a version start at
+// 1 and those without CreatedAt or UpdatedAt are created or updated now
+func (m *MemoryRepository) Put(users ...*User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+	now := time.Now()
+	for _, u := range users {
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = now
+		}
+		if u.UpdatedAt.IsZero() {
+			u.UpdatedAt = now
+		}
+		m.users[u.Id] = u
+	}
+}
+
+// SeedUsers mock user records, bill can log in with password "deadbug"
+func SeedUsers() []*User {
+	return []*User{
+		{Id: "fece", Email: "bill@deadbug.com", PasswordHash: "$2a$10$6fCghE1hh2w2P5nL88SRVeCNVv8uVVaEowolQcBqDOquh/KByXA3i"},
+		{Id: "d00f", Email: "hhill@stricklandpropance.com", ManagerId: "fece"},
+	}
+}
+
+func (m *MemoryRepository) Get(ctx context.Context, id string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if u, ok := m.users[id]; ok {
+		return u, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryRepository) GetMany(ctx context.Context, ids []string) (map[string]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := make(map[string]*User, len(ids))
+	for _, id := range ids {
+		if u, ok := m.users[id]; ok {
+			found[id] = u
+		}
+	}
+	return found, nil
+}
+
+func (m *MemoryRepository) List(ctx context.Context) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]*User, 0, len(m.users))
+	for _, u := range m.users {
+		list = append(list, u)
+	}
+	// map order is random, keep listings stable
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list, nil
+}
+
+// Find filters and sorts a snapshot, as a database would with a WHERE and
+// ORDER BY built from q
+func (m *MemoryRepository) Find(ctx context.Context, q query.Query) ([]*User, error) {
+	all, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*User, 0, len(all))
+	for _, u := range all {
+		if Match(u, q) {
+			list = append(list, u)
+		}
+	}
+	SortUsers(list, q)
+	return list, nil
+}
+
+// Each walks a snapshot of the users, so fn runs without the lock and slow
+// callers don't hold up writes
+func (m *MemoryRepository) Each(ctx context.Context, fn func(*User) error) error {
+	list, err := m.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range list {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.users {
+		if u.DeletedAt == nil && strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CreateMany and UpdateMany take the lock once for the whole batch
+func (m *MemoryRepository) CreateMany(ctx context.Context, users []*User) error {
+	return m.writeMany(ctx, users, true)
+}
+
+func (m *MemoryRepository) UpdateMany(ctx context.Context, users []*User) error {
+	return m.writeMany(ctx, users, false)
+}
+
+func (m *MemoryRepository) writeMany(ctx context.Context, users []*User, create bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes++
+	var failures []ItemError
+	now := time.Now()
+	for i, u := range users {
+		stored, exists := m.users[u.Id]
+		switch {
+		case create && exists:
+			failures = append(failures, ItemError{Index: i, Id: u.Id, Err: ErrExists})
+		case !create && !exists:
+			failures = append(failures, ItemError{Index: i, Id: u.Id, Err: ErrNotFound})
+		case !create && stored.Version != u.Version:
+			failures = append(failures, ItemError{Index: i, Id: u.Id, Err: ErrVersionMismatch})
+		case create:
+			u.Version, u.CreatedAt, u.UpdatedAt = 1, now, now
+			m.users[u.Id] = u
+		default:
+			u.Version, u.UpdatedAt = u.Version+1, now
+			m.users[u.Id] = u
+		}
+	}
+	return batchErr(failures)
+}
+
+func (m *MemoryRepository) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, u := range m.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+			delete(m.users, id)
+			n++
+		}
+	}
+	if n > 0 {
+		m.writes++
+	}
+	return n, nil
+}
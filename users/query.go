@@ -0,0 +1,79 @@
+package users
+
+import (
+	"sort"
+
+	"go-chi-microservice/query"
+)
+
+// Fields are the fields users can be filtered and sorted on with Find. Only
+// these reach a backend, so a query can't touch columns like the password
+// hash.
+var Fields = map[string]query.Kind{
+	"id":             query.String,
+	"tenant_id":      query.String,
+	"email":          query.String,
+	"phone":          query.String,
+	"manager_id":     query.String,
+	"disabled":       query.Bool,
+	"suspended":      query.Bool,
+	"email_verified": query.Bool,
+	"guest":          query.Bool,
+	"created_at":     query.Time,
+	"updated_at":     query.Time,
+}
+
+// field is u's value of one of Fields
+func field(u *User, name string) any {
+	switch name {
+	case "id":
+		return u.Id
+	case "tenant_id":
+		return u.TenantID
+	case "email":
+		return u.Email
+	case "phone":
+		return u.Phone
+	case "manager_id":
+		return u.ManagerId
+	case "disabled":
+		return u.Disabled
+	case "suspended":
+		return u.Suspended
+	case "email_verified":
+		return u.EmailVerified
+	case "guest":
+		return u.Guest
+	case "created_at":
+		return u.CreatedAt
+	case "updated_at":
+		return u.UpdatedAt
+	}
+	return nil
+}
+
+// Match is true when u meets every condition of q's filter
+func Match(u *User, q query.Query) bool {
+	for _, c := range q.Filter {
+		if !c.Matches(field(u, c.Field)) {
+			return false
+		}
+	}
+	return true
+}
+
+// SortUsers orders list by q's sort, then by id so pages stay stable
+func SortUsers(list []*User, q query.Query) {
+	sort.SliceStable(list, func(i, j int) bool {
+		for _, o := range q.Sort {
+			cmp := query.Compare(field(list[i], o.Field), field(list[j], o.Field))
+			if o.Desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return list[i].Id < list[j].Id
+	})
+}
@@ -0,0 +1,46 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go-chi-microservice/query"
+)
+
+var ErrNotFound = errors.New("user not found")
+
+// ErrVersionMismatch fails an update of a user that was written since it
+// was read, so concurrent writers don't overwrite each other's changes
+var ErrVersionMismatch = errors.New("user was changed since it was read")
+
+// Repository is the storage interface for users. Backends implement this
+// and the service layer is the only caller.
+type Repository interface {
+	Get(ctx context.Context, id string) (*User, error)
+	// GetMany returns the users found for ids, keyed by id. Missing ids are
+	// simply absent from the result rather than an error.
+	GetMany(ctx context.Context, ids []string) (map[string]*User, error)
+	List(ctx context.Context) ([]*User, error)
+	// Find returns the users matching q's filter in q's order, then id
+	// order. q only names fields in Fields.
+	Find(ctx context.Context, q query.Query) ([]*User, error)
+	// Each calls fn with every user in id order, stopping at the first
+	// error fn returns, which Each returns. It streams, so a backend never
+	// holds the whole collection in memory.
+	Each(ctx context.Context, fn func(*User) error) error
+	// GetByEmail finds a user by email, ignoring case and soft deleted
+	// users, whose emails may have been taken since
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	// CreateMany inserts users, failing those whose id exists with
+	// ErrExists. UpdateMany replaces existing users, failing missing ones
+	// with ErrNotFound and those whose Version isn't the stored one with
+	// ErrVersionMismatch. Both write what they can in one go and report the
+	// rest in a *BatchError, indexed by position in users, and set the
+	// Version of the users written to the new one.
+	CreateMany(ctx context.Context, users []*User) error
+	UpdateMany(ctx context.Context, users []*User) error
+	// PurgeDeleted removes the users soft deleted before t for good, in one
+	// go so a user restored meanwhile is kept, and returns how many
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+}
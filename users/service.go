@@ -0,0 +1,442 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go-chi-microservice/ctxkeys"
+	"go-chi-microservice/dataloader"
+	"go-chi-microservice/metrics"
+	"go-chi-microservice/query"
+)
+
+// Service holds the user business logic on top of a Repository
+type Service struct {
+	repo       Repository
+	loaderOpts dataloader.Options
+	batchSize  int
+	validator  *Validator
+	onCreate   []func(ctx context.Context, u *User)
+	onUpdate   []func(ctx context.Context, u *User)
+	onChange   []func(ctx context.Context, before, after *User)
+}
+
+type ServiceOptions struct {
+	Loader     dataloader.Options
+	BatchSize  int // most users per repository write, 500 by default
+	Validation ValidationOptions
+}
+
+func NewService(repo Repository, opts ServiceOptions) *Service {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	return &Service{repo: repo, loaderOpts: opts.Loader, batchSize: opts.BatchSize, validator: NewValidator(opts.Validation)}
+}
+
+// OnCreate calls fn with each user added by Create or Provision, after it's
+// stored. Batch imports don't call it. Hooks are added while wiring up,
+// before the service is used.
+func (s *Service) OnCreate(fn func(ctx context.Context, u *User)) {
+	s.onCreate = append(s.onCreate, fn)
+}
+
+func (s *Service) created(ctx context.Context, u *User) {
+	for _, fn := range s.onCreate {
+		fn(ctx, u)
+	}
+}
+
+// OnUpdate calls fn with each user replaced by Update, after it's stored.
+// Like OnCreate, bulk updates don't call it.
+func (s *Service) OnUpdate(fn func(ctx context.Context, u *User)) {
+	s.onUpdate = append(s.onUpdate, fn)
+}
+
+// OnChange calls fn with the stored user before and after each single user
+// write, before nil for a new one, for an audit trail. Bulk writes don't
+// call it.
+func (s *Service) OnChange(fn func(ctx context.Context, before, after *User)) {
+	s.onChange = append(s.onChange, fn)
+}
+
+func (s *Service) changed(ctx context.Context, before, after *User) {
+	for _, fn := range s.onChange {
+		fn(ctx, before, after)
+	}
+}
+
+// WithLoader returns a context carrying a fresh user loader. Gets made with
+// that context are batched and cached for its lifetime, so it should be
+// request scoped.
+func (s *Service) WithLoader(ctx context.Context) context.Context {
+	l := dataloader.New(s.repo.GetMany, s.loaderOpts)
+	return ctxkeys.With(ctx, ctxkeys.Loader, l)
+}
+
+func loaderFrom(ctx context.Context) *dataloader.Loader[string, *User] {
+	l, _ := ctxkeys.Value[*dataloader.Loader[string, *User]](ctx, ctxkeys.Loader)
+	return l
+}
+
+func (s *Service) Get(ctx context.Context, id string) (*User, error) {
+	var u *User
+	var err error
+	if l := loaderFrom(ctx); l != nil {
+		u, err = l.Load(ctx, id)
+		if errors.Is(err, dataloader.ErrNotFound) {
+			err = ErrNotFound
+		}
+	} else {
+		u, err = s.repo.Get(ctx, id)
+	}
+	if err == nil && u.DeletedAt != nil && !deletedIncluded(ctx) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no user with id: %s: %w", id, err)
+	}
+	return u, nil
+}
+
+// Active reports whether the user with id may still sign in: it's stored,
+// not soft deleted, and neither suspended nor disabled
+func (s *Service) Active(ctx context.Context, id string) (bool, error) {
+	u, err := s.Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return u.DeletedAt == nil && u.CanSignIn(), nil
+}
+
+// IncludeDeleted returns a context in which reads return soft deleted users
+// too, for admins. Without it they're left out, as if they were gone.
+func IncludeDeleted(ctx context.Context) context.Context {
+	return ctxkeys.With(ctx, ctxkeys.IncludeDeleted, true)
+}
+
+func deletedIncluded(ctx context.Context) bool {
+	included, _ := ctxkeys.Value[bool](ctx, ctxkeys.IncludeDeleted)
+	return included
+}
+
+// live drops soft deleted users from list unless ctx includes them
+func live(ctx context.Context, list []*User) []*User {
+	if deletedIncluded(ctx) {
+		return list
+	}
+	kept := list[:0:0]
+	for _, u := range list {
+		if u.DeletedAt == nil {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// remember replaces what the loader in ctx has for u after a write, so
+// later Gets in the same request see it
+func (s *Service) remember(ctx context.Context, u *User) {
+	if l := loaderFrom(ctx); l != nil {
+		l.Clear(u.Id)
+		l.Prime(u.Id, u)
+	}
+}
+
+// GetMany loads a batch of users in a single repository call. Blank and
+// duplicate ids are dropped so callers can pass foreign keys straight through.
+func (s *Service) GetMany(ctx context.Context, ids []string) (map[string]*User, error) {
+	seen := make(map[string]struct{}, len(ids))
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		keys = append(keys, id)
+	}
+	if len(keys) == 0 {
+		return map[string]*User{}, nil
+	}
+	var found map[string]*User
+	var err error
+	if l := loaderFrom(ctx); l != nil {
+		found, err = l.LoadMany(ctx, keys)
+	} else {
+		found, err = s.repo.GetMany(ctx, keys)
+	}
+	if err != nil || deletedIncluded(ctx) {
+		return found, err
+	}
+	for id, u := range found {
+		if u.DeletedAt != nil {
+			delete(found, id)
+		}
+	}
+	return found, nil
+}
+
+// List returns all users. With a loader in ctx the results are primed into
+// it so enriching the list doesn't go back to the repository for them.
+func (s *Service) List(ctx context.Context) ([]*User, error) {
+	list, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list = live(ctx, list)
+	if l := loaderFrom(ctx); l != nil {
+		for _, u := range list {
+			l.Prime(u.Id, u)
+		}
+	}
+	return list, nil
+}
+
+// Find returns the users matching q in its order, primed into a loader in
+// ctx like List
+func (s *Service) Find(ctx context.Context, q query.Query) ([]*User, error) {
+	list, err := s.repo.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	list = live(ctx, list)
+	if l := loaderFrom(ctx); l != nil {
+		for _, u := range list {
+			l.Prime(u.Id, u)
+		}
+	}
+	return list, nil
+}
+
+// Each streams every user to fn in id order, for exports too big to List.
+// Users aren't primed into a loader, that would hold them all in memory.
+func (s *Service) Each(ctx context.Context, fn func(*User) error) error {
+	if deletedIncluded(ctx) {
+		return s.repo.Each(ctx, fn)
+	}
+	return s.repo.Each(ctx, func(u *User) error {
+		if u.DeletedAt != nil {
+			return nil
+		}
+		return fn(u)
+	})
+}
+
+// GetByEmail looks a user up by login email, always from the repository.
+// The email is normalized first, an invalid one is looked up as it is.
+// Guests have no email, so an empty one is never found.
+func (s *Service) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if email == "" {
+		return nil, ErrNotFound
+	}
+	if normalized, err := s.validator.NormalizeEmail(email); err == nil {
+		email = normalized
+	}
+	return s.repo.GetByEmail(ctx, email)
+}
+
+// Create adds u, giving it an id when it has none, and counts it under via
+// like UsersCreated. Its id and email must pass the Validator, ErrInvalid
+// otherwise, and the email must not be in use, ErrExists otherwise.
+func (s *Service) Create(ctx context.Context, u *User, via string) error {
+	if err := s.validator.Check(u); err != nil {
+		return err
+	}
+	if _, err := s.GetByEmail(ctx, u.Email); !errors.Is(err, ErrNotFound) {
+		if err == nil {
+			return fmt.Errorf("email %s: %w", u.Email, ErrExists)
+		}
+		return err
+	}
+	if u.Id == "" {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		u.Id = id
+	}
+	if err := single(s.repo.CreateMany(ctx, []*User{u})); err != nil {
+		return err
+	}
+	metrics.UsersCreated(via, 1)
+	s.remember(ctx, u)
+	s.changed(ctx, nil, u)
+	s.created(ctx, u)
+	return nil
+}
+
+// Update replaces the stored user with u, ErrNotFound when there's none.
+// A changed email must pass the Validator and not be in use by another
+// user, and is unverified. An unchanged one is kept as it was stored, so
+// users from before a stricter rule can still be updated.
+func (s *Service) Update(ctx context.Context, u *User) error {
+	other, err := s.GetByEmail(ctx, u.Email)
+	switch {
+	case err == nil && other.Id != u.Id:
+		return fmt.Errorf("email %s: %w", u.Email, ErrExists)
+	case errors.Is(err, ErrNotFound):
+		if u.Email != "" {
+			if u.Email, err = s.validator.NormalizeEmail(u.Email); err != nil {
+				return err
+			}
+		}
+		u.EmailVerified = false
+	case err != nil:
+		return err
+	}
+	return s.write(ctx, u)
+}
+
+// Delete soft deletes u: it's kept with DeletedAt set, but reads leave it
+// out until it's restored, or purged for good by PurgeDeleted. Its email is
+// free for another user meanwhile. u must carry the stored Version.
+func (s *Service) Delete(ctx context.Context, u *User) error {
+	if u.DeletedAt != nil {
+		return nil
+	}
+	deleted := *u
+	now := time.Now()
+	deleted.DeletedAt = &now
+	if err := s.write(ctx, &deleted); err != nil {
+		return err
+	}
+	*u = deleted
+	return nil
+}
+
+// Restore undoes the soft delete of the user with id, ErrExists when
+// another user took its email in the meantime
+func (s *Service) Restore(ctx context.Context, id string) (*User, error) {
+	u, err := s.Get(IncludeDeleted(ctx), id)
+	if err != nil || u.DeletedAt == nil {
+		return u, err
+	}
+	if u.Email != "" {
+		if _, err := s.repo.GetByEmail(ctx, u.Email); !errors.Is(err, ErrNotFound) {
+			if err == nil {
+				return nil, fmt.Errorf("email %s: %w", u.Email, ErrExists)
+			}
+			return nil, err
+		}
+	}
+	restored := *u
+	restored.DeletedAt = nil
+	if err := s.write(ctx, &restored); err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
+
+// write stores a checked change to a single user and calls the OnUpdate
+// and OnChange hooks
+func (s *Service) write(ctx context.Context, u *User) error {
+	var before *User
+	if len(s.onChange) > 0 {
+		// usually a hit in the request's loader, primed as the handler read u
+		before, _ = s.Get(IncludeDeleted(ctx), u.Id)
+	}
+	if err := single(s.repo.UpdateMany(ctx, []*User{u})); err != nil {
+		return err
+	}
+	metrics.UsersUpdated(1)
+	s.remember(ctx, u)
+	s.changed(ctx, before, u)
+	for _, fn := range s.onUpdate {
+		fn(ctx, u)
+	}
+	return nil
+}
+
+// PurgeDeleted removes the users soft deleted before t for good, and
+// returns how many
+func (s *Service) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	return s.repo.PurgeDeleted(ctx, before)
+}
+
+// CreateGuest adds a guest user, one with no email or password who can
+// become a full user with Upgrade
+func (s *Service) CreateGuest(ctx context.Context) (*User, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	u := &User{Id: id, Guest: true}
+	if err := single(s.repo.CreateMany(ctx, []*User{u})); err != nil {
+		return nil, err
+	}
+	metrics.UsersCreated("guest", 1)
+	s.changed(ctx, nil, u)
+	return u, nil
+}
+
+// Upgrade turns the guest with id into a full user with email and
+// passwordHash. It's the same record under the same id, so whatever the
+// guest made carries over in the one write. ErrNotFound when id isn't a
+// guest, ErrExists when email is in use.
+func (s *Service) Upgrade(ctx context.Context, id, email, passwordHash string) (*User, error) {
+	guest, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !guest.Guest || guest.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	u := *guest
+	u.Guest, u.Email, u.PasswordHash, u.EmailVerified = false, email, passwordHash, false
+	if err := s.Update(ctx, &u); err != nil {
+		return nil, err
+	}
+	metrics.UsersCreated("guest_upgrade", 1)
+	s.created(ctx, &u)
+	return &u, nil
+}
+
+// single unwraps the *BatchError of a one user write
+func single(err error) error {
+	var be *BatchError
+	if errors.As(err, &be) && len(be.Failures) == 1 {
+		return be.Failures[0].Err
+	}
+	return err
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Provision returns the user with email, creating one if there's none. It's
+// for sign ins vouched for by an external identity provider, so new users
+// start with a verified email.
+func (s *Service) Provision(ctx context.Context, email string) (*User, error) {
+	email, err := s.validator.NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.repo.GetByEmail(ctx, email)
+	if !errors.Is(err, ErrNotFound) {
+		return u, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	u = &User{Id: id, Email: email, EmailVerified: true}
+	if err := s.repo.CreateMany(ctx, []*User{u}); err != nil {
+		return nil, err
+	}
+	metrics.UsersCreated("provision", 1)
+	s.changed(ctx, nil, u)
+	s.created(ctx, u)
+	return u, nil
+}
@@ -0,0 +1,151 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the snapshot format this build reads and writes. A
+// change to the format bumps it and adds a SnapshotMigrations entry
+// bringing older snapshots up to it as they load.
+const SnapshotVersion = 1
+
+// SnapshotMigration is a change to the snapshot format
+type SnapshotMigration struct {
+	Version int
+	Name    string
+	upgrade func(*snapshot) error
+}
+
+// SnapshotMigrations is the changelog of the snapshot format, oldest first
+var SnapshotMigrations = []SnapshotMigration{
+	// snapshots from before versioning are this format, they read as 0
+	{Version: 1, Name: "versioned snapshot format"},
+}
+
+// snapshot is the file format of SaveSnapshot
+type snapshot struct {
+	Version int            `json:"version"`
+	Taken   time.Time      `json:"taken"`
+	Users   []snapshotUser `json:"users"`
+}
+
+// snapshotUser brings back the fields User keeps out of JSON responses, a
+// new one of those must be added here too or it's lost on restore
+type snapshotUser struct {
+	*User
+	PasswordHash string    `json:"password_hash,omitempty"`
+	AvatarKey    string    `json:"avatar_key,omitempty"`
+	TOTP         TOTP      `json:"totp"`
+	Passkeys     []Passkey `json:"passkeys,omitempty"`
+}
+
+// SaveSnapshot writes every user to path as JSON, through a temporary file
+// renamed into place so a crash never leaves half a snapshot. The file holds
+// password hashes and TOTP secrets, it's only readable by its owner.
+func (m *MemoryRepository) SaveSnapshot(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := m.WriteSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteSnapshot writes every user to w in SaveSnapshot's format
+func (m *MemoryRepository) WriteSnapshot(w io.Writer) error {
+	m.mu.RLock()
+	s := snapshot{Version: SnapshotVersion, Taken: time.Now(), Users: make([]snapshotUser, 0, len(m.users))}
+	for _, u := range m.users {
+		s.Users = append(s.Users, snapshotUser{User: u, PasswordHash: u.PasswordHash, AvatarKey: u.AvatarKey, TOTP: u.TOTP, Passkeys: u.Passkeys})
+	}
+	// in id order, so snapshots diff well
+	sort.Slice(s.Users, func(i, j int) bool { return s.Users[i].Id < s.Users[j].Id })
+	body, err := json.Marshal(s)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// LoadSnapshot replaces the users with those saved at path. A missing file
+// is fs.ErrNotExist, for the caller to seed instead.
+func (m *MemoryRepository) LoadSnapshot(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	taken, err := m.ReadSnapshot(f)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return taken, nil
+}
+
+// ReadSnapshot replaces the users with those in a snapshot read from r,
+// returning when it was taken. Older formats are migrated as they load, a
+// newer one is refused. Nothing changes unless the whole snapshot is good.
+func (m *MemoryRepository) ReadSnapshot(r io.Reader) (time.Time, error) {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return time.Time{}, err
+	}
+	if s.Version > SnapshotVersion {
+		return time.Time{}, fmt.Errorf("snapshot format %d is newer than this build's, %d", s.Version, SnapshotVersion)
+	}
+	for _, mig := range SnapshotMigrations {
+		if mig.Version <= s.Version {
+			continue
+		}
+		if mig.upgrade != nil {
+			if err := mig.upgrade(&s); err != nil {
+				return time.Time{}, fmt.Errorf("migrating the snapshot to format %d, %s: %w", mig.Version, mig.Name, err)
+			}
+		}
+		s.Version = mig.Version
+	}
+	loaded := make(map[string]*User, len(s.Users))
+	for _, su := range s.Users {
+		if su.User == nil || su.Id == "" {
+			return time.Time{}, errors.New("user without an id")
+		}
+		u := su.User
+		u.PasswordHash, u.AvatarKey, u.TOTP, u.Passkeys = su.PasswordHash, su.AvatarKey, su.TOTP, su.Passkeys
+		loaded[u.Id] = u
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users = loaded
+	return s.Taken, nil
+}
+
+// Writes changes with every write, so a snapshot is only taken when there
+// is something new to save
+func (m *MemoryRepository) Writes() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.writes
+}
@@ -0,0 +1,70 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// transientError marks an error a backend knows is worth retrying
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string   { return e.err.Error() }
+func (e transientError) Unwrap() error   { return e.err }
+func (e transientError) Transient() bool { return true }
+
+// Transient wraps err so IsTransient reports true for it, for backends
+// whose driver errors don't say so by themselves
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientError{err}
+}
+
+// postgres SQLSTATEs worth a retry, the statement never took effect
+var transientSQLStates = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"55P03": true, // lock_not_available
+	"57P01": true, // admin_shutdown, e.g. a failover
+	"08000": true, // connection_exception
+	"08003": true, // connection_does_not_exist
+	"08006": true, // connection_failure
+}
+
+// IsTransient reports whether err is likely to go away on retry: errors
+// marked with Transient or a Transient() bool method, SQL serialization
+// failures and deadlocks, mongo errors labelled retryable, connection resets
+// and network timeouts. Driver errors are matched by their methods so no
+// driver needs importing here.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var marked interface{ Transient() bool }
+	if errors.As(err, &marked) {
+		return marked.Transient()
+	}
+	// pgx's PgError, lib/pq's Error has SQLState too
+	var sqlErr interface{ SQLState() string }
+	if errors.As(err, &sqlErr) {
+		return transientSQLStates[sqlErr.SQLState()]
+	}
+	// mongo driver errors
+	var labelled interface{ HasErrorLabel(string) bool }
+	if errors.As(err, &labelled) &&
+		(labelled.HasErrorLabel("TransientTransactionError") || labelled.HasErrorLabel("RetryableWriteError")) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,60 @@
+package users
+
+import "time"
+
+type User struct {
+	Id            string
+	TenantID      string `json:",omitempty"` // the tenant the user belongs to, see package tenant
+	Email         string
+	Phone         string    `json:",omitempty"` // E.164, e.g. +15005550006, for SMS notifications
+	ManagerId     string    `json:",omitempty"`
+	PasswordHash  string    `json:"-"`          // see auth.HashPassword, empty means no password login
+	Disabled      bool      `json:",omitempty"` // deprovisioned, kept but can't sign in
+	EmailVerified bool      `json:",omitempty"` // by a verification link, or an identity provider vouching for it
+	Guest         bool      `json:",omitempty"` // no email or password until upgraded, see Service.Upgrade
+	AvatarURL     string    `json:",omitempty"` // where the uploaded picture is served from
+	AvatarKey     string    `json:"-"`          // the picture's storage key
+	TOTP          TOTP      `json:"-"`
+	Passkeys      []Passkey `json:"-"`
+	// Version counts the writes to the user, an update must carry the
+	// stored one, see ErrVersionMismatch
+	Version int64
+	// CreatedAt and UpdatedAt are when the user was created and last
+	// written, set by the repository
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt is when the user was soft deleted, see Service.Delete
+	DeletedAt *time.Time `json:",omitempty"`
+	// Suspended is set by an operator, the user is kept but can't sign in
+	// until unsuspended, SuspendedReason says why
+	Suspended       bool   `json:",omitempty"`
+	SuspendedReason string `json:",omitempty"`
+	// PasswordResetRequired is set by an operator, the password is refused
+	// until the user chooses a new one with a reset link
+	PasswordResetRequired bool `json:",omitempty"`
+}
+
+// CanSignIn reports whether the user may start a session, neither
+// deprovisioned nor suspended
+func (u *User) CanSignIn() bool {
+	return !u.Disabled && !u.Suspended
+}
+
+// TOTP is the user's authenticator app enrollment for two factor logins,
+// see auth.CheckTOTP
+type TOTP struct {
+	Secret        string   // base32, empty until enrollment is confirmed
+	Pending       string   // secret handed out to enroll, waiting for its first code
+	LastStep      int64    // time step of the last code accepted, so codes can't be replayed
+	RecoveryCodes []string // hashes of the unused recovery codes
+}
+
+// Passkey is a WebAuthn credential the user signs in with instead of a
+// password
+type Passkey struct {
+	ID         string // the credential id, base64url
+	Name       string // the user's label, e.g. "work laptop"
+	Created    time.Time
+	LastUsed   time.Time
+	Credential []byte // the public key and sign count, see auth.EncodeCredential
+}
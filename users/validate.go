@@ -0,0 +1,189 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/netip"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// ErrInvalid is wrapped by errors for users whose id or email breaks the
+// format rules
+var ErrInvalid = errors.New("invalid user")
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrInvalid}, args...)...)
+}
+
+// How closely emails are checked, see ValidationOptions.EmailStrictness
+const (
+	EmailBasic    = "basic"
+	EmailStandard = "standard"
+	EmailStrict   = "strict"
+)
+
+// What happens to the +tag of an address such as bob+news@example.com, see
+// ValidationOptions.PlusAddressing
+const (
+	PlusKeep   = "keep"
+	PlusStrip  = "strip"
+	PlusReject = "reject"
+)
+
+// DefaultIDPattern is 1 to 64 letters, digits, _ and -, starting with a
+// letter or digit. Generated ids are hex, so they always match.
+var DefaultIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+type ValidationOptions struct {
+	// EmailStrictness is EmailStandard by default:
+	//
+	//	basic     local@domain without spaces, the domain's case and
+	//	          punycode normalized when it's a valid name
+	//	standard  an RFC 5322 address without a display name, the local part
+	//	          at most 64 bytes and the domain a DNS name with a dot, or
+	//	          an IP literal
+	//	strict    standard, but the local part is plain ASCII, dot separated
+	//	          letters, digits and ._%+-, and the domain a name whose top
+	//	          level is letters or punycode
+	EmailStrictness string
+	// PlusAddressing is PlusKeep by default. PlusStrip drops the tag, so
+	// bob+news@ is stored and looked up as bob@ and one mailbox is one
+	// account. PlusReject turns tagged addresses away.
+	PlusAddressing string
+	// IDPattern is what ids given by clients must match, DefaultIDPattern
+	// when nil
+	IDPattern *regexp.Regexp
+}
+
+// Validator checks user ids and normalizes emails, the Service runs every
+// write and email lookup through it
+type Validator struct {
+	opts ValidationOptions
+}
+
+func NewValidator(opts ValidationOptions) *Validator {
+	if opts.EmailStrictness == "" {
+		opts.EmailStrictness = EmailStandard
+	}
+	if opts.PlusAddressing == "" {
+		opts.PlusAddressing = PlusKeep
+	}
+	if opts.IDPattern == nil {
+		opts.IDPattern = DefaultIDPattern
+	}
+	return &Validator{opts: opts}
+}
+
+// dnsName converts internationalized domains to punycode, lower cases them
+// and checks label and name lengths
+var dnsName = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+var strictLocal = regexp.MustCompile(`^[A-Za-z0-9_%+-]+(\.[A-Za-z0-9_%+-]+)*$`)
+
+var strictTLD = regexp.MustCompile(`^([a-z]{2,}|xn--[a-z0-9-]+)$`)
+
+// NormalizeEmail returns email as it is stored and looked up: trimmed, the
+// domain lower cased and in ASCII, with internationalized names as
+// punycode, and the +tag handled by PlusAddressing. The local part keeps
+// its case, mail servers may treat it as significant.
+func (v *Validator) NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 || at == len(email)-1 {
+		return "", invalidf("email %q must be local@domain", email)
+	}
+	if strings.IndexFunc(email, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return "", invalidf("email %q has spaces or control characters", email)
+	}
+	local, domain, err := v.domain(email[:at], email[at+1:])
+	if err != nil {
+		return "", err
+	}
+	if v.opts.EmailStrictness != EmailBasic {
+		if len(local) > 64 {
+			return "", invalidf("email %q has a local part over 64 bytes", email)
+		}
+		addr, err := mail.ParseAddress(local + "@" + domain)
+		if err != nil || addr.Name != "" {
+			return "", invalidf("email %q is not a valid address", email)
+		}
+	}
+	if v.opts.EmailStrictness == EmailStrict && !strictLocal.MatchString(local) {
+		return "", invalidf("email %q has characters other than letters, digits and ._%%+- before the @", email)
+	}
+	if tag := strings.IndexByte(local, '+'); tag > 0 && !strings.HasPrefix(local, `"`) {
+		switch v.opts.PlusAddressing {
+		case PlusStrip:
+			local = local[:tag]
+		case PlusReject:
+			return "", invalidf("email %q has a +tag, use the plain address", email)
+		}
+	}
+	return local + "@" + domain, nil
+}
+
+// domain checks and normalizes the domain of local@domain
+func (v *Validator) domain(local, domain string) (string, string, error) {
+	email := local + "@" + domain
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		if v.opts.EmailStrictness == EmailStrict {
+			return "", "", invalidf("email %q has an IP address for a domain", email)
+		}
+		if _, err := netip.ParseAddr(strings.TrimPrefix(domain[1:len(domain)-1], "IPv6:")); err != nil && v.opts.EmailStrictness != EmailBasic {
+			return "", "", invalidf("email %q has an invalid IP address for a domain", email)
+		}
+		return local, domain, nil
+	}
+	ascii, err := dnsName.ToASCII(domain)
+	if err != nil {
+		if v.opts.EmailStrictness == EmailBasic {
+			return local, strings.ToLower(domain), nil
+		}
+		return "", "", invalidf("email %q has an invalid domain", email)
+	}
+	if v.opts.EmailStrictness == EmailBasic {
+		return local, ascii, nil
+	}
+	if !strings.Contains(ascii, ".") {
+		return "", "", invalidf("email %q has a domain without a dot", email)
+	}
+	if v.opts.EmailStrictness == EmailStrict && !strictTLD.MatchString(ascii[strings.LastIndexByte(ascii, '.')+1:]) {
+		return "", "", invalidf("email %q has an invalid top level domain", email)
+	}
+	return local, ascii, nil
+}
+
+// ValidateID checks an id given by a client against IDPattern
+func (v *Validator) ValidateID(id string) error {
+	if !v.opts.IDPattern.MatchString(id) {
+		return invalidf("id %q must match %s", id, v.opts.IDPattern)
+	}
+	return nil
+}
+
+// Check validates u's id, when it has one, and normalizes its email in
+// place. Only guests may go without an email.
+func (v *Validator) Check(u *User) error {
+	if u.Id != "" {
+		if err := v.ValidateID(u.Id); err != nil {
+			return err
+		}
+	}
+	if u.Email == "" {
+		if u.Guest {
+			return nil
+		}
+		return invalidf("email is required")
+	}
+	email, err := v.NormalizeEmail(u.Email)
+	if err != nil {
+		return err
+	}
+	u.Email = email
+	return nil
+}
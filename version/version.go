@@ -0,0 +1,80 @@
+// Package version identifies the running build. Release builds set the vars
+// with ldflags, e.g.
+//
+//	go build -ldflags "-X go-chi-microservice/version.Version=v1.2.0 \
+//		-X go-chi-microservice/version.Commit=$(git rev-parse HEAD) \
+//		-X go-chi-microservice/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// otherwise they're filled from the module and vcs info go build embeds.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	Version = ""
+	Commit  = ""
+	Date    = ""
+)
+
+// Info is the build identity served on /version
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a dirty tree
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build info, ldflags values win over what the toolchain
+// recorded
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
+
+// String is the one line form used by --version
+func (i Info) String() string {
+	s := i.Version + " (" + i.Commit
+	if i.Modified {
+		s += ", modified"
+	}
+	if i.Date != "" {
+		s += ", " + i.Date
+	}
+	return s + ") " + i.GoVersion + " " + i.Platform
+}
@@ -0,0 +1,139 @@
+// Package views renders HTML pages with html/template. Templates live under
+// views/templates, embedded in the binary:
+//
+//	layouts/*.html   define "layout", the page frame, which calls {{template "content" .}}
+//	partials/*.html  define snippets any page can use, e.g. {{template "user_row" .}}
+//	<dir>/*.html     pages, each defining "content", named by path, e.g. "users/list"
+package views
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+//go:embed templates
+var embedded embed.FS
+
+type Options struct {
+	// Dir reads templates from disk instead of the embedded copy, a
+	// directory laid out like views/templates
+	Dir string
+	// Reload parses the templates again for every render, so edits in Dir
+	// show up without a restart. For development only.
+	Reload bool
+}
+
+// Renderer executes pages inside their layout
+type Renderer struct {
+	fsys   fs.FS
+	reload bool
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+// New parses every template up front, so a broken one fails startup rather
+// than a request
+func New(opts Options) (*Renderer, error) {
+	var fsys fs.FS
+	if opts.Dir != "" {
+		fsys = os.DirFS(opts.Dir)
+	} else {
+		sub, err := fs.Sub(embedded, "templates")
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	}
+	r := &Renderer{fsys: fsys, reload: opts.Reload}
+	pages, err := parse(fsys)
+	if err != nil {
+		return nil, err
+	}
+	r.pages = pages
+	return r, nil
+}
+
+// Page is what layouts are executed with, pages get Data
+type Page struct {
+	Title string
+	Data  any
+}
+
+// parse builds one template set per page: the layouts and partials, then
+// the page, so every page can define its own "content"
+func parse(fsys fs.FS) (map[string]*template.Template, error) {
+	base := template.New("")
+	for _, dir := range []string{"layouts", "partials"} {
+		matches, err := fs.Glob(fsys, dir+"/*.html")
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		if base, err = base.ParseFS(fsys, matches...); err != nil {
+			return nil, err
+		}
+	}
+	if base.Lookup("layout") == nil {
+		return nil, fmt.Errorf("no layout template, define \"layout\" in layouts/")
+	}
+	pages := map[string]*template.Template{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(name) != ".html" || strings.HasPrefix(name, "layouts/") || strings.HasPrefix(name, "partials/") {
+			return nil
+		}
+		page, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		if page, err = page.ParseFS(fsys, name); err != nil {
+			return err
+		}
+		pages[strings.TrimSuffix(name, ".html")] = page
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// Render writes page in its layout to w, data is usually a Page. The page
+// is executed into a buffer first, so a template error leaves w untouched
+// for an error response.
+func (r *Renderer) Render(w io.Writer, page string, data any) error {
+	if r.reload {
+		pages, err := parse(r.fsys)
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.pages = pages
+		r.mu.Unlock()
+	}
+	r.mu.RLock()
+	t, ok := r.pages[page]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no template for page %q", page)
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
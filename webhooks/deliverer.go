@@ -0,0 +1,315 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"go-chi-microservice/egress"
+	"go-chi-microservice/metrics"
+)
+
+// IDHeader and EventHeader carry the delivery id, the same on every retry so
+// receivers can drop duplicates, and the event
+const (
+	IDHeader    = "X-Webhook-Id"
+	EventHeader = "X-Webhook-Event"
+)
+
+type Options struct {
+	Workers        int           // deliveries in flight at once, 4 by default
+	MaxAttempts    int           // in total, 6 by default
+	InitialBackoff time.Duration // before the second attempt, doubled after, 1s by default
+	MaxBackoff     time.Duration // 5m by default
+	Timeout        time.Duration // per attempt, 10s by default
+	QueueSize      int           // deliveries waiting for a worker, 1000 by default
+	Client         *http.Client
+	// Egress checks subscription URLs and where deliveries go, nil for no checks
+	Egress *egress.Policy
+}
+
+// Payload is the JSON body of every delivery
+type Payload struct {
+	ID    string    `json:"id"` // the delivery id
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+// Deliverer posts events to the subscriptions that want them. Publish
+// queues the deliveries and Run's workers send them, failed attempts wait
+// out a jittered exponential backoff and go back on the queue. Deliveries
+// still queued or waiting when Run returns are left pending, the queue
+// lives in memory.
+type Deliverer struct {
+	store  Store
+	opts   Options
+	logger *zerolog.Logger
+	queue  chan job
+	wg     sync.WaitGroup // retries waiting out their backoff
+	stop   chan struct{}
+}
+
+type job struct {
+	delivery Delivery
+	body     []byte
+}
+
+func NewDeliverer(store Store, opts Options, logger *zerolog.Logger) *Deliverer {
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 6
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+	if opts.Egress != nil {
+		c := *opts.Client
+		c.Transport = opts.Egress.Transport(c.Transport)
+		opts.Client = &c
+	}
+	return &Deliverer{store: store, opts: opts, logger: logger, queue: make(chan job, opts.QueueSize), stop: make(chan struct{})}
+}
+
+// Workers is how many deliveries are sent at once
+func (d *Deliverer) Workers() int {
+	return d.opts.Workers
+}
+
+// Store is where subscriptions and deliveries are kept
+func (d *Deliverer) Store() Store {
+	return d.store
+}
+
+// Subscribe adds a subscription to events at url with a new secret, which
+// the returned subscription carries
+func (d *Deliverer) Subscribe(ctx context.Context, url string, events []string) (*Subscription, error) {
+	if err := d.CheckURL(url); err != nil {
+		return nil, err
+	}
+	id, err := newID(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newID(32)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{ID: id, URL: url, Events: events, Secret: "whsec_" + secret, Created: time.Now()}
+	if err := d.store.CreateSubscription(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CheckURL is an error wrapping egress.ErrInvalidURL or egress.ErrBlocked
+// when deliveries to rawURL would be refused
+func (d *Deliverer) CheckURL(rawURL string) error {
+	u, err := egress.ParseURL(rawURL)
+	if err != nil || d.opts.Egress == nil {
+		return err
+	}
+	return d.opts.Egress.CheckURL(u)
+}
+
+// Publish queues event with data, marshalled to JSON, for each subscription
+// that wants it. It doesn't wait for the deliveries, a full queue fails them
+// at once.
+func (d *Deliverer) Publish(ctx context.Context, event string, data any) error {
+	subs, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range subs {
+		if !s.Wants(event) {
+			continue
+		}
+		j, err := d.newJob(ctx, s.ID, event, data)
+		if err != nil {
+			return err
+		}
+		select {
+		case d.queue <- j:
+		default:
+			metrics.WebhookDelivery(event, metrics.Dropped)
+			d.finish(ctx, j.delivery, StatusFailed, 0, errors.New("delivery queue full"))
+		}
+	}
+	return nil
+}
+
+// Test sends a ping to the subscription once, right away, and returns how
+// it went. It's recorded with the other deliveries but not retried.
+func (d *Deliverer) Test(ctx context.Context, subscriptionID string) (Delivery, error) {
+	s, err := d.store.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	j, err := d.newJob(ctx, s.ID, EventPing, map[string]string{"subscription_id": s.ID})
+	if err != nil {
+		return Delivery{}, err
+	}
+	code, err := d.send(ctx, s, j)
+	j.delivery.Attempts = 1
+	status := StatusSucceeded
+	if err != nil {
+		status = StatusFailed
+	}
+	return d.finish(ctx, j.delivery, status, code, err), nil
+}
+
+// Run sends queued deliveries until ctx is done
+func (d *Deliverer) Run(ctx context.Context) error {
+	var workers sync.WaitGroup
+	for i := 0; i < d.opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case j := <-d.queue:
+					d.attempt(ctx, j)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	close(d.stop)
+	d.wg.Wait()
+	return nil
+}
+
+func (d *Deliverer) newJob(ctx context.Context, subscriptionID, event string, data any) (job, error) {
+	id, err := newID(16)
+	if err != nil {
+		return job{}, err
+	}
+	now := time.Now()
+	body, err := json.Marshal(Payload{ID: id, Event: event, Time: now, Data: data})
+	if err != nil {
+		return job{}, err
+	}
+	dl := Delivery{ID: id, SubscriptionID: subscriptionID, Event: event, Status: StatusPending, Created: now, Updated: now}
+	if err := d.store.SaveDelivery(ctx, dl); err != nil {
+		return job{}, err
+	}
+	return job{delivery: dl, body: body}, nil
+}
+
+// attempt sends j once and records how it went, scheduling the next
+// attempt when it failed and there are attempts left
+func (d *Deliverer) attempt(ctx context.Context, j job) {
+	dl := j.delivery
+	s, err := d.store.GetSubscription(ctx, dl.SubscriptionID)
+	if errors.Is(err, ErrNotFound) {
+		// unsubscribed since, nothing left to record it on
+		return
+	}
+	if err != nil {
+		d.logger.Error().Err(err).Str("delivery_id", dl.ID).Msg("webhook subscription")
+		d.retry(ctx, j)
+		return
+	}
+	code, err := d.send(ctx, s, j)
+	j.delivery.Attempts++
+	if err == nil {
+		metrics.WebhookDelivery(dl.Event, metrics.Success)
+		d.finish(ctx, j.delivery, StatusSucceeded, code, nil)
+		return
+	}
+	metrics.WebhookDelivery(dl.Event, metrics.Failure)
+	log := d.logger.Warn().Err(err).Str("delivery_id", dl.ID).Str("subscription_id", s.ID).Int("attempt", j.delivery.Attempts)
+	if j.delivery.Attempts >= d.opts.MaxAttempts || errors.Is(err, egress.ErrBlocked) {
+		log.Msg("webhook delivery failed, giving up")
+		d.finish(ctx, j.delivery, StatusFailed, code, err)
+		return
+	}
+	log.Msg("webhook delivery failed, will retry")
+	j.delivery = d.finish(ctx, j.delivery, StatusPending, code, err)
+	d.retry(ctx, j)
+}
+
+// retry puts j back on the queue after its backoff, unless Run is stopping
+func (d *Deliverer) retry(ctx context.Context, j job) {
+	delay := min(d.opts.InitialBackoff<<max(j.delivery.Attempts-1, 0), d.opts.MaxBackoff)
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case d.queue <- j:
+		case <-d.stop:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// send posts j's body to s, signed, and returns the response status. Any
+// status but 2xx is an error.
+func (d *Deliverer) send(ctx context.Context, s *Subscription, j job) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDHeader, j.delivery.ID)
+	req.Header.Set(EventHeader, j.delivery.Event)
+	req.Header.Set(SignatureHeader, Sign(s.Secret, time.Now(), j.body))
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s responded %s", s.URL, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// finish records the outcome of an attempt on dl and returns it
+func (d *Deliverer) finish(ctx context.Context, dl Delivery, status string, code int, err error) Delivery {
+	dl.Status, dl.ResponseCode, dl.Error, dl.Updated = status, code, "", time.Now()
+	if err != nil {
+		dl.Error = err.Error()
+	}
+	// a cancelled request still gets its delivery recorded
+	if err := d.store.SaveDelivery(context.WithoutCancel(ctx), dl); err != nil {
+		d.logger.Error().Err(err).Str("delivery_id", dl.ID).Msg("recording webhook delivery")
+	}
+	return dl
+}
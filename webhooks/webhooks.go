@@ -0,0 +1,199 @@
+// Package webhooks delivers user events to URLs other services subscribe.
+// Each delivery is signed with the subscription's secret, retried with
+// backoff and recorded so its status can be looked up.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is an unknown subscription
+var ErrNotFound = errors.New("subscription not found")
+
+// events subscriptions can pick
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	// EventPing is only sent by Test
+	EventPing = "ping"
+)
+
+// Events are every event a subscription can ask for
+var Events = []string{EventUserCreated, EventUserUpdated}
+
+// delivery statuses
+const (
+	StatusPending   = "pending" // waiting for its first or next attempt
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed" // out of attempts, or refused for good
+)
+
+type Subscription struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"-"` // signs deliveries, shown once when created
+	Created time.Time `json:"created"`
+}
+
+// Wants reports whether s subscribed to event
+func (s *Subscription) Wants(event string) bool {
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type Delivery struct {
+	ID             string    `json:"id"`
+	SubscriptionID string    `json:"subscription_id"`
+	Event          string    `json:"event"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	ResponseCode   int       `json:"response_code,omitempty"` // of the last attempt
+	Error          string    `json:"error,omitempty"`         // of the last attempt
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Store keeps subscriptions and the recent deliveries to each
+type Store interface {
+	CreateSubscription(ctx context.Context, s *Subscription) error
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]*Subscription, error)
+	// DeleteSubscription removes s along with its deliveries
+	DeleteSubscription(ctx context.Context, id string) error
+	// SaveDelivery adds or replaces d
+	SaveDelivery(ctx context.Context, d Delivery) error
+	// ListDeliveries returns the subscription's deliveries, newest first
+	ListDeliveries(ctx context.Context, subscriptionID string) ([]Delivery, error)
+}
+
+// MemoryStore is a Store for a single instance, subscriptions don't
+// survive a restart. Each subscription keeps its last keep deliveries.
+type MemoryStore struct {
+	mu         sync.RWMutex
+	keep       int
+	subs       map[string]*Subscription
+	deliveries map[string][]Delivery // by subscription, oldest first
+}
+
+func NewMemoryStore(keep int) *MemoryStore {
+	if keep <= 0 {
+		keep = 100
+	}
+	return &MemoryStore{keep: keep, subs: map[string]*Subscription{}, deliveries: map[string][]Delivery{}}
+}
+
+func (m *MemoryStore) CreateSubscription(ctx context.Context, s *Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *s
+	m.subs[s.ID] = &c
+	return nil
+}
+
+func (m *MemoryStore) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.subs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *MemoryStore) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]*Subscription, 0, len(m.subs))
+	for _, s := range m.subs {
+		c := *s
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, nil
+}
+
+func (m *MemoryStore) DeleteSubscription(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.subs, id)
+	delete(m.deliveries, id)
+	return nil
+}
+
+func (m *MemoryStore) SaveDelivery(ctx context.Context, d Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subs[d.SubscriptionID]; !ok {
+		// deleted while the delivery was in flight
+		return nil
+	}
+	list := m.deliveries[d.SubscriptionID]
+	for i := range list {
+		if list[i].ID == d.ID {
+			list[i] = d
+			return nil
+		}
+	}
+	list = append(list, d)
+	if len(list) > m.keep {
+		list = list[len(list)-m.keep:]
+	}
+	m.deliveries[d.SubscriptionID] = list
+	return nil
+}
+
+func (m *MemoryStore) ListDeliveries(ctx context.Context, subscriptionID string) ([]Delivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.subs[subscriptionID]; !ok {
+		return nil, ErrNotFound
+	}
+	list := m.deliveries[subscriptionID]
+	out := make([]Delivery, len(list))
+	for i, d := range list {
+		out[len(list)-1-i] = d
+	}
+	return out, nil
+}
+
+// SignatureHeader carries t=<unix seconds>,v1=<hex HMAC-SHA256 of
+// "<t>.<body>"> keyed with the subscription secret. Receivers should
+// recompute it and reject old timestamps, so a captured delivery can't be
+// replayed.
+const SignatureHeader = "X-Webhook-Signature"
+
+// Sign returns the SignatureHeader value for body sent at t
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func newID(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}